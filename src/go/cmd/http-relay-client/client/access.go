@@ -0,0 +1,148 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+// AccessAction is what happens to a request matching an AccessRule.
+type AccessAction string
+
+const (
+	AccessAllow AccessAction = "allow"
+	AccessDeny  AccessAction = "deny"
+)
+
+// AccessRule allows or denies relayed requests before they reach the
+// backend. A request matches the rule if its method is one of Methods
+// (compared case-insensitively, any method if empty) and its path matches
+// PathPattern. PathPattern is a path.Match pattern, or a regular expression if
+// it starts with "^". If there are rules, requests for non-canonical paths,
+// eg with dot segments, repeated or encoded slashes, are denied before any
+// rule is evaluated, as the backend may resolve them to a denied path.
+type AccessRule struct {
+	Methods     []string
+	PathPattern string
+	Action      AccessAction
+}
+
+// ParseAccessRule parses a rule given as "ACTION,METHODS,PATH_PATTERN", where
+// METHODS is a |-separated list of methods, or empty for any method.
+func ParseAccessRule(s string) (AccessRule, error) {
+	parts := strings.SplitN(s, ",", 3)
+	if len(parts) != 3 {
+		return AccessRule{}, fmt.Errorf("expected ACTION,METHODS,PATH_PATTERN, got %q", s)
+	}
+	r := AccessRule{
+		Action:      AccessAction(parts[0]),
+		PathPattern: parts[2],
+	}
+	if parts[1] != "" {
+		r.Methods = strings.Split(parts[1], "|")
+	}
+	return r, nil
+}
+
+// accessRule is an AccessRule prepared for matching.
+type accessRule struct {
+	AccessRule
+	re *regexp.Regexp
+}
+
+func compileAccessRules(rules []AccessRule) ([]accessRule, error) {
+	compiled := make([]accessRule, 0, len(rules))
+	for _, r := range rules {
+		if r.Action != AccessAllow && r.Action != AccessDeny {
+			return nil, fmt.Errorf("invalid action %q for path pattern %q, want %q or %q",
+				r.Action, r.PathPattern, AccessAllow, AccessDeny)
+		}
+		c := accessRule{AccessRule: r}
+		if strings.HasPrefix(r.PathPattern, "^") {
+			re, err := regexp.Compile(r.PathPattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path pattern %q: %v", r.PathPattern, err)
+			}
+			c.re = re
+		} else if _, err := path.Match(r.PathPattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %v", r.PathPattern, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func (r *accessRule) matches(method, p string) bool {
+	if len(r.Methods) > 0 {
+		found := false
+		for _, m := range r.Methods {
+			found = found || strings.EqualFold(m, method)
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.re != nil {
+		return r.re.MatchString(p)
+	}
+	ok, _ := path.Match(r.PathPattern, p)
+	return ok
+}
+
+// cleanPath returns path.Clean(p), but keeps a trailing slash.
+func cleanPath(p string) string {
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// canonicalPath returns whether the path of u is already clean, see
+// cleanPath, and has no encoded slashes.
+func canonicalPath(u *url.URL) bool {
+	if u.Path == "" {
+		return true
+	}
+	if strings.Contains(strings.ToLower(u.RawPath), "%2f") {
+		return false
+	}
+	return cleanPath(u.Path) == u.Path
+}
+
+// allowed returns whether the first access rule matching the request allows
+// it. Requests that don't match any rule are allowed, requests for
+// non-canonical paths are denied.
+func (c *Client) allowed(breq *pb.HttpRequest) bool {
+	if len(c.accessRules) == 0 {
+		return true
+	}
+	u, err := url.Parse(breq.GetUrl())
+	if err != nil || !canonicalPath(u) {
+		return false
+	}
+	for i := range c.accessRules {
+		if c.accessRules[i].matches(breq.GetMethod(), u.Path) {
+			return c.accessRules[i].Action == AccessAllow
+		}
+	}
+	return true
+}
@@ -0,0 +1,191 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func newAccessClient(t *testing.T, rules ...AccessRule) *Client {
+	t.Helper()
+	config := DefaultClientConfig()
+	config.Rules = rules
+	c := newClient(config)
+	var err error
+	if c.accessRules, err = compileAccessRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func accessRequest(method, path string) *pb.HttpRequest {
+	return &pb.HttpRequest{
+		Method: proto.String(method),
+		Url:    proto.String("http://invalid" + path + "?watch=true"),
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	c := newAccessClient(t,
+		AccessRule{PathPattern: "^/api/v1/secrets(/|$)", Action: AccessDeny},
+		AccessRule{Methods: []string{"get", "WATCH"}, PathPattern: "^/apis?(/|$)", Action: AccessAllow},
+		AccessRule{PathPattern: "/healthz", Action: AccessAllow},
+		AccessRule{Methods: []string{"GET"}, PathPattern: "/logs/*", Action: AccessAllow},
+		AccessRule{PathPattern: "^/", Action: AccessDeny},
+	)
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"GET", "/api/v1/secrets", false},
+		{"GET", "/api/v1/secrets/foo", false},
+		{"GET", "/api/v1/secretsfoo", true},
+		{"GET", "/api/v1/pods", true},
+		{"get", "/apis/apps/v1", true},
+		{"Watch", "/api/v1/pods", true},
+		{"POST", "/api/v1/pods", false},
+		{"DELETE", "/healthz", true},
+		{"GET", "/logs/foo", true},
+		{"GET", "/logs/foo/bar", false},
+		{"POST", "/logs/foo", false},
+		{"GET", "/other", false},
+	}
+	for _, tc := range tests {
+		if got := c.allowed(accessRequest(tc.method, tc.path)); got != tc.want {
+			t.Errorf("allowed(%s %s) = %t, want %t", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestAccessRulesDenyNonCanonicalPaths(t *testing.T) {
+	c := newAccessClient(t,
+		AccessRule{PathPattern: "^/api/v1/secrets(/|$)", Action: AccessDeny},
+		AccessRule{PathPattern: "^/api/", Action: AccessAllow},
+	)
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/api/v1/../v1/secrets", false},
+		{"/api/v1/pods/../secrets", false},
+		{"/api/v1/./secrets", false},
+		{"//api/v1/secrets", false},
+		{"/api//v1/secrets", false},
+		{"/api/v1%2Fsecrets", false},
+		{"/api/v1/pods%2f..%2fsecrets", false},
+		{"/api/v1/pods/", true},
+		{"/api/v1/pods", true},
+	}
+	for _, tc := range tests {
+		if got := c.allowed(accessRequest("GET", tc.path)); got != tc.want {
+			t.Errorf("allowed(GET %s) = %t, want %t", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestAccessRulesFirstMatchWins(t *testing.T) {
+	c := newAccessClient(t,
+		AccessRule{PathPattern: "^/api/", Action: AccessAllow},
+		AccessRule{PathPattern: "^/api/v1/secrets", Action: AccessDeny},
+	)
+	if !c.allowed(accessRequest("GET", "/api/v1/secrets")) {
+		t.Errorf("Later deny rule took precedence over earlier allow rule")
+	}
+}
+
+func TestAccessRulesAllowAllByDefault(t *testing.T) {
+	c := newAccessClient(t)
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		if !c.allowed(accessRequest(method, "/api/v1/secrets")) {
+			t.Errorf("%s denied without rules", method)
+		}
+	}
+	c = newAccessClient(t, AccessRule{PathPattern: "/foo", Action: AccessDeny})
+	if !c.allowed(accessRequest("GET", "/bar")) {
+		t.Errorf("Request matching no rule denied")
+	}
+}
+
+func TestCompileAccessRulesRejectsInvalidRules(t *testing.T) {
+	for _, r := range []AccessRule{
+		{PathPattern: "/foo", Action: "block"},
+		{PathPattern: "^/foo(", Action: AccessDeny},
+		{PathPattern: "/foo/[", Action: AccessDeny},
+	} {
+		if _, err := compileAccessRules([]AccessRule{r}); err == nil {
+			t.Errorf("compileAccessRules(%+v) succeeded, want error", r)
+		}
+	}
+}
+
+func TestParseAccessRule(t *testing.T) {
+	r, err := ParseAccessRule("allow,GET|WATCH,^/api(/|$)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Action != AccessAllow || strings.Join(r.Methods, "|") != "GET|WATCH" || r.PathPattern != "^/api(/|$)" {
+		t.Errorf("ParseAccessRule() = %+v", r)
+	}
+	if r, err = ParseAccessRule("deny,,/healthz"); err != nil || r.Methods != nil {
+		t.Errorf("ParseAccessRule() = %+v, %v, want any method", r, err)
+	}
+	if _, err := ParseAccessRule("deny,/healthz"); err == nil {
+		t.Errorf("Expected error for missing field")
+	}
+}
+
+func TestDeniedRequestDoesNotReachBackend(t *testing.T) {
+	var backendRequests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests.Add(1)
+	}))
+	defer backend.Close()
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	c := newAccessClient(t, AccessRule{PathPattern: "^/api/v1/secrets", Action: AccessDeny})
+	c.config.RelayScheme = "http"
+	c.config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	c.config.BackendScheme = "http"
+	c.config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	c.config.AccessDeniedMessage = "secrets stay on the robot"
+	c.handleRequest(&http.Client{}, &http.Client{}, &pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/api/v1/secrets/foo"),
+	})
+
+	received := relay.responses("15")
+	if len(received) != 1 {
+		t.Fatalf("Got %d responses, want 1", len(received))
+	}
+	if got := received[0].GetStatusCode(); got != http.StatusForbidden {
+		t.Errorf("Status = %d, want %d", got, http.StatusForbidden)
+	}
+	if got := string(received[0].Body); got != "secrets stay on the robot" {
+		t.Errorf("Body = %q, want the configured message", got)
+	}
+	if n := backendRequests.Load(); n != 0 {
+		t.Errorf("Backend got %d requests, want 0", n)
+	}
+}
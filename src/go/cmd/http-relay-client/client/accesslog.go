@@ -0,0 +1,221 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/googlecloudrobotics/ilog"
+)
+
+// Number of access log entries that may wait for the writer before new ones
+// are dropped, see relay_client_access_log_dropped_total.
+const accessLogBuffer = 1024
+
+// accessLogEntry is a line of the access log.
+type accessLogEntry struct {
+	Time   time.Time `json:"time"`
+	ID     string    `json:"id"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	// Query only has the parameter names for requests matching
+	// NoStorePathPrefixes.
+	Query string `json:"query,omitempty"`
+	// Status is the status code of the response, or 0 if none was posted.
+	Status   int     `json:"status"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration_seconds"`
+	// State is the final phase of the request, see requestPhase.
+	State string `json:"state"`
+	// Principal identifies the user-client by its certificate, if the relay
+	// server forwarded one.
+	Principal string `json:"principal,omitempty"`
+	Streaming bool   `json:"streaming,omitempty"`
+	// Priority is the priority the relay server gave the request, if any.
+	Priority int32 `json:"priority,omitempty"`
+}
+
+// accessLogger writes access log entries as JSON lines in the background, so
+// that handleRequest never waits for the disk. A logger writing to a file can
+// reopen it, eg after logrotate moved it.
+type accessLogger struct {
+	entries chan *accessLogEntry
+	reopens chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	path string
+	// w is only used by run.
+	w io.Writer
+}
+
+// newAccessLogger returns a logger writing to the file at path, or to w if
+// path is empty.
+func newAccessLogger(path string, w io.Writer) (*accessLogger, error) {
+	l := &accessLogger{
+		entries: make(chan *accessLogEntry, accessLogBuffer),
+		reopens: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		path:    path,
+		w:       w,
+	}
+	if path != "" {
+		f, err := openAccessLog(path)
+		if err != nil {
+			return nil, err
+		}
+		l.w = f
+	}
+	go l.run()
+	return l, nil
+}
+
+func openAccessLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+// log queues e for writing. If the writer falls behind, e is dropped and
+// counted. It's a no-op on a nil logger.
+func (l *accessLogger) log(e *accessLogEntry) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.entries <- e:
+	default:
+		accessLogDropped.Inc()
+	}
+}
+
+// reopen makes the logger reopen its file before writing the next entry.
+func (l *accessLogger) reopen() {
+	if l == nil || l.path == "" {
+		return
+	}
+	select {
+	case l.reopens <- struct{}{}:
+	default:
+		// A reopen is pending already.
+	}
+}
+
+// close writes the queued entries and closes the file. Later entries are
+// dropped.
+func (l *accessLogger) close() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() { close(l.done) })
+	<-l.stopped
+}
+
+func (l *accessLogger) run() {
+	defer close(l.stopped)
+	defer func() {
+		if f, ok := l.w.(*os.File); ok && l.path != "" {
+			f.Close()
+		}
+	}()
+	enc := json.NewEncoder(l.w)
+	for {
+		select {
+		case e := <-l.entries:
+			if err := enc.Encode(e); err != nil {
+				slog.Error("Failed to write access log", slog.String("File", l.path), ilog.Err(err))
+			}
+		case <-l.reopens:
+			f, err := openAccessLog(l.path)
+			if err != nil {
+				slog.Error("Failed to reopen access log, keeping the old file", slog.String("File", l.path), ilog.Err(err))
+				continue
+			}
+			l.w.(*os.File).Close()
+			l.w = f
+			enc = json.NewEncoder(f)
+		case <-l.done:
+			for {
+				select {
+				case e := <-l.entries:
+					enc.Encode(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// ReopenAccessLog reopens the AccessLogPath file, eg on SIGHUP after the log
+// was rotated.
+func (c *Client) ReopenAccessLog() {
+	c.accessLog.reopen()
+}
+
+// logAccess writes the access log entry for a request once handleRequest
+// returns.
+func (c *Client) logAccess(breq *pb.HttpRequest, s *requestState, start time.Time) {
+	if c.accessLog == nil {
+		return
+	}
+	e := &accessLogEntry{
+		Time:      time.Now(),
+		ID:        s.id,
+		Method:    breq.GetMethod(),
+		Duration:  time.Since(start).Seconds(),
+		State:     s.current().String(),
+		Principal: principal(breq.GetPeerCertificate()),
+		Streaming: s.streaming,
+		Priority:  breq.GetPriority(),
+	}
+	e.Status, e.Bytes = s.response()
+	if u, err := url.Parse(breq.GetUrl()); err == nil {
+		e.Path = u.Path
+		e.Query = u.RawQuery
+		if s.noStore {
+			e.Query = queryNames(u.Query())
+		}
+	}
+	c.accessLog.log(e)
+}
+
+// principal returns the identity of the user-client's certificate: its first
+// URI SAN, eg a SPIFFE ID, or else its subject.
+func principal(cert *pb.PeerCertificate) string {
+	if uris := cert.GetUris(); len(uris) > 0 {
+		return uris[0]
+	}
+	return cert.GetSubject()
+}
+
+// queryNames returns the sorted parameter names of query, without values.
+func queryNames(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, url.QueryEscape(name))
+	}
+	sort.Strings(names)
+	return strings.Join(names, "&")
+}
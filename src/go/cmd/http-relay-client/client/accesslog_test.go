@@ -0,0 +1,181 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// readAccessLog parses the JSON lines of an access log.
+func readAccessLog(t *testing.T, r io.Reader) []accessLogEntry {
+	t.Helper()
+	var entries []accessLogEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var e accessLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid access log line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAccessLog(t *testing.T) {
+	relay := newRecordingRelay()
+	defer relay.Close()
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.NoStorePathPrefixes = []string{"/secrets/"}
+	client := newClient(config)
+	var buf bytes.Buffer
+	var err error
+	if client.accessLog, err = newAccessLogger("", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"kind": "Pod"}`
+	for _, tc := range []struct {
+		id          string
+		url         string
+		cert        *pb.PeerCertificate
+		knownLength bool
+	}{
+		{id: "small", url: "http://invalid/api/pods?watch=false&token=abc", knownLength: true},
+		{id: "streamed", url: "http://invalid/api/pods?watch=true", cert: &pb.PeerCertificate{
+			Subject: proto.String("CN=robot"),
+			Uris:    []string{"spiffe://example.com/robot"},
+		}},
+		{id: "no-store", url: "http://invalid/secrets/a?token=abc&b=1", cert: &pb.PeerCertificate{
+			Subject: proto.String("CN=robot"),
+		}, knownLength: true},
+		{id: "invalid", url: "http://invalid/%zz"},
+	} {
+		client.handleRequest(&http.Client{}, newFixedBackend(body, tc.knownLength), &pb.HttpRequest{
+			Id:              proto.String(tc.id),
+			Method:          proto.String("GET"),
+			Url:             proto.String(tc.url),
+			PeerCertificate: tc.cert,
+		})
+	}
+	client.accessLog.close()
+
+	entries := readAccessLog(t, &buf)
+	if len(entries) != 4 {
+		t.Fatalf("Got %d access log entries, want 4:\n%s", len(entries), buf.String())
+	}
+	for i, want := range []accessLogEntry{
+		{ID: "small", Method: "GET", Path: "/api/pods", Query: "watch=false&token=abc", Status: 200, Bytes: int64(len(body)), State: "Done"},
+		{ID: "streamed", Method: "GET", Path: "/api/pods", Query: "watch=true", Status: 200, Bytes: int64(len(body)), State: "Done",
+			Principal: "spiffe://example.com/robot", Streaming: true},
+		{ID: "no-store", Method: "GET", Path: "/secrets/a", Query: "b&token", Status: 200, Bytes: int64(len(body)), State: "Done",
+			Principal: "CN=robot"},
+		{ID: "invalid", Method: "GET", Status: 500, State: "Failed"},
+	} {
+		got := entries[i]
+		if got.Time.IsZero() || got.Duration <= 0 {
+			t.Errorf("Entry %s has time %v and duration %v, want both set", got.ID, got.Time, got.Duration)
+		}
+		got.Time, got.Duration = time.Time{}, 0
+		if got != want {
+			t.Errorf("Access log entry\n%+v\nwant\n%+v", got, want)
+		}
+	}
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLogger(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.log(&accessLogEntry{ID: "before"})
+	// Like logrotate, which moves the file and then sends SIGHUP.
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if fi, err := os.Stat(path); err == nil && fi.Size() > 0 {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("Entry wasn't written")
+		}
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	l.reopen()
+	l.log(&accessLogEntry{ID: "after"})
+	l.close()
+
+	for file, want := range map[string]string{path + ".1": "before", path: "after"} {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if entries := readAccessLog(t, f); len(entries) != 1 || entries[0].ID != want {
+			t.Errorf("%s has entries %+v, want only %q", file, entries, want)
+		}
+	}
+}
+
+// blockingWriter blocks writes until unblock is closed.
+type blockingWriter struct {
+	unblock chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return w.buf.Write(p)
+}
+
+func TestAccessLogDropsWhenBehind(t *testing.T) {
+	w := &blockingWriter{unblock: make(chan struct{})}
+	l, err := newAccessLogger("", w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*accessLogBuffer; i++ {
+			l.log(&accessLogEntry{ID: "15"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Logging blocked on the writer")
+	}
+	close(w.unblock)
+	l.close()
+	// One entry may have been taken by the writer before the buffer filled.
+	if n := len(readAccessLog(t, &w.buf)); n > accessLogBuffer+1 {
+		t.Errorf("Wrote %d entries, want at most %d", n, accessLogBuffer+1)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// normalizeAddress returns addr, a host with an optional port like
+// BackendAddress or RelayAddress, in the form used as URL host. IPv6 literals
+// are put in brackets, so "fd00::1:8080" becomes "[fd00::1]:8080" and
+// "fe80::1%eth0:8080" becomes "[fe80::1%eth0]:8080". As the last group of an
+// IPv6 literal without brackets is its port, it must be followed by one.
+// Hostnames and IPv4 addresses may omit the port, to use the default port of
+// the scheme.
+func normalizeAddress(addr string) (string, error) {
+	if strings.HasPrefix(addr, "[") {
+		if !strings.Contains(addr, "]:") {
+			if host, ok := strings.CutSuffix(addr[1:], "]"); ok && isIPv6(host) {
+				return addr, nil
+			}
+			return "", fmt.Errorf("address %q has no IPv6 address in brackets", addr)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", err
+		}
+		if !isIPv6(host) {
+			return "", fmt.Errorf("address %q has no IPv6 address in brackets", addr)
+		}
+		return joinHostPort(addr, host, port)
+	}
+	switch strings.Count(addr, ":") {
+	case 0:
+		return addr, nil
+	case 1:
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", err
+		}
+		return joinHostPort(addr, host, port)
+	}
+	i := strings.LastIndex(addr, ":")
+	host, port := addr[:i], addr[i+1:]
+	if !isIPv6(host) || !validPort(port) {
+		return "", fmt.Errorf("address %q is an IPv6 address without port, use brackets and a port, eg %s",
+			addr, net.JoinHostPort(addr, "443"))
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// addressHost returns the host of a normalized address, without port and
+// brackets.
+func addressHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// joinHostPort returns host and port joined, if port is valid.
+func joinHostPort(addr, host, port string) (string, error) {
+	if !validPort(port) {
+		return "", fmt.Errorf("address %q has an invalid port %q, want a number from 1 to 65535, or no colon for the default port", addr, port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func isIPv6(host string) bool {
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.Is6()
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 1 && n <= 65535
+}
+
+// normalizeAddresses normalizes the addresses in config, see
+// normalizeAddress. Invalid ones are left as they are, they are reported by
+// Validate.
+func normalizeAddresses(config *ClientConfig) {
+	normalize := func(addr *string) {
+		if normalized, err := normalizeAddress(*addr); err == nil {
+			*addr = normalized
+		}
+	}
+	normalize(&config.BackendAddress)
+	normalize(&config.RelayAddress)
+	normalize(&config.RelayResolverAddress)
+	config.RelayAddresses = append([]string(nil), config.RelayAddresses...)
+	for i := range config.RelayAddresses {
+		normalize(&config.RelayAddresses[i])
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{addr: "relay.example.com", want: "relay.example.com"},
+		{addr: "localhost:8080", want: "localhost:8080"},
+		{addr: "10.0.0.1", want: "10.0.0.1"},
+		{addr: "10.0.0.1:8080", want: "10.0.0.1:8080"},
+		{addr: "fd00::1:8080", want: "[fd00::1]:8080"},
+		{addr: "[fd00::1]:8080", want: "[fd00::1]:8080"},
+		{addr: "[fd00::1]", want: "[fd00::1]"},
+		{addr: "fe80::1%eth0:8080", want: "[fe80::1%eth0]:8080"},
+		{addr: "[fe80::1%eth0]:8080", want: "[fe80::1%eth0]:8080"},
+		{addr: "fd00::1", wantErr: true},
+		{addr: "fe80::1%eth0", wantErr: true},
+		{addr: "localhost:", wantErr: true},
+		{addr: "localhost:http", wantErr: true},
+		{addr: "localhost:70000", wantErr: true},
+		{addr: "[fd00::1]:", wantErr: true},
+		{addr: "[fd00::1", wantErr: true},
+		{addr: "[relay.example.com]:80", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := normalizeAddress(tc.addr)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("normalizeAddress(%q) = %q, want error", tc.addr, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("normalizeAddress(%q) = %q, %v, want %q", tc.addr, got, err, tc.want)
+		}
+	}
+}
+
+func TestAddressHost(t *testing.T) {
+	for addr, want := range map[string]string{
+		"relay.example.com":   "relay.example.com",
+		"10.0.0.1:8080":       "10.0.0.1",
+		"[fd00::1]:8080":      "fd00::1",
+		"[fd00::1]":           "fd00::1",
+		"[fe80::1%eth0]:8080": "fe80::1%eth0",
+	} {
+		if got := addressHost(addr); got != want {
+			t.Errorf("addressHost(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestAddressURLs(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"relay.example.com", "relay.example.com"},
+		{"10.0.0.1:8080", "10.0.0.1:8080"},
+		{"fd00::1:8080", "[fd00::1]:8080"},
+		{"[fd00::1]:8080", "[fd00::1]:8080"},
+		{"fe80::1%eth0:8080", "[fe80::1%eth0]:8080"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.addr, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.BackendAddress = tc.addr
+			config.RelayAddress = tc.addr
+			if err := config.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			client := newClient(config)
+
+			req, err := client.createBackendRequest(&pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+			if err != nil {
+				t.Fatalf("createBackendRequest() failed: %v", err)
+			}
+			if req.URL.Host != tc.want {
+				t.Errorf("Backend request host = %q, want %q", req.URL.Host, tc.want)
+			}
+
+			relayURL, err := url.Parse(client.buildRelayURL(client.relayAddress("")))
+			if err != nil {
+				t.Fatalf("buildRelayURL() is invalid: %v", err)
+			}
+			if relayURL.Host != tc.want {
+				t.Errorf("Relay URL host = %q, want %q", relayURL.Host, tc.want)
+			}
+
+			var posted string
+			remote := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				posted = req.URL.Host
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader("ok")),
+				}, nil
+			})}
+			if err := client.postResponse(remote, &pb.HttpResponse{Id: proto.String("15")}); err != nil {
+				t.Fatalf("postResponse() failed: %v", err)
+			}
+			if posted != tc.want {
+				t.Errorf("Response posted to host %q, want %q", posted, tc.want)
+			}
+		})
+	}
+}
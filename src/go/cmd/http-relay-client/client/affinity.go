@@ -0,0 +1,97 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"strings"
+)
+
+// relayInstanceHeader names the relay server replica that handed out a
+// request, if the relay server runs as several replicas behind a load
+// balancer that routes by it.
+const relayInstanceHeader = "X-Relay-Instance"
+
+// relayAffinity routes the calls for a request to the relay server replica
+// that handed it out: the response chunks and the polls of the request
+// stream must reach the replica that holds the request. It consists of the
+// cookies, eg the affinity cookie of a load balancer, and the
+// X-Relay-Instance header of the response to the poll.
+type relayAffinity struct {
+	cookies  []*http.Cookie
+	instance string
+}
+
+// parseRelayAffinity returns the affinity in the response to a poll, or nil
+// if it has none.
+func parseRelayAffinity(resp *http.Response) *relayAffinity {
+	a := &relayAffinity{cookies: resp.Cookies(), instance: resp.Header.Get(relayInstanceHeader)}
+	if len(a.cookies) == 0 && a.instance == "" {
+		return nil
+	}
+	return a
+}
+
+// apply adds the affinity to req. It's a no-op on a nil affinity.
+func (a *relayAffinity) apply(req *http.Request) {
+	if a == nil {
+		return
+	}
+	for _, cookie := range a.cookies {
+		// Only name and value are sent back, the other attributes are for
+		// the cookie jar.
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	if a.instance != "" {
+		req.Header.Set(relayInstanceHeader, a.instance)
+	}
+}
+
+// key identifies the replica that the affinity routes to, so that only
+// responses for the same replica are batched together.
+func (a *relayAffinity) key() string {
+	if a == nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(a.instance)
+	for _, cookie := range a.cookies {
+		b.WriteString(";" + cookie.Name + "=" + cookie.Value)
+	}
+	return b.String()
+}
+
+// recordAffinity keeps the affinity in the response to the poll that handed
+// out request id, until forgetRequest.
+func (c *Client) recordAffinity(id string, resp *http.Response) {
+	if a := parseRelayAffinity(resp); a != nil {
+		c.requestAffinity.Store(id, a)
+	}
+}
+
+// affinity returns the affinity of request id, or nil if it has none.
+func (c *Client) affinity(id string) *relayAffinity {
+	if a, ok := c.requestAffinity.Load(id); ok {
+		return a.(*relayAffinity)
+	}
+	return nil
+}
+
+// forgetRequest drops the relay server and affinity of request id, once
+// it's done.
+func (c *Client) forgetRequest(id string) {
+	c.requestRelays.Delete(id)
+	c.requestAffinity.Delete(id)
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRelayAffinity(t *testing.T) {
+	tests := []struct {
+		desc       string
+		header     http.Header
+		wantCookie string
+		wantHeader string
+	}{
+		{"none", http.Header{}, "", ""},
+		{
+			desc:       "cookies",
+			header:     http.Header{"Set-Cookie": {"lb=a; Path=/; HttpOnly; Max-Age=60", "session=1"}},
+			wantCookie: "lb=a; session=1",
+		},
+		{
+			desc:       "instance",
+			header:     http.Header{"X-Relay-Instance": {"relay-2"}},
+			wantHeader: "relay-2",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			a := parseRelayAffinity(&http.Response{Header: tc.header})
+			if (a == nil) != (tc.wantCookie == "" && tc.wantHeader == "") {
+				t.Fatalf("parseRelayAffinity() = %+v", a)
+			}
+			req := httptest.NewRequest("POST", "/server/response", nil)
+			a.apply(req)
+			if got := req.Header.Get("Cookie"); got != tc.wantCookie {
+				t.Errorf("Cookie = %q, want %q", got, tc.wantCookie)
+			}
+			if got := req.Header.Get(relayInstanceHeader); got != tc.wantHeader {
+				t.Errorf("%s = %q, want %q", relayInstanceHeader, got, tc.wantHeader)
+			}
+		})
+	}
+}
+
+// fakeLoadBalancer spreads polls over two fake relay server replicas, and
+// routes all other calls by the affinity cookie or X-Relay-Instance header
+// that it adds to the polls handing out a request. Calls without affinity go
+// to the second replica and are recorded as misrouted.
+type fakeLoadBalancer struct {
+	*httptest.Server
+	replicas []*relaytest.Server
+
+	mu        sync.Mutex
+	polls     int
+	misrouted []string
+}
+
+func newFakeLoadBalancer(useCookie bool) *fakeLoadBalancer {
+	lb := &fakeLoadBalancer{replicas: []*relaytest.Server{relaytest.NewServer(), relaytest.NewServer()}}
+	names := []string{"a", "b"}
+	var proxies []*httputil.ReverseProxy
+	for i, replica := range lb.replicas {
+		i := i
+		target, _ := url.Parse(replica.URL)
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			if resp.Request.URL.Path != relaytest.RequestPath || resp.StatusCode != http.StatusOK {
+				return nil
+			}
+			if useCookie {
+				resp.Header.Add("Set-Cookie", (&http.Cookie{Name: "lb-affinity", Value: names[i], Path: "/"}).String())
+			} else {
+				resp.Header.Set(relayInstanceHeader, names[i])
+			}
+			return nil
+		}
+		proxies = append(proxies, proxy)
+	}
+	lb.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lb.mu.Lock()
+		var i int
+		if r.URL.Path == relaytest.RequestPath {
+			// The first poll goes to the second replica.
+			i = (lb.polls + 1) % len(proxies)
+			lb.polls++
+		} else {
+			name := r.Header.Get(relayInstanceHeader)
+			if cookie, err := r.Cookie("lb-affinity"); err == nil {
+				name = cookie.Value
+			}
+			switch name {
+			case "a":
+				i = 0
+			case "b":
+				i = 1
+			default:
+				lb.misrouted = append(lb.misrouted, r.URL.Path)
+				i = 1
+			}
+		}
+		lb.mu.Unlock()
+		proxies[i].ServeHTTP(w, r)
+	}))
+	return lb
+}
+
+func (lb *fakeLoadBalancer) Close() {
+	lb.Server.Close()
+	for _, replica := range lb.replicas {
+		replica.Close()
+	}
+}
+
+func TestRelayAffinityWithReplicas(t *testing.T) {
+	for _, useCookie := range []bool{true, false} {
+		t.Run(map[bool]string{true: "cookie", false: "instance header"}[useCookie], func(t *testing.T) {
+			backend := newEchoBackend(t)
+			defer backend.Close()
+			lb := newFakeLoadBalancer(useCookie)
+			defer lb.Close()
+			a, b := lb.replicas[0], lb.replicas[1]
+			a.Enqueue(&pb.HttpRequest{
+				Id:     proto.String("exec"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/exec"),
+				Header: []*pb.HttpHeader{
+					{Name: proto.String("Connection"), Value: proto.String("Upgrade")},
+					{Name: proto.String("Upgrade"), Value: proto.String("echo")},
+				},
+			})
+			a.SendRequestStream("exec", []byte("hi\n"))
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(lb.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.StartupJitter = 0
+			config.PollJitter = 0
+			c := newClient(config)
+			c.startWorker(&http.Client{}, c.newLocalClient(nil), false)
+			responses, err := a.WaitForResponses("exec", 10*time.Second)
+			// If the request stream was misrouted, this ends the exec.
+			b.SendRequestStream("exec", []byte("\n"))
+			c.Stop()
+			c.workerGroup.Wait()
+			c.requests.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := body(responses); got != "hi\n" {
+				t.Errorf("Relayed body = %q, want %q", got, "hi\n")
+			}
+			if got := b.Responses("exec"); len(got) != 0 {
+				t.Errorf("Other replica got %d responses", len(got))
+			}
+			lb.mu.Lock()
+			defer lb.mu.Unlock()
+			if len(lb.misrouted) != 0 {
+				t.Errorf("Calls without affinity: %v", lb.misrouted)
+			}
+			if _, ok := c.requestAffinity.Load("exec"); ok {
+				t.Errorf("Affinity of the request is kept after it's done")
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// BackendAuth authenticates relayed requests whose path starts with
+// PathPrefix to the backend with the token in TokenFile, instead of
+// AuthenticationTokenFile. The prefix only matches whole path segments, eg
+// /api matches /api and /api/x, but not /apis, and is compared with the
+// cleaned path, see path.Clean. If several match, the one with the longest
+// PathPrefix wins. The token is sent in Header, Authorization by default,
+// after Scheme. Scheme defaults to Bearer for the Authorization header, and
+// to none for other headers, eg X-Api-Key. The file is read for each
+// request, so that rotated tokens are picked up.
+type BackendAuth struct {
+	PathPrefix string
+	TokenFile  string
+	Header     string
+	Scheme     string
+}
+
+// ParseBackendAuth parses a backend authentication given as
+// "PATH_PREFIX,TOKEN_FILE[,HEADER[,SCHEME]]".
+func ParseBackendAuth(s string) (BackendAuth, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) < 2 || len(parts) > 4 || parts[1] == "" {
+		return BackendAuth{}, fmt.Errorf("expected PATH_PREFIX,TOKEN_FILE[,HEADER[,SCHEME]], got %q", s)
+	}
+	parts = append(parts, "", "")
+	return BackendAuth{
+		PathPrefix: parts[0],
+		TokenFile:  parts[1],
+		Header:     parts[2],
+		Scheme:     parts[3],
+	}, nil
+}
+
+// header returns the header that the token is sent in.
+func (a *BackendAuth) header() string {
+	if a.Header == "" {
+		return "Authorization"
+	}
+	return a.Header
+}
+
+// value returns the header value for token.
+func (a *BackendAuth) value(token string) string {
+	scheme := a.Scheme
+	if scheme == "" && http.CanonicalHeaderKey(a.header()) == "Authorization" {
+		scheme = "Bearer"
+	}
+	if scheme == "" {
+		return token
+	}
+	return scheme + " " + token
+}
+
+// matchBackendAuth returns the backend authentication with the longest
+// PathPrefix matching path, or nil if none matches.
+func (c *Client) matchBackendAuth(path string) *BackendAuth {
+	path = cleanPath(path)
+	var match *BackendAuth
+	for i := range c.config.BackendAuth {
+		a := &c.config.BackendAuth[i]
+		if path != a.PathPrefix && !strings.HasPrefix(path, strings.TrimSuffix(a.PathPrefix, "/")+"/") {
+			continue
+		}
+		if match == nil || len(a.PathPrefix) > len(match.PathPrefix) {
+			match = a
+		}
+	}
+	return match
+}
+
+// setBackendAuth sets the token of the backend authentication matching path
+// on header, or else the one in AuthenticationTokenFile, if any.
+func (c *Client) setBackendAuth(path string, header http.Header) error {
+	if a := c.matchBackendAuth(path); a != nil {
+		token, err := os.ReadFile(a.TokenFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read authentication token for %s from %s: %v", a.PathPrefix, a.TokenFile, err)
+		}
+		// Editors and Kubernetes secrets often add a trailing newline.
+		header.Set(a.header(), a.value(strings.TrimRight(string(token), "\r\n")))
+		return nil
+	}
+	if c.config.AuthenticationTokenFile != "" {
+		token, err := os.ReadFile(c.config.AuthenticationTokenFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read authentication token from %s: %v", c.config.AuthenticationTokenFile, err)
+		}
+		header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	return nil
+}
+
+// backendAuthHeaders returns the headers that BackendAuth sets, which are
+// redacted in logs.
+func (c *Client) backendAuthHeaders() []string {
+	var headers []string
+	for i := range c.config.BackendAuth {
+		headers = append(headers, c.config.BackendAuth[i].header())
+	}
+	return headers
+}
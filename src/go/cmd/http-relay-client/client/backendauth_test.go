@@ -0,0 +1,136 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseBackendAuth(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    BackendAuth
+		wantErr bool
+	}{
+		{in: "/api/,token", want: BackendAuth{PathPrefix: "/api/", TokenFile: "token"}},
+		{in: "/api/,token,X-Api-Key", want: BackendAuth{PathPrefix: "/api/", TokenFile: "token", Header: "X-Api-Key"}},
+		{in: "/,token,Authorization,Token", want: BackendAuth{PathPrefix: "/", TokenFile: "token", Header: "Authorization", Scheme: "Token"}},
+		{in: "/api/", wantErr: true},
+		{in: "/api/,", wantErr: true},
+		{in: "/api/,token,X-Api-Key,Bearer,extra", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := ParseBackendAuth(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseBackendAuth(%q) = %+v, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("ParseBackendAuth(%q) = %+v, %v, want %+v", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestBackendAuth(t *testing.T) {
+	dir := t.TempDir()
+	writeToken := func(name, token string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	config := DefaultClientConfig()
+	config.AuthenticationTokenFile = writeToken("global", "global-token")
+	config.BackendAuth = []BackendAuth{
+		{PathPrefix: "/api/", TokenFile: writeToken("api", "sa-token")},
+		{PathPrefix: "/api/jobs/", TokenFile: writeToken("jobs", "jwt-token"), Scheme: "JWT"},
+		{PathPrefix: "/keyed/", TokenFile: writeToken("keyed", "api-key"), Header: "X-Api-Key"},
+		{PathPrefix: "/internal", TokenFile: writeToken("internal", "internal-token")},
+	}
+	client := newClient(config)
+
+	tests := []struct {
+		path       string
+		wantHeader string
+		wantValue  string
+	}{
+		{"/api/robots", "Authorization", "Bearer sa-token"},
+		{"/api/jobs/1", "Authorization", "JWT jwt-token"},
+		{"/keyed/x", "X-Api-Key", "api-key"},
+		{"/internal", "Authorization", "Bearer internal-token"},
+		{"/internal/x", "Authorization", "Bearer internal-token"},
+		// Prefixes only match whole segments of the cleaned path.
+		{"/internal-debug/x", "Authorization", "Bearer global-token\n"},
+		{"/internals", "Authorization", "Bearer global-token\n"},
+		{"/public/../internal/x", "Authorization", "Bearer internal-token"},
+		{"/internal/../public", "Authorization", "Bearer global-token\n"},
+		{"/api/../keyed/x", "X-Api-Key", "api-key"},
+		// The global token is sent as before, including the newline.
+		{"/other", "Authorization", "Bearer global-token\n"},
+	}
+	for _, tc := range tests {
+		req, err := client.createBackendRequest(&pb.HttpRequest{
+			Id:     proto.String("15"),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid" + tc.path),
+		})
+		if err != nil {
+			t.Fatalf("createBackendRequest(%s) failed: %v", tc.path, err)
+		}
+		if got := req.Header.Get(tc.wantHeader); got != tc.wantValue {
+			t.Errorf("%s: %s = %q, want %q", tc.path, tc.wantHeader, got, tc.wantValue)
+		}
+		if tc.wantHeader != "Authorization" && req.Header.Get("Authorization") != "" {
+			t.Errorf("%s: Authorization = %q, want none", tc.path, req.Header.Get("Authorization"))
+		}
+		if got := client.redactHeader(req.Header).Get(tc.wantHeader); got == tc.wantValue {
+			t.Errorf("%s: %s not redacted", tc.path, tc.wantHeader)
+		}
+	}
+}
+
+func TestBackendAuthWithoutGlobalToken(t *testing.T) {
+	config := DefaultClientConfig()
+	config.BackendAuth = []BackendAuth{{PathPrefix: "/api/", TokenFile: filepath.Join(t.TempDir(), "missing")}}
+	client := newClient(config)
+
+	req, err := client.createBackendRequest(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/other"),
+	})
+	if err != nil {
+		t.Fatalf("createBackendRequest() failed: %v", err)
+	}
+	if got := req.Header.Values("Authorization"); len(got) != 0 {
+		t.Errorf("Authorization = %q, want none", got)
+	}
+
+	if _, err := client.createBackendRequest(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/api/robots"),
+	}); err == nil {
+		t.Errorf("createBackendRequest() succeeded with a missing token file")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/http2"
+)
+
+// dialBackendH2 connects to an https backend for ForceHttp2 like
+// dialBackendTLS. Unless BackendHttp2PriorKnowledge is set, it fails if the
+// backend didn't choose HTTP/2 with ALPN, as it would then fail to parse
+// HTTP/2 frames anyway, with a less helpful error.
+func (c *Client) dialBackendH2(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := c.dialBackendTLS(ctx, network, addr, cfg)
+	if err != nil || c.config.BackendHttp2PriorKnowledge {
+		return conn, err
+	}
+	if p := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("backend at %s doesn't offer HTTP/2 with ALPN (negotiated %q), "+
+			"set BackendHttp2PriorKnowledge if it speaks HTTP/2 nonetheless", addr, p)
+	}
+	return conn, nil
+}
+
+// configureHttp2Health sets up the health checks of the HTTP/2 connections of
+// t, see BackendHttp2ReadIdleTimeout.
+func (c *Client) configureHttp2Health(t *http2.Transport) {
+	t.ReadIdleTimeout = c.config.BackendHttp2ReadIdleTimeout
+	t.PingTimeout = c.config.BackendHttp2PingTimeout
+}
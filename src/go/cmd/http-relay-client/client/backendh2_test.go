@@ -0,0 +1,153 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp"
+	"golang.org/x/net/http2"
+)
+
+// protoHandler responds with the protocol of the request.
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.Proto))
+})
+
+// newHttp2OnlyBackend returns the URL of an https backend that only speaks
+// HTTP/2, and offers the nextProtos with ALPN.
+func newHttp2OnlyBackend(t *testing.T, nextProtos []string) string {
+	// The httptest server provides the certificate.
+	certs := httptest.NewTLSServer(protoHandler)
+	certs.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: certs.TLS.Certificates,
+		NextProtos:   nextProtos,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// http2.Server checks the negotiated TLS version.
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					conn.Close()
+					return
+				}
+				(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: protoHandler})
+			}()
+		}
+	}()
+	return "https://" + l.Addr().String()
+}
+
+func TestBackendProtocols(t *testing.T) {
+	h1 := httptest.NewTLSServer(protoHandler)
+	defer h1.Close()
+	alpn := httptest.NewUnstartedServer(protoHandler)
+	alpn.EnableHTTP2 = true
+	alpn.StartTLS()
+	defer alpn.Close()
+	backends := map[string]string{
+		"h1-only":         h1.URL,
+		"h2-only":         newHttp2OnlyBackend(t, []string{"h2"}),
+		"alpn":            alpn.URL,
+		"h2-without-alpn": newHttp2OnlyBackend(t, nil),
+	}
+	modes := map[string]func(*ClientConfig){
+		"default":         func(c *ClientConfig) {},
+		"DisableHttp2":    func(c *ClientConfig) { c.DisableHttp2 = true },
+		"ForceHttp2":      func(c *ClientConfig) { c.ForceHttp2 = true },
+		"ForceHttp2 + PK": func(c *ClientConfig) { c.ForceHttp2, c.BackendHttp2PriorKnowledge = true, true },
+	}
+	// The protocol that each mode reaches each backend with, or "" if it
+	// fails, see the matrix in the doc comment of ForceHttp2.
+	tests := []struct {
+		backend, mode, want string
+	}{
+		{"h1-only", "default", "HTTP/1.1"},
+		{"h1-only", "DisableHttp2", "HTTP/1.1"},
+		{"h1-only", "ForceHttp2", ""},
+		{"h1-only", "ForceHttp2 + PK", ""},
+		{"h2-only", "default", "HTTP/2.0"},
+		{"h2-only", "DisableHttp2", ""},
+		{"h2-only", "ForceHttp2", "HTTP/2.0"},
+		{"h2-only", "ForceHttp2 + PK", "HTTP/2.0"},
+		{"alpn", "default", "HTTP/2.0"},
+		{"alpn", "DisableHttp2", "HTTP/1.1"},
+		{"alpn", "ForceHttp2", "HTTP/2.0"},
+		{"alpn", "ForceHttp2 + PK", "HTTP/2.0"},
+		{"h2-without-alpn", "default", ""},
+		{"h2-without-alpn", "DisableHttp2", ""},
+		{"h2-without-alpn", "ForceHttp2", ""},
+		{"h2-without-alpn", "ForceHttp2 + PK", "HTTP/2.0"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.backend+"/"+tc.mode, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.BackendTLSInsecureSkipVerify = true
+			config.BackendDialTimeout = 5 * time.Second
+			modes[tc.mode](&config)
+			c := newClient(config)
+			local := c.newLocalClient(c.insecureBackendTLSConfig())
+			local.Timeout = 5 * time.Second
+
+			resp, err := local.Get(backends[tc.backend])
+			if tc.want == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Errorf("Request succeeded with %s, want an error", resp.Proto)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.Proto != tc.want || string(body) != tc.want {
+				t.Errorf("Got %s, backend saw %s, want %s", resp.Proto, body, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackendHttp2Health(t *testing.T) {
+	config := DefaultClientConfig()
+	config.ForceHttp2 = true
+	config.BackendHttp2ReadIdleTimeout = 10 * time.Second
+	config.BackendHttp2PingTimeout = 5 * time.Second
+	local := newClient(config).newLocalClient(nil)
+
+	h2transport := local.Transport.(*ochttp.Transport).Base.(*headerTimeoutTransport).base.(*http2.Transport)
+	if h2transport.ReadIdleTimeout != 10*time.Second || h2transport.PingTimeout != 5*time.Second {
+		t.Errorf("ReadIdleTimeout = %v and PingTimeout = %v, want 10s and 5s",
+			h2transport.ReadIdleTimeout, h2transport.PingTimeout)
+	}
+	if h2transport.IdleConnTimeout == 0 {
+		t.Errorf("Idle connections are kept forever")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"golang.org/x/net/http/httpguts"
+)
+
+// protectedBackendHeaders can't be changed with BackendHeaderAdditions and
+// BackendHeaderRemovals, as the transport derives them from the request
+// itself.
+var protectedBackendHeaders = map[string]bool{
+	"Host":           true,
+	"Content-Length": true,
+}
+
+// headerTemplateVars are the variables that can be used as {name} in the
+// values of BackendHeaderAdditions.
+var headerTemplateVars = map[string]bool{
+	"request_id":        true,
+	"server_name":       true,
+	"hostname":          true,
+	"timestamp_rfc3339": true,
+}
+
+var headerTemplateVar = regexp.MustCompile(`\{([a-z0-9_]+)\}`)
+
+// hostname is the name of this machine for the {hostname} variable. It's
+// looked up once, as it's the same for all requests.
+var hostname = sync.OnceValue(func() string {
+	name, _ := os.Hostname()
+	return name
+})
+
+// checkBackendHeaders returns an error if a header in additions or removals
+// is invalid or protected, or if a value in additions uses an unknown
+// template variable.
+func checkBackendHeaders(additions map[string]string, removals []string) error {
+	check := func(name string) error {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if protectedBackendHeaders[http.CanonicalHeaderKey(name)] {
+			return fmt.Errorf("header %s can't be changed", http.CanonicalHeaderKey(name))
+		}
+		return nil
+	}
+	for _, name := range removals {
+		if err := check(name); err != nil {
+			return err
+		}
+	}
+	for name, value := range additions {
+		if err := check(name); err != nil {
+			return err
+		}
+		for _, m := range headerTemplateVar.FindAllStringSubmatch(value, -1) {
+			if !headerTemplateVars[m[1]] {
+				return fmt.Errorf("unknown variable {%s} in header %s", m[1], name)
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteBackendHeaders removes the BackendHeaderRemovals from header, then
+// sets the BackendHeaderAdditions with their template variables expanded.
+// An addition thus replaces a header of the same name sent by the
+// user-client.
+func (c *Client) rewriteBackendHeaders(breq *pb.HttpRequest, header http.Header) {
+	for _, name := range c.config.BackendHeaderRemovals {
+		header.Del(name)
+	}
+	if len(c.config.BackendHeaderAdditions) == 0 {
+		return
+	}
+	vars := map[string]func() string{
+		"request_id":        breq.GetId,
+		"server_name":       func() string { return c.config.ServerName },
+		"hostname":          hostname,
+		"timestamp_rfc3339": func() string { return time.Now().UTC().Format(time.RFC3339) },
+	}
+	for name, value := range c.config.BackendHeaderAdditions {
+		header.Set(name, expandHeaderTemplate(value, vars))
+	}
+}
+
+// expandHeaderTemplate replaces the {name} variables in tmpl. Unknown
+// variables, which checkBackendHeaders rejects, are left as they are.
+func expandHeaderTemplate(tmpl string, vars map[string]func() string) string {
+	if !strings.Contains(tmpl, "{") {
+		return tmpl
+	}
+	return headerTemplateVar.ReplaceAllStringFunc(tmpl, func(m string) string {
+		if value, ok := vars[m[1:len(m)-1]]; ok {
+			return value()
+		}
+		return m
+	})
+}
+
+// transportHeaders keep their canonical names with PreserveHeaderCase and
+// BackendHeaderCase, as the transport looks them up to frame the request and
+// to negotiate compression, and would miss them otherwise.
+var transportHeaders = map[string]bool{
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"User-Agent":        true,
+}
+
+// withHeaderCase returns req with its header names spelled as in breq, if
+// PreserveHeaderCase is set, and as in BackendHeaderCase. Go canonicalizes
+// header names, eg SOAPAction to Soapaction, which some backends reject.
+// The HTTP/1 transport writes the names as they are in the header map, so
+// this sets them there directly instead of through Header.Set. req itself
+// keeps the canonical names, which the rest of the client looks up.
+//
+// The casing of the backend's response header names can't be preserved, as
+// net/http canonicalizes them when reading the response.
+func (c *Client) withHeaderCase(breq *pb.HttpRequest, req *http.Request) *http.Request {
+	var names []string
+	if c.config.PreserveHeaderCase {
+		for _, h := range breq.Header {
+			names = append(names, h.GetName())
+		}
+	}
+	names = append(names, c.config.BackendHeaderCase...)
+	var header http.Header
+	for _, name := range names {
+		key := http.CanonicalHeaderKey(name)
+		if name == key || transportHeaders[key] {
+			continue
+		}
+		if header == nil {
+			if _, ok := req.Header[key]; !ok {
+				continue
+			}
+			header = req.Header.Clone()
+		}
+		if values, ok := header[key]; ok {
+			delete(header, key)
+			header[name] = values
+		}
+	}
+	if header == nil {
+		return req
+	}
+	r := req.WithContext(req.Context())
+	r.Header = header
+	return r
+}
@@ -0,0 +1,273 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRewriteBackendHeaders(t *testing.T) {
+	tests := []struct {
+		desc      string
+		additions map[string]string
+		removals  []string
+		header    []*pb.HttpHeader
+		want      http.Header
+	}{
+		{
+			desc:      "static",
+			additions: map[string]string{"X-Static": "value"},
+			want:      http.Header{"X-Static": {"value"}},
+		},
+		{
+			desc: "templates",
+			additions: map[string]string{
+				"X-Robot-Id":       "{server_name}",
+				"X-Correlation-Id": "relay-{request_id}-{server_name}",
+			},
+			want: http.Header{
+				"X-Robot-Id":       {"robot-1"},
+				"X-Correlation-Id": {"relay-15-robot-1"},
+			},
+		},
+		{
+			desc:      "hostname",
+			additions: map[string]string{"X-Host": "{hostname}"},
+			want:      http.Header{"X-Host": {hostname()}},
+		},
+		{
+			desc:      "literal braces are kept",
+			additions: map[string]string{"X-Literal": "{} {Request_Id} {request_id"},
+			want:      http.Header{"X-Literal": {"{} {Request_Id} {request_id"}},
+		},
+		{
+			desc:      "addition replaces user-client header",
+			additions: map[string]string{"x-robot-id": "{server_name}"},
+			header: []*pb.HttpHeader{
+				{Name: proto.String("X-Robot-Id"), Value: proto.String("spoofed")},
+			},
+			want: http.Header{"X-Robot-Id": {"robot-1"}},
+		},
+		{
+			desc:     "removal",
+			removals: []string{"cookie", "X-Unset"},
+			header: []*pb.HttpHeader{
+				{Name: proto.String("Cookie"), Value: proto.String("a=b")},
+				{Name: proto.String("Cookie"), Value: proto.String("c=d")},
+				{Name: proto.String("Accept"), Value: proto.String("*/*")},
+			},
+			want: http.Header{"Cookie": nil, "Accept": {"*/*"}},
+		},
+		{
+			desc:      "removal before addition",
+			additions: map[string]string{"X-Robot-Id": "{server_name}"},
+			removals:  []string{"X-Robot-Id"},
+			header: []*pb.HttpHeader{
+				{Name: proto.String("X-Robot-Id"), Value: proto.String("spoofed")},
+			},
+			want: http.Header{"X-Robot-Id": {"robot-1"}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.ServerName = "robot-1"
+			config.BackendHeaderAdditions = tc.additions
+			config.BackendHeaderRemovals = tc.removals
+			if err := config.Validate(); err != nil {
+				t.Fatalf("Validate() failed: %v", err)
+			}
+			client := newClient(config)
+
+			req, err := client.createBackendRequest(&pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Host:   proto.String("example.com"),
+				Url:    proto.String("http://invalid/foo"),
+				Header: tc.header,
+			})
+			if err != nil {
+				t.Fatalf("createBackendRequest() failed: %v", err)
+			}
+			for name, want := range tc.want {
+				got := req.Header.Values(name)
+				if strings.Join(got, "|") != strings.Join(want, "|") {
+					t.Errorf("Header %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteBackendHeadersTimestamp(t *testing.T) {
+	config := DefaultClientConfig()
+	config.BackendHeaderAdditions = map[string]string{"X-Sent-At": "{timestamp_rfc3339}"}
+	client := newClient(config)
+
+	before := time.Now().Truncate(time.Second)
+	req, err := client.createBackendRequest(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/foo"),
+	})
+	if err != nil {
+		t.Fatalf("createBackendRequest() failed: %v", err)
+	}
+	sent, err := time.Parse(time.RFC3339, req.Header.Get("X-Sent-At"))
+	if err != nil {
+		t.Fatalf("X-Sent-At is not RFC 3339: %v", err)
+	}
+	if sent.Before(before) || sent.After(time.Now()) {
+		t.Errorf("X-Sent-At = %v, want between %v and now", sent, before)
+	}
+}
+
+func TestCheckBackendHeaders(t *testing.T) {
+	tests := []struct {
+		desc      string
+		additions map[string]string
+		removals  []string
+		wantErr   string
+	}{
+		{
+			desc:      "valid",
+			additions: map[string]string{"X-Robot-Id": "{hostname}", "X-Sent-At": "{timestamp_rfc3339}"},
+			removals:  []string{"Cookie"},
+		},
+		{
+			desc:      "host addition",
+			additions: map[string]string{"host": "example.com"},
+			wantErr:   "Host",
+		},
+		{
+			desc:      "content-length addition",
+			additions: map[string]string{"Content-Length": "0"},
+			wantErr:   "Content-Length",
+		},
+		{
+			desc:     "content-length removal",
+			removals: []string{"content-length"},
+			wantErr:  "Content-Length",
+		},
+		{
+			desc:      "invalid name",
+			additions: map[string]string{"X Robot": "a"},
+			wantErr:   "invalid header name",
+		},
+		{
+			desc:      "unknown variable",
+			additions: map[string]string{"X-Robot-Id": "{robot}"},
+			wantErr:   "{robot}",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := checkBackendHeaders(tc.additions, tc.removals)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkBackendHeaders() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("checkBackendHeaders() = %v, want error mentioning %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestHeaderCase(t *testing.T) {
+	header := []*pb.HttpHeader{
+		{Name: proto.String("SOAPAction"), Value: proto.String("urn:Reboot")},
+		{Name: proto.String("x-device-ID"), Value: proto.String("robot-1")},
+		{Name: proto.String("x-device-ID"), Value: proto.String("robot-2")},
+		{Name: proto.String("content-type"), Value: proto.String("text/xml")},
+		{Name: proto.String("x-forwarded-client-cert"), Value: proto.String("Hash=0000")},
+		{Name: proto.String("accept-encoding"), Value: proto.String("identity")},
+	}
+	tests := []struct {
+		desc       string
+		preserve   bool
+		headerCase []string
+		want       []string
+		dontWant   []string
+	}{
+		{
+			desc:     "canonical",
+			want:     []string{"Soapaction: urn:Reboot", "X-Device-Id: robot-1", "Content-Type: text/xml"},
+			dontWant: []string{"SOAPAction:"},
+		},
+		{
+			desc:     "preserve",
+			preserve: true,
+			want: []string{"SOAPAction: urn:Reboot", "x-device-ID: robot-1", "x-device-ID: robot-2",
+				"content-type: text/xml", "Accept-Encoding: identity"},
+			dontWant: []string{"Soapaction:", "X-Device-Id:", "Content-Type:", "accept-encoding:"},
+		},
+		{
+			desc:       "listed names",
+			headerCase: []string{"SOAPAction", "Content-type", "Host", "X-Missing"},
+			want:       []string{"SOAPAction: urn:Reboot", "X-Device-Id: robot-1", "Content-type: text/xml", "Host: "},
+			dontWant:   []string{"Soapaction:", "HOST:", "X-Missing:"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			backend := newRawBackend(t)
+			relay := newRecordingRelay()
+			defer relay.Close()
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = backend.addr
+			config.PreserveHeaderCase = tc.preserve
+			config.BackendHeaderCase = tc.headerCase
+			client := newClient(config)
+
+			client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("POST"),
+				Url:    proto.String("http://invalid/control"),
+				Header: header,
+				Body:   []byte("<Envelope/>"),
+			})
+
+			received := <-backend.header
+			for _, line := range tc.want {
+				if !strings.Contains(received, "\r\n"+line) {
+					t.Errorf("Backend didn't receive %q:\n%s", line, received)
+				}
+			}
+			for _, line := range append(tc.dontWant, "x-forwarded-client-cert:", "X-Forwarded-Client-Cert:") {
+				if strings.Contains(received, "\r\n"+line) {
+					t.Errorf("Backend received %q:\n%s", line, received)
+				}
+			}
+			if got := strings.Count(strings.ToLower(received), "\r\nhost:"); got != 1 {
+				t.Errorf("Backend received %d Host headers:\n%s", got, received)
+			}
+			if got := <-backend.body; got != "<Envelope/>" {
+				t.Errorf("Backend received body %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// newStallingListener returns the address of a listener that accepts
+// connections, but never reads from or writes to them.
+func newStallingListener(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return l.Addr().String()
+}
+
+func TestStalledBackendTimesOut(t *testing.T) {
+	tests := []struct {
+		desc       string
+		scheme     string
+		forceHttp2 bool
+		modify     func(config *ClientConfig)
+	}{
+		{"tls handshake", "https", false, func(config *ClientConfig) {
+			config.BackendTLSHandshakeTimeout = 100 * time.Millisecond
+		}},
+		{"tls handshake http2", "https", true, func(config *ClientConfig) {
+			config.BackendTLSHandshakeTimeout = 100 * time.Millisecond
+		}},
+		{"response header", "http", false, func(config *ClientConfig) {
+			config.BackendResponseHeaderTimeout = 100 * time.Millisecond
+		}},
+		{"response header http2", "http", true, func(config *ClientConfig) {
+			config.BackendResponseHeaderTimeout = 100 * time.Millisecond
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := newRecordingRelay()
+			defer relay.Close()
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = tc.scheme
+			config.BackendAddress = newStallingListener(t)
+			config.ForceHttp2 = tc.forceHttp2
+			tc.modify(&config)
+			client := newClient(config)
+
+			start := time.Now()
+			client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Request took %v, want the timeout to apply", elapsed)
+			}
+
+			received := relay.responses("15")
+			if len(received) != 1 {
+				t.Fatalf("Got %d responses, want 1", len(received))
+			}
+			if got := received[0].GetStatusCode(); got != http.StatusGatewayTimeout {
+				t.Errorf("Status = %d, want %d", got, http.StatusGatewayTimeout)
+			}
+			for _, h := range received[0].Header {
+				if h.GetName() == relayErrorHeader && h.GetValue() != errorBackendTimeout {
+					t.Errorf("%s = %q, want %q", relayErrorHeader, h.GetValue(), errorBackendTimeout)
+				}
+			}
+		})
+	}
+}
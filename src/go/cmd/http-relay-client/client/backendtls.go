@@ -0,0 +1,57 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+)
+
+// checkBackendTLS returns an error if BackendTLSInsecureSkipVerify is
+// combined with a RootCAFile, which would never be used.
+func checkBackendTLS(config ClientConfig) error {
+	if config.BackendTLSInsecureSkipVerify && config.RootCAFile != "" {
+		return errors.New("skipping backend certificate verification and a root CA file are mutually exclusive")
+	}
+	return nil
+}
+
+// insecureBackendTLSConfig returns the TLS config for backends whose
+// certificates aren't verified, see BackendTLSInsecureSkipVerify. It's never
+// used for the relay server.
+func (c *Client) insecureBackendTLSConfig() *tls.Config {
+	slog.Warn("INSECURE: backend TLS certificates are not verified, do not use this in production",
+		slog.String("BackendAddress", c.config.BackendAddress))
+	return &tls.Config{InsecureSkipVerify: true}
+}
+
+// withBackendServerName sets the TLS server name for https backends to
+// BackendTLSServerName or BackendHostOverride, if set. tlsConfig may be nil,
+// for the default config.
+func (c *Client) withBackendServerName(tlsConfig *tls.Config) *tls.Config {
+	serverName := c.config.BackendTLSServerName
+	if serverName == "" {
+		serverName = c.config.BackendHostOverride
+	}
+	if serverName == "" || c.config.BackendScheme != "https" {
+		return tlsConfig
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.ServerName = serverName
+	return tlsConfig
+}
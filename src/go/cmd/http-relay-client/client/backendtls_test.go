@@ -0,0 +1,210 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCheckBackendTLS(t *testing.T) {
+	config := DefaultClientConfig()
+	config.BackendTLSInsecureSkipVerify = true
+	if err := checkBackendTLS(config); err != nil {
+		t.Errorf("checkBackendTLS() = %v, want no error", err)
+	}
+	config.RootCAFile = "/etc/ssl/robot-ca.pem"
+	if err := checkBackendTLS(config); err == nil {
+		t.Errorf("checkBackendTLS() = nil, want error with RootCAFile")
+	}
+}
+
+func TestInsecureBackendTLS(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	for _, forceHttp2 := range []bool{false, true} {
+		config := DefaultClientConfig()
+		config.ForceHttp2 = forceHttp2
+		config.BackendTLSInsecureSkipVerify = true
+		c := newClient(config)
+
+		if _, err := c.newLocalClient(nil).Get(backend.URL); err == nil {
+			t.Errorf("ForceHttp2=%v: self-signed certificate was accepted by default", forceHttp2)
+		}
+		resp, err := c.newLocalClient(c.insecureBackendTLSConfig()).Get(backend.URL)
+		if err != nil {
+			t.Errorf("ForceHttp2=%v: request failed despite BackendTLSInsecureSkipVerify: %v", forceHttp2, err)
+			continue
+		}
+		resp.Body.Close()
+		if forceHttp2 && resp.ProtoMajor != 2 {
+			t.Errorf("ForceHttp2=%v: backend was reached with %s", forceHttp2, resp.Proto)
+		}
+	}
+}
+
+func TestInsecureBackendTLSDoesNotAffectRelay(t *testing.T) {
+	var polls atomic.Int32
+	relay := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		http.Error(w, "No request received within timeout", http.StatusRequestTimeout)
+	}))
+	// The client is expected to fail the handshakes.
+	relay.Config.ErrorLog = log.New(io.Discard, "", 0)
+	relay.StartTLS()
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "https"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "https://")
+	config.DisableAuthForRemote = true
+	config.StartupJitter = 0
+	config.BackendTLSInsecureSkipVerify = true
+	c := newClient(config)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Start()
+	}()
+	time.Sleep(300 * time.Millisecond)
+	c.Stop()
+	<-done
+	if n := polls.Load(); n != 0 {
+		t.Errorf("Relay server with a self-signed certificate got %d polls, want none", n)
+	}
+}
+
+func TestBackendHostOverride(t *testing.T) {
+	type seen struct{ host, serverName string }
+	got := make(chan seen, 1)
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- seen{r.Host, r.TLS.ServerName}
+	}))
+	defer backend.Close()
+	address := strings.TrimPrefix(backend.URL, "https://")
+
+	tests := []struct {
+		desc         string
+		preserveHost bool
+		override     string
+		want         seen
+	}{
+		// No SNI is sent for IP addresses.
+		{"backend address", false, "", seen{address, ""}},
+		{"preserved host", true, "", seen{"user.example.com", ""}},
+		{"override", false, "kubernetes.default.svc", seen{"kubernetes.default.svc", "kubernetes.default.svc"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.BackendAddress = address
+			config.BackendTLSInsecureSkipVerify = true
+			config.PreserveHost = tc.preserveHost
+			config.BackendHostOverride = tc.override
+			c := newClient(config)
+
+			req, err := c.createBackendRequest(&pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Host:   proto.String("user.example.com"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+			if err != nil {
+				t.Fatalf("createBackendRequest() failed: %v", err)
+			}
+			resp, err := c.newLocalClient(c.withBackendServerName(c.insecureBackendTLSConfig())).Do(req)
+			if err != nil {
+				t.Fatalf("Backend request failed: %v", err)
+			}
+			resp.Body.Close()
+			if s := <-got; s != tc.want {
+				t.Errorf("Backend saw Host %q and SNI %q, want %q and %q", s.host, s.serverName, tc.want.host, tc.want.serverName)
+			}
+		})
+	}
+}
+
+func TestBackendTLSServerName(t *testing.T) {
+	// The backend is dialed by IP address, but its certificate is only
+	// valid for another name, like behind an SNI routing proxy.
+	ca, cert := newTestServerCert(t, "service", "service.internal")
+	type seen struct{ host, serverName string }
+	got := make(chan seen, 1)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- seen{r.Host, r.TLS.ServerName}
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	backend.EnableHTTP2 = true
+	// The client is expected to fail the handshakes without a server name.
+	backend.Config.ErrorLog = log.New(io.Discard, "", 0)
+	backend.StartTLS()
+	defer backend.Close()
+	address := strings.TrimPrefix(backend.URL, "https://")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, forceHttp2 := range []bool{false, true} {
+		for _, serverName := range []string{"", "service.internal"} {
+			config := DefaultClientConfig()
+			config.DisableAuthForRemote = true
+			config.RootCAFile = caFile
+			config.BackendAddress = address
+			config.ForceHttp2 = forceHttp2
+			config.BackendTLSServerName = serverName
+			_, local, err := newClient(config).newHTTPClients()
+			if err != nil {
+				t.Fatalf("newHTTPClients() failed: %v", err)
+			}
+
+			resp, err := local.Get(backend.URL)
+			if serverName == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Errorf("ForceHttp2=%v: certificate for service.internal was accepted for %s", forceHttp2, address)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("ForceHttp2=%v: request failed with BackendTLSServerName: %v", forceHttp2, err)
+				continue
+			}
+			resp.Body.Close()
+			want := seen{address, serverName}
+			if s := <-got; s != want {
+				t.Errorf("ForceHttp2=%v: backend saw Host %q and SNI %q, want %q and %q", forceHttp2, s.host, s.serverName, want.host, want.serverName)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// The relay server sets this header on /server/request responses if it
+// accepts batches of responses on /server/responses.
+const responseBatchHeader = "X-Relay-Response-Batch"
+
+// errBatchesUnsupported is returned for a batch that the relay server didn't
+// accept because it doesn't know /server/responses. Batching stays off until
+// the relay server advertises support for it again.
+var errBatchesUnsupported = errors.New("relay server doesn't support batched responses")
+
+// recordResponseBatchSupport stores whether the relay server advertised
+// support for batched responses in its response header.
+func (c *Client) recordResponseBatchSupport(header http.Header) {
+	c.responseBatches.Store(header.Get(responseBatchHeader) != "")
+}
+
+// responseBatcher coalesces the responses to all requests in flight and posts
+// them to the relay server together. For chatty workloads with many small
+// responses, this saves most of the overhead of an HTTP exchange per chunk.
+//
+// handleRequest waits for each response to be posted before sending the next
+// one for the same request, so a batch never holds two responses to the same
+// request, and the order of each request's responses is preserved. Responses
+// to requests from different relay servers, or different replicas of one, are
+// batched separately.
+type responseBatcher struct {
+	c        *Client
+	delay    time.Duration
+	maxBytes int
+
+	mu sync.Mutex
+	// current holds the batches being filled, by relay server and affinity
+	// key.
+	current map[string]*responseBatch
+}
+
+type responseBatch struct {
+	relay     string
+	affinity  *relayAffinity
+	key       string
+	responses []*batchedResponse
+	size      int
+}
+
+type batchedResponse struct {
+	resp     *pb.HttpResponse
+	queued   time.Time
+	priority int32
+	// done receives the result of posting resp.
+	done chan error
+}
+
+func newResponseBatcher(c *Client, delay time.Duration, maxBytes int) *responseBatcher {
+	return &responseBatcher{c: c, delay: delay, maxBytes: maxBytes, current: map[string]*responseBatch{}}
+}
+
+// send adds resp to the current batch and waits until the batch has been
+// posted. A batch is posted once its first response has waited for the batch
+// delay, or earlier once it reaches the maximum size, so no response, EOF or
+// not, is held back for longer than the delay. A response to a
+// high-priority request isn't held back at all: the batch is posted right
+// away, with the high-priority responses first. If the relay server rejected
+// resp, the error is wrapped with backoff.Permanent, as posting it on its own
+// would fail in the same way.
+func (b *responseBatcher) send(remote *http.Client, resp *pb.HttpResponse) error {
+	r := &batchedResponse{
+		resp:     resp,
+		queued:   time.Now(),
+		priority: b.c.requestPriority(resp.GetId()),
+		done:     make(chan error, 1),
+	}
+	relay, affinity := b.c.relayAddress(resp.GetId()), b.c.affinity(resp.GetId())
+	key := relay + "\x00" + affinity.key()
+	b.mu.Lock()
+	batch := b.current[key]
+	if batch == nil {
+		batch = &responseBatch{relay: relay, affinity: affinity, key: key}
+		b.current[key] = batch
+		time.AfterFunc(b.delay, func() {
+			if b.take(batch) {
+				b.post(remote, batch)
+			}
+		})
+	}
+	batch.responses = append(batch.responses, r)
+	batch.size += proto.Size(resp)
+	postNow := batch.size >= b.maxBytes || r.priority > 0
+	b.mu.Unlock()
+
+	if postNow && b.take(batch) {
+		b.post(remote, batch)
+	}
+	return <-r.done
+}
+
+// take ends batch, if it's still being filled, and returns true if the
+// caller should post it.
+func (b *responseBatcher) take(batch *responseBatch) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current[batch.key] != batch {
+		return false
+	}
+	delete(b.current, batch.key)
+	return true
+}
+
+// post posts batch to the relay server and reports the result to the senders
+// of its responses.
+func (b *responseBatcher) post(remote *http.Client, batch *responseBatch) {
+	responseBatchSize.Observe(float64(len(batch.responses)))
+	sort.SliceStable(batch.responses, func(i, j int) bool {
+		return batch.responses[i].priority > batch.responses[j].priority
+	})
+	msg := &pb.HttpResponses{}
+	for _, r := range batch.responses {
+		if !isKeepAlive(r.resp) {
+			r.resp.UploadAttempts = proto.Int32(1)
+			r.resp.UploadDurationMs = proto.Int64(timeSince(r.queued).Milliseconds())
+		}
+		msg.Response = append(msg.Response, r.resp)
+	}
+	errs, err := b.c.postResponses(remote, batch.relay, batch.affinity, msg)
+	for i, r := range batch.responses {
+		if err != nil {
+			r.done <- err
+		} else {
+			r.done <- errs[i]
+		}
+	}
+}
+
+// postResponses posts a batch of responses to the relay server at relay, with
+// affinity. It returns an error if the batch as a whole failed, or the result
+// for each response otherwise.
+func (c *Client) postResponses(remote *http.Client, relay string, affinity *relayAffinity, msg *pb.HttpResponses) ([]error, error) {
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	responsesURL := url.URL{
+		Scheme: c.config.RelayScheme,
+		Host:   relay,
+		Path:   c.config.RelayPrefix + "/server/responses",
+	}
+	ctx, cancel := withTimeout(context.Background(), c.config.RelayPostTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", responsesURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.google.protobuf;proto=cloudrobotics.http_relay.v1alpha1.HttpResponses")
+	req.Header.Set(clientVersionHeader, clientVersion())
+	affinity.apply(req)
+	resp, err := remote.Do(req)
+	c.relays.record(relay, err)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't post responses to relay server: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read relay server's response body: %v", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		c.responseBatches.Store(false)
+		return nil, errBatchesUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewRelayServerError(fmt.Sprintf("relay server responded %s: %s", http.StatusText(resp.StatusCode), body))
+	}
+	// The relay server answers with an "ok" line per accepted response, or a
+	// line describing the error.
+	acks := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if len(acks) != len(msg.Response) {
+		return nil, NewRelayServerError(fmt.Sprintf("relay server acknowledged %d of %d responses", len(acks), len(msg.Response)))
+	}
+	errs := make([]error, len(acks))
+	for i, ack := range acks {
+		if ack != "ok" {
+			errs[i] = backoff.Permanent(NewRelayServerError("relay server rejected response: " + ack))
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// newBatchRelay returns a relay server that accepts responses on their own
+// and, unless batching is false, in batches. It rejects the responses to
+// the requests in reject.
+func newBatchRelay(batching bool, reject ...string) *relaytest.Server {
+	relay := relaytest.NewServer()
+	relay.DisableBatches = !batching
+	for _, id := range reject {
+		relay.ForgetRequest(id, 0)
+	}
+	return relay
+}
+
+func newBatchClient(relay *relaytest.Server, delay time.Duration, maxBytes int) *Client {
+	config := fakeRelayConfig(relay)
+	config.BatchDelay = delay
+	config.BatchMaxBytes = maxBytes
+	config.ResponseRetryPolicy.InitialInterval = time.Millisecond
+	config.ResponseRetryPolicy.MaxRetries = 1
+	c := newClient(config)
+	c.responseBatches.Store(true)
+	return c
+}
+
+// sendAll sends a response for each id concurrently and returns the errors.
+func sendAll(c *Client, ids ...string) []error {
+	errs := make([]error, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			errs[i] = c.sendResponse(http.DefaultClient, nil, &pb.HttpResponse{
+				Id:   proto.String(id),
+				Body: []byte("body of " + id),
+				Eof:  proto.Bool(true),
+			}, nil)
+		}(i, id)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestResponsesAreBatched(t *testing.T) {
+	relay := newBatchRelay(true)
+	defer relay.Close()
+	c := newBatchClient(relay, 200*time.Millisecond, 64*1024)
+
+	start := time.Now()
+	for i, err := range sendAll(c, "1", "2", "3") {
+		if err != nil {
+			t.Errorf("sendResponse(%d) failed: %v", i+1, err)
+		}
+	}
+	// No response is held back for much longer than the batch delay.
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Sending took %v, want about 200ms", d)
+	}
+	batches, posted := relay.Batches(), relay.Calls(relaytest.ResponsePath)
+	if len(batches) != 1 || len(batches[0]) != 3 || posted != 0 {
+		t.Fatalf("Relay got %d batches and %d single responses, want 1 batch of 3", len(batches), posted)
+	}
+	for _, resp := range batches[0] {
+		if string(resp.Body) != "body of "+resp.GetId() || resp.GetUploadAttempts() != 1 {
+			t.Errorf("Relay got response %v", resp)
+		}
+	}
+}
+
+func TestFullBatchIsPostedEarly(t *testing.T) {
+	relay := newBatchRelay(true)
+	defer relay.Close()
+	// Every response fills a batch on its own.
+	c := newBatchClient(relay, time.Hour, 1)
+
+	for i, err := range sendAll(c, "1", "2") {
+		if err != nil {
+			t.Errorf("sendResponse(%d) failed: %v", i+1, err)
+		}
+	}
+	if got := len(relay.Batches()); got != 2 {
+		t.Errorf("Relay got %d batches, want 2", got)
+	}
+}
+
+func TestBatchFallsBackToPosting(t *testing.T) {
+	relay := newBatchRelay(false)
+	defer relay.Close()
+	c := newBatchClient(relay, time.Millisecond, 64*1024)
+
+	if err := sendAll(c, "1")[0]; err != nil {
+		t.Errorf("sendResponse() failed: %v", err)
+	}
+	if c.responseBatches.Load() {
+		t.Error("Batching still enabled after the relay server didn't accept a batch")
+	}
+	if got := relay.Calls(relaytest.ResponsePath); got != 1 || len(relay.Responses("1")) != 1 {
+		t.Errorf("Relay got %d single responses and %v, want the response posted on its own", got, relay.Responses("1"))
+	}
+}
+
+func TestRejectedResponseInBatch(t *testing.T) {
+	relay := newBatchRelay(true, "2")
+	defer relay.Close()
+	c := newBatchClient(relay, 50*time.Millisecond, 64*1024)
+
+	errs := sendAll(c, "1", "2")
+	if errs[0] != nil {
+		t.Errorf("sendResponse(1) failed: %v", errs[0])
+	}
+	if errs[1] == nil || !strings.Contains(errs[1].Error(), "invalid request ID 2") {
+		t.Errorf("sendResponse(2) = %v, want the relay server's error", errs[1])
+	}
+	if relay.Calls(relaytest.ResponsePath) != 0 {
+		t.Errorf("Rejected response was posted again on its own")
+	}
+}
+
+func TestRecordResponseBatchSupport(t *testing.T) {
+	c := newClient(DefaultClientConfig())
+	c.recordResponseBatchSupport(http.Header{responseBatchHeader: {"1"}})
+	if !c.responseBatches.Load() {
+		t.Error("Batching not enabled after relay server advertised support")
+	}
+	c.recordResponseBatchSupport(http.Header{})
+	if c.responseBatches.Load() {
+		t.Error("Batching still enabled after relay server stopped advertising support")
+	}
+}
+
+func TestHighPriorityResponsesAreNotHeldBack(t *testing.T) {
+	relay := newBatchRelay(true)
+	defer relay.Close()
+	c := newBatchClient(relay, time.Hour, 1<<20)
+	c.inFlight.Store("high", &inFlightRequest{priority: 1})
+
+	errs := make(chan []error, 1)
+	go func() { errs <- sendAll(c, "1", "2") }()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		c.batcher.mu.Lock()
+		batched := 0
+		for _, batch := range c.batcher.current {
+			batched += len(batch.responses)
+		}
+		c.batcher.mu.Unlock()
+		if batched == 2 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Responses weren't batched")
+		}
+	}
+	for _, err := range sendAll(c, "high") {
+		if err != nil {
+			t.Fatalf("sendResponse() failed: %v", err)
+		}
+	}
+	select {
+	case got := <-errs:
+		for _, err := range got {
+			if err != nil {
+				t.Errorf("sendResponse() failed: %v", err)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Batched responses were held back despite the high-priority response")
+	}
+
+	batches := relay.Batches()
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("Got batches %v, want one of 3 responses", batches)
+	}
+	if got := batches[0][0].GetId(); got != "high" {
+		t.Errorf("First response in batch is %q, want %q", got, "high")
+	}
+}
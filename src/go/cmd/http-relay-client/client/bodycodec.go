@@ -0,0 +1,154 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// statusError is an error that is reported to the user-client with the given
+// status code instead of 500 Internal Server Error.
+type statusError struct {
+	statusCode int
+	err        error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// decodeRequestBody undoes the body codec (gzip or zstd) that the relay server
+// applied to the request body. To protect the backend from decompression bombs,
+// the decompressed body is limited to MaxDecompressedBodySize and to
+// MaxDecompressionRatio times the size of the compressed body.
+func (c *Client) decodeRequestBody(codec string, body []byte) ([]byte, error) {
+	limit := c.config.MaxDecompressedBodySize
+	if ratio := c.config.MaxDecompressionRatio; ratio > 0 && int64(ratio)*int64(len(body)) < limit {
+		limit = int64(ratio) * int64(len(body))
+	}
+
+	var r io.Reader
+	switch codec {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, &statusError{http.StatusBadRequest, fmt.Errorf("invalid gzip request body: %v", err)}
+		}
+		defer zr.Close()
+		r = zr
+	case "zstd":
+		// The decoder also caps the memory for the frames' windows, which
+		// the frame header may declare much larger than the body.
+		zr, err := zstd.NewReader(bytes.NewReader(body),
+			zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)+1))
+		if err != nil {
+			return nil, &statusError{http.StatusBadRequest, fmt.Errorf("invalid zstd request body: %v", err)}
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, &statusError{http.StatusUnsupportedMediaType, fmt.Errorf("unsupported request body codec %q", codec)}
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, &statusError{http.StatusRequestEntityTooLarge,
+			fmt.Errorf("decompressed request body exceeds %d bytes", limit)}
+	}
+	if err != nil {
+		return nil, &statusError{http.StatusBadRequest, fmt.Errorf("invalid %s request body: %v", codec, err)}
+	}
+	if int64(len(decoded)) > limit {
+		return nil, &statusError{http.StatusRequestEntityTooLarge,
+			fmt.Errorf("decompressed request body exceeds %d bytes", limit)}
+	}
+	return decoded, nil
+}
+
+// acceptsGzip returns whether header advertises gzip in Accept-Encoding,
+// either explicitly or with a wildcard, and with a non-zero quality.
+func acceptsGzip(header http.Header) bool {
+	for _, v := range header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(coding, ";")
+			coding = strings.TrimSpace(coding)
+			if !strings.EqualFold(coding, "gzip") && coding != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// decodeResponseBody decompresses a gzip response body if the user-client
+// didn't accept gzip. The backend transports don't decompress transparently,
+// so that compressed bodies are relayed as they are, with their
+// Content-Encoding, Content-Length and ETag intact. This is the fallback for
+// backends that compress regardless of the request.
+func decodeResponseBody(req *http.Request, resp *http.Response) {
+	if resp.Body == http.NoBody || hasNoBody(req, resp) {
+		return
+	}
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") || acceptsGzip(req.Header) {
+		return
+	}
+	resp.Body = &gzipBody{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// gzipBody decompresses a response body. The gzip header is read on the
+// first Read, so that the response header can be relayed before the backend
+// sends the body.
+type gzipBody struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil && b.err == nil {
+		b.zr, b.err = gzip.NewReader(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.zr.Read(p)
+}
+
+func (b *gzipBody) Close() error {
+	return b.body.Close()
+}
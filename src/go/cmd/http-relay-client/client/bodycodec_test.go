@@ -0,0 +1,307 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zstdBytes compresses b with an encoder of its own, so that the encoder
+// state for large bodies doesn't stay alive for the rest of the tests.
+func zstdBytes(t *testing.T, b []byte) []byte {
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	return w.EncodeAll(b, nil)
+}
+
+func TestRequestBodyCodec(t *testing.T) {
+	type received struct {
+		body            string
+		contentLength   int64
+		contentEncoding string
+	}
+	got := make(chan received, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{string(body), r.ContentLength, r.Header.Get("Content-Encoding")}
+	}))
+	defer backend.Close()
+
+	plain := strings.Repeat("hello relay ", 100)
+	gzipped, zstded := gzipBytes(t, []byte(plain)), zstdBytes(t, []byte(plain))
+	tests := []struct {
+		desc       string
+		decompress bool
+		codec      string
+		body       []byte
+		want       received
+	}{
+		{"decompress gzip", true, "gzip", gzipped, received{plain, int64(len(plain)), ""}},
+		{"passthrough gzip", false, "gzip", gzipped, received{string(gzipped), int64(len(gzipped)), "gzip"}},
+		{"decompress zstd", true, "zstd", zstded, received{plain, int64(len(plain)), ""}},
+		{"passthrough zstd", false, "zstd", zstded, received{string(zstded), int64(len(zstded)), "zstd"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.DecompressRequestBodies = tc.decompress
+			client := newClient(config)
+
+			req, err := client.createBackendRequest(&pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("POST"),
+				Url:    proto.String("http://invalid/foo"),
+				Header: []*pb.HttpHeader{{
+					Name:  proto.String("Content-Length"),
+					Value: proto.String("7"),
+				}},
+				Body:      tc.body,
+				BodyCodec: proto.String(tc.codec),
+			})
+			if err != nil {
+				t.Fatalf("createBackendRequest() failed: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Backend request failed: %v", err)
+			}
+			resp.Body.Close()
+			if r := <-got; r != tc.want {
+				t.Errorf("Backend received %d bytes with Content-Length %d and Content-Encoding %q, want %d bytes with %d and %q",
+					len(r.body), r.contentLength, r.contentEncoding,
+					len(tc.want.body), tc.want.contentLength, tc.want.contentEncoding)
+			}
+		})
+	}
+}
+
+func TestRequestBodyCodecErrors(t *testing.T) {
+	zeros := gzipBytes(t, make([]byte, 1<<20))
+	zstdZeros := zstdBytes(t, make([]byte, 1<<20))
+	tests := []struct {
+		desc       string
+		modify     func(config *ClientConfig)
+		body       []byte
+		codec      string
+		wantStatus int
+	}{
+		{"ratio exceeded", func(config *ClientConfig) {}, zeros, "gzip", http.StatusRequestEntityTooLarge},
+		{"size exceeded", func(config *ClientConfig) {
+			config.MaxDecompressionRatio = 0
+			config.MaxDecompressedBodySize = 1000
+		}, zeros, "gzip", http.StatusRequestEntityTooLarge},
+		{"within limits", func(config *ClientConfig) {
+			config.MaxDecompressionRatio = 0
+		}, zeros, "gzip", 0},
+		{"corrupt body", func(config *ClientConfig) {}, []byte("not gzip"), "gzip", http.StatusBadRequest},
+		{"zstd ratio exceeded", func(config *ClientConfig) {}, zstdZeros, "zstd", http.StatusRequestEntityTooLarge},
+		{"zstd size exceeded", func(config *ClientConfig) {
+			config.MaxDecompressionRatio = 0
+			config.MaxDecompressedBodySize = 1000
+		}, zstdZeros, "zstd", http.StatusRequestEntityTooLarge},
+		{"zstd within limits", func(config *ClientConfig) {
+			config.MaxDecompressionRatio = 0
+		}, zstdZeros, "zstd", 0},
+		{"corrupt zstd body", func(config *ClientConfig) {}, []byte("not zstd"), "zstd", http.StatusBadRequest},
+		{"unsupported codec", func(config *ClientConfig) {}, zeros, "br", http.StatusUnsupportedMediaType},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.DecompressRequestBodies = true
+			tc.modify(&config)
+			client := newClient(config)
+
+			_, err := client.createBackendRequest(&pb.HttpRequest{
+				Id:        proto.String("15"),
+				Method:    proto.String("POST"),
+				Url:       proto.String("http://invalid/foo"),
+				Body:      tc.body,
+				BodyCodec: proto.String(tc.codec),
+			})
+			status := 0
+			var serr *statusError
+			if errors.As(err, &serr) {
+				status = serr.statusCode
+			} else if err != nil {
+				t.Fatalf("createBackendRequest() = %v, want a statusError", err)
+			}
+			if status != tc.wantStatus {
+				t.Errorf("createBackendRequest() status = %d, want %d", status, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDecompressionBombIsRejected(t *testing.T) {
+	for codec, body := range map[string][]byte{
+		"gzip": gzipBytes(t, make([]byte, 1<<20)),
+		"zstd": zstdBytes(t, make([]byte, 1<<20)),
+	} {
+		relay := newRecordingRelay()
+		defer relay.Close()
+
+		config := DefaultClientConfig()
+		config.RelayScheme = "http"
+		config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+		config.DecompressRequestBodies = true
+		client := newClient(config)
+		client.handleRequest(&http.Client{}, &http.Client{}, &pb.HttpRequest{
+			Id:        proto.String("15"),
+			Method:    proto.String("POST"),
+			Url:       proto.String("http://invalid/foo"),
+			Body:      body,
+			BodyCodec: proto.String(codec),
+		})
+
+		received := relay.responses("15")
+		if len(received) != 1 || received[0].GetStatusCode() != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: relay received %v, want a single 413 response", codec, received)
+		}
+	}
+}
+
+func TestResponseBodyCompression(t *testing.T) {
+	plain := strings.Repeat("hello relay ", 100)
+	compressed := gzipBytes(t, []byte(plain))
+	// The backend compresses whether or not the request accepts gzip.
+	acceptEncoding := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding <- r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(compressed)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		desc                string
+		acceptEncoding      string
+		wantBody            string
+		wantContentEncoding string
+		wantContentLength   string
+	}{
+		{"gzip accepted", "gzip, deflate", string(compressed), "gzip", strconv.Itoa(len(compressed))},
+		{"gzip refused", "gzip;q=0", plain, "", ""},
+		{"no accept-encoding", "", plain, "", ""},
+	}
+	for i, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := newRecordingRelay()
+			defer relay.Close()
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			client := newClient(config)
+			id := strconv.Itoa(i)
+			breq := &pb.HttpRequest{
+				Id:     proto.String(id),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			}
+			if tc.acceptEncoding != "" {
+				breq.Header = []*pb.HttpHeader{{
+					Name:  proto.String("Accept-Encoding"),
+					Value: proto.String(tc.acceptEncoding),
+				}}
+			}
+			client.handleRequest(&http.Client{}, client.newLocalClient(nil), breq)
+
+			if got := <-acceptEncoding; got != tc.acceptEncoding {
+				t.Errorf("Backend received Accept-Encoding %q, want %q", got, tc.acceptEncoding)
+			}
+			received := relay.responses(id)
+			if len(received) == 0 {
+				t.Fatal("No response received")
+			}
+			header := map[string]string{}
+			for _, h := range received[0].Header {
+				header[h.GetName()] = h.GetValue()
+			}
+			var body []byte
+			for _, r := range received {
+				body = append(body, r.Body...)
+			}
+			if string(body) != tc.wantBody {
+				t.Errorf("Relayed %d body bytes, want %d", len(body), len(tc.wantBody))
+			}
+			if got := header["Content-Encoding"]; got != tc.wantContentEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tc.wantContentEncoding)
+			}
+			if got := header["Content-Length"]; got != tc.wantContentLength {
+				t.Errorf("Content-Length = %q, want %q", got, tc.wantContentLength)
+			}
+			if got := header["Etag"]; got != `"v1"` {
+				t.Errorf("ETag = %q, want %q", got, `"v1"`)
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, GZIP", true},
+		{"br;q=1.0, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"identity", false},
+	}
+	for _, tc := range tests {
+		header := http.Header{}
+		if tc.acceptEncoding != "" {
+			header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		if got := acceptsGzip(header); got != tc.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is reported for requests that aren't sent to the backend
+// because the breaker is open.
+var errBreakerOpen = errors.New("too many failed connection attempts")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker stops sending requests to a backend that can't be
+// connected to, so that pulled requests fail fast instead of each waiting
+// for the dial timeout. After threshold consecutive connection failures
+// within window, it opens for cooldown. Then it lets a single probe request
+// through (half-open), which closes it again on success.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu           sync.Mutex
+	state        breakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow returns true if a request may be sent to the backend. In that case,
+// the caller must report the outcome with record.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// The probe is still in flight.
+		return false
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a backend request.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isConnectionError(err) {
+		b.failures = 0
+		if b.state == breakerHalfOpen {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	now := b.now()
+	if b.state == breakerHalfOpen {
+		b.openedAt = now
+		b.setState(breakerOpen)
+		return
+	}
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures += 1
+	if b.state == breakerClosed && b.failures >= b.threshold {
+		b.openedAt = now
+		b.failures = 0
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(s breakerState) {
+	if s != breakerHalfOpen {
+		slog.Info("Backend circuit breaker changed state", slog.String("State", s.String()))
+	}
+	b.state = s
+	backendBreakerState.Set(float64(s))
+}
+
+// isConnectionError returns true if err shows that no connection to the
+// backend could be established, as opposed to a failure of the request.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var authErr x509.UnknownAuthorityError
+	return (errors.As(err, &opErr) && opErr.Op == "dial") ||
+		errors.As(err, &dnsErr) ||
+		errors.As(err, &certErr) ||
+		errors.As(err, &recordErr) ||
+		errors.As(err, &authErr)
+}
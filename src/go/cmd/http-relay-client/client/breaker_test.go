@@ -0,0 +1,184 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeClock is a manually advanced clock for the circuit breaker.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+var errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	b := newCircuitBreaker(3, 10*time.Second, 5*time.Second)
+	b.now = clock.now
+
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("allow() = false after %d failures, want true", i)
+		}
+		b.record(errRefused)
+	}
+	// A failure of the request itself doesn't count as the backend being down.
+	b.record(errors.New("unexpected EOF"))
+	b.record(errRefused)
+	b.record(errRefused)
+	if b.state != breakerClosed {
+		t.Fatalf("state = %v after reset and 2 failures, want closed", b.state)
+	}
+
+	b.record(errRefused)
+	if b.state != breakerOpen {
+		t.Fatalf("state = %v after 3 failures, want open", b.state)
+	}
+	if b.allow() {
+		t.Errorf("allow() = true while open, want false")
+	}
+
+	// After the cooldown, a single probe is let through.
+	clock.advance(5 * time.Second)
+	if !b.allow() {
+		t.Fatalf("allow() = false after cooldown, want true")
+	}
+	if b.allow() {
+		t.Errorf("allow() = true while probe is in flight, want false")
+	}
+	// A failed probe opens the breaker for another cooldown.
+	b.record(errRefused)
+	if b.state != breakerOpen {
+		t.Fatalf("state = %v after failed probe, want open", b.state)
+	}
+	clock.advance(4 * time.Second)
+	if b.allow() {
+		t.Errorf("allow() = true before cooldown, want false")
+	}
+	clock.advance(time.Second)
+	if !b.allow() {
+		t.Fatalf("allow() = false after cooldown, want true")
+	}
+	b.record(nil)
+	if b.state != breakerClosed {
+		t.Fatalf("state = %v after successful probe, want closed", b.state)
+	}
+	if !b.allow() {
+		t.Errorf("allow() = false when closed, want true")
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	b := newCircuitBreaker(3, 10*time.Second, 5*time.Second)
+	b.now = clock.now
+
+	// Failures spread out further than the window don't trip the breaker.
+	for i := 0; i < 6; i++ {
+		b.record(errRefused)
+		clock.advance(6 * time.Second)
+	}
+	if b.state != breakerClosed {
+		t.Errorf("state = %v after sparse failures, want closed", b.state)
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		desc string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"refused", fmt.Errorf("Get: %w", errRefused), true},
+		{"dns", &net.DNSError{Err: "no such host", Name: "backend"}, true},
+		{"unknown authority", x509.UnknownAuthorityError{}, true},
+		{"read", &net.OpError{Op: "read", Err: errors.New("connection reset")}, false},
+		{"other", errors.New("unexpected EOF"), false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := isConnectionError(tc.err); got != tc.want {
+				t.Errorf("isConnectionError(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerAnswersWithUnavailable(t *testing.T) {
+	// Get the address of a closed port, so that connections are refused.
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backendAddress := strings.TrimPrefix(backend.URL, "http://")
+	backend.Close()
+
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = backendAddress
+	config.BackendBreakerThreshold = 2
+	config.BackendBreakerCooldown = time.Hour
+	client := newClient(config)
+	local := client.newLocalClient(nil)
+
+	for _, id := range []string{"1", "2", "3"} {
+		client.handleRequest(&http.Client{}, local, &pb.HttpRequest{
+			Id:     proto.String(id),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid/foo"),
+		})
+	}
+
+	for _, id := range []string{"1", "2"} {
+		received := relay.responses(id)
+		if len(received) == 0 {
+			t.Fatalf("Request %s: no response received", id)
+		}
+		if got := received[0].GetStatusCode(); got != http.StatusBadGateway {
+			t.Errorf("Request %s: status = %d, want %d", id, got, http.StatusBadGateway)
+		}
+	}
+	received := relay.responses("3")
+	if len(received) == 0 {
+		t.Fatalf("Request 3: no response received")
+	}
+	if got := received[0].GetStatusCode(); got != http.StatusServiceUnavailable {
+		t.Errorf("Request 3: status = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	if got := string(received[0].GetBody()); !strings.Contains(got, "Backend unavailable") {
+		t.Errorf("Request 3: body = %q, want it to mention the unavailable backend", got)
+	}
+}
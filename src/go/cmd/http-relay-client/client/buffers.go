@@ -0,0 +1,127 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// maxPooledBufferSize is the capacity above which buffers aren't put back
+// into bufferPool, so that a single large message doesn't stay allocated.
+const maxPooledBufferSize = 1 << 20
+
+// bufferPool holds the buffers that messages to and from the relay server are
+// marshalled into and read into. They're pointers, so putting them back
+// doesn't allocate.
+var bufferPool = sync.Pool{New: func() any { return new([]byte) }}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBufferSize {
+		return
+	}
+	*b = (*b)[:0]
+	bufferPool.Put(b)
+}
+
+// readAppend appends everything read from r to b, like io.ReadAll does to an
+// empty slice.
+func readAppend(b []byte, r io.Reader) ([]byte, error) {
+	for {
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return b, err
+		}
+	}
+}
+
+// requestBody is a message marshalled into a pooled buffer, to be sent as
+// the body of a request to the relay server. Transports may read and close
+// the body after Do returned, and open it again with GetBody to retry, so the
+// buffer is only put back once the caller released it and every body opened
+// from it is closed.
+type requestBody struct {
+	buf *[]byte
+
+	mu   sync.Mutex
+	refs int
+}
+
+func marshalRequestBody(m proto.Message) (*requestBody, error) {
+	buf := getBuffer()
+	b, err := proto.MarshalOptions{}.MarshalAppend(*buf, m)
+	if err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	*buf = b
+	return &requestBody{buf: buf, refs: 1}, nil
+}
+
+// attach makes b the body of req.
+func (b *requestBody) attach(req *http.Request) {
+	req.ContentLength = int64(len(*b.buf))
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+		return
+	}
+	req.Body = b.open()
+	req.GetBody = func() (io.ReadCloser, error) { return b.open(), nil }
+}
+
+func (b *requestBody) open() io.ReadCloser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refs++
+	return &requestBodyReader{Reader: bytes.NewReader(*b.buf), body: b}
+}
+
+// release drops a reference to the buffer, and puts it back once there's
+// none left.
+func (b *requestBody) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refs--
+	if b.refs == 0 {
+		putBuffer(b.buf)
+		b.buf = nil
+	}
+}
+
+type requestBodyReader struct {
+	*bytes.Reader
+	body *requestBody
+	once sync.Once
+}
+
+func (r *requestBodyReader) Close() error {
+	r.once.Do(r.body.release)
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestReadAppend(t *testing.T) {
+	for _, initial := range [][]byte{nil, make([]byte, 0, 3), make([]byte, 0, 100)} {
+		got, err := readAppend(initial, iotest.HalfReader(strings.NewReader("hello world")))
+		if err != nil || string(got) != "hello world" {
+			t.Errorf("readAppend() = %q, %v, want %q", got, err, "hello world")
+		}
+	}
+	if _, err := readAppend(nil, iotest.ErrReader(io.ErrUnexpectedEOF)); err != io.ErrUnexpectedEOF {
+		t.Errorf("readAppend() = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestRequestBodyIsReleasedOnceClosed(t *testing.T) {
+	body, err := marshalRequestBody(&pb.HttpResponse{Id: proto.String("15")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := func() bool {
+		body.mu.Lock()
+		defer body.mu.Unlock()
+		return body.buf == nil
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://invalid", nil)
+	body.attach(req)
+	retry, _ := req.GetBody()
+	body.release()
+	if released() {
+		t.Fatal("Buffer released while the bodies are open")
+	}
+	req.Body.Close()
+	req.Body.Close()
+	if released() {
+		t.Fatal("Buffer released while a body is open")
+	}
+	b, _ := io.ReadAll(retry)
+	resp := &pb.HttpResponse{}
+	if err := proto.Unmarshal(b, resp); err != nil || resp.GetId() != "15" {
+		t.Errorf("Retried body = %v, %v, want the response", resp, err)
+	}
+	retry.Close()
+	if !released() {
+		t.Error("Buffer not released after all bodies were closed")
+	}
+}
+
+func TestPostResponseConcurrently(t *testing.T) {
+	// The relay server answers some posts before reading their body, so
+	// that the transport is still busy with it when postResponse returns.
+	var posts atomic.Int32
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if posts.Add(1)%2 == 0 {
+			w.Write([]byte("ok"))
+			w.(http.Flusher).Flush()
+		}
+		body, _ := io.ReadAll(r.Body)
+		resp := &pb.HttpResponse{}
+		if err := proto.Unmarshal(body, resp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if want := bytes.Repeat([]byte(resp.GetId()), 1000); !bytes.Equal(resp.Body, want) {
+			t.Errorf("Response %s has a body of another response", resp.GetId())
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer relay.Close()
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	client := newClient(config)
+	remote := &http.Client{Transport: &http.Transport{}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				id := fmt.Sprintf("%d-%d", i, j)
+				client.postResponse(remote, &pb.HttpResponse{
+					Id:   proto.String(id),
+					Body: bytes.Repeat([]byte(id), 1000),
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkPostResponse(b *testing.B) {
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer relay.Close()
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	client := newClient(config)
+	remote := &http.Client{}
+	resp := &pb.HttpResponse{
+		Id:   proto.String("15"),
+		Body: []byte(strings.Repeat("x", config.MaxChunkSize)),
+	}
+	b.SetBytes(int64(len(resp.Body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.postResponse(remote, resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetRequest(b *testing.B) {
+	body := strings.Repeat("x", DefaultClientConfig().MaxChunkSize)
+	req, _ := proto.Marshal(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("POST"),
+		Url:    proto.String("http://invalid/foo"),
+		Body:   []byte(body),
+	})
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(req)
+	}))
+	defer relay.Close()
+	client := newClient(DefaultClientConfig())
+	remote := &http.Client{}
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.getRequest(remote, relay.URL); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"container/list"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/googlecloudrobotics/ilog"
+	"google.golang.org/protobuf/proto"
+)
+
+// responseCache keeps responses to GET and HEAD requests that the backend
+// allows shared caches to store, so that repeated requests, eg of dashboards
+// polling the same endpoints, are answered without a round trip to the
+// backend. Once all entries take up more than maxBytes, the least recently
+// used ones are evicted.
+type responseCache struct {
+	maxEntryBytes int
+	maxBytes      int64
+	now           func() time.Time
+
+	mu sync.Mutex
+	// vary holds the request headers that select a variant, by primaryKey.
+	vary map[string][]string
+	// entries holds elements of lru, by variant key.
+	entries map[string]*list.Element
+	// lru holds *cacheEntry, most recently used first.
+	lru  *list.List
+	size int64
+}
+
+func newResponseCache(maxEntryBytes int, maxBytes int64) *responseCache {
+	return &responseCache{
+		maxEntryBytes: maxEntryBytes,
+		maxBytes:      maxBytes,
+		now:           time.Now,
+		vary:          map[string][]string{},
+		entries:       map[string]*list.Element{},
+		lru:           list.New(),
+	}
+}
+
+// cacheEntry is a cached 200 response.
+type cacheEntry struct {
+	key    string
+	header []*pb.HttpHeader
+	body   []byte
+	// date is when the response was generated, according to its Age when
+	// it was stored.
+	date time.Time
+	// lifetime is how long the response is fresh after date. Responses with
+	// a lifetime of 0 are revalidated each time.
+	lifetime     time.Duration
+	etag         string
+	lastModified string
+}
+
+func (e *cacheEntry) size() int64 {
+	n := len(e.key) + len(e.body)
+	for _, h := range e.header {
+		n += len(h.GetName()) + len(h.GetValue())
+	}
+	return int64(n)
+}
+
+// cacheFill is the use of the cache by a single request. It's nil for
+// requests that bypass the cache.
+type cacheFill struct {
+	cache   *responseCache
+	primary string
+	header  http.Header
+	// noHit is set if the user-client asked for a response from the
+	// backend.
+	noHit bool
+	// stale is a cached response that is being revalidated.
+	stale *cacheEntry
+
+	// entry collects the response, if it can be stored. vary is the list of
+	// request headers it varies by.
+	entry *cacheEntry
+	vary  []string
+}
+
+// startCaching returns the cache fill for req, or nil if the response to req
+// can't be cached. Requests matching NoStorePathPrefixes are never cached, and
+// requests with preconditions or ranges always go to the backend.
+func (c *Client) startCaching(req *http.Request, noStore bool) *cacheFill {
+	if c.cache == nil || noStore || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return nil
+	}
+	for _, h := range []string{"Upgrade", "Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"} {
+		if req.Header.Get(h) != "" {
+			return nil
+		}
+	}
+	directives := cacheControl(req.Header)
+	if _, ok := directives["no-store"]; ok {
+		return nil
+	}
+	_, noCache := directives["no-cache"]
+	return &cacheFill{
+		cache:   c.cache,
+		primary: req.Method + " " + req.URL.String(),
+		header:  req.Header,
+		noHit:   noCache || directives["max-age"] == "0",
+	}
+}
+
+// hit returns the cached response for the request, or nil if there's no fresh
+// one. If there's a stale one that can be revalidated, it adds the
+// preconditions to req.
+func (f *cacheFill) hit(id string, req *http.Request) *pb.HttpResponse {
+	if f == nil {
+		return nil
+	}
+	c := f.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[variantKey(f.primary, c.vary[f.primary], f.header)]
+	if !ok {
+		responseCacheLookups.WithLabelValues("miss").Inc()
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	c.lru.MoveToFront(el)
+	age := c.now().Sub(entry.date)
+	if !f.noHit && age < entry.lifetime {
+		responseCacheLookups.WithLabelValues("hit").Inc()
+		return entry.response(id, age)
+	}
+	responseCacheLookups.WithLabelValues("stale").Inc()
+	if entry.etag != "" {
+		req.Header.Set("If-None-Match", entry.etag)
+		f.stale = entry
+	} else if entry.lastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.lastModified)
+		f.stale = entry
+	}
+	return nil
+}
+
+// revalidated returns the stale cached response if the backend confirmed it
+// with 304 Not Modified, or nil otherwise. The response is fresh again for
+// the lifetime given by the 304 response.
+func (f *cacheFill) revalidated(id string, hresp *http.Response) *pb.HttpResponse {
+	if f == nil || f.stale == nil || hresp.StatusCode != http.StatusNotModified {
+		return nil
+	}
+	c := f.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	entry := *f.stale
+	entry.date = now.Add(-responseAge(hresp.Header))
+	if lifetime, ok := freshnessLifetime(hresp.Header, now); ok {
+		entry.lifetime = lifetime
+	}
+	// Concurrent requests may have replaced or evicted the stale entry.
+	if el, ok := c.entries[entry.key]; ok && el.Value == f.stale {
+		el.Value = &entry
+	}
+	responseCacheLookups.WithLabelValues("revalidated").Inc()
+	return entry.response(id, now.Sub(entry.date))
+}
+
+// postCachedResponse posts resp, a response from the cache, to the relay
+// server.
+func (c *Client) postCachedResponse(remote *http.Client, breq *pb.HttpRequest, resp *pb.HttpResponse, state *requestState, rec *recording) {
+	state.respond(int(resp.GetStatusCode()))
+	state.transition(phaseStreaming)
+	state.transition(phaseFinalizing)
+	c.throttleUpload(requestUploadLimiter(breq), resp)
+	err := c.sendResponse(remote, nil, resp, func(err error, _ time.Duration) {
+		c.logSampler.log(slog.LevelError, "Failed to post response to relay", err,
+			slog.String("ID", resp.GetId()))
+	})
+	if err != nil {
+		slog.Error("Failed to post cached response to relay",
+			slog.String("ID", resp.GetId()), ilog.Err(err))
+		c.reportError(err, resp.GetId())
+		state.transition(phaseFailed)
+		return
+	}
+	rec.add(resp)
+	state.sent(len(resp.Body))
+	state.transition(phaseDone)
+}
+
+// response returns the cached response to request id.
+func (e *cacheEntry) response(id string, age time.Duration) *pb.HttpResponse {
+	header := slices.Clone(e.header)
+	header = append(header, &pb.HttpHeader{
+		Name:  proto.String("Age"),
+		Value: proto.String(strconv.Itoa(int(age.Seconds()))),
+	})
+	return &pb.HttpResponse{
+		Id:         proto.String(id),
+		StatusCode: proto.Int32(http.StatusOK),
+		Header:     header,
+		Body:       e.body,
+		Eof:        proto.Bool(true),
+	}
+}
+
+// setResponse decides whether resp, the response header to the request as
+// posted to the relay server, can be stored. Responses to requests with an
+// Authorization header are only stored if the backend explicitly allows it.
+func (f *cacheFill) setResponse(resp *pb.HttpResponse) {
+	if f == nil || resp.GetStatusCode() != http.StatusOK {
+		return
+	}
+	header := pbHeader(resp.Header)
+	directives := cacheControl(header)
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := directives[d]; ok {
+			return
+		}
+	}
+	if f.header.Get("Authorization") != "" {
+		_, public := directives["public"]
+		_, sMaxAge := directives["s-maxage"]
+		_, mustRevalidate := directives["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return
+		}
+	}
+	if header.Get("Set-Cookie") != "" {
+		return
+	}
+	var vary []string
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return
+			}
+			if name != "" && !slices.Contains(vary, name) {
+				vary = append(vary, name)
+			}
+		}
+	}
+	slices.Sort(vary)
+	now := f.cache.now()
+	lifetime, ok := freshnessLifetime(header, now)
+	if _, noCache := directives["no-cache"]; noCache {
+		lifetime = 0
+	}
+	etag, lastModified := header.Get("Etag"), header.Get("Last-Modified")
+	if !ok && etag == "" && lastModified == "" {
+		// The response could neither be served nor revalidated.
+		return
+	}
+	// The Age is set when the entry is served.
+	stored := slices.DeleteFunc(slices.Clone(resp.Header), func(h *pb.HttpHeader) bool {
+		return http.CanonicalHeaderKey(h.GetName()) == "Age"
+	})
+	f.entry = &cacheEntry{
+		key:          variantKey(f.primary, vary, f.header),
+		header:       stored,
+		date:         now.Add(-responseAge(header)),
+		lifetime:     lifetime,
+		etag:         etag,
+		lastModified: lastModified,
+	}
+	f.vary = vary
+}
+
+// add adds the body of a posted response chunk to the entry, and stores the
+// entry with the final chunk. Responses with trailers or larger than
+// maxEntryBytes aren't stored.
+func (f *cacheFill) add(resp *pb.HttpResponse) {
+	if f == nil || f.entry == nil {
+		return
+	}
+	if len(resp.Trailer) > 0 || len(f.entry.body)+len(resp.Body) > f.cache.maxEntryBytes {
+		f.entry = nil
+		return
+	}
+	f.entry.body = append(f.entry.body, resp.Body...)
+	if resp.GetEof() {
+		f.cache.store(f.primary, f.vary, f.entry)
+		f.entry = nil
+	}
+}
+
+// store adds entry to the cache, replacing the previous response to the same
+// request, and evicts the least recently used entries if the cache is full.
+func (c *responseCache) store(primary string, vary []string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vary[primary] = vary
+	if el, ok := c.entries[entry.key]; ok {
+		c.remove(el)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size()
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	responseCacheBytes.Set(float64(c.size))
+}
+
+func (c *responseCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// variantKey returns the key of the response to the request with the given
+// primary key and header, if the response varies by the vary headers.
+func variantKey(primary string, vary []string, header http.Header) string {
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ": " + strings.Join(header.Values(name), ", "))
+	}
+	return b.String()
+}
+
+// cacheControl returns the directives of the Cache-Control header, with
+// their values, if any.
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, v := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// freshnessLifetime returns how long a response with header is fresh, from
+// the s-maxage or max-age directives, or Expires. It returns false if the
+// header doesn't say.
+func freshnessLifetime(header http.Header, now time.Time) (time.Duration, bool) {
+	directives := cacheControl(header)
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[d]; ok {
+			// Invalid values mean the response has expired.
+			return parseSeconds(v), true
+		}
+	}
+	if v := header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// Invalid dates, like "0", mean the response has expired.
+			return 0, true
+		}
+		date := now
+		if d, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = d
+		}
+		return max(expires.Sub(date), 0), true
+	}
+	return 0, false
+}
+
+// responseAge returns the Age of a response, or 0 if it has none.
+func responseAge(header http.Header) time.Duration {
+	return parseSeconds(header.Get("Age"))
+}
+
+// parseSeconds parses a non-negative number of seconds, as used in HTTP
+// headers. It returns 0 for invalid values.
+func parseSeconds(v string) time.Duration {
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(min(secs, math.MaxInt64/int64(time.Second))) * time.Second
+}
@@ -0,0 +1,230 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// cacheTest relays requests through a client with a response cache to a
+// backend, which numbers its responses.
+type cacheTest struct {
+	t        *testing.T
+	client   *Client
+	relay    *recordingRelay
+	clock    *fakeClock
+	backend  atomic.Int32
+	requests int
+}
+
+// newCacheTest starts a backend that sets header on its responses, after
+// calling modify, if it's set.
+func newCacheTest(t *testing.T, maxBytes int64, header http.Header, modify func(w http.ResponseWriter, r *http.Request) bool) *cacheTest {
+	ct := &cacheTest{t: t, clock: &fakeClock{t: time.Unix(1000, 0)}}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := ct.backend.Add(1)
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		if modify != nil && !modify(w, r) {
+			return
+		}
+		fmt.Fprintf(w, "response %d", n)
+	}))
+	t.Cleanup(backend.Close)
+	ct.relay = newRecordingRelay()
+	t.Cleanup(ct.relay.Close)
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = ct.relay.Listener.Addr().String()
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.ResponseCacheMaxBytes = maxBytes
+	ct.client = newClient(config)
+	ct.client.cache.now = ct.clock.now
+	return ct
+}
+
+// do relays a request and returns the single response to it.
+func (ct *cacheTest) do(method, path string, header ...string) *pb.HttpResponse {
+	ct.t.Helper()
+	ct.requests++
+	id := fmt.Sprint(ct.requests)
+	req := &pb.HttpRequest{
+		Id:     proto.String(id),
+		Method: proto.String(method),
+		Url:    proto.String("http://invalid" + path),
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header = append(req.Header, &pb.HttpHeader{Name: proto.String(header[i]), Value: proto.String(header[i+1])})
+	}
+	ct.client.handleRequest(&http.Client{}, &http.Client{}, req)
+	responses := ct.relay.responses(id)
+	if len(responses) != 1 {
+		ct.t.Fatalf("Got %d responses, want 1", len(responses))
+	}
+	return responses[0]
+}
+
+// expect checks that the request was answered with body, and, if cached, with
+// an Age header.
+func (ct *cacheTest) expect(resp *pb.HttpResponse, body string, cached bool, age string) {
+	ct.t.Helper()
+	if got := resp.GetStatusCode(); got != http.StatusOK {
+		ct.t.Errorf("Status = %d, want %d", got, http.StatusOK)
+	}
+	if got := string(resp.Body); got != body {
+		ct.t.Errorf("Body = %q, want %q", got, body)
+	}
+	gotAge := pbHeader(resp.Header).Get("Age")
+	if !cached {
+		age = ""
+	}
+	if gotAge != age {
+		ct.t.Errorf("Age = %q, want %q", gotAge, age)
+	}
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	ct := newCacheTest(t, 1<<20, http.Header{"Cache-Control": {"max-age=10"}}, nil)
+
+	ct.expect(ct.do("GET", "/version"), "response 1", false, "")
+	ct.clock.advance(3 * time.Second)
+	ct.expect(ct.do("GET", "/version"), "response 1", true, "3")
+	// HEAD requests are cached separately.
+	ct.do("HEAD", "/version")
+	ct.clock.advance(8 * time.Second)
+	ct.expect(ct.do("GET", "/version"), "response 3", false, "")
+	ct.expect(ct.do("GET", "/version"), "response 3", true, "0")
+	if got := ct.backend.Load(); got != 3 {
+		t.Errorf("Backend got %d requests, want 3", got)
+	}
+}
+
+func TestResponseCacheKeepsAgeOfBackend(t *testing.T) {
+	ct := newCacheTest(t, 1<<20, http.Header{"Cache-Control": {"max-age=10"}, "Age": {"8"}}, nil)
+
+	ct.do("GET", "/version")
+	ct.clock.advance(time.Second)
+	ct.expect(ct.do("GET", "/version"), "response 1", true, "9")
+	ct.clock.advance(time.Second)
+	ct.do("GET", "/version")
+	if got := ct.backend.Load(); got != 2 {
+		t.Errorf("Backend got %d requests, want 2", got)
+	}
+}
+
+func TestResponseCacheRevalidatesETag(t *testing.T) {
+	ct := newCacheTest(t, 1<<20, http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}},
+		func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.Header().Set("Cache-Control", "max-age=5")
+				w.WriteHeader(http.StatusNotModified)
+				return false
+			}
+			return true
+		})
+
+	ct.expect(ct.do("GET", "/api"), "response 1", false, "")
+	// The backend confirms the cached response, which is then fresh for 5s.
+	ct.expect(ct.do("GET", "/api"), "response 1", true, "0")
+	ct.clock.advance(2 * time.Second)
+	ct.expect(ct.do("GET", "/api"), "response 1", true, "2")
+	if got := ct.backend.Load(); got != 2 {
+		t.Errorf("Backend got %d requests, want 2", got)
+	}
+	// Preconditions of the user-client are passed to the backend as is.
+	if got := ct.do("GET", "/api", "If-None-Match", `"v1"`).GetStatusCode(); got != http.StatusNotModified {
+		t.Errorf("Status = %d, want %d", got, http.StatusNotModified)
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	ct := newCacheTest(t, 1<<20, http.Header{"Cache-Control": {"max-age=10"}, "Vary": {"Accept, accept-language"}}, nil)
+
+	ct.expect(ct.do("GET", "/api", "Accept", "application/json"), "response 1", false, "")
+	ct.expect(ct.do("GET", "/api", "Accept", "text/plain"), "response 2", false, "")
+	ct.expect(ct.do("GET", "/api", "Accept", "text/plain", "Accept-Language", "de"), "response 3", false, "")
+	ct.expect(ct.do("GET", "/api", "Accept", "application/json"), "response 1", true, "0")
+	ct.expect(ct.do("GET", "/api", "Accept", "text/plain"), "response 2", true, "0")
+}
+
+func TestResponseCacheMemoryCap(t *testing.T) {
+	ct := newCacheTest(t, 1<<20, http.Header{"Cache-Control": {"max-age=10"}}, nil)
+
+	ct.do("GET", "/a")
+	// All entries have the same size, and two of them fit.
+	maxBytes := ct.client.cache.size * 5 / 2
+	ct.client.cache.maxBytes = maxBytes
+	ct.do("GET", "/b")
+	ct.expect(ct.do("GET", "/a"), "response 1", true, "0")
+	ct.do("GET", "/c")
+	// /b was the least recently used entry.
+	ct.expect(ct.do("GET", "/a"), "response 1", true, "0")
+	ct.expect(ct.do("GET", "/b"), "response 4", false, "")
+	if got := ct.client.cache.size; got > maxBytes {
+		t.Errorf("Cache size = %d, want at most %d", got, maxBytes)
+	}
+
+	ct.client.cache.maxEntryBytes = 5
+	ct.do("GET", "/d")
+	ct.expect(ct.do("GET", "/d"), "response 6", false, "")
+}
+
+func TestResponseCacheSkipsUncacheable(t *testing.T) {
+	tests := []struct {
+		desc   string
+		header http.Header
+		method string
+		// request is the header of the request.
+		request []string
+		cached  bool
+	}{
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, "GET", nil, false},
+		{"private", http.Header{"Cache-Control": {"private, max-age=10"}}, "GET", nil, false},
+		{"no freshness", http.Header{}, "GET", nil, false},
+		{"vary all", http.Header{"Cache-Control": {"max-age=10"}, "Vary": {"*"}}, "GET", nil, false},
+		{"cookie", http.Header{"Cache-Control": {"max-age=10"}, "Set-Cookie": {"a=b"}}, "GET", nil, false},
+		{"post", http.Header{"Cache-Control": {"max-age=10"}}, "POST", nil, false},
+		{"client no-cache", http.Header{"Cache-Control": {"max-age=10"}}, "GET", []string{"Cache-Control", "no-cache"}, false},
+		{"authorization", http.Header{"Cache-Control": {"max-age=10"}}, "GET", []string{"Authorization", "Bearer x"}, false},
+		{"authorization, public", http.Header{"Cache-Control": {"public, max-age=10"}}, "GET", []string{"Authorization", "Bearer x"}, true},
+		{"expires", http.Header{"Expires": {time.Unix(1010, 0).UTC().Format(http.TimeFormat)}, "Date": {time.Unix(1000, 0).UTC().Format(http.TimeFormat)}}, "GET", nil, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			ct := newCacheTest(t, 1<<20, tc.header, nil)
+			ct.do(tc.method, "/api", tc.request...)
+			ct.do(tc.method, "/api", tc.request...)
+			want := int32(2)
+			if tc.cached {
+				want = 1
+			}
+			if got := ct.backend.Load(); got != want {
+				t.Errorf("Backend got %d requests, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/cenkalti/backoff"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+// minSplitBodySize is the body size below which a response that the relay
+// server rejects as too large isn't split any further, as the body is then
+// unlikely to be the problem.
+const minSplitBodySize = 1 << 10
+
+// postSplitResponse posts br, which the relay server rejected with err for
+// being too large, as two responses with half the body each, splitting them
+// further as needed. This keeps large downloads working if MaxChunkSize is
+// above the relay server's limit.
+//
+// Once the first half is posted, resending br would duplicate it, so the
+// second half is retried according to the ResponseRetryPolicy, and its
+// failure is permanent. Responses with a Sequence or BodyCodec aren't split,
+// as the relay server handles those per response.
+func (c *Client) postSplitResponse(remote *http.Client, br *pb.HttpResponse, err error) error {
+	if len(br.Body) < 2*minSplitBodySize || br.Sequence != nil || br.BodyCodec != nil {
+		return backoff.Permanent(err)
+	}
+	c.chunkSizeWarning.Do(func() {
+		slog.Warn("Relay server rejected a response as too large, splitting it. Consider lowering MaxChunkSize",
+			slog.String("ID", br.GetId()),
+			slog.Int("ByteCount", len(br.Body)),
+			slog.Int("MaxChunkSize", c.config.MaxChunkSize))
+	})
+	first, rest := splitResponse(br)
+	if err := c.postResponse(remote, first); err != nil {
+		return err
+	}
+	if err := c.postResponseWithRetry(remote, rest, nil); err != nil {
+		return backoff.Permanent(err)
+	}
+	return nil
+}
+
+// splitResponse splits br into two responses with half the body each. The
+// first one has everything that belongs to the start of the response, like
+// the status and header, the second one everything that belongs to its end,
+// like EOF and the trailer.
+func splitResponse(br *pb.HttpResponse) (*pb.HttpResponse, *pb.HttpResponse) {
+	half := len(br.Body) / 2
+	first := &pb.HttpResponse{
+		Id:                br.Id,
+		StatusCode:        br.StatusCode,
+		Header:            br.Header,
+		Body:              br.Body[:half],
+		BackendDurationMs: br.BackendDurationMs,
+		UploadAttempts:    br.UploadAttempts,
+		UploadDurationMs:  br.UploadDurationMs,
+		ElapsedMs:         br.ElapsedMs,
+		ChunkIntervalMs:   br.ChunkIntervalMs,
+	}
+	rest := &pb.HttpResponse{
+		Id:          br.Id,
+		Body:        br.Body[half:],
+		Eof:         br.Eof,
+		Trailer:     br.Trailer,
+		TotalBytes:  br.TotalBytes,
+		ChunkIndex:  br.ChunkIndex,
+		StreamError: br.StreamError,
+	}
+	return first, rest
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOversizedChunksAreSplit(t *testing.T) {
+	content := make([]byte, 200<<10)
+	rand.Read(content)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "yes")
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write(content)
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer backend.Close()
+	relay := relaytest.NewServer()
+	defer relay.Close()
+	relay.MaxResponseBytes = 10 << 10
+
+	config := fakeRelayConfig(relay)
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.MaxChunkSize = 64 << 10
+	client := newClient(config)
+	client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/download"),
+	})
+
+	accepted := relay.Responses("15")
+	if relay.Calls(relaytest.ResponsePath) == len(accepted) {
+		t.Fatalf("Relay rejected no responses, the test doesn't exercise splitting")
+	}
+	if len(accepted) == 0 {
+		t.Fatal("Got no responses")
+	}
+	first, last := accepted[0], accepted[len(accepted)-1]
+	if first.GetStatusCode() != http.StatusOK {
+		t.Errorf("Status = %d, want %d", first.GetStatusCode(), http.StatusOK)
+	}
+	if !hasHeader(first.Header, "X-Backend") {
+		t.Errorf("First response lacks the header: %v", first.Header)
+	}
+	var body []byte
+	for i, resp := range accepted {
+		if i > 0 && (resp.StatusCode != nil || len(resp.Header) > 0) {
+			t.Errorf("Response %d repeats the status or header", i)
+		}
+		if resp != last && (resp.GetEof() || len(resp.Trailer) > 0) {
+			t.Errorf("Response %d has EOF or trailer before the end", i)
+		}
+		body = append(body, resp.Body...)
+	}
+	if !bytes.Equal(body, content) {
+		t.Errorf("Got %d body bytes, not the %d in order that the backend sent", len(body), len(content))
+	}
+	if !last.GetEof() || !hasHeader(last.Trailer, "X-Checksum") {
+		t.Errorf("Last response has EOF %v and trailer %v, want EOF and X-Checksum", last.GetEof(), last.Trailer)
+	}
+	if last.GetTotalBytes() != int64(len(content)) {
+		t.Errorf("TotalBytes = %d, want %d", last.GetTotalBytes(), len(content))
+	}
+}
+
+func TestSplittingStopsAtFloor(t *testing.T) {
+	relay := relaytest.NewServer()
+	defer relay.Close()
+	relay.MaxResponseBytes = 100
+	client := newClient(fakeRelayConfig(relay))
+
+	err := client.postResponse(&http.Client{}, &pb.HttpResponse{
+		Id:   proto.String("15"),
+		Body: make([]byte, 4*minSplitBodySize),
+		Eof:  proto.Bool(true),
+	})
+	if err == nil {
+		t.Fatal("postResponse() succeeded, want an error")
+	}
+	// The response and the first halves down to the floor.
+	if got, accepted := relay.Calls(relaytest.ResponsePath), len(relay.Responses("15")); got != 3 || accepted != 0 {
+		t.Errorf("Relay got %d responses and accepted %d, want 3 and 0", got, accepted)
+	}
+}
+
+func hasHeader(header []*pb.HttpHeader, name string) bool {
+	for _, h := range header {
+		if h.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
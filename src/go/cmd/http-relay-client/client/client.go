@@ -24,7 +24,6 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -34,8 +33,10 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -47,15 +48,17 @@ import (
 	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
 	"go.opencensus.io/trace"
 	"golang.org/x/net/http2"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/protobuf/proto"
 )
 
 var (
-	ErrTimeout        = errors.New(http.StatusText(http.StatusRequestTimeout))
-	ErrForbidden      = errors.New(http.StatusText(http.StatusForbidden))
-	debugLogs    bool = false
+	ErrTimeout   = errors.New(http.StatusText(http.StatusRequestTimeout))
+	ErrForbidden = errors.New(http.StatusText(http.StatusForbidden))
+	// ErrBackendUnavailable matches errors of requests to the backend.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+	// ErrRelayRejected matches error responses of the relay server, see
+	// RelayServerError.
+	ErrRelayRejected = errors.New("relay server rejected request")
 )
 
 // This is a package internal variable which we define to be able to overwrite
@@ -64,6 +67,17 @@ var (
 var timeSince = time.Since
 
 type ClientConfig struct {
+	// RelayPollTimeout limits the long-poll for the next request, which the
+	// relay server answers with 408 once no request arrived for a while.
+	// RelayPostTimeout limits each call that posts a response or reads the
+	// request stream, including reading the relay server's answer. Zero
+	// means no limit.
+	RelayPollTimeout time.Duration
+	RelayPostTimeout time.Duration
+	// RemoteRequestTimeout, if set, replaces both RelayPollTimeout and
+	// RelayPostTimeout.
+	//
+	// Deprecated: Use RelayPollTimeout and RelayPostTimeout.
 	RemoteRequestTimeout   time.Duration
 	BackendResponseTimeout time.Duration
 	IdleConnTimeout        time.Duration
@@ -73,42 +87,520 @@ type ClientConfig struct {
 	RootCAFile              string
 	AuthenticationTokenFile string
 
+	// BackendAuth authenticates requests to the backend with a token by
+	// path, eg for services behind one gateway that need tokens for
+	// different audiences. Requests matching none of them use
+	// AuthenticationTokenFile.
+	BackendAuth []BackendAuth
+
+	// BackendTLSInsecureSkipVerify disables the verification of the
+	// backend's certificate, eg for self-signed certificates on developer
+	// robots. It can't be combined with RootCAFile, and doesn't affect the
+	// connection to the relay server.
+	BackendTLSInsecureSkipVerify bool
+
+	// RelayAuthScopes are the OAuth scopes of the access token used to
+	// authenticate to the relay server, by default the read-only
+	// cloud-platform scope. If RelayIDTokenAudience is set, an ID token for
+	// this audience is used instead, eg for a relay server behind
+	// Identity-Aware Proxy. Only one of them can be set. Both are ignored if
+	// DisableAuthForRemote is set.
+	RelayAuthScopes      []string
+	RelayIDTokenAudience string
+	// RelayAuthenticationTokenFile, if set, holds a static bearer token that
+	// authenticates to the relay server instead of the default credentials,
+	// eg for a reverse proxy in front of it. The file is read for each call,
+	// so that a rotated token is picked up. It can't be combined with
+	// DisableAuthForRemote, RelayAuthScopes or RelayIDTokenAudience.
+	RelayAuthenticationTokenFile string
+	// TokenEndpointDirect makes the relay authentication tokens be fetched
+	// without the proxy used for the relay server (eg from HTTPS_PROXY),
+	// for when the metadata server must be reached directly.
+	TokenEndpointDirect bool
+
+	// TLSReloadInterval is how often RootCAFile and the client certificates
+	// of BackendRoutes are reloaded, so that rotated certificates are used
+	// for new backend connections. Disabled if 0.
+	TLSReloadInterval time.Duration
+
+	// BackendAddress and RelayAddress are a host with an optional port.
+	// IPv6 literals need a port, and are put in brackets if they lack them,
+	// see normalizeAddress.
 	BackendScheme  string
 	BackendAddress string
 	BackendPath    string
 	PreserveHost   bool
+	BackendRoutes  []BackendRoute
+
+	// BackendHostOverride, if set, is sent as the Host of all backend
+	// requests, and is the TLS server name for https backends. This is for
+	// backends that route on a virtual host name, eg kubernetes.default.svc.
+	// It can't be combined with PreserveHost.
+	BackendHostOverride string
+	// BackendTLSServerName, if set, is the TLS server name for https
+	// backends, which is sent for SNI and verified against the backend's
+	// certificate, eg for a backend behind an SNI routing proxy. It takes
+	// precedence over BackendHostOverride, and doesn't change the Host.
+	BackendTLSServerName string
+	// BackendDialCommand, if set, is run for each backend connection instead
+	// of connecting to BackendAddress, and the connection is made over its
+	// stdin and stdout, like ProxyCommand of OpenSSH. This reaches backends
+	// only accessible through a helper, eg
+	// ["ssh", "-W", "localhost:8080", "bastion"]. BackendAddress is still
+	// the Host and TLS server name. The command is killed when the
+	// connection is closed, its stderr is logged.
+	BackendDialCommand []string
+
+	// BackendDialTimeout and BackendTLSHandshakeTimeout limit the time to
+	// connect to the backend. BackendResponseHeaderTimeout limits the time
+	// from sending a request to the backend until its response headers
+	// arrive, requests exceeding it get a 504 Gateway Timeout. Zero means no
+	// limit.
+	BackendDialTimeout           time.Duration
+	BackendTLSHandshakeTimeout   time.Duration
+	BackendResponseHeaderTimeout time.Duration
+
+	// MaxStreamDuration limits the time a response is streamed from the
+	// backend, eg to bound watches that never end. Then the backend request
+	// is cancelled and the body read so far is sent with a final chunk
+	// carrying the X-Relay-Stream-Timeout trailer. Upgraded connections, eg
+	// kubectl exec, are limited by MaxUpgradedStreamDuration instead. Zero
+	// means no limit.
+	MaxStreamDuration         time.Duration
+	MaxUpgradedStreamDuration time.Duration
+
+	// BackendHealthPath is the path, after BackendPath, at which Doctor
+	// checks that the backend responds.
+	BackendHealthPath string
+
+	// BuiltinEchoBackend answers requests with an in-process echo backend
+	// instead of connecting to BackendAddress, to check the relay on a robot
+	// without a backend. See newEchoHandler for what it serves.
+	BuiltinEchoBackend bool
+
+	// RequireUpgradeSupport fails Start if the backend client can't relay
+	// upgraded connections (kubectl exec, attach and port-forward), instead
+	// of only logging an error. See checkUpgradeSupport.
+	RequireUpgradeSupport bool
+
+	// Rules allow or deny requests before the backend is contacted. The
+	// first rule matching a request applies, requests matching no rule are
+	// allowed. Denied requests get a 403 Forbidden response with
+	// AccessDeniedMessage.
+	Rules               []AccessRule
+	AccessDeniedMessage string
+
+	// ErrorResponseFormat is the format of the error responses of the relay
+	// client: "text" for a plain text message, or "problem+json" for an RFC
+	// 7807 problem details object.
+	ErrorResponseFormat string
+
+	// After BackendBreakerThreshold consecutive failures to connect to the
+	// backend within BackendBreakerWindow, requests are answered with 503
+	// Service Unavailable for BackendBreakerCooldown, instead of waiting for
+	// the backend. Disabled if BackendBreakerThreshold is 0.
+	BackendBreakerThreshold int
+	BackendBreakerWindow    time.Duration
+	BackendBreakerCooldown  time.Duration
+
+	// DecompressRequestBodies decodes request bodies that the relay server
+	// compressed before passing them to the backend. Otherwise they are
+	// passed on with a Content-Encoding header. The decompressed size is
+	// limited to MaxDecompressedBodySize bytes and MaxDecompressionRatio
+	// times the compressed size (if positive).
+	DecompressRequestBodies bool
+	MaxDecompressedBodySize int64
+	MaxDecompressionRatio   int
+
+	// SetForwardedHeaders passes the user-client's address, scheme and host
+	// to the backend in X-Forwarded-* headers, or in the RFC 7239 Forwarded
+	// header if UseForwardedHeader is set.
+	SetForwardedHeaders bool
+	UseForwardedHeader  bool
+
+	// ForwardClientCertInfo lists the attributes of the user-client's
+	// certificate (see clientCertAttributes) that are passed to the backend
+	// in the ClientCertHeader, if the relay server received one. If empty,
+	// no certificate is passed on. Either way, the ClientCertHeader sent by
+	// the user-client is removed, as it can't be trusted.
+	ForwardClientCertInfo []string
+	ClientCertHeader      string
+
+	// BackendHeaderRemovals are removed from all backend requests, then the
+	// BackendHeaderAdditions are set, replacing any header of the same name.
+	// Their values can use the variables {request_id}, {server_name},
+	// {hostname} and {timestamp_rfc3339}. Host and Content-Length can't be
+	// changed.
+	BackendHeaderAdditions map[string]string
+	BackendHeaderRemovals  []string
+
+	// PreserveHeaderCase sends the request header names to HTTP/1 backends
+	// spelled as in the relayed request, instead of canonicalized. As the
+	// relay server canonicalizes the names it receives, backends that need
+	// an exact spelling, eg SOAPAction, are served by listing it in
+	// BackendHeaderCase, which applies whether or not PreserveHeaderCase is
+	// set. HTTP/2 backends always receive lowercase names.
+	PreserveHeaderCase bool
+	BackendHeaderCase  []string
 
 	RelayScheme  string
 	RelayAddress string
 	RelayPrefix  string
 
+	// RelayAddresses, if set, replaces RelayAddress with a list of relay
+	// servers in the order of preference, eg in different regions. Polls go
+	// to the first one, and fail over to the next one after
+	// RelayFailoverThreshold consecutive connection errors. Every
+	// RelayReprobeInterval, one poll checks whether the first one is back.
+	// The responses to a request always go to the relay server that it was
+	// pulled from.
+	RelayAddresses         []string
+	RelayFailoverThreshold int
+	RelayReprobeInterval   time.Duration
+
+	// RelayResolverAddress, if set, is the DNS server ("10.0.0.53:53") that
+	// resolves the hostnames of the relay servers, eg for split-horizon DNS,
+	// instead of the ones in /etc/resolv.conf. The port defaults to 53.
+	// RelayHostOverride, if set, is the IP address that connections to the
+	// relay servers go to, instead of the one of their hostname. TLS still
+	// uses the hostname for SNI and to verify the certificate.
+	RelayResolverAddress string
+	RelayHostOverride    string
+
 	ServerName string
 
+	// RelayUserAgent is the User-Agent of the calls to the relay server,
+	// "http-relay-client/<version> (<ServerName>)" if empty. RelayClientID,
+	// if set, is sent in the X-Relay-Client-Id header of the calls, as a
+	// stable identifier of the client, eg for per-robot dashboards built from
+	// the relay server's load balancer logs.
+	RelayUserAgent string
+	RelayClientID  string
+
 	NumPendingRequests  int
+	MaxPendingRequests  int
 	MaxIdleConnsPerHost int
 
+	// StartupJitter delays the first poll of each worker, and PollJitter the
+	// poll following a timeout, by a random duration up to the given value.
+	// This spreads out the polls of a fleet of clients restarted together.
+	StartupJitter time.Duration
+	PollJitter    time.Duration
+
+	// Until the first poll succeeds, eg while the network comes up at boot,
+	// failed polls are retried with exponential backoff up to
+	// StartupMaxInterval. Start gives up once StartupDeadline has passed, zero
+	// means it keeps trying.
+	StartupMaxInterval time.Duration
+	StartupDeadline    time.Duration
+
+	// Workers whose poll has been running for 3 times RelayPollTimeout are
+	// logged as stuck. If ResetStuckWorkerConnections is set, the idle
+	// connections to the relay server are closed then, so that new polls
+	// don't reuse a dead one.
+	ResetStuckWorkerConnections bool
+
+	// After ResetConnectionsAfterPollFailures consecutive polls that failed
+	// to reach the relay server, the idle connections to it are closed, eg
+	// because they went stale when the robot switched networks. Zero
+	// disables this.
+	ResetConnectionsAfterPollFailures int
+
+	// RelayHttp2Multiplexing sends the polls and responses of all workers
+	// over a single HTTP/2 connection to the relay server, instead of a pool
+	// of connections that may speak HTTP/1.1, saving TLS sessions on slow
+	// networks. More connections are only opened if the relay server limits
+	// the number of concurrent streams. A dead connection is detected with
+	// pings after ReadIdleTimeout. If the relay server doesn't negotiate
+	// HTTP/2, or is reached over http or through a proxy, the pool is used.
+	RelayHttp2Multiplexing bool
+
+	// After IdleTimeoutsBeforeBackoff consecutive polls without a request,
+	// workers wait before polling again, with the delay doubling up to
+	// MaxIdlePollInterval. Zero MaxIdlePollInterval disables the backoff.
+	IdleTimeoutsBeforeBackoff int
+	MaxIdlePollInterval       time.Duration
+
+	// MaxConcurrentRequests limits the number of requests handled at the
+	// same time, independent of the number of polls. Once the limit is
+	// reached, workers wait for a request to finish before polling again,
+	// or, if RejectWhenSaturated is set, keep polling and answer the
+	// requests they get with 503 Service Unavailable. Zero means no limit.
+	// The limit is fixed: the queue depth reported by the relay server only
+	// scales the number of workers (see scaleWorkers), which wait for a slot
+	// like any other.
+	MaxConcurrentRequests int
+	RejectWhenSaturated   bool
+	// ReservedPrioritySlots are additional slots for high-priority requests
+	// (see isHighPriority), eg kubectl exec, so they don't wait for
+	// background requests at the MaxConcurrentRequests limit. As the
+	// priority is only known once a request is polled, workers poll while
+	// reserved slots are free, and low-priority requests they get that way
+	// wait in the client for a regular slot.
+	ReservedPrioritySlots int
+
+	// WorkerRecycleInterval replaces workers that have been running for
+	// longer than this by fresh goroutines, once the requests they dispatched
+	// are done. This mitigates slow memory growth of long-running clients.
+	// Zero disables recycling.
+	WorkerRecycleInterval time.Duration
+
+	// DrainTimeout bounds how long Start waits for running requests to
+	// finish once Stop was called.
+	DrainTimeout time.Duration
+
 	MaxChunkSize int
 	BlockSize    int
 
-	DisableHttp2 bool
-	ForceHttp2   bool
+	// MaxTrailerCount and MaxTrailerBytes limit the number and total size of
+	// the trailers of a backend response. Trailers over the limits are dropped.
+	MaxTrailerCount int
+	MaxTrailerBytes int
+	// MaxHeaderBytes limits the total size of the headers of a backend
+	// response, and of the trailers known with them. The largest headers are
+	// dropped until the rest fit, and the response is marked with an
+	// X-Relay-Headers-Truncated header. Zero means no limit.
+	MaxHeaderBytes int
+
+	// MaxUploadBytesPerSecond limits the rate at which the response bodies
+	// of all requests together are posted to the relay server, so large
+	// downloads don't starve other traffic on the uplink. 0 means no limit.
+	// The relay server can limit single requests further, see
+	// rateLimitHeader.
+	MaxUploadBytesPerSecond int
+
+	// ResponseRetryPolicy controls how posting a response (chunk) to the
+	// relay server is retried.
+	ResponseRetryPolicy RetryPolicy
+
+	// UseResponseStreams sends the chunks of streamed responses in a single
+	// POST, if the relay server supports it. If the stream fails, the client
+	// falls back to posting each chunk.
+	UseResponseStreams bool
+
+	// BatchDelay is how long responses are held back to be posted together
+	// with responses to other requests, if the relay server supports it. A
+	// batch is posted early once it reaches BatchMaxBytes. 0 disables
+	// batching.
+	BatchDelay    time.Duration
+	BatchMaxBytes int
+
+	// MaxChunksInFlight is the number of chunks of a response that are posted
+	// to the relay server at once, if it supports putting them back in order.
+	// The chunk with the status code and headers is always posted on its own.
+	// Response streams and batches post one chunk at a time regardless.
+	MaxChunksInFlight int
+
+	// SpillDir, if set, is where the chunks of a response are kept once
+	// more than SpillThresholdBytes of them are waiting to be posted, eg
+	// while the relay server is unreachable. This lets the backend finish
+	// large responses with bounded memory. Without SpillDir, the backend
+	// isn't read from while chunks are waiting. Spill files are removed when
+	// the request ends, and at startup if a previous run left them behind.
+	// Requests matching NoStorePathPrefixes are never spilled.
+	SpillDir            string
+	SpillThresholdBytes int64
+
+	// ResumeWindow, if set, lets a GET response that was aborted because its
+	// chunks couldn't be posted continue where it stopped. If the relay
+	// server delivers the same request again within ResumeWindow, the
+	// backend is asked for the rest of the body with a Range request, and
+	// the 206 Partial Content response carries the offset in the
+	// X-Relay-Resumed-From header, for the relay server to stitch the
+	// bodies. This needs a backend that supports ranges (Accept-Ranges:
+	// bytes) and sends an ETag or Last-Modified, which the backend checks
+	// with If-Range to send the whole body if it changed in the meantime.
+	ResumeWindow time.Duration
+
+	// ResponseCodecs are the codecs, "zstd" or "gzip", that response bodies
+	// are compressed with on the way to the relay server, in order of
+	// preference. The first one that the relay server supports is used.
+	// Chunks smaller than ResponseCompressionMinBytes and responses with
+	// compressed content, eg images, are posted as they are.
+	ResponseCodecs              []string
+	ResponseCompressionMinBytes int
+
+	// IntegrityChecks protects bodies end-to-end against corruption between
+	// the relay server and the relay client. With "verify", requests whose
+	// body doesn't match the SHA-256 hash that the relay server sent along
+	// are answered with 400 Bad Request instead of being passed on to the
+	// backend. "verify-and-sign" additionally adds the hashes of each
+	// response body chunk and of the whole body to the responses, for the
+	// relay server to check. Bodies without a hash are passed on, so either
+	// side may be older. The default is "off".
+	IntegrityChecks string
+
+	// PostHeadersEarly posts the headers of event streams and chunked backend
+	// responses as soon as they arrive, instead of with the first body chunk.
+	// Otherwise, user-clients only see the headers after BackendResponseTimeout.
+	PostHeadersEarly bool
+
+	// DisableHttp2, ForceHttp2 and BackendHttp2PriorKnowledge (PK) select
+	// the protocol to the backend:
+	//
+	//	                  http backend   https backend
+	//	default           HTTP/1.1       HTTP/2 if offered with ALPN, else HTTP/1.1
+	//	DisableHttp2      HTTP/1.1       HTTP/1.1
+	//	ForceHttp2        HTTP/2 (h2c)   HTTP/2, fails unless offered with ALPN
+	//	ForceHttp2 + PK   HTTP/2 (h2c)   HTTP/2, even if not offered with ALPN
+	//
+	// BackendHttp2PriorKnowledge is for backends that speak HTTP/2 over TLS
+	// without offering it, eg behind some TLS terminating proxies. Upgraded
+	// connections, eg kubectl exec, need HTTP/1.1, so they don't work with
+	// ForceHttp2.
+	DisableHttp2               bool
+	ForceHttp2                 bool
+	BackendHttp2PriorKnowledge bool
+	// HTTP/2 connections to the backend are health checked with a ping after
+	// BackendHttp2ReadIdleTimeout without frames, and closed if the ping isn't
+	// answered within BackendHttp2PingTimeout. This detects dead connections,
+	// eg after the backend's host was lost, which would otherwise take new
+	// requests until the kernel gives up on them. Zero disables the check.
+	BackendHttp2ReadIdleTimeout time.Duration
+	BackendHttp2PingTimeout     time.Duration
+
+	// StrictResponseOrdering aborts a request if its response chunks would
+	// be posted out of order. Otherwise violations are only logged.
+	StrictResponseOrdering bool
+
+	// StrictResponseHeaderValidation fails requests whose backend response
+	// has header values with CR, LF or NUL bytes, instead of stripping them.
+	StrictResponseHeaderValidation bool
+
+	// RedactedHeaders lists headers whose values are redacted in logs, in
+	// addition to credentials like Authorization and Cookie.
+	RedactedHeaders []string
+
+	// NoStorePathPrefixes lists path prefixes of requests whose bodies must
+	// not outlive the request. Their request and response bodies are zeroed
+	// once they've been relayed, and are never logged, even with debug logs.
+	NoStorePathPrefixes []string
+
+	// RecordDir, if set, is where each relayed exchange is recorded for
+	// offline debugging, see LoadRecording. Only requests whose path starts
+	// with one of RecordPathPrefixes are recorded, or all if there are none,
+	// but never those matching NoStorePathPrefixes. The values of sensitive
+	// headers are redacted, as in logs. Bodies are truncated to
+	// RecordMaxFileBytes, and the oldest recordings are removed once all of
+	// them take up more than RecordMaxTotalBytes.
+	RecordDir           string
+	RecordPathPrefixes  []string
+	RecordMaxFileBytes  int
+	RecordMaxTotalBytes int64
+
+	// AccessLogPath, if set, is a file to which a JSON line is appended for
+	// each relayed request once it has ended, as an audit trail. Requests
+	// matching NoStorePathPrefixes are logged without query values. The
+	// file is reopened by ReopenAccessLog, eg after it was rotated. Entries
+	// are written in the background, and dropped if writing falls behind.
+	AccessLogPath string
+
+	// ResponseCacheMaxBytes, if set, enables caching of the responses to GET
+	// and HEAD requests that the backend allows shared caches to store, see
+	// Cache-Control. While they're fresh, cached responses are relayed with
+	// an Age header, without contacting the backend. Stale ones are
+	// revalidated with their ETag or Last-Modified date. Only 200 responses
+	// of up to ResponseCacheMaxEntryBytes are cached, and the least recently
+	// used ones are evicted once all of them take up more than
+	// ResponseCacheMaxBytes. Requests matching NoStorePathPrefixes are never
+	// cached.
+	ResponseCacheMaxBytes      int64
+	ResponseCacheMaxEntryBytes int
+
+	// DebugLogging logs every step of relaying requests, including dumps of
+	// the (redacted) backend requests and responses. It can be toggled at
+	// runtime with SetDebugLogging.
+	DebugLogging bool
+
+	// DisableTracing skips the OpenCensus spans of relayed requests and the
+	// ochttp wrapper of the backend transport, for deployments that don't
+	// collect traces.
+	DisableTracing bool
+
+	// LogSampling limits how often errors that repeat for every attempt,
+	// like failed polls, backend requests and response posts, are logged.
+	LogSampling LogSampling
+
+	// FaultInjection makes the client fail on purpose, for chaos testing. It
+	// only applies if EnableFaultInjection is set.
+	EnableFaultInjection bool
+	FaultInjection       FaultInjection
+
+	// HealthAddress, if set, is where health checks, metrics and the debug
+	// endpoints are served. An address without host, eg ":8082", binds to
+	// localhost; use eg "0.0.0.0:8082" for all interfaces. If
+	// HealthTokenFile is set, all requests but /healthz must carry the
+	// token in it as bearer token.
+	HealthAddress   string
+	HealthTokenFile string
+	// EnablePprof serves the net/http/pprof profiles under /debug/pprof/ on
+	// HealthAddress. PprofMutexProfileFraction and PprofBlockProfileRate
+	// enable the mutex and block profiles, see
+	// runtime.SetMutexProfileFraction and runtime.SetBlockProfileRate. They
+	// cost CPU, so they're off by default.
+	EnablePprof               bool
+	PprofMutexProfileFraction int
+	PprofBlockProfileRate     int
+
+	// RequestHook, if set, is called with each backend request before it is
+	// sent, and may modify it. If it returns an error, the request is not
+	// sent and the user-client receives an error response instead: 403
+	// Forbidden if the error wraps ErrForbidden, else 500.
+	// ResponseHook, if set, is called with each backend response before the
+	// first chunk is posted to the relay, and may modify the status code and
+	// headers.
+	// Both hooks are called concurrently for parallel requests.
+	RequestHook  func(ctx context.Context, req *http.Request) error
+	ResponseHook func(ctx context.Context, resp *pb.HttpResponse, hresp *http.Response)
+
+	// ErrorHandler, if set, is called with the failures to poll the relay
+	// server, failed backend requests, failures to post responses and
+	// aborted requests, in addition to logging them. id is the ID of the
+	// affected request, or empty for poll failures. Use errors.Is to tell
+	// the errors apart: failed backend requests match ErrBackendUnavailable,
+	// and ErrTimeout if the backend didn't respond in time, error responses
+	// of the relay server match ErrRelayRejected, and a failure to
+	// authenticate to it matches ErrForbidden. Polls that time out without
+	// a request aren't failures.
+	// It's called concurrently for parallel requests.
+	ErrorHandler func(err error, id string)
+
+	// AccessLogWriter, if set, receives the access log instead of
+	// AccessLogPath, which must be empty then.
+	AccessLogWriter io.Writer
 }
 
 type RelayServerError struct {
 	msg string
+	// retryAfter, if set, is the delay the relay server asked for before the
+	// next attempt.
+	retryAfter time.Duration
 }
 
 func NewRelayServerError(msg string) error {
-	return &RelayServerError{msg}
+	return &RelayServerError{msg: msg}
 }
 
 func (e *RelayServerError) Error() string {
 	return e.msg
 }
 
+func (e *RelayServerError) Is(target error) bool {
+	return target == ErrRelayRejected
+}
+
+// reportError passes err to the ErrorHandler, if there is one.
+func (c *Client) reportError(err error, id string) {
+	if c.config.ErrorHandler != nil {
+		c.config.ErrorHandler(err, id)
+	}
+}
+
 func DefaultClientConfig() ClientConfig {
 	return ClientConfig{
-		RemoteRequestTimeout:   60 * time.Second,
+		RelayPollTimeout:       60 * time.Second,
+		RelayPostTimeout:       60 * time.Second,
+		RemoteRequestTimeout:   0,
 		BackendResponseTimeout: 100 * time.Millisecond,
 
 		// ReadIdleTimeout works around an upstream issue by enabling
@@ -122,42 +614,407 @@ func DefaultClientConfig() ClientConfig {
 		DisableAuthForRemote:    false,
 		RootCAFile:              "",
 		AuthenticationTokenFile: "",
+		BackendAuth:             nil,
+
+		BackendTLSInsecureSkipVerify: false,
+
+		RelayAuthScopes:              nil,
+		RelayIDTokenAudience:         "",
+		RelayAuthenticationTokenFile: "",
+		TokenEndpointDirect:          false,
+
+		TLSReloadInterval: time.Minute,
 
 		BackendScheme:  "https",
 		BackendAddress: "localhost:8080",
 		BackendPath:    "",
 		PreserveHost:   true,
+		BackendRoutes:  nil,
+
+		BackendHostOverride:  "",
+		BackendTLSServerName: "",
+		BackendDialCommand:   nil,
+
+		BackendDialTimeout:           30 * time.Second,
+		BackendTLSHandshakeTimeout:   10 * time.Second,
+		BackendResponseHeaderTimeout: 0,
+
+		MaxStreamDuration:         0,
+		MaxUpgradedStreamDuration: 0,
+
+		BackendHealthPath: "/",
+
+		BuiltinEchoBackend: false,
+
+		RequireUpgradeSupport: false,
+
+		Rules:               nil,
+		AccessDeniedMessage: "Forbidden by relay client access rules",
+
+		ErrorResponseFormat: errorFormatText,
+
+		BackendBreakerThreshold: 0,
+		BackendBreakerWindow:    10 * time.Second,
+		BackendBreakerCooldown:  5 * time.Second,
+
+		DecompressRequestBodies: false,
+		MaxDecompressedBodySize: 64 << 20,
+		MaxDecompressionRatio:   100,
+
+		SetForwardedHeaders: false,
+		UseForwardedHeader:  false,
+
+		ForwardClientCertInfo: []string{"Hash", "Subject", "URI", "DNS"},
+		ClientCertHeader:      "X-Forwarded-Client-Cert",
+
+		BackendHeaderAdditions: nil,
+		BackendHeaderRemovals:  nil,
+
+		PreserveHeaderCase: false,
+		BackendHeaderCase:  nil,
 
 		RelayScheme:  "https",
 		RelayAddress: "localhost:8081",
 		RelayPrefix:  "",
 
+		RelayAddresses:         nil,
+		RelayFailoverThreshold: 3,
+		RelayReprobeInterval:   time.Minute,
+
+		RelayResolverAddress: "",
+		RelayHostOverride:    "",
+
 		ServerName: "server_name",
 
+		RelayUserAgent: "",
+		RelayClientID:  "",
+
 		NumPendingRequests:  1,
+		MaxPendingRequests:  10,
 		MaxIdleConnsPerHost: 100,
 
+		StartupJitter: 5 * time.Second,
+		PollJitter:    500 * time.Millisecond,
+
+		StartupMaxInterval: 30 * time.Second,
+		StartupDeadline:    0,
+
+		ResetStuckWorkerConnections: false,
+
+		ResetConnectionsAfterPollFailures: 0,
+
+		RelayHttp2Multiplexing: false,
+
+		IdleTimeoutsBeforeBackoff: 3,
+		MaxIdlePollInterval:       0,
+
+		MaxConcurrentRequests: 0,
+		RejectWhenSaturated:   false,
+		ReservedPrioritySlots: 0,
+
+		WorkerRecycleInterval: 0,
+		DrainTimeout:          25 * time.Second,
+
 		MaxChunkSize: 50 * 1024,
 		BlockSize:    10 * 1024,
 
-		DisableHttp2: false,
-		ForceHttp2:   false,
+		MaxTrailerCount: 100,
+		MaxTrailerBytes: 16 * 1024,
+		MaxHeaderBytes:  1 << 20,
+
+		MaxUploadBytesPerSecond: 0,
+
+		ResponseRetryPolicy: DefaultRetryPolicy(),
+		UseResponseStreams:  true,
+		BatchDelay:          0,
+		BatchMaxBytes:       64 * 1024,
+		MaxChunksInFlight:   1,
+
+		SpillDir:            "",
+		SpillThresholdBytes: 16 << 20,
+		ResumeWindow:        0,
+		PostHeadersEarly:    true,
+
+		ResponseCodecs:              nil,
+		ResponseCompressionMinBytes: 1024,
+
+		IntegrityChecks: integrityOff,
+
+		DisableHttp2:                false,
+		ForceHttp2:                  false,
+		BackendHttp2PriorKnowledge:  false,
+		BackendHttp2ReadIdleTimeout: 30 * time.Second,
+		BackendHttp2PingTimeout:     15 * time.Second,
+
+		StrictResponseOrdering:         true,
+		StrictResponseHeaderValidation: false,
+
+		RedactedHeaders:     nil,
+		NoStorePathPrefixes: nil,
+
+		RecordDir:           "",
+		RecordPathPrefixes:  nil,
+		RecordMaxFileBytes:  1 << 20,
+		RecordMaxTotalBytes: 100 << 20,
+
+		AccessLogPath: "",
+
+		ResponseCacheMaxBytes:      0,
+		ResponseCacheMaxEntryBytes: 64 * 1024,
+
+		DebugLogging: false,
+
+		DisableTracing: false,
+
+		LogSampling: LogSampling{First: 10, Interval: time.Minute},
+
+		EnableFaultInjection: false,
+		FaultInjection:       FaultInjection{},
+
+		HealthAddress:   "",
+		HealthTokenFile: "",
+
+		EnablePprof:               false,
+		PprofMutexProfileFraction: 0,
+		PprofBlockProfileRate:     0,
+
+		RequestHook:  nil,
+		ResponseHook: nil,
+
+		AccessLogWriter: nil,
 	}
 }
 
 type Client struct {
 	config ClientConfig
+
+	// accessRules are the compiled Rules.
+	accessRules []accessRule
+	// routeClients holds one backend client per TLS identity configured in
+	// BackendRoutes, keyed by BackendRoute.tlsIdentity().
+	routeClients map[string]*http.Client
+
+	// queueDepth is the number of queued requests last reported by the relay
+	// server, or -1 if unknown.
+	queueDepth atomic.Int64
+	// workers is the number of running localProxyWorkers, and workerSlots
+	// identifies them.
+	workers     atomic.Int32
+	workerSlots workerSlots
+	// responseStreams is true if the relay server last reported support for
+	// response streams.
+	responseStreams atomic.Bool
+	// debugLogging is the current DebugLogging setting.
+	debugLogging atomic.Bool
+	// responseBatches is true if the relay server last reported support for
+	// batched responses.
+	responseBatches atomic.Bool
+	// sequencedResponses is true if the relay server last reported support
+	// for sequenced responses.
+	sequencedResponses atomic.Bool
+	// bodyCodecs are the codecs of ResponseCodecs that the relay server last
+	// reported support for.
+	bodyCodecs atomic.Pointer[[]string]
+	// uploadLimiter enforces MaxUploadBytesPerSecond, it's nil if there's no
+	// limit.
+	uploadLimiter *tokenBucket
+	// recorder records exchanges, if RecordDir is set.
+	recorder *recorder
+	// batcher posts responses in batches, if BatchDelay is set.
+	batcher *responseBatcher
+	// cache keeps responses, if ResponseCacheMaxBytes is set.
+	cache *responseCache
+
+	// relays tracks the health of the relay servers, if RelayAddresses is
+	// set. requestRelays maps the ids of the requests being relayed to the
+	// relay server they were pulled from.
+	relays        *relayPool
+	requestRelays sync.Map
+	// requestAffinity maps the ids of the requests being relayed to the
+	// *relayAffinity that routes calls for them to the right replica of the
+	// relay server.
+	requestAffinity sync.Map
+
+	// breaker guards the backend, if BackendBreakerThreshold is set.
+	breaker *circuitBreaker
+	// logSampler limits repeated error logs, it's nil if LogSampling is
+	// disabled.
+	logSampler *logSampler
+	// faults are the faults to inject, it's nil unless EnableFaultInjection
+	// is set.
+	faults *faultInjector
+	// recycler replaces old workers, if WorkerRecycleInterval is set.
+	recycler *workerRecycler
+	// limiter enforces MaxConcurrentRequests, it's nil if there's no limit.
+	limiter *requestLimiter
+	// tlsReloaders is the TLS material reloaded by watchTLS.
+	tlsReloaders []tlsReloader
+	// inFlight maps the ids of the requests being relayed to their
+	// *inFlightRequest. A sync.Map, as entries are written once per request
+	// but the map is shared by all workers.
+	inFlight sync.Map
+
+	// stopping is closed by Stop. pollCtx is the context of the polls for
+	// requests, which stopPolls cancels.
+	stopping  chan struct{}
+	stopOnce  sync.Once
+	pollCtx   context.Context
+	stopPolls context.CancelFunc
+	// workerGroup tracks the running localProxyWorkers, and requests the
+	// handleRequest calls they dispatched.
+	workerGroup sync.WaitGroup
+	requests    sync.WaitGroup
+	// awaitingRelay is true until the first poll succeeds, see awaitRelay.
+	awaitingRelay atomic.Bool
+	// accessLog is nil unless AccessLogPath or AccessLogWriter is set.
+	accessLog *accessLogger
+	// remote is the client for the relay server, once Start has set it up,
+	// for ResetRelayConnections. pollFailures counts the consecutive polls
+	// that failed to reach the relay server, see recordPollOutcome.
+	remote       atomic.Pointer[http.Client]
+	pollFailures atomic.Int32
+	// resume remembers where aborted responses stopped, if ResumeWindow is
+	// set.
+	resume *resumePoints
+	// chunkSizeWarning logs once that the relay server rejected a response
+	// as too large, see postSplitResponse.
+	chunkSizeWarning sync.Once
+}
+
+// NewClient returns a client for config. It fails if config isn't valid,
+// listing all problems, see ClientConfig.Validate.
+func NewClient(config ClientConfig) (*Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return newClient(config), nil
 }
 
-func NewClient(config ClientConfig) *Client {
+// NewClientUnchecked returns a client for config without validating it. An
+// invalid config makes Start fail.
+//
+// Deprecated: Use NewClient, which reports an invalid config to the caller.
+func NewClientUnchecked(config ClientConfig) *Client {
+	return newClient(config)
+}
+
+func newClient(config ClientConfig) *Client {
+	normalizeAddresses(&config)
+	if config.RemoteRequestTimeout > 0 {
+		config.RelayPollTimeout = config.RemoteRequestTimeout
+		config.RelayPostTimeout = config.RemoteRequestTimeout
+	}
 	c := &Client{}
 	c.config = config
+	c.queueDepth.Store(-1)
+	c.debugLogging.Store(config.DebugLogging)
+	c.stopping = make(chan struct{})
+	c.pollCtx, c.stopPolls = context.WithCancel(context.Background())
+	if len(config.RelayAddresses) > 0 {
+		c.relays = newRelayPool(config.RelayAddresses, config.RelayFailoverThreshold, config.RelayReprobeInterval)
+	}
+	if config.BackendBreakerThreshold > 0 {
+		c.breaker = newCircuitBreaker(config.BackendBreakerThreshold,
+			config.BackendBreakerWindow, config.BackendBreakerCooldown)
+	}
+	if config.LogSampling.Interval > 0 {
+		c.logSampler = newLogSampler(config.LogSampling)
+	}
+	if config.EnableFaultInjection {
+		slog.Warn("Fault injection is enabled", slog.Any("FaultInjection", config.FaultInjection))
+		c.faults = newFaultInjector(config.FaultInjection)
+	}
+	if config.WorkerRecycleInterval > 0 {
+		c.recycler = newWorkerRecycler(config.WorkerRecycleInterval)
+	}
+	if config.MaxConcurrentRequests > 0 {
+		c.limiter = newRequestLimiter(config.MaxConcurrentRequests, config.ReservedPrioritySlots)
+	}
+	if config.MaxUploadBytesPerSecond > 0 {
+		c.uploadLimiter = newTokenBucket(config.MaxUploadBytesPerSecond)
+	}
+	if config.RecordDir != "" {
+		c.recorder = &recorder{c: c}
+	}
+	if config.BatchDelay > 0 {
+		c.batcher = newResponseBatcher(c, config.BatchDelay, config.BatchMaxBytes)
+	}
+	if config.ResponseCacheMaxBytes > 0 {
+		c.cache = newResponseCache(config.ResponseCacheMaxEntryBytes, config.ResponseCacheMaxBytes)
+	}
+	if config.ResumeWindow > 0 {
+		c.resume = newResumePoints(config.ResumeWindow)
+	}
 	return c
 }
 
-func (c *Client) Start() {
+// Start relays requests until Stop is called. It fails if the config is
+// invalid, or if the relay server can't be reached within StartupDeadline.
+func (c *Client) Start() error {
 	var err error
 
+	slog.Info("Starting relay client", slog.String("Version", clientVersion()))
+	if err := c.config.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if c.accessRules, err = compileAccessRules(c.config.Rules); err != nil {
+		return fmt.Errorf("invalid access rule: %w", err)
+	}
+
+	remote, local, err := c.newHTTPClients()
+	if err != nil {
+		return fmt.Errorf("failed to set up HTTP clients: %w", err)
+	}
+	c.remote.Store(remote)
+	if c.config.BuiltinEchoBackend {
+		slog.Warn("Answering requests with the builtin echo backend instead of the backend",
+			slog.String("BackendAddress", c.config.BackendAddress))
+	}
+	if err := c.checkUpgradeSupport(local); err != nil {
+		if c.config.RequireUpgradeSupport {
+			return fmt.Errorf("backend client can't relay upgraded connections: %w", err)
+		}
+		slog.Error("Backend client can't relay upgraded connections, kubectl exec, attach and port-forward will fail",
+			ilog.Err(err))
+	}
+	if c.config.AccessLogPath != "" || c.config.AccessLogWriter != nil {
+		if c.accessLog, err = newAccessLogger(c.config.AccessLogPath, c.config.AccessLogWriter); err != nil {
+			return fmt.Errorf("failed to open access log: %w", err)
+		}
+		defer c.accessLog.close()
+	}
+	if c.config.SpillDir != "" {
+		removeStaleSpills(c.config.SpillDir)
+	}
+
+	if c.config.TLSReloadInterval > 0 && len(c.tlsReloaders) > 0 {
+		go c.watchTLS()
+	}
+	if c.config.HealthAddress != "" {
+		go c.serveHealth()
+	}
+
+	if err := c.awaitRelay(remote, local); err != nil {
+		return err
+	}
+	for i := 0; i < c.config.NumPendingRequests; i++ {
+		c.startWorker(remote, local, false)
+	}
+	if c.config.RelayPollTimeout > 0 {
+		go c.watchWorkers(remote)
+	}
+	// The workers run until Stop is called.
+	<-c.stopping
+	c.drain(remote)
+	return nil
+}
+
+// newHTTPClients creates the clients used to talk to the relay server
+// (remote) and to the backend (local), as well as the clients of the
+// BackendRoutes. Start and Doctor share them, so that Doctor checks the
+// connections exactly as they're made when relaying.
+func (c *Client) newHTTPClients() (remote, local *http.Client, err error) {
 	remoteTransport := http.DefaultTransport.(*http.Transport).Clone()
 	remoteTransport.MaxIdleConns = c.config.MaxIdleConnsPerHost
 	remoteTransport.MaxIdleConnsPerHost = c.config.MaxIdleConnsPerHost
@@ -166,31 +1023,29 @@ func (c *Client) Start() {
 	if err == nil {
 		http2Trans.ReadIdleTimeout = c.config.ReadIdleTimeout
 	}
-	remote := &http.Client{Transport: remoteTransport}
+	remoteTransport.DialContext = countClosedConns(c.newRelayDialer(remoteTransport.DialContext))
+	var remoteBase http.RoundTripper = remoteTransport
+	if c.config.RelayHttp2Multiplexing {
+		remoteBase = c.newRelayH2Transport(remoteTransport)
+	}
+	remote = &http.Client{Transport: c.newRelayHeaderTransport(&relayConnTransport{base: remoteBase})}
 
-	if !c.config.DisableAuthForRemote {
-		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, remote)
-		scope := "https://www.googleapis.com/auth/cloud-platform.read-only"
-		if remote, err = google.DefaultClient(ctx, scope); err != nil {
-			slog.Error("unable to set up credentials for relay-server authentication", ilog.Err(err))
-			os.Exit(1)
+	if c.config.RelayAuthenticationTokenFile != "" {
+		remote = c.newRelayTokenFileClient(remote)
+	} else if !c.config.DisableAuthForRemote {
+		if remote, err = c.newRelayAuthClient(remote); err != nil {
+			return nil, nil, fmt.Errorf("unable to set up credentials for relay-server authentication: %v", err)
 		}
 	}
-	remote.Timeout = c.config.RemoteRequestTimeout
 
 	var tlsConfig *tls.Config
+	if c.config.BackendTLSInsecureSkipVerify {
+		tlsConfig = c.insecureBackendTLSConfig()
+	}
 	if c.config.RootCAFile != "" {
-		rootCAs := x509.NewCertPool()
-		certs, err := os.ReadFile(c.config.RootCAFile)
-		if err != nil {
-			slog.Error("Failed to read CA file", slog.String("File", c.config.RootCAFile), ilog.Err(err))
-			os.Exit(1)
+		if tlsConfig, err = c.newRootCATLSConfig(); err != nil {
+			return nil, nil, fmt.Errorf("invalid root CA file %s: %v", c.config.RootCAFile, err)
 		}
-		if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
-			slog.Error("No certs found", slog.String("File", c.config.RootCAFile))
-			os.Exit(1)
-		}
-		tlsConfig = &tls.Config{RootCAs: rootCAs}
 
 		if keyLogFile := os.Getenv("SSLKEYLOGFILE"); keyLogFile != "" {
 			keyLog, err := os.OpenFile(keyLogFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
@@ -202,32 +1057,49 @@ func (c *Client) Start() {
 		}
 	}
 
+	tlsConfig = c.withBackendServerName(tlsConfig)
+
+	local = c.newLocalClient(tlsConfig)
+	if c.routeClients, err = c.newRouteClients(tlsConfig); err != nil {
+		return nil, nil, fmt.Errorf("invalid backend route: %v", err)
+	}
+	return remote, local, nil
+}
+
+// newLocalClient creates the client used to talk to the backend, using
+// tlsConfig for https backends.
+func (c *Client) newLocalClient(tlsConfig *tls.Config) *http.Client {
 	var transport http.RoundTripper
 	if c.config.ForceHttp2 {
 		h2transport := &http2.Transport{}
 		h2transport.TLSClientConfig = tlsConfig
-
-		if c.config.DisableHttp2 {
-			slog.Error("Cannot use --force_http2 together with --disable_http2")
-			os.Exit(1)
-		}
+		h2transport.DisableCompression = true
+		h2transport.DialTLSContext = c.dialBackendH2
+		h2transport.IdleConnTimeout = http.DefaultTransport.(*http.Transport).IdleConnTimeout
+		c.configureHttp2Health(h2transport)
 
 		if c.config.BackendScheme == "http" {
 			// Enable HTTP/2 Cleartext (H2C) for gRPC backends.
 			h2transport.AllowHTTP = true
-			h2transport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			h2transport.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
 				// Pretend we are dialing a TLS endpoint.
 				// Note, we ignore the passed tls.Config
-				return net.Dial(network, addr)
+				return c.dialBackend(ctx, network, addr)
 			}
 		}
 
-		transport = h2transport
+		// http2.Transport has no timeout for the response headers.
+		transport = &headerTimeoutTransport{base: h2transport, timeout: c.config.BackendResponseHeaderTimeout}
 	} else {
 		h1transport := http.DefaultTransport.(*http.Transport).Clone()
 		h1transport.MaxIdleConns = c.config.MaxIdleConnsPerHost
 		h1transport.MaxIdleConnsPerHost = c.config.MaxIdleConnsPerHost
 		h1transport.TLSClientConfig = tlsConfig
+		// Compressed bodies are relayed as they are, see decodeResponseBody.
+		h1transport.DisableCompression = true
+		h1transport.DialContext = c.dialBackend
+		h1transport.TLSHandshakeTimeout = c.config.BackendTLSHandshakeTimeout
+		h1transport.ResponseHeaderTimeout = c.config.BackendResponseHeaderTimeout
 
 		if c.config.DisableHttp2 {
 			// Fix for: http2: invalid Upgrade request header: ["SPDY/3.1"]
@@ -236,46 +1108,85 @@ func (c *Client) Start() {
 			//    Server.TLSNextProto (for servers) to a non-nil, empty map.
 			//
 			h1transport.TLSNextProto = map[string]func(authority string, c *tls.Conn) http.RoundTripper{}
+		} else {
+			// This is what http.Transport does for ALPN by default, but it
+			// gives us the http2.Transport to configure the health checks.
+			// The config is cloned, as the "h2" protocol is added to it.
+			h1transport.TLSClientConfig = tlsConfig.Clone()
+			h2transport, err := http2.ConfigureTransports(h1transport)
+			if err != nil {
+				// Only fails if HTTP/2 was already configured.
+				slog.Error("Failed to configure HTTP/2 to the backend", ilog.Err(err))
+			} else {
+				c.configureHttp2Health(h2transport)
+			}
 		}
 
 		transport = h1transport
 	}
+	if c.config.BuiltinEchoBackend {
+		transport = newEchoTransport(c.newEchoHandler())
+	}
+
+	if !c.config.DisableTracing {
+		transport = &ochttp.Transport{Base: transport}
+	}
 
 	// TODO(https://github.com/golang/go/issues/31391): reimplement timeouts if possible
 	// (see also https://github.com/golang/go/issues/30876)
-	local := &http.Client{
+	return &http.Client{
 		CheckRedirect: func(*http.Request, []*http.Request) error {
 			// Don't follow redirects: instead, pass them through the relay untouched.
 			return http.ErrUseLastResponse
 		},
-		Transport: &ochttp.Transport{Base: transport},
-	}
-
-	wg := new(sync.WaitGroup)
-	wg.Add(c.config.NumPendingRequests)
-	for i := 0; i < c.config.NumPendingRequests; i++ {
-		go c.localProxyWorker(remote, local)
+		Transport: transport,
 	}
-	// Waiting for all goroutines to finish (they never do)
-	wg.Wait()
 }
 
-func addServiceName(span *trace.Span) {
-	relayClientAttr := trace.StringAttribute("service.name", "http-relay-client")
-	span.AddAttributes(relayClientAttr)
+// withTimeout limits a call to the relay server. The remote client has no
+// Timeout of its own, as polling and posting need different limits, and the
+// request and response streams mustn't be limited as a whole.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 func (c *Client) getRequest(remote *http.Client, relayURL string) (*pb.HttpRequest, error) {
-	if debugLogs {
+	if c.debugLogs() {
 		slog.Info("Connecting to relay server to get next request", slog.String("ServerName", c.config.ServerName))
 	}
 
-	resp, err := remote.Get(relayURL)
+	if err := c.faults.failPoll(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(c.pollCtx, c.config.RelayPollTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, relayURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := remote.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	c.recordQueueDepth(resp.Header)
+	c.recordResponseStreamSupport(resp.Header)
+	c.recordResponseBatchSupport(resp.Header)
+	c.recordBodyCodecs(resp.Header)
+	c.recordSequencedResponseSupport(resp.Header)
+	// Unmarshal copies the fields it needs, so the buffer can be reused
+	// right away. The request itself can't, as it's handled after the next
+	// poll started.
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if resp.ContentLength > 0 && resp.ContentLength <= maxPooledBufferSize {
+		*buf = slices.Grow(*buf, int(resp.ContentLength)+1)
+	}
+	body, err := readAppend(*buf, resp.Body)
+	*buf = body
 	if err != nil {
 		return nil, err
 	}
@@ -292,20 +1203,49 @@ func (c *Client) getRequest(remote *http.Client, relayURL string) (*pb.HttpReque
 	breq := pb.HttpRequest{}
 	err = proto.Unmarshal(body, &breq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal request: %v. request was: %q", err, string(body))
+		// The raw request can't be redacted selectively, as it didn't parse.
+		return nil, fmt.Errorf("failed to unmarshal request: %v. request was: %s", err, redacted(string(body)))
 	}
+	c.recordAffinity(breq.GetId(), resp)
 
 	return &breq, nil
 }
 
-func marshalHeader(h *http.Header) []*pb.HttpHeader {
+func marshalHeader(h *http.Header, strict bool) ([]*pb.HttpHeader, error) {
 	r := []*pb.HttpHeader{}
 	for k, vs := range *h {
 		for _, v := range vs {
 			r = append(r, &pb.HttpHeader{Name: proto.String(k), Value: proto.String(v)})
 		}
 	}
-	return r
+	if err := sanitizeHeader(r, strict); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// sanitizeHeader guards against response splitting by a backend that echoes
+// untrusted input into a header: CR, LF and NUL bytes are stripped from the
+// header values or, if strict is set, rejected with an error.
+func sanitizeHeader(header []*pb.HttpHeader, strict bool) error {
+	for _, h := range header {
+		if !strings.ContainsAny(h.GetValue(), "\r\n\x00") {
+			continue
+		}
+		if strict {
+			invalidHeaderValues.WithLabelValues("rejected").Inc()
+			return fmt.Errorf("value of header %q contains CR, LF or NUL", h.GetName())
+		}
+		invalidHeaderValues.WithLabelValues("stripped").Inc()
+		slog.Warn("Stripping CR, LF and NUL from header value", slog.String("Header", h.GetName()))
+		h.Value = proto.String(strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == 0 {
+				return -1
+			}
+			return r
+		}, h.GetValue()))
+	}
+	return nil
 }
 
 func extractRequestHeader(breq *pb.HttpRequest, header *http.Header) {
@@ -320,37 +1260,84 @@ func (c *Client) createBackendRequest(breq *pb.HttpRequest) (*http.Request, erro
 	if err != nil {
 		return nil, err
 	}
+	path := targetUrl.Path
 	targetUrl.Scheme = c.config.BackendScheme
 	targetUrl.Host = c.config.BackendAddress
-	targetUrl.Path = c.config.BackendPath + targetUrl.Path
+	prependPath(targetUrl, c.config.BackendPath)
 	slog.Debug("Sending request to backend",
 		slog.String("ID", id),
 		slog.String("Method", *breq.Method),
 		slog.Any("TargetURL", *targetUrl))
-	req, err := http.NewRequest(*breq.Method, targetUrl.String(), bytes.NewReader(breq.Body))
+	if err := c.verifyRequestBody(breq); err != nil {
+		return nil, err
+	}
+	body := breq.Body
+	if breq.BodyCodec != nil && c.config.DecompressRequestBodies {
+		if body, err = c.decodeRequestBody(*breq.BodyCodec, body); err != nil {
+			return nil, err
+		}
+	}
+	// The body length determines the Content-Length header.
+	req, err := http.NewRequest(*breq.Method, targetUrl.String(), bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	if c.config.PreserveHost && breq.Host != nil {
 		req.Host = *breq.Host
 	}
+	if c.config.BackendHostOverride != "" {
+		req.Host = c.config.BackendHostOverride
+	}
 	extractRequestHeader(breq, &req.Header)
-	if c.config.AuthenticationTokenFile != "" {
-		token, err := os.ReadFile(c.config.AuthenticationTokenFile)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to read authentication token from %s: %v", c.config.AuthenticationTokenFile, err)
-		}
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Del(rateLimitHeader)
+	// The relay server has already received the whole body, so there's
+	// nothing left for the backend to approve. Forwarding the expectation
+	// would only make the backend wait for the transport to ask for the body.
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		req.Header.Del("Expect")
+	}
+	setGRPCRequestHeader(req.Header)
+	if breq.BodyCodec != nil && !c.config.DecompressRequestBodies {
+		// Codings are listed in the order they were applied.
+		appendHeader(req.Header, "Content-Encoding", *breq.BodyCodec)
+	}
+	if c.config.SetForwardedHeaders {
+		c.setForwardedHeaders(breq, req.Header)
+	}
+	c.setClientCertHeader(breq, req.Header)
+	c.rewriteBackendHeaders(breq, req.Header)
+	if err := c.setBackendAuth(path, req.Header); err != nil {
+		return nil, err
 	}
 
-	if debugLogs {
-		dump, _ := httputil.DumpRequest(req, false)
+	if c.debugLogs() {
+		dump, _ := httputil.DumpRequest(c.redactRequest(req), false)
 		slog.Info("DumpRequest", slog.String("Request", string(dump)))
 	}
 
 	return req, nil
 }
 
+// prependPath prepends prefix to the path of u. The path is kept in the
+// encoding used by the user client, as the backend may treat e.g. %2F in a
+// Kubernetes resource name differently from /. The query isn't touched, so it
+// reaches the backend unchanged too.
+func prependPath(u *url.URL, prefix string) {
+	if prefix == "" {
+		return
+	}
+	escaped := u.EscapedPath()
+	if strings.HasSuffix(prefix, "/") && strings.HasPrefix(u.Path, "/") {
+		prefix = strings.TrimSuffix(prefix, "/")
+	}
+	u.Path = prefix + u.Path
+	rawPath := (&url.URL{Path: prefix}).EscapedPath() + escaped
+	u.RawPath = ""
+	if rawPath != u.EscapedPath() {
+		u.RawPath = rawPath
+	}
+}
+
 // This function builds and executes a http.Request from the proto request we
 // received from the user-client. This user-client (e.g. Chrome) request is
 // executed in the network in which the relay-client is running. In case of
@@ -359,74 +1346,135 @@ func (c *Client) createBackendRequest(breq *pb.HttpRequest) (*http.Request, erro
 // It returns both a new pb.HttpResponse as well as the related http.Response so
 // that the caller can access e.g. http trailers once the response body has
 // been read.
-func makeBackendRequest(ctx context.Context, local *http.Client, req *http.Request, id string) (*pb.HttpResponse, *http.Response, error) {
-	_, backendSpan := trace.StartSpan(ctx, "Sent."+req.URL.Path)
-	addServiceName(backendSpan)
-	f := &tracecontext.HTTPFormat{}
-	f.SpanContextToRequest(backendSpan.SpanContext(), req)
+func (c *Client) makeBackendRequest(ctx context.Context, local *http.Client, req *http.Request, id string) (*pb.HttpResponse, *http.Response, error) {
+	_, backendSpan := c.startSpan(ctx, "Sent."+req.URL.Path)
+	if backendSpan != nil {
+		f := &tracecontext.HTTPFormat{}
+		f.SpanContextToRequest(backendSpan.SpanContext(), req)
+	}
+	if err := c.faults.delayBackend(req.Context(), id); err != nil {
+		backendSpan.End()
+		return nil, nil, err
+	}
 	resp, err := local.Do(req)
 	if err != nil {
 		backendSpan.End()
 		return nil, nil, err
 	}
 	backendSpan.End()
+	decodeResponseBody(req, resp)
 
-	_, backendResp := trace.StartSpan(ctx, "Creating response (proto marshaling)")
-	addServiceName(backendResp)
+	_, backendResp := c.startSpan(ctx, "Creating response (proto marshaling)")
 	defer backendResp.End()
 
-	if debugLogs {
+	if c.debugLogs() {
 		slog.Info("Backend responded", slog.String("ID", id), slog.Int("Status", resp.StatusCode))
 
-		dump, _ := httputil.DumpResponse(resp, false)
+		dump, _ := httputil.DumpResponse(c.redactResponse(resp), false)
 		slog.Info("DumpResponse", slog.String("Response", string(dump)))
-		// We get 'Grpc-Status' and 'Grpc-Message' headers that we need to persist.
-		// Why is it not part of Trailers?
 		slog.Info("Headers",
 			slog.String("ID", id),
-			slog.String("Header", fmt.Sprintf("%+v", resp.Header)))
+			slog.String("Header", fmt.Sprintf("%+v", c.redactHeader(resp.Header))))
 		// Initially only keys, values are set after body has be read (EOF)
 		slog.Info("Trailers",
 			slog.String("ID", id),
-			slog.String("Trailer", fmt.Sprintf("%+v", resp.Trailer)))
+			slog.String("Trailer", fmt.Sprintf("%+v", c.redactHeader(resp.Trailer))))
 	}
 
+	// Trailers-only gRPC responses have 'Grpc-Status' and 'Grpc-Message'
+	// headers, which we relay as trailers.
+	status := takeTrailersOnlyStatus(resp.Header)
+	header, err := marshalHeader(&resp.Header, c.config.StrictResponseHeaderValidation)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	trailer, err := marshalHeader(&resp.Trailer, c.config.StrictResponseHeaderValidation)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	if status != nil {
+		statusTrailer, err := marshalHeader(&status, c.config.StrictResponseHeaderValidation)
+		if err != nil {
+			resp.Body.Close()
+			return nil, nil, err
+		}
+		trailer = append(trailer, statusTrailer...)
+	}
+	header, dropped := c.limitHeaders(header)
+	if dropped > 0 {
+		slog.Warn("Dropping headers over the limit",
+			slog.String("ID", id), slog.Int("Count", dropped))
+		header = append(header, truncatedHeadersMarker(dropped))
+	}
+	trailer, dropped = c.limitHeaders(trailer)
+	if dropped > 0 {
+		slog.Warn("Dropping trailers over the limit",
+			slog.String("ID", id), slog.Int("Count", dropped))
+		trailer = append(trailer, truncatedTrailersMarker(dropped))
+	}
 	return &pb.HttpResponse{
 		Id:         proto.String(id),
 		StatusCode: proto.Int32(int32(resp.StatusCode)),
-		Header:     marshalHeader(&resp.Header),
-		Trailer:    marshalHeader(&resp.Trailer),
+		Header:     header,
+		Trailer:    trailer,
 	}, resp, nil
 }
 
 func (c *Client) postResponse(remote *http.Client, br *pb.HttpResponse) error {
-	body, err := proto.Marshal(br)
+	if c.faults.dropResponse(br) {
+		return nil
+	}
+	reqBody, err := marshalRequestBody(c.faults.corruptChunk(br))
 	if err != nil {
 		return err
 	}
+	defer reqBody.release()
 
+	relay := c.relayAddress(br.GetId())
 	responseUrl := url.URL{
 		Scheme: c.config.RelayScheme,
-		Host:   c.config.RelayAddress,
+		Host:   relay,
 		Path:   c.config.RelayPrefix + "/server/response",
 	}
 
-	resp, err := remote.Post(responseUrl.String(), "application/vnd.google.protobuf;proto=cloudrobotics.http_relay.v1alpha1.HttpResponse", bytes.NewReader(body))
-
+	ctx, cancel := withTimeout(context.Background(), c.config.RelayPostTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", responseUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	reqBody.attach(req)
+	req.Header.Set("Content-Type", "application/vnd.google.protobuf;proto=cloudrobotics.http_relay.v1alpha1.HttpResponse")
+	req.Header.Set(clientVersionHeader, clientVersion())
+	c.affinity(br.GetId()).apply(req)
+	resp, err := remote.Do(req)
+	c.relays.record(relay, err)
 	if err != nil {
-		return fmt.Errorf("couldn't post response to relay server: %v", err)
+		return fmt.Errorf("couldn't post response to relay server: %w", err)
 	}
 
 	defer resp.Body.Close()
-	body, err = io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("couldn't read relay server's response body: %v", err)
 	}
 	if resp.StatusCode != http.StatusOK {
-		err := NewRelayServerError(fmt.Sprintf("relay server responded %s: %s", http.StatusText(resp.StatusCode), body))
-		if resp.StatusCode == http.StatusBadRequest {
+		err := &RelayServerError{msg: fmt.Sprintf("relay server responded %s: %s", http.StatusText(resp.StatusCode), body)}
+		switch resp.StatusCode {
+		case http.StatusBadRequest:
 			// http-relay-server may have restarted or the client cancelled the request.
 			return backoff.Permanent(err)
+		case http.StatusRequestEntityTooLarge:
+			// Our MaxChunkSize is above the relay server's limit.
+			return c.postSplitResponse(remote, br, err)
+		case http.StatusServiceUnavailable:
+			err.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		case http.StatusBadGateway:
+			// Usually a load balancer that lost its connection to the relay
+			// server, which is likely gone by the next attempt.
+			err.retryAfter = c.config.ResponseRetryPolicy.InitialInterval
 		}
 		return err
 	}
@@ -434,28 +1482,62 @@ func (c *Client) postResponse(remote *http.Client, br *pb.HttpResponse) error {
 	return nil
 }
 
+// Readers may return (0, nil), eg a hijacked connection whose peer is idle.
+// streamBytes backs off exponentially between such reads, up to
+// maxZeroReadBackoff, instead of spinning on them.
+const (
+	minZeroReadBackoff = time.Millisecond
+	maxZeroReadBackoff = 100 * time.Millisecond
+)
+
 // streamBytes converts an io.Reader into a channel to enable select{}-style timeouts.
-func (c *Client) streamBytes(id string, in io.ReadCloser, out chan<- []byte) {
-	eof := false
-	for !eof {
-		// This must be a new buffer each time, as the channel is not making a copy
-		buffer := make([]byte, c.config.BlockSize)
-		if debugLogs {
+// Read errors end the stream like EOF, but are reported to state, which marks
+// the final response as truncated. Once ctx is done, eg because the response
+// can't be posted anymore, it closes in and stops.
+func (c *Client) streamBytes(ctx context.Context, id string, in io.ReadCloser, out chan<- []byte, state *requestState) {
+	var buffer []byte
+	backoff := time.Duration(0)
+	for {
+		// This must be a new buffer after each send, as the channel is not
+		// making a copy.
+		if buffer == nil {
+			buffer = make([]byte, c.config.BlockSize)
+		}
+		if c.debugLogs() {
 			slog.Info("Reading from backend", slog.String("ID", id))
 		}
 		n, err := in.Read(buffer)
-		if err != nil && err != io.EOF {
-			slog.Error("Failed to read from backend", slog.String("ID", id), ilog.Err(err))
-		}
-		eof = err != nil
+		// Following the io.Reader contract, the data is handled before the
+		// error.
 		if n > 0 {
-			if debugLogs {
+			if c.debugLogs() {
 				slog.Info("Forward from backend", slog.String("ID", id), slog.Int("ByteCount", n))
 			}
-			out <- buffer[:n]
+			if !emit(ctx, out, buffer[:n]) {
+				// Nothing posts the response anymore, so the backend
+				// connection is released right away.
+				in.Close()
+				break
+			}
+			buffer = nil
+			backoff = 0
+		}
+		if err != nil {
+			// Errors after the request ended come from the backend request
+			// being cancelled, see abortStream.
+			if err != io.EOF && !state.current().terminal() && !state.endedByTimeout() {
+				slog.Error("Failed to read from backend", slog.String("ID", id), ilog.Err(err))
+				c.reportError(&backendError{err}, id)
+				state.failStream(err)
+			}
+			break
+		}
+		if n == 0 {
+			backoff = min(max(2*backoff, minZeroReadBackoff), maxZeroReadBackoff)
+			time.Sleep(backoff)
 		}
 	}
-	if debugLogs {
+	if c.debugLogs() {
 		slog.Info("Got EOF reading from backend", slog.String("ID", id))
 	}
 	close(out)
@@ -468,9 +1550,32 @@ func (c *Client) streamBytes(id string, in io.ReadCloser, out chan<- []byte) {
 //     Timeout is determined by the maximum latency the user should see.
 //   - No data needs to be transferred. We keep sending empty responses every few seconds
 //     to show the relay server that we're still alive.
-func (c *Client) buildResponses(in <-chan []byte, resp *pb.HttpResponse, out chan<- *pb.HttpResponse) {
+//
+// If headersFirst is set, resp is passed on before any data is read from in.
+// With eventFraming, in is an event stream, which is passed on as soon as an
+// event (or keep-alive comment) is complete, or BlockSize bytes are pending,
+// instead of being accumulated for BackendResponseTimeout. With
+// grpcWebFraming, chunks only end after complete frames, even if a frame is
+// larger than MaxChunkSize, and no keep-alive is sent while a frame is
+// incomplete, as proxies that recombine the chunks can't be trusted to do so
+// mid-frame.
+//
+// Once ctx is done, eg because the response can't be posted anymore, it
+// stops without waiting for out to be read.
+func (c *Client) buildResponses(ctx context.Context, in <-chan []byte, resp *pb.HttpResponse, out chan<- *pb.HttpResponse, headersFirst bool, framing bodyFraming, timer *chunkTimer) {
 	defer close(out)
-	timer := time.NewTimer(c.config.BackendResponseTimeout)
+	if headersFirst {
+		if c.debugLogs() {
+			slog.Info("Posting response headers to relay", slog.String("ID", *resp.Id))
+		}
+		timer.stamp(resp)
+		if !emit(ctx, out, resp) {
+			return
+		}
+		resp = &pb.HttpResponse{Id: resp.Id}
+	}
+	timeout := time.NewTimer(c.config.BackendResponseTimeout)
+	defer timeout.Stop()
 	timeouts := 0
 
 	// TODO(haukeheibel): Why are we not simply reading the entire body? Why the chunking?
@@ -479,32 +1584,115 @@ func (c *Client) buildResponses(in <-chan []byte, resp *pb.HttpResponse, out cha
 		case b, more := <-in:
 			resp.Body = append(resp.Body, b...)
 			if !more {
-				if debugLogs {
+				if c.debugLogs() {
 					slog.Info("Posting final response to relay",
 						slog.String("ID", *resp.Id), slog.Int("ByteCount", len(resp.Body)))
 				}
 				resp.Eof = proto.Bool(true)
-				out <- resp
+				timer.stamp(resp)
+				emit(ctx, out, resp)
 				return
 			} else if len(resp.Body) > c.config.MaxChunkSize {
-				if debugLogs {
+				n := len(resp.Body)
+				if framing == grpcWebFraming {
+					if n = grpcWebBoundary(resp.Body); n == 0 {
+						continue
+					}
+				}
+				if c.debugLogs() {
 					slog.Info("Posting intermediate response to relay",
-						slog.String("ID", *resp.Id), slog.Int("ByteCount", len(resp.Body)))
+						slog.String("ID", *resp.Id), slog.Int("ByteCount", n))
 				}
-				out <- resp
-				resp = &pb.HttpResponse{Id: resp.Id}
+				var pending []byte
+				if n < len(resp.Body) {
+					pending = append(pending, resp.Body[n:]...)
+				}
+				resp.Body = resp.Body[:n]
+				timer.stamp(resp)
+				if !emit(ctx, out, resp) {
+					return
+				}
+				resp = &pb.HttpResponse{Id: resp.Id, Body: pending}
+				timeouts = 0
+			} else if framing == eventFraming {
+				n := eventBoundary(resp.Body)
+				if len(resp.Body) >= c.config.BlockSize {
+					n = len(resp.Body)
+				}
+				if n == 0 {
+					continue
+				}
+				if c.debugLogs() {
+					slog.Info("Posting events to relay",
+						slog.String("ID", *resp.Id), slog.Int("ByteCount", n))
+				}
+				var pending []byte
+				if n < len(resp.Body) {
+					pending = append(pending, resp.Body[n:]...)
+				}
+				resp.Body = resp.Body[:n]
+				timer.stamp(resp)
+				if !emit(ctx, out, resp) {
+					return
+				}
+				resp = &pb.HttpResponse{Id: resp.Id, Body: pending}
 				timeouts = 0
 			}
-		case <-timer.C:
-			timer.Reset(c.config.BackendResponseTimeout)
+		case <-ctx.Done():
+			return
+		case <-timeout.C:
+			timeout.Reset(c.config.BackendResponseTimeout)
 			timeouts += 1
+			if framing == grpcWebFraming {
+				// Complete frames are posted, the rest waits for the end of
+				// its frame. The headers are posted in time either way.
+				n := grpcWebBoundary(resp.Body)
+				if n < len(resp.Body) {
+					if n == 0 && resp.StatusCode == nil {
+						continue
+					}
+					pending := append([]byte(nil), resp.Body[n:]...)
+					resp.Body = resp.Body[:n]
+					if n == 0 {
+						resp.Body = nil
+					}
+					timer.stamp(resp)
+					if !emit(ctx, out, resp) {
+						return
+					}
+					resp = &pb.HttpResponse{Id: resp.Id, Body: pending}
+					timeouts = 0
+					continue
+				}
+			}
+			if framing == eventFraming && len(resp.Body) > 0 && timeouts <= 30 {
+				// An incomplete event waits for the rest of it, but the
+				// headers are posted in time.
+				if resp.StatusCode == nil {
+					continue
+				}
+				pending := resp.Body
+				resp.Body = nil
+				timer.stamp(resp)
+				if !emit(ctx, out, resp) {
+					return
+				}
+				resp = &pb.HttpResponse{Id: resp.Id, Body: pending}
+				timeouts = 0
+				continue
+			}
 			// We send an (empty) response after 30 timeouts as a keep-alive packet.
 			if len(resp.Body) > 0 || resp.StatusCode != nil || timeouts > 30 {
-				if debugLogs {
+				if c.debugLogs() {
 					slog.Info("Posting partial response to relay",
 						slog.String("ID", *resp.Id), slog.Int("ByteCount", len(resp.Body)))
 				}
-				out <- resp
+				if !isKeepAlive(resp) {
+					timer.stamp(resp)
+				}
+				if !emit(ctx, out, resp) {
+					return
+				}
 				resp = &pb.HttpResponse{Id: resp.Id}
 				timeouts = 0
 			}
@@ -512,117 +1700,393 @@ func (c *Client) buildResponses(in <-chan []byte, resp *pb.HttpResponse, out cha
 	}
 }
 
-// postErrorResponse resolves the client's request in case of an internal error.
-// This is not strictly necessary, but avoids kubectl hanging in such cases. As
-// this is best-effort, errors posting the response are logged and ignored.
-func (c *Client) postErrorResponse(remote *http.Client, id string, message string) {
-	resp := &pb.HttpResponse{
-		Id:         proto.String(id),
-		StatusCode: proto.Int32(http.StatusInternalServerError),
-		Header: []*pb.HttpHeader{{
-			Name:  proto.String("Content-Type"),
-			Value: proto.String("text/plain"),
-		}},
-		Body: []byte(message),
-		Eof:  proto.Bool(true),
+// bodyFraming is where buildResponses may end the chunks of a response body.
+type bodyFraming int
+
+const (
+	// The body is cut anywhere.
+	unframed bodyFraming = iota
+	// The body is an event stream, see isEventStream.
+	eventFraming
+	// The body consists of gRPC-Web frames, see isGRPCWebResponse.
+	grpcWebFraming
+)
+
+// responseFraming returns the framing of the body of hresp.
+func responseFraming(hresp *http.Response) bodyFraming {
+	switch {
+	case isEventStream(hresp):
+		return eventFraming
+	case isGRPCWebResponse(hresp):
+		return grpcWebFraming
+	}
+	return unframed
+}
+
+// emit sends v on out, unless ctx is done first. It returns false in that
+// case.
+func emit[T any](ctx context.Context, out chan<- T, v T) bool {
+	select {
+	case out <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// chunkTimer records the timing of the responses of a request in their
+// ElapsedMs and ChunkIntervalMs.
+type chunkTimer struct {
+	start, last time.Time
+}
+
+func newChunkTimer(start time.Time) *chunkTimer {
+	return &chunkTimer{start: start, last: start}
+}
+
+func (t *chunkTimer) stamp(resp *pb.HttpResponse) {
+	resp.ElapsedMs = proto.Int64(timeSince(t.start).Milliseconds())
+	resp.ChunkIntervalMs = proto.Int64(timeSince(t.last).Milliseconds())
+	t.last = time.Now()
+}
+
+// postResponseWithRetry posts resp to the relay server, retrying according
+// to the ResponseRetryPolicy. Before each attempt, it records the attempt
+// number and the time spent posting so far in resp, so the relay server can
+// tell slow uploads from slow backends. Keep-alives are sent without these
+// fields. A Retry-After of the relay server overrides the policy's interval.
+func (c *Client) postResponseWithRetry(remote *http.Client, resp *pb.HttpResponse, notify backoff.Notify) error {
+	keepAlive := isKeepAlive(resp)
+	start := time.Now()
+	attempts := int32(0)
+	b := c.config.ResponseRetryPolicy.hintedBackOff()
+	return backoff.RetryNotify(
+		func() error {
+			attempts += 1
+			if !keepAlive {
+				resp.UploadAttempts = proto.Int32(attempts)
+				resp.UploadDurationMs = proto.Int64(timeSince(start).Milliseconds())
+			}
+			err := c.postResponse(remote, resp)
+			b.observe(err)
+			return err
+		},
+		b,
+		notify,
+	)
+}
+
+// isKeepAlive returns true if resp is an empty chunk that only shows the relay
+// server that the request is still being handled.
+func isKeepAlive(resp *pb.HttpResponse) bool {
+	return resp.StatusCode == nil && len(resp.Body) == 0 && len(resp.Trailer) == 0 && !resp.GetEof()
+}
+
+// postErrorResponse resolves the client's request in case of an error. This
+// is not strictly necessary, but avoids kubectl hanging in such cases. The
+// error class (see relayErrorHeader) is sent along with the status code. As
+// this is best-effort, errors posting the response are retried according to
+// the ResponseRetryPolicy, then logged and ignored.
+func (c *Client) postErrorResponse(remote *http.Client, id string, statusCode int, class string, message string) {
+	resp := c.errorResponse(id, statusCode, class, message)
+	if err := sanitizeHeader(resp.Header, c.config.StrictResponseHeaderValidation); err != nil {
+		slog.Error("Failed to create error response",
+			slog.String("ID", id), ilog.Err(err))
+		return
 	}
-	if err := c.postResponse(remote, resp); err != nil {
-		slog.Error("Failed to post error response to relay",
-			slog.String("ID", *resp.Id), ilog.Err(err))
+	err := c.postResponseWithRetry(remote, resp, func(err error, _ time.Duration) {
+		c.logSampler.log(slog.LevelWarn, "Retrying error response", err,
+			slog.String("ID", *resp.Id))
+	})
+	if err != nil {
+		c.logSampler.log(slog.LevelError, "Failed to post error response to relay", err,
+			slog.String("ID", *resp.Id))
+		c.reportError(err, id)
 	}
 }
 
+// abortStream logs that the response to request id was abandoned after
+// sentBytes body bytes because posting a chunk failed with err. The relay
+// server rejects chunks of requests that it doesn't know, usually because it
+// restarted.
+func (c *Client) abortStream(id string, sentBytes int64, err error) {
+	reason, msg := "post_failed", "Stream aborted: failed to post response"
+	if errors.Is(err, ErrRelayRejected) {
+		reason, msg = "relay_rejected", "Stream aborted: relay restarted"
+	}
+	slog.Error(msg,
+		slog.String("ID", id), slog.Int64("BytesSent", sentBytes), ilog.Err(err))
+	abortedStreams.WithLabelValues(reason).Inc()
+	c.reportError(err, id)
+}
+
+// maxEmptyRequestStreamPolls is the number of consecutive polls of the request
+// stream without data after which streamToBackend checks whether the request
+// has ended.
+const maxEmptyRequestStreamPolls = 10
+
 // streamToBackend streams data from the client (eg kubectl) to the
 // backend. For example, when using `kubectl exec` this handles stdin.
-// It fails permanently and closes the backend connection on any failure, as
-// the relay-server doesn't have sufficiently advanced flow control to recover
-// from dropped/duplicate "packets".
-func (c *Client) streamToBackend(remote *http.Client, id string, backendWriter io.WriteCloser) {
-	// Close the backend connection on stream failure. This should cause the
-	// response stream to end and prevent the client from hanging in the case
-	// of an error in the request stream.
-	defer backendWriter.Close()
-
+// Transient failures to poll the request stream are retried with backoff, but
+// only if no data was read from the failed call. The relay-server doesn't have
+// sufficiently advanced flow control to recover from dropped/duplicate
+// "packets", so any other failure closes the backend connection.
+// The end of the request stream (410 Gone) is not a failure: the user-client
+// is done sending, but the backend may still be sending (eg the echo of a
+// WebSocket close frame), so the connection is left open and handleRequest
+// closes it once the response stream has ended. streamToBackend returns once
+// ctx is done, which handleRequest cancels when it's done with the request.
+func (c *Client) streamToBackend(ctx context.Context, remote *http.Client, id string, backendWriter io.WriteCloser, state *requestState) {
 	streamURL := (&url.URL{
 		Scheme:   c.config.RelayScheme,
-		Host:     c.config.RelayAddress,
+		Host:     c.relayAddress(id),
 		Path:     c.config.RelayPrefix + "/server/requeststream",
 		RawQuery: "id=" + id,
 	}).String()
+	emptyPolls := 0
 	for {
-		// Get data from the "request stream", then copy it to the backend.
-		// We use a Post with empty body to avoid caching.
-		resp, err := remote.Post(streamURL, "text/plain", http.NoBody)
+		done := false
+		n := int64(0)
+		err := backoff.RetryNotify(
+			func() error {
+				if ctx.Err() != nil {
+					return backoff.Permanent(ctx.Err())
+				}
+				var err error
+				n, done, err = c.copyRequestStream(ctx, remote, streamURL, id, backendWriter)
+				return err
+			},
+			backoff.WithContext(c.config.ResponseRetryPolicy.backOff(), ctx),
+			func(err error, _ time.Duration) {
+				slog.Warn("Retrying request stream",
+					slog.String("ID", id), ilog.Err(err))
+			},
+		)
+		if ctx.Err() != nil {
+			if c.debugLogs() {
+				slog.Info("Request has ended, stopping request stream", slog.String("ID", id))
+			}
+			return
+		}
 		if err != nil {
-			// TODO(rodrigoq): detect transient failure and retry w/ backoff?
-			// e.g. "server status Request Timeout: No request received within timeout"
-			slog.Error("Failed to get request stream",
+			slog.Error("Failed to stream request to backend",
 				slog.String("ID", id), ilog.Err(err))
+			c.reportError(err, id)
+			state.transition(phaseFailed)
+			backendWriter.Close()
 			return
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode == http.StatusGone {
-			if debugLogs {
-				slog.Info("End of request stream", slog.String("ID", id))
-			}
+		if done {
 			return
-		} else if resp.StatusCode != http.StatusOK {
-			msg, err := io.ReadAll(resp.Body)
-			if err != nil {
-				msg = []byte(fmt.Sprintf("<failed to read response body: %v>", err))
+		}
+		if n > 0 {
+			emptyPolls = 0
+			continue
+		}
+		// The relay server should end the stream once the request is done,
+		// but don't rely on it to stop polling.
+		if emptyPolls++; emptyPolls >= maxEmptyRequestStreamPolls {
+			emptyPolls = 0
+			if state.current().terminal() {
+				if c.debugLogs() {
+					slog.Info("Request has ended, stopping request stream", slog.String("ID", id))
+				}
+				return
 			}
-			if debugLogs {
-				slog.Info("Relay server request stream responded",
-					slog.String("ID", id),
-					slog.String("Status", http.StatusText(resp.StatusCode)),
-					slog.String("Message", string(msg)))
+		}
+	}
+}
 
-			}
-			return
+// copyRequestStream polls the request stream once and copies the data to
+// the backend. It returns the number of bytes copied, and true once the
+// user-client has finished sending. Each poll is limited to RelayPostTimeout.
+// Errors are wrapped with backoff.Permanent unless a retry is safe: the
+// relay-server has already dequeued whatever it sent, so after a partial
+// read a retry would silently drop data.
+func (c *Client) copyRequestStream(ctx context.Context, remote *http.Client, streamURL, id string, backendWriter io.Writer) (int64, bool, error) {
+	// Get data from the "request stream", then copy it to the backend.
+	// We use a Post with empty body to avoid caching.
+	ctx, cancel := withTimeout(ctx, c.config.RelayPostTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", streamURL, http.NoBody)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	c.affinity(id).apply(req)
+	resp, err := remote.Do(req)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get request stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		if c.debugLogs() {
+			slog.Info("End of request stream", slog.String("ID", id))
 		}
-		if n, err := io.Copy(backendWriter, resp.Body); err != nil {
-			slog.Error("Failed to write to backend:",
-				slog.String("ID", id), ilog.Err(err))
-			return
-		} else {
-			if debugLogs {
-				slog.Info("Wrote to backend",
-					slog.String("ID", id), slog.Int64("ByteCount", n))
-			}
+		return 0, true, nil
+	} else if resp.StatusCode != http.StatusOK {
+		msg, err := io.ReadAll(resp.Body)
+		if err != nil {
+			msg = []byte(fmt.Sprintf("<failed to read response body: %v>", err))
 		}
+		err = fmt.Errorf("relay server request stream responded %q: %s",
+			http.StatusText(resp.StatusCode), msg)
+		if resp.StatusCode < http.StatusInternalServerError {
+			return 0, false, backoff.Permanent(err)
+		}
+		return 0, false, err
+	}
+	body := &countingReader{r: resp.Body}
+	n, err := io.Copy(backendWriter, body)
+	if err != nil {
+		// Without any data read, the error can only come from the relay.
+		if body.n == 0 {
+			return 0, false, fmt.Errorf("failed to read request stream: %v", err)
+		}
+		return n, false, backoff.Permanent(fmt.Errorf("failed to copy request stream to backend: %v", err))
+	}
+	if c.debugLogs() {
+		slog.Info("Wrote to backend",
+			slog.String("ID", id), slog.Int64("ByteCount", n))
 	}
+	return n, false, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
 }
 
 func (c *Client) handleRequest(remote *http.Client, local *http.Client, pbreq *pb.HttpRequest) {
 	ts := time.Now()
 	id := *pbreq.Id
+	state := newRequestState(id)
+	state.debug = &c.debugLogging
+	defer requestFinished(state, ts)
+	defer c.logAccess(pbreq, state, ts)
+	requestsByPriority.WithLabelValues(priorityLabel(pbreq)).Inc()
+	if state.noStore = c.isNoStore(pbreq); state.noStore {
+		defer clear(pbreq.Body)
+	}
+	rec := c.startRecording(pbreq, state.noStore)
+	defer rec.finish()
 	req, err := c.createBackendRequest(pbreq)
 	if err != nil {
-		c.postErrorResponse(remote, id, fmt.Sprintf("Failed to create request for backend: %v", err))
+		state.transition(phaseFailed)
+		statusCode, class := http.StatusInternalServerError, errorInternal
+		var serr *statusError
+		if errors.As(err, &serr) {
+			statusCode, class = serr.statusCode, errorInvalidRequest
+		}
+		state.respond(statusCode)
+		c.postErrorResponse(remote, id, statusCode, class, fmt.Sprintf("Failed to create request for backend: %v", err))
+		return
 	}
+	// The goroutines of the request run in group, and have all returned once
+	// handleRequest does. Cancelling the group stops streamBytes and
+	// buildResponses, which don't wait for their output to be read then, and
+	// releases the backend connection, if the response can't be posted
+	// anymore.
+	group := newRequestGroup(req.Context())
+	defer group.wait()
+	// Cancelling the backend request alone lets the response builders post
+	// what they got so far, see limitStreamDuration.
+	backendCtx, cancelBackend := context.WithCancel(group.ctx)
+	defer cancelBackend()
+	req = req.WithContext(withRequestID(backendCtx, id))
 	// Measure edge processing time.
-	f := &tracecontext.HTTPFormat{}
-	ctx := req.Context()
-	var span *trace.Span
-	if sctx, ok := f.SpanContextFromRequest(req); ok {
-		ctx, span = trace.StartSpanWithRemoteParent(ctx, "Recv."+req.URL.Path, sctx)
-	} else {
-		ctx, span = trace.StartSpan(ctx, "Recv."+req.URL.Path)
-	}
-	addServiceName(span)
+	ctx, span := c.startRequestSpan(req)
 	defer span.End()
+	inFlight, untrack := c.trackRequest(state, pbreq, traceID(span), ts)
+	defer untrack()
+	defer inFlight.logAbnormalEnd()
+
+	if !c.allowed(pbreq) {
+		slog.Info("Access rules denied request",
+			slog.String("ID", id), slog.String("Method", pbreq.GetMethod()), slog.String("Path", req.URL.Path))
+		state.transition(phaseFailed)
+		state.respond(http.StatusForbidden)
+		c.postErrorResponse(remote, id, http.StatusForbidden, errorForbidden, c.config.AccessDeniedMessage)
+		return
+	}
+
+	if c.config.RequestHook != nil {
+		if err := c.config.RequestHook(ctx, req); err != nil {
+			statusCode, class := http.StatusInternalServerError, errorInternal
+			if errors.Is(err, ErrForbidden) {
+				statusCode, class = http.StatusForbidden, errorForbidden
+			}
+			slog.Info("Request hook denied request",
+				slog.String("ID", id), ilog.Err(err))
+			state.transition(phaseFailed)
+			state.respond(statusCode)
+			c.postErrorResponse(remote, id, statusCode, class, err.Error())
+			return
+		}
+	}
+
+	resumeOffset := c.resumeRequest(pbreq, req)
+	fill := c.startCaching(req, state.noStore)
+	if cached := fill.hit(id, req); cached != nil {
+		state.transition(phaseBackendDialing)
+		c.postCachedResponse(remote, pbreq, cached, state, rec)
+		return
+	}
 
-	resp, hresp, err := makeBackendRequest(ctx, local, req, id)
+	if c.breaker != nil && !c.breaker.allow() {
+		c.reportError(&backendError{errBreakerOpen}, id)
+		state.transition(phaseFailed)
+		state.respond(http.StatusServiceUnavailable)
+		c.postErrorResponse(remote, id, http.StatusServiceUnavailable, errorBackendUnavailable,
+			"Backend unavailable: too many failed connection attempts")
+		return
+	}
+	state.transition(phaseBackendDialing)
+	resp, hresp, err := c.makeBackendRequest(ctx, c.backendClient(local, pbreq), c.withHeaderCase(pbreq, req), id)
+	if c.breaker != nil {
+		c.breaker.record(err)
+	}
 	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			state.transition(phaseCancelled)
+		} else {
+			state.transition(phaseFailed)
+		}
 		// Even if we couldn't handle the backend request, send an
 		// answer to the relay that signals the error.
 		errorMessage := fmt.Sprintf("Backend request failed with error: %v", err)
-		slog.Error("BackendRequest",
+		c.logSampler.log(slog.LevelError, "BackendRequest", err,
 			slog.String("ID", id), slog.String("Message", errorMessage))
-		c.postErrorResponse(remote, id, errorMessage)
+		c.reportError(&backendError{err}, id)
+		statusCode, class := classifyBackendError(err)
+		state.respond(statusCode)
+		c.postErrorResponse(remote, id, statusCode, class, errorMessage)
 		return
 	}
-
+	if cached := fill.revalidated(id, hresp); cached != nil {
+		hresp.Body.Close()
+		c.postCachedResponse(remote, pbreq, cached, state, rec)
+		return
+	}
+	if c.config.ResponseHook != nil {
+		c.config.ResponseHook(ctx, resp, hresp)
+	}
+	resumeOffset = c.resumedResponse(id, resumeOffset, resp, hresp)
+	fill.setResponse(resp)
+	state.respond(int(*resp.StatusCode))
+	state.transition(phaseStreaming)
+
+	// For 101 Switching Protocols, this closes the bidirectional connection
+	// once the backend has finished sending. `streamToBackend` only closes it
+	// earlier on failures.
+	defer hresp.Body.Close()
 	if *resp.StatusCode == http.StatusSwitchingProtocols {
 		// A 101 Switching Protocols response means that the request will be
 		// used for bidirectional streaming, so start a goroutine to stream
@@ -631,109 +2095,268 @@ func (c *Client) handleRequest(remote *http.Client, local *http.Client, pbreq *p
 		if !ok {
 			slog.Warn("Error: 101 Switching Protocols response with non-writable body.")
 			slog.Warn("       This occurs when using Go <1.12 or when http.Client.Timeout > 0.")
-			c.postErrorResponse(remote, id, "Backend returned 101 Switching Protocols, which is not supported.")
+			state.transition(phaseFailed)
+			state.respond(http.StatusInternalServerError)
+			c.postErrorResponse(remote, id, http.StatusInternalServerError, errorInternal,
+				"Backend returned 101 Switching Protocols, which is not supported.")
 			return
 		}
 		// Stream stdin from remote to backend
-		go c.streamToBackend(remote, id, bodyWriter)
-	} else {
-		// `streamToBackend` will close `hresp.Body` but it is only called on websocket connections.
-		// We need to close it here for http connections.
-		defer hresp.Body.Close()
+		group.Go(func() { c.streamToBackend(group.ctx, remote, id, bodyWriter, state) })
 	}
 
-	ctx, respChSpan := trace.StartSpan(ctx, "Building (chunked) response channel")
-	addServiceName(respChSpan)
-
-	bodyChannel := make(chan []byte)
-	responseChannel := make(chan *pb.HttpResponse)
-	// Stream stdout from backend to bodyChannel
-	go c.streamBytes(*resp.Id, hresp.Body, bodyChannel)
-	// collect data from bodyChannel and send to remote (relay-server)
-	go c.buildResponses(bodyChannel, resp, responseChannel)
+	timer := newChunkTimer(ts)
+	var responseChannel <-chan *pb.HttpResponse
+	var bodyChannel chan []byte
+	var stream *responseStream
+	if hasNoBody(req, hresp) {
+		responseChannel = c.readEmptyResponse(resp, hresp, timer)
+	} else if c.isSmallResponse(hresp) {
+		responseChannel = c.readSmallResponse(resp, hresp, state, timer)
+	} else {
+		var respChSpan *trace.Span
+		ctx, respChSpan = c.startSpan(ctx, "Building (chunked) response channel")
+
+		state.streaming = hresp.ContentLength < 0 || *resp.StatusCode == http.StatusSwitchingProtocols
+		bodyChannel = make(chan []byte)
+		chunkChannel := make(chan *pb.HttpResponse)
+		// Stream stdout from backend to bodyChannel
+		group.Go(func() { c.streamBytes(group.ctx, *resp.Id, hresp.Body, bodyChannel, state) })
+		// collect data from bodyChannel and send to remote (relay-server)
+		if *resp.StatusCode == http.StatusSwitchingProtocols {
+			group.Go(func() { c.buildUpgradedResponses(group.ctx, bodyChannel, resp, chunkChannel, timer) })
+		} else {
+			headersEarly, framing := c.postsHeadersEarly(hresp), responseFraming(hresp)
+			group.Go(func() { c.buildResponses(group.ctx, bodyChannel, resp, chunkChannel, headersEarly, framing, timer) })
+		}
+		responseChannel = chunkChannel
+		if stop := c.limitStreamDuration(id, hresp, state, cancelBackend); stop != nil {
+			defer stop()
+		}
+		// Upgraded connections are interactive, so there's nothing to gain
+		// from spilling them.
+		if c.config.SpillDir != "" && !state.noStore && *resp.StatusCode != http.StatusSwitchingProtocols {
+			responseChannel = c.spillResponses(group, id, chunkChannel, state)
+		}
 
-	respChSpan.End()
+		// A single chunk isn't worth a stream, but streamed responses
+		// often consist of many small chunks.
+		if c.config.UseResponseStreams && c.responseStreams.Load() {
+			if stream, err = c.openResponseStream(remote, id); err != nil {
+				slog.Warn("Failed to open response stream, posting responses instead",
+					slog.String("ID", id), ilog.Err(err))
+			} else {
+				defer stream.close()
+			}
+		}
 
-	exponentialBackoff := backoff.ExponentialBackOff{
-		InitialInterval:     time.Second,
-		RandomizationFactor: 0,
-		Multiplier:          2,
-		MaxInterval:         10 * time.Second,
-		MaxElapsedTime:      0,
-		Clock:               backoff.SystemClock,
+		respChSpan.End()
 	}
 
+	uploadLimiter := requestUploadLimiter(pbreq)
+	codec := c.responseCodec(hresp)
+	signer := c.newResponseSigner()
+	var order responseOrder
+	totalBytes, sentBytes := int64(0), int64(0)
+	// Once the loop ends, the backend request is cancelled and what's left of
+	// the response is discarded. This is a no-op if the whole response was
+	// posted.
+	defer func() {
+		group.cancel()
+		if hresp.StatusCode == http.StatusSwitchingProtocols {
+			// Cancelling doesn't affect upgraded connections.
+			hresp.Body.Close()
+		}
+		for range responseChannel {
+		}
+		// The response builders stop without reading the rest of
+		// bodyChannel, but streamBytes may still be reading hresp.Body,
+		// which mustn't be closed concurrently.
+		if bodyChannel != nil {
+			for range bodyChannel {
+			}
+		}
+	}()
+	pipeline := c.newResponsePipeline(stream, group)
+	aborted := false
+	// complete handles the end of posting a chunk, and returns false if the
+	// request has to be aborted.
+	complete := func(resp *pb.HttpResponse, body []byte, err error) bool {
+		resp.Body, resp.BodyCodec = body, nil
+		if aborted {
+			return false
+		}
+		// Any error suggests the request should be aborted.
+		// A missing chunk will cause clients to receive corrupted data, in most cases it is better
+		// to close the connection to avoid that.
+		if err != nil {
+			c.abortStream(id, sentBytes, err)
+			c.recordResumePoint(pbreq, req, hresp, resumeOffset, sentBytes)
+			state.transition(phaseFailed)
+			aborted = true
+			return false
+		}
+		sentBytes += int64(len(resp.Body))
+		state.sent(len(resp.Body))
+		inFlight.posted(resp)
+		rec.add(resp)
+		fill.add(resp)
+		if state.noStore {
+			clear(resp.Body)
+		}
+		order.acknowledged(resp)
+		if resp.GetEof() {
+			state.transition(phaseDone)
+		}
+		return true
+	}
+	// Chunks that are still being posted once the loop ends, eg after an
+	// error, are waited for.
+	defer func() {
+		for pipeline.busy() {
+			complete(pipeline.next())
+		}
+	}()
 	// This call here blocks until all data from the bodyChannel has been read.
+loop:
 	for resp := range responseChannel {
-		_, respCh := trace.StartSpan(ctx, "Sending response from channel")
-		addServiceName(respCh)
+		_, respCh := c.startSpan(ctx, "Sending response from channel")
 		defer respCh.End()
 
-		// Q(hauke): do we really need exponential backoff in the relay?
-		exponentialBackoff.Reset()
-		err := backoff.RetryNotify(
-			func() error {
-				if len(hresp.Trailer) > 0 {
-					slog.Info("Trailers",
-						slog.String("ID", *resp.Id),
-						slog.String("Trailer", fmt.Sprintf("%+v", hresp.Trailer)))
-					resp.Trailer = append(resp.Trailer, marshalHeader(&hresp.Trailer)...)
-				}
-				if resp.Eof != nil && *resp.Eof {
-					duration := timeSince(ts)
-					resp.BackendDurationMs = proto.Int64(duration.Milliseconds())
-					// see makeBackendRequest()
-					urlPath := strings.TrimPrefix(*pbreq.Url, "http://invalid")
-					slog.Debug("Backend request",
-						slog.String("ID", *resp.Id),
-						slog.Float64("Duration", duration.Seconds()),
-						slog.String("Path", urlPath))
-				} else {
-					// Q(hauke): When are we ending up in this branch?
-					// What are the semantics and why are we not setting a request duration?
-					// Even in a streaming case I would expect a duration which represents the
-					// processing time of the last item.
-				}
-				return c.postResponse(remote, resp)
-			},
-			backoff.WithMaxRetries(&exponentialBackoff, 10),
-			func(err error, _ time.Duration) {
-				slog.Error("Failed to post response to relay",
+		if err := order.check(resp); err != nil {
+			if c.config.StrictResponseOrdering {
+				slog.Error("Aborting request",
 					slog.String("ID", *resp.Id), ilog.Err(err))
-			},
-		)
-		// Any error suggests the request should be aborted.
-		// A missing chunk will cause clients to receive corrupted data, in most cases it is better
-		// to close the connection to avoid that.
-		if err != nil {
-			slog.Error("Closing backend connection",
+				c.reportError(err, id)
+				state.transition(phaseFailed)
+				break loop
+			}
+			slog.Warn("Posting response anyway",
 				slog.String("ID", *resp.Id), ilog.Err(err))
-			break
+		}
+
+		// Trailers are only complete once the body has been read, which the
+		// final chunk guarantees. Reading them earlier races with streamBytes.
+		if resp.GetEof() && len(hresp.Trailer) > 0 {
+			slog.Info("Trailers",
+				slog.String("ID", *resp.Id),
+				slog.String("Trailer", fmt.Sprintf("%+v", c.redactHeader(hresp.Trailer))))
+			trailer, err := marshalHeader(&hresp.Trailer, c.config.StrictResponseHeaderValidation)
+			if err != nil {
+				slog.Error("Aborting request",
+					slog.String("ID", *resp.Id), ilog.Err(err))
+				c.reportError(err, id)
+				state.transition(phaseFailed)
+				break loop
+			}
+			trailer, dropped := c.limitTrailers(trailer)
+			if dropped > 0 {
+				slog.Warn("Dropping trailers over the limit",
+					slog.String("ID", *resp.Id), slog.Int("Count", dropped))
+				trailer = append(trailer, truncatedTrailersMarker(dropped))
+			}
+			resp.Trailer = append(resp.Trailer, trailer...)
+		}
+		// The relay server must not end a truncated body like a complete one.
+		if err := state.streamError(); resp.GetEof() && err != nil {
+			resp.StreamError = proto.String(err.Error())
+			resp.Trailer = append(resp.Trailer, streamErrorMarker(err))
+		}
+		if resp.GetEof() && state.streamTimedOut() {
+			resp.Trailer = append(resp.Trailer, streamTimeoutMarker(c.maxStreamDuration(hresp)))
+		}
+		totalBytes += int64(len(resp.Body))
+		if resp.Eof != nil && *resp.Eof {
+			state.transition(phaseFinalizing)
+			duration := timeSince(ts)
+			resp.BackendDurationMs = proto.Int64(duration.Milliseconds())
+			resp.TotalBytes = proto.Int64(totalBytes)
+			resp.ChunkIndex = proto.Int32(int32(pipeline.started))
+			// see makeBackendRequest()
+			urlPath := strings.TrimPrefix(*pbreq.Url, "http://invalid")
+			slog.Debug("Backend request",
+				slog.String("ID", *resp.Id),
+				slog.String("Method", pbreq.GetMethod()),
+				slog.String("Path", urlPath),
+				slog.Int("Status", int(hresp.StatusCode)),
+				slog.Int64("Bytes", totalBytes),
+				slog.Int("Chunks", pipeline.started+1),
+				slog.Float64("Duration", duration.Seconds()),
+				slog.Int("Priority", int(pbreq.GetPriority())))
+		}
+		// The hashes cover the body as the backend sent it, and are updated
+		// chunk by chunk, so the whole body is never hashed at once.
+		signer.sign(resp)
+		body := c.encodeBody(codec, resp)
+		// Throttling here, rather than when reading from the backend, lets
+		// buildResponses collect larger chunks in the meantime.
+		c.throttleUpload(uploadLimiter, resp)
+		// Q(hauke): do we really need exponential backoff in the relay?
+		inFlight.startPosting()
+		// The closure runs after the loop moved on to the next chunk.
+		resp := resp
+		pipeline.post(resp, body, func() error {
+			return c.sendResponse(remote, stream, resp, func(err error, _ time.Duration) {
+				c.logSampler.log(slog.LevelError, "Failed to post response to relay", err,
+					slog.String("ID", *resp.Id))
+			})
+		})
+		// The chunk with the status code and headers is acknowledged before
+		// any other chunk is posted, see responseOrder.
+		for pipeline.full() || pipeline.busy() && order.acked == 0 {
+			if !complete(pipeline.next()) {
+				break loop
+			}
 		}
 	}
 }
 
-func (c *Client) localProxy(remote, local *http.Client) error {
-	// Read pending request from the relay-server.
-	relayURL := c.buildRelayURL()
+// localProxy polls the relay server for a request and dispatches it to the
+// backend. w tracks the dispatched request until it's done.
+func (c *Client) localProxy(remote, local *http.Client, w *proxyWorker) error {
+	admitted, reserved := false, false
+	if !c.config.RejectWhenSaturated {
+		// Don't poll for requests that we couldn't handle.
+		var ok bool
+		if reserved, ok = c.limiter.acquire(c.stopping); !ok {
+			return nil
+		}
+		admitted = true
+		defer func() {
+			if admitted {
+				c.limiter.release(reserved)
+			}
+		}()
+	}
 
+	// Read pending request from the relay-server.
 	var req *pb.HttpRequest = nil
 	var err error = nil
+	var relay string
 
 	deadline := time.Now().Add(5 * time.Second)
 	for time.Now().Before(deadline) {
-		req, err = c.getRequest(remote, relayURL)
+		relay = c.pollRelay()
+		w.slot.pollStarted()
+		req, err = c.getRequest(remote, c.buildRelayURL(relay))
+		w.slot.pollDone()
+		c.relays.record(relay, err)
+		c.recordPollOutcome(remote, err)
 		if err != nil {
 			if errors.Is(err, ErrTimeout) {
 				return err
 			} else if errors.Is(err, ErrForbidden) {
 				slog.Error("failed to authenticate to cloud-api, restarting", ilog.Err(err))
+				c.reportError(err, "")
 				os.Exit(1)
+			} else if c.awaitingRelay.Load() {
+				// awaitRelay retries with backoff.
+				return fmt.Errorf("failed to get request from relay: %w", err)
 			} else if errors.Is(err, syscall.ECONNREFUSED) {
-				slog.Warn("Failed to connect to relay server. Retrying.")
+				c.logSampler.log(slog.LevelWarn, "Failed to connect to relay server. Retrying.", err, w.slot.attr())
 				continue
 			} else {
-				return fmt.Errorf("failed to get request from relay: %v", err)
+				return fmt.Errorf("failed to get request from relay: %w", err)
 			}
 		} else {
 			break
@@ -742,31 +2365,136 @@ func (c *Client) localProxy(remote, local *http.Client) error {
 
 	if err != nil {
 		slog.Error("failed to connect to cloud-api, restarting", ilog.Err(err))
+		c.reportError(err, "")
 		os.Exit(1)
 	}
 
+	c.requestRelays.Store(req.GetId(), relay)
+	if c.config.RejectWhenSaturated {
+		var ok bool
+		if reserved, ok = c.limiter.tryAcquire(isHighPriority(req)); !ok {
+			slog.Warn("Rejecting request, too many concurrent requests",
+				slog.String("ID", req.GetId()), slog.Int("Limit", c.config.MaxConcurrentRequests))
+			c.postErrorResponse(remote, req.GetId(), http.StatusServiceUnavailable, errorOverloaded,
+				"Too many concurrent requests in relay client")
+			c.forgetRequest(req.GetId())
+			return nil
+		}
+	} else if reserved && !isHighPriority(req) {
+		// The reserved slot is kept for high-priority requests, so this one
+		// waits for a regular slot.
+		c.limiter.release(true)
+		reserved, admitted = false, false
+		if !c.limiter.acquireRegular(c.stopping) {
+			c.postErrorResponse(remote, req.GetId(), http.StatusServiceUnavailable, errorShuttingDown,
+				"Relay client is shutting down")
+			c.forgetRequest(req.GetId())
+			return nil
+		}
+	}
+	// The goroutine handling the request releases it.
+	admitted = false
+
 	// Forward the request to the backend.
-	go c.handleRequest(remote, local, req)
+	w.inFlight.Add(1)
+	c.requests.Add(1)
+	go func() {
+		defer c.requests.Done()
+		defer c.limiter.release(reserved)
+		defer w.inFlight.Add(-1)
+		defer c.forgetRequest(req.GetId())
+		defer func() {
+			if p := recover(); p != nil {
+				logPanic("request", req.GetId(), p)
+				c.reportError(fmt.Errorf("panic: %v", p), req.GetId())
+				// The response may be posted partially already, in which case
+				// the relay server rejects this one.
+				c.postErrorResponse(remote, req.GetId(), http.StatusInternalServerError, errorInternal,
+					"Relay client failed to handle the request")
+			}
+		}()
+		c.handleRequest(remote, local, req)
+	}()
 	return nil
 }
 
-func (c *Client) localProxyWorker(remote, local *http.Client) {
-	slog.Info("Starting to relay server request loop", slog.String("ServerName", c.config.ServerName))
-	for {
-		err := c.localProxy(remote, local)
-		if err != nil && !errors.Is(err, ErrTimeout) {
-			slog.Error("localProxy", ilog.Err(err))
-			time.Sleep(1 * time.Second)
+// localProxyWorker polls the relay server for requests until it's no longer
+// needed. recycled is true for the replacement of a recycled worker. A worker
+// that panics is replaced, so that the pool doesn't shrink silently. The
+// worker owns slot until it exits, or hands it to its replacement.
+func (c *Client) localProxyWorker(remote, local *http.Client, slot *workerSlot, surplus, recycled bool) {
+	defer c.workerGroup.Done()
+	defer func() {
+		if p := recover(); p != nil {
+			logPanic("worker", "", p)
+			// The replacement takes over the slot in c.workers, and the
+			// recycle if this worker was a replacement that didn't poll yet.
+			c.workerGroup.Add(1)
+			go c.localProxyWorker(remote, local, slot, surplus, recycled)
+		}
+	}()
+	switch {
+	case recycled:
+		// The worker replaces one that has been polling already.
+	case !surplus:
+		slog.Info("Starting to relay server request loop", slog.String("ServerName", c.config.ServerName), slot.attr())
+		c.sleep(jitter(c.config.StartupJitter))
+	case c.debugLogs():
+		slog.Info("Starting surplus relay server request loop", slog.String("ServerName", c.config.ServerName), slot.attr())
+	}
+	w := &proxyWorker{}
+	if c.recycler != nil {
+		w = c.recycler.newWorker()
+	}
+	w.slot = slot
+	idle := &idleBackoff{after: c.config.IdleTimeoutsBeforeBackoff, max: c.config.MaxIdlePollInterval}
+	for !c.draining() {
+		err := c.localProxy(remote, local, w)
+		if c.draining() {
+			// The poll was cancelled, or the request it got is handled
+			// already.
+			break
+		}
+		delay := idle.next(err)
+		if errors.Is(err, ErrTimeout) {
+			// All polls of a fleet would otherwise time out together.
+			c.sleep(delay + jitter(c.config.PollJitter))
+		} else if err != nil {
+			c.logSampler.log(slog.LevelError, "localProxy", err, slot.attr())
+			c.reportError(err, "")
+			// Retry after a second on average, but not in lockstep with the
+			// other workers.
+			c.sleep(500*time.Millisecond + jitter(time.Second))
+		}
+		if recycled {
+			// The replacement is polling, so the next worker may be recycled.
+			c.recycler.done()
+			recycled = false
+		}
+		if !c.scaleWorkers(remote, local, surplus) {
+			c.workerSlots.release(slot)
+			return
+		}
+		if c.recycler != nil && c.recycler.tryRecycle(w) {
+			slog.Info("Recycling idle worker", slot.attr(),
+				slog.Duration("Age", c.recycler.now().Sub(w.started)))
+			workerRecycles.Inc()
+			c.workerGroup.Add(1)
+			go c.localProxyWorker(remote, local, slot, surplus, true)
+			return
 		}
 	}
+	c.workerSlots.release(slot)
+	relayPollWorkers.Set(float64(c.workers.Add(-1)))
 }
 
-func (c *Client) buildRelayURL() string {
+func (c *Client) buildRelayURL(address string) string {
 	query := url.Values{}
 	query.Add("server", c.config.ServerName)
+	query.Add(clientVersionParam, clientVersion())
 	relayURL := url.URL{
 		Scheme:   c.config.RelayScheme,
-		Host:     c.config.RelayAddress,
+		Host:     address,
 		Path:     c.config.RelayPrefix + "/server/request",
 		RawQuery: query.Encode(),
 	}
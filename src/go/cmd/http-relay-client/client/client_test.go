@@ -16,13 +16,28 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
 	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
 
 	. "github.com/onsi/gomega"
+	"go.uber.org/goleak"
 	"google.golang.org/protobuf/proto"
 	"gopkg.in/h2non/gock.v1"
 )
@@ -82,6 +97,12 @@ func TestLocalProxy(t *testing.T) {
 		Body:              []byte("theresponsebody"),
 		Eof:               proto.Bool(true),
 		BackendDurationMs: proto.Int64(0),
+		UploadAttempts:    proto.Int32(1),
+		UploadDurationMs:  proto.Int64(0),
+		ElapsedMs:         proto.Int64(0),
+		ChunkIntervalMs:   proto.Int64(0),
+		TotalBytes:        proto.Int64(15),
+		ChunkIndex:        proto.Int32(0),
 	})
 	gock.New("https://localhost:8081").
 		Get("/server/request").
@@ -103,8 +124,8 @@ func TestLocalProxy(t *testing.T) {
 
 	config := DefaultClientConfig()
 	config.ServerName = "foo"
-	client := NewClient(config)
-	err := client.localProxy(&http.Client{}, &http.Client{})
+	client := newClient(config)
+	err := client.localProxy(&http.Client{}, &http.Client{}, &proxyWorker{})
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -136,6 +157,12 @@ func TestBackendError(t *testing.T) {
 		Body:              []byte("theresponsebody"),
 		Eof:               proto.Bool(true),
 		BackendDurationMs: proto.Int64(0),
+		UploadAttempts:    proto.Int32(1),
+		UploadDurationMs:  proto.Int64(0),
+		ElapsedMs:         proto.Int64(0),
+		ChunkIntervalMs:   proto.Int64(0),
+		TotalBytes:        proto.Int64(15),
+		ChunkIndex:        proto.Int32(0),
 	})
 
 	relayServerAddress := "https://localhost:8081"
@@ -167,13 +194,13 @@ func TestBackendError(t *testing.T) {
 
 	config := DefaultClientConfig()
 	config.ServerName = "foo"
-	client := NewClient(config)
+	client := newClient(config)
 
 	// localProxy ...
 	// 1. pulls a request from the realy-server (/server/request)
 	// 2. send that request to the backend server (here localhost:8080/foo/bar?a=b)
 	// 3. retrieves the response from the backend and sends it to the relay-server
-	err := client.localProxy(&http.Client{}, &http.Client{})
+	err := client.localProxy(&http.Client{}, &http.Client{}, &proxyWorker{})
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -203,8 +230,8 @@ func TestServerTimeout(t *testing.T) {
 
 	config := DefaultClientConfig()
 	config.ServerName = "foo"
-	client := NewClient(config)
-	err := client.localProxy(&http.Client{}, &http.Client{})
+	client := newClient(config)
+	err := client.localProxy(&http.Client{}, &http.Client{}, &proxyWorker{})
 	if err != ErrTimeout {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -221,8 +248,8 @@ func TestBuildResponsesTimesOut(t *testing.T) {
 	}
 	config := DefaultClientConfig()
 	config.BackendResponseTimeout = 10 * time.Millisecond
-	client := NewClient(config)
-	go client.buildResponses(bodyChannel, resp, responseChannel)
+	client := newClient(config)
+	go client.buildResponses(context.Background(), bodyChannel, resp, responseChannel, false, unframed, newChunkTimer(time.Now()))
 	bodyChannel <- []byte("foo")
 	resp = <-responseChannel
 	g.Expect(*resp.Id).To(Equal("20"))
@@ -242,3 +269,994 @@ func TestBuildResponsesTimesOut(t *testing.T) {
 	g.Expect(string(resp.Body)).To(Equal(""))
 	g.Expect(*resp.Eof).To(Equal(true))
 }
+
+func TestBuildResponsesRecordsChunkTiming(t *testing.T) {
+	defer func() { timeSince = time.Since }()
+	timeSince = time.Since
+	bodyChannel := make(chan []byte)
+	responseChannel := make(chan *pb.HttpResponse)
+	config := DefaultClientConfig()
+	config.BackendResponseTimeout = 10 * time.Millisecond
+	client := newClient(config)
+	// The request was received a second ago.
+	timer := newChunkTimer(time.Now().Add(-time.Second))
+	go client.buildResponses(context.Background(), bodyChannel, &pb.HttpResponse{Id: proto.String("20")}, responseChannel, false, unframed, timer)
+
+	bodyChannel <- []byte("foo")
+	first := <-responseChannel
+	time.Sleep(100 * time.Millisecond)
+	bodyChannel <- []byte("bar")
+	second := <-responseChannel
+	close(bodyChannel)
+	final := <-responseChannel
+
+	if got := first.GetElapsedMs(); got < 1000 || got != first.GetChunkIntervalMs() {
+		t.Errorf("First chunk has ElapsedMs %d and ChunkIntervalMs %d, want the same value >= 1000",
+			got, first.GetChunkIntervalMs())
+	}
+	if got := second.GetElapsedMs(); got < 1100 {
+		t.Errorf("Second chunk has ElapsedMs %d, want >= 1100", got)
+	}
+	if got := second.GetChunkIntervalMs(); got < 100 || got >= 1000 {
+		t.Errorf("Second chunk has ChunkIntervalMs %d, want the time since the first chunk", got)
+	}
+	if !final.GetEof() || final.ElapsedMs == nil || final.ChunkIntervalMs == nil {
+		t.Errorf("Final chunk %v is missing the timing", final)
+	}
+}
+
+// idleReader returns (0, nil) until the deadline, then data and EOF.
+type idleReader struct {
+	deadline time.Time
+	reads    int
+	done     bool
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.reads++
+	if time.Now().Before(r.deadline) {
+		return 0, nil
+	}
+	if r.done {
+		return 0, io.EOF
+	}
+	r.done = true
+	// The last data comes with EOF, which is allowed by io.Reader.
+	return copy(p, "data"), io.EOF
+}
+
+func TestStreamBytesBacksOffOnEmptyReads(t *testing.T) {
+	client := newClient(DefaultClientConfig())
+	in := &idleReader{deadline: time.Now().Add(500 * time.Millisecond)}
+	out := make(chan []byte)
+	go client.streamBytes(context.Background(), "15", io.NopCloser(in), out, newRequestState("15"))
+
+	var body []byte
+	for b := range out {
+		body = append(body, b...)
+	}
+	if string(body) != "data" {
+		t.Errorf("Body = %q, want %q", body, "data")
+	}
+	// Without backoff, this would be millions of reads.
+	if in.reads > 20 {
+		t.Errorf("Got %d reads within 500ms, want at most 20", in.reads)
+	}
+}
+
+// newCloseEchoBackend returns a websocket backend that speaks raw frames, as
+// x/net/websocket has no API for close frames. It echoes text frames and, as
+// RFC 6455 asks for, answers a close frame with a close frame with the same
+// status code. Frames must be shorter than 126 bytes.
+func newCloseEchoBackend(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Failed to hijack connection: %v", err)
+			return
+		}
+		defer conn.Close()
+		accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+			base64.StdEncoding.EncodeToString(accept[:]))
+		if err := rw.Flush(); err != nil {
+			t.Errorf("Failed to send handshake: %v", err)
+			return
+		}
+		for {
+			var head [2]byte
+			if _, err := io.ReadFull(rw, head[:]); err != nil {
+				t.Errorf("Backend didn't get a close frame: %v", err)
+				return
+			}
+			var mask [4]byte
+			if head[1]&0x80 != 0 {
+				io.ReadFull(rw, mask[:])
+			}
+			payload := make([]byte, head[1]&0x7f)
+			io.ReadFull(rw, payload)
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+			opcode := head[0] & 0x0f
+			rw.Write(append([]byte{0x80 | opcode, byte(len(payload))}, payload...))
+			rw.Flush()
+			if opcode == 0x8 {
+				// Make sure the relay client has already seen the end of the
+				// request stream.
+				time.Sleep(100 * time.Millisecond)
+				return
+			}
+		}
+	}))
+}
+
+// maskedFrame returns a final frame with opcode and payload, masked as sent
+// by the user-client. Payload must be shorter than 126 bytes.
+func maskedFrame(opcode byte, payload []byte) []byte {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestWebsocketCloseFrameIsRelayed(t *testing.T) {
+	backend := newCloseEchoBackend(t)
+	defer backend.Close()
+	relay := relaytest.NewServer()
+	defer relay.Close()
+
+	// The user-client sends "hello" and closes with status 1000, Normal
+	// Closure.
+	closeCode := binary.BigEndian.AppendUint16(nil, 1000)
+	relay.SendRequestStream("15", append(maskedFrame(0x1, []byte("hello")), maskedFrame(0x8, closeCode)...))
+	relay.CloseRequestStream("15")
+
+	config := fakeRelayConfig(relay)
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.BackendResponseTimeout = 10 * time.Millisecond
+	client := newClient(config)
+
+	header := func(name, value string) *pb.HttpHeader {
+		return &pb.HttpHeader{Name: proto.String(name), Value: proto.String(value)}
+	}
+	done := make(chan struct{})
+	go func() {
+		client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+			Id:     proto.String("15"),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid/ws"),
+			Header: []*pb.HttpHeader{
+				header("Connection", "Upgrade"),
+				header("Upgrade", "websocket"),
+				header("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ=="),
+				header("Sec-WebSocket-Version", "13"),
+			},
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handleRequest didn't return after the websocket was closed")
+	}
+
+	responses, err := relay.WaitForResponses("15", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := responses[0].GetStatusCode(); got != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want %d", got, http.StatusSwitchingProtocols)
+	}
+	// Unmasked frames as sent by the backend: the echoed text frame, and the
+	// close frame with the status of the user-client's one.
+	want := "\x81\x05hello\x88\x02" + string(closeCode)
+	if got := body(responses); got != want {
+		t.Errorf("Relayed frames = %q, want %q", got, want)
+	}
+}
+
+// backendRecorder records what streamToBackend writes to the backend.
+type backendRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (r *backendRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+// resetConnection simulates a network failure by closing the connection
+// without a complete response.
+func resetConnection(t *testing.T, w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Errorf("Failed to hijack connection: %v", err)
+		return
+	}
+	conn.Close()
+}
+
+func newStreamTestClient(relay *httptest.Server) *Client {
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.ResponseRetryPolicy.InitialInterval = time.Millisecond
+	return newClient(config)
+}
+
+func TestStreamToBackendRetriesTransientErrors(t *testing.T) {
+	// Every other poll fails, alternating between a server error and a
+	// connection reset, before any data was sent.
+	polls := 0
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls += 1
+		switch polls {
+		case 1:
+			w.Write([]byte("a"))
+		case 2:
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+		case 3:
+			w.Write([]byte("b"))
+		case 4:
+			resetConnection(t, w)
+		case 5:
+			w.Write([]byte("c"))
+		default:
+			http.Error(w, "No ongoing request", http.StatusGone)
+		}
+	}))
+	defer relay.Close()
+
+	backend := &backendRecorder{}
+	newStreamTestClient(relay).streamToBackend(context.Background(), &http.Client{}, "15", backend, newRequestState("15"))
+
+	if got := backend.String(); got != "abc" {
+		t.Errorf("Backend received %q, want %q", got, "abc")
+	}
+	if backend.closed {
+		t.Errorf("Backend connection was closed at the end of the request stream")
+	}
+}
+
+func TestStreamToBackendFailsPermanently(t *testing.T) {
+	tests := []struct {
+		desc    string
+		handler func(t *testing.T, w http.ResponseWriter)
+		want    string
+	}{
+		{
+			desc: "client error",
+			handler: func(t *testing.T, w http.ResponseWriter) {
+				http.Error(w, "Missing id query parameter", http.StatusBadRequest)
+			},
+			want: "",
+		},
+		{
+			// Retrying would drop the rest of the data that the relay
+			// has already dequeued.
+			desc: "failure after partial read",
+			handler: func(t *testing.T, w http.ResponseWriter) {
+				w.Header().Set("Content-Length", "10")
+				w.Write([]byte("ab"))
+				w.(http.Flusher).Flush()
+				resetConnection(t, w)
+			},
+			want: "ab",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			polls := 0
+			relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				polls += 1
+				tc.handler(t, w)
+			}))
+			defer relay.Close()
+
+			backend := &backendRecorder{}
+			newStreamTestClient(relay).streamToBackend(context.Background(), &http.Client{}, "15", backend, newRequestState("15"))
+
+			if polls != 1 {
+				t.Errorf("Relay was polled %d times, want 1", polls)
+			}
+			if got := backend.String(); got != tc.want {
+				t.Errorf("Backend received %q, want %q", got, tc.want)
+			}
+			if !backend.closed {
+				t.Errorf("Backend connection was not closed")
+			}
+		})
+	}
+}
+
+// countingTransport counts the response bodies that haven't been closed yet.
+type countingTransport struct {
+	open, maxOpen atomic.Int32
+}
+
+type countingBody struct {
+	io.ReadCloser
+	t    *countingTransport
+	once sync.Once
+}
+
+func (b *countingBody) Close() error {
+	b.once.Do(func() { b.t.open.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	n := t.open.Add(1)
+	for m := t.maxOpen.Load(); n > m && !t.maxOpen.CompareAndSwap(m, n); m = t.maxOpen.Load() {
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, t: t}
+	return resp, nil
+}
+
+func TestStreamToBackendClosesEachPoll(t *testing.T) {
+	const dataPolls = 300
+	polls := 0
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls += 1
+		switch {
+		case polls > 2*dataPolls:
+			http.Error(w, "No ongoing request", http.StatusGone)
+		case polls%2 == 0:
+			w.Write([]byte("x"))
+		}
+	}))
+	defer relay.Close()
+
+	goroutines := runtime.NumGoroutine()
+	transport := &countingTransport{}
+	backend := &backendRecorder{}
+	newStreamTestClient(relay).streamToBackend(context.Background(), &http.Client{Transport: transport}, "15", backend, newRequestState("15"))
+
+	if got := backend.Len(); got != dataPolls {
+		t.Errorf("Backend received %d bytes, want %d", got, dataPolls)
+	}
+	if got := transport.maxOpen.Load(); got > 1 {
+		t.Errorf("Up to %d request stream bodies were open at once, want 1", got)
+	}
+	if got := transport.open.Load(); got != 0 {
+		t.Errorf("%d request stream bodies weren't closed", got)
+	}
+	// Allow for the idle connection of the transport and its readers.
+	if got := runtime.NumGoroutine(); got > goroutines+5 {
+		t.Errorf("%d goroutines after the request stream, want about %d", got, goroutines)
+	}
+}
+
+func TestStreamToBackendStopsAfterRequestEnded(t *testing.T) {
+	// The relay server never ends the request stream.
+	var polls atomic.Int32
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+	}))
+	defer relay.Close()
+
+	state := newRequestState("15")
+	state.transition(phaseCancelled)
+	done := make(chan struct{})
+	go func() {
+		newStreamTestClient(relay).streamToBackend(context.Background(), &http.Client{}, "15", &backendRecorder{}, state)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("streamToBackend kept polling after the request ended")
+	}
+	if got := polls.Load(); got != maxEmptyRequestStreamPolls {
+		t.Errorf("Relay was polled %d times, want %d", got, maxEmptyRequestStreamPolls)
+	}
+}
+
+// recordingRelay is a fake relay server that records the posted responses.
+type recordingRelay struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received map[string][]*pb.HttpResponse
+}
+
+func newRecordingRelay() *recordingRelay {
+	r := &recordingRelay{received: map[string][]*pb.HttpResponse{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		resp := &pb.HttpResponse{}
+		if err := proto.Unmarshal(body, resp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		r.received[resp.GetId()] = append(r.received[resp.GetId()], resp)
+		r.mu.Unlock()
+		w.Write([]byte("ok"))
+	}))
+	return r
+}
+
+// responses returns the responses posted for the request with the given id.
+func (r *recordingRelay) responses(id string) []*pb.HttpResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.received[id]
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestResponseHeaderValidation(t *testing.T) {
+	// A backend that echoes untrusted input into a header, as seen through a
+	// transport that doesn't validate header values.
+	local := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Content-Type": {"text/plain"},
+				"X-Echo":       {"foo\r\nSet-Cookie: evil=1\x00"},
+			},
+			Body: io.NopCloser(strings.NewReader("body")),
+		}, nil
+	})}
+
+	tests := []struct {
+		desc       string
+		strict     bool
+		wantStatus int32
+		wantEcho   string
+	}{
+		{"strip", false, http.StatusOK, "fooSet-Cookie: evil=1"},
+		{"reject", true, http.StatusInternalServerError, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := newRecordingRelay()
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.StrictResponseHeaderValidation = tc.strict
+			client := newClient(config)
+			client.handleRequest(&http.Client{}, local, &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+
+			received := relay.responses("15")
+			if len(received) == 0 {
+				t.Fatal("No response received")
+			}
+			if got := received[0].GetStatusCode(); got != tc.wantStatus {
+				t.Errorf("Status = %d, want %d", got, tc.wantStatus)
+			}
+			echo := ""
+			for _, resp := range received {
+				for _, h := range append(resp.Header, resp.Trailer...) {
+					if strings.ContainsAny(h.GetValue(), "\r\n\x00") {
+						t.Errorf("Header %s has invalid value %q", h.GetName(), h.GetValue())
+					}
+					if h.GetName() == "X-Echo" {
+						echo = h.GetValue()
+					}
+				}
+			}
+			if echo != tc.wantEcho {
+				t.Errorf("X-Echo = %q, want %q", echo, tc.wantEcho)
+			}
+		})
+	}
+}
+
+func TestPostHeadersEarly(t *testing.T) {
+	tests := []struct {
+		desc             string
+		contentType      string
+		postHeadersEarly bool
+		wantFirstBody    string
+		wantFirstEof     bool
+	}{
+		{"event stream", "text/event-stream", true, "", false},
+		{"chunked", "text/plain", true, "", false},
+		// The event is posted as soon as it's complete, before EOF.
+		{"disabled", "text/event-stream", false, "data: foo\n\n", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := newRecordingRelay()
+			defer relay.Close()
+			// The backend only sends the body once the relay has seen the
+			// headers, or after a while if they are never posted early.
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				for deadline := time.Now().Add(200 * time.Millisecond); time.Now().Before(deadline); {
+					if len(relay.responses("15")) > 0 {
+						break
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+				w.Write([]byte("data: foo\n\n"))
+			}))
+			defer backend.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.BackendResponseTimeout = time.Second
+			config.PostHeadersEarly = tc.postHeadersEarly
+			client := newClient(config)
+			client.handleRequest(&http.Client{}, &http.Client{}, &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/events"),
+			})
+
+			received := relay.responses("15")
+			if len(received) == 0 {
+				t.Fatal("No response received")
+			}
+			first := received[0]
+			if got := first.GetStatusCode(); got != http.StatusOK {
+				t.Errorf("Status = %d, want %d", got, http.StatusOK)
+			}
+			if got := string(first.Body); got != tc.wantFirstBody {
+				t.Errorf("First body = %q, want %q", got, tc.wantFirstBody)
+			}
+			if got := first.GetEof(); got != tc.wantFirstEof {
+				t.Errorf("First Eof = %t, want %t", got, tc.wantFirstEof)
+			}
+			var body string
+			for _, resp := range received {
+				body += string(resp.Body)
+			}
+			if body != "data: foo\n\n" {
+				t.Errorf("Body = %q, want %q", body, "data: foo\n\n")
+			}
+			if !received[len(received)-1].GetEof() {
+				t.Errorf("Last response isn't final")
+			}
+		})
+	}
+}
+
+func TestCreateBackendRequestKeepsURLEncoding(t *testing.T) {
+	uris := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uris <- r.RequestURI
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		desc        string
+		url         string
+		backendPath string
+		want        string
+	}{
+		{"encoded slash", "/api/v1/services/a%2Fb/proxy", "", "/api/v1/services/a%2Fb/proxy"},
+		{"encoded slash with prefix", "/services/a%2Fb/proxy", "/api/v1", "/api/v1/services/a%2Fb/proxy"},
+		{"prefix with trailing slash", "/a%2Fb", "/api/", "/api/a%2Fb"},
+		{"encoded space", "/a%20b", "/api", "/api/a%20b"},
+		{"plus in path", "/a+b", "/api", "/api/a+b"},
+		{"semicolons", "/a;b?x=1;y=2", "/api", "/api/a;b?x=1;y=2"},
+		{"query kept as is", "/a?q=a%2Fb+c&e=%20&p=1+1", "/api", "/api/a?q=a%2Fb+c&e=%20&p=1+1"},
+		{"encoded UTF-8", "/%C3%BC?q=%C3%BC", "/api", "/api/%C3%BC?q=%C3%BC"},
+		// Raw UTF-8 isn't valid in a request line. The backend gets the same
+		// path, percent-encoded.
+		{"literal UTF-8", "/ü", "/api", "/api/%C3%BC"},
+		{"prefix needing escaping", "/a%2Fb", "/my api", "/my%20api/a%2Fb"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.BackendPath = tc.backendPath
+			client := newClient(config)
+
+			req, err := client.createBackendRequest(&pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid" + tc.url),
+			})
+			if err != nil {
+				t.Fatalf("createBackendRequest() failed: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Backend request failed: %v", err)
+			}
+			resp.Body.Close()
+			if got := <-uris; got != tc.want {
+				t.Errorf("Backend got request URI %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequestAndResponseHooks(t *testing.T) {
+	var backendRequests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests.Add(1)
+		w.Header().Set("X-Tenant", r.Header.Get("X-Tenant"))
+		w.Write([]byte("body"))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		desc         string
+		method       string
+		wantStatus   int32
+		wantTenant   string
+		wantAudited  bool
+		wantRequests int32
+	}{
+		{"allow", "GET", http.StatusOK, "tenant-a", true, 1},
+		{"deny write", "POST", http.StatusForbidden, "", false, 0},
+		{"hook failure", "DELETE", http.StatusInternalServerError, "", false, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := newRecordingRelay()
+			defer relay.Close()
+			backendRequests.Store(0)
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.RequestHook = func(ctx context.Context, req *http.Request) error {
+				switch req.Method {
+				case "POST":
+					return fmt.Errorf("maintenance window: %w", ErrForbidden)
+				case "DELETE":
+					return errors.New("audit log unavailable")
+				}
+				req.Header.Set("X-Tenant", "tenant-a")
+				return nil
+			}
+			config.ResponseHook = func(ctx context.Context, resp *pb.HttpResponse, hresp *http.Response) {
+				resp.Header = append(resp.Header, &pb.HttpHeader{
+					Name:  proto.String("X-Audited"),
+					Value: proto.String(hresp.Request.Method),
+				})
+			}
+			client := newClient(config)
+			local := client.newLocalClient(nil)
+
+			// Hooks are called concurrently for parallel requests.
+			const numRequests = 4
+			var wg sync.WaitGroup
+			for i := 0; i < numRequests; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					client.handleRequest(&http.Client{}, local, &pb.HttpRequest{
+						Id:     proto.String(strconv.Itoa(i)),
+						Method: proto.String(tc.method),
+						Url:    proto.String("http://invalid/foo"),
+					})
+				}(i)
+			}
+			wg.Wait()
+
+			if got, want := backendRequests.Load(), numRequests*tc.wantRequests; got != want {
+				t.Errorf("Backend received %d requests, want %d", got, want)
+			}
+			for i := 0; i < numRequests; i++ {
+				received := relay.responses(strconv.Itoa(i))
+				if len(received) == 0 {
+					t.Errorf("Request %d: no response received", i)
+					continue
+				}
+				if got := received[0].GetStatusCode(); got != tc.wantStatus {
+					t.Errorf("Request %d: status = %d, want %d", i, got, tc.wantStatus)
+				}
+				tenant, audited := "", false
+				for _, h := range received[0].Header {
+					switch h.GetName() {
+					case "X-Tenant":
+						tenant = h.GetValue()
+					case "X-Audited":
+						audited = true
+					}
+				}
+				if tenant != tc.wantTenant {
+					t.Errorf("Request %d: X-Tenant = %q, want %q", i, tenant, tc.wantTenant)
+				}
+				if audited != tc.wantAudited {
+					t.Errorf("Request %d: audited = %v, want %v", i, audited, tc.wantAudited)
+				}
+			}
+		})
+	}
+}
+
+func TestFinalResponseCountsBytes(t *testing.T) {
+	tests := []struct {
+		desc string
+		size int
+	}{
+		{"single chunk", 5},
+		{"multiple chunks", 3000},
+		{"empty", 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Flushing makes the response chunked, so that it's not read
+				// at once.
+				for i := 0; i < tc.size; i += 1000 {
+					w.Write([]byte(strings.Repeat("x", min(1000, tc.size-i))))
+					w.(http.Flusher).Flush()
+				}
+			}))
+			defer backend.Close()
+			relay := newRecordingRelay()
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.MaxChunkSize = 500
+			config.BlockSize = 100
+			client := newClient(config)
+			client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+
+			received := relay.responses("15")
+			if len(received) == 0 {
+				t.Fatal("No response received")
+			}
+			for _, resp := range received[:len(received)-1] {
+				if resp.TotalBytes != nil || resp.ChunkIndex != nil {
+					t.Errorf("Intermediate response has TotalBytes %d and ChunkIndex %d, want none",
+						resp.GetTotalBytes(), resp.GetChunkIndex())
+				}
+			}
+			final := received[len(received)-1]
+			if got := final.GetTotalBytes(); got != int64(tc.size) {
+				t.Errorf("TotalBytes = %d, want %d", got, tc.size)
+			}
+			if got, want := final.GetChunkIndex(), int32(len(received)-1); final.ChunkIndex == nil || got != want {
+				t.Errorf("ChunkIndex = %d, want %d", got, want)
+			}
+			if tc.size > config.MaxChunkSize && len(received) < 2 {
+				t.Errorf("Got %d responses, want multiple chunks", len(received))
+			}
+		})
+	}
+}
+
+func TestRelayTimeouts(t *testing.T) {
+	// The relay server answers polls after 200ms and never answers posts.
+	done := make(chan struct{})
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/server/request" {
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(http.StatusRequestTimeout)
+			return
+		}
+		<-done
+	}))
+	defer relay.Close()
+	defer close(done)
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.RelayPostTimeout = 50 * time.Millisecond
+	client := newClient(config)
+	remote := &http.Client{}
+
+	if _, err := client.getRequest(remote, relay.URL+"/server/request"); err != ErrTimeout {
+		t.Errorf("getRequest() = %v, want ErrTimeout after the poll took longer than RelayPostTimeout", err)
+	}
+	start := time.Now()
+	if err := client.postResponse(remote, &pb.HttpResponse{Id: proto.String("15")}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("postResponse() = %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("postResponse() failed after %v, want about RelayPostTimeout", d)
+	}
+
+	client.config.RelayPollTimeout = 50 * time.Millisecond
+	if _, err := client.getRequest(remote, relay.URL+"/server/request"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("getRequest() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestTruncatedBackendResponse(t *testing.T) {
+	tests := []struct {
+		desc          string
+		contentLength int
+	}{
+		{"small response", 500},
+		{"streamed response", 5000},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			// The backend announces more bytes than it sends, then closes
+			// the connection.
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, bufrw, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Errorf("Hijack failed: %v", err)
+					return
+				}
+				defer conn.Close()
+				fmt.Fprintf(bufrw, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", tc.contentLength, strings.Repeat("x", 100))
+				bufrw.Flush()
+			}))
+			defer backend.Close()
+			relay := newRecordingRelay()
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.MaxChunkSize = 1000
+			client := newClient(config)
+			client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+
+			received := relay.responses("15")
+			if len(received) == 0 {
+				t.Fatal("No response received")
+			}
+			final := received[len(received)-1]
+			if !final.GetEof() {
+				t.Fatalf("Last response %v isn't final", final)
+			}
+			if final.StreamError == nil {
+				t.Errorf("Final response has no StreamError")
+			}
+			marked := false
+			for _, h := range final.Trailer {
+				marked = marked || h.GetName() == streamErrorTrailer
+			}
+			if !marked {
+				t.Errorf("Final response trailers %v lack %s", final.Trailer, streamErrorTrailer)
+			}
+			for _, resp := range received[:len(received)-1] {
+				if resp.StreamError != nil {
+					t.Errorf("Intermediate response has StreamError %q", resp.GetStreamError())
+				}
+			}
+		})
+	}
+}
+
+func TestRelayRestartAbortsStream(t *testing.T) {
+	tests := []struct {
+		desc    string
+		upgrade bool
+	}{
+		{"streamed response", false},
+		{"upgraded connection", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			// The backend sends until the relay client hangs up.
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tc.upgrade {
+					for r.Context().Err() == nil {
+						w.Write([]byte(strings.Repeat("x", 100)))
+						w.(http.Flusher).Flush()
+						time.Sleep(10 * time.Millisecond)
+					}
+					return
+				}
+				conn, bufrw, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Errorf("Hijack failed: %v", err)
+					return
+				}
+				defer conn.Close()
+				bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+				for {
+					bufrw.WriteString(strings.Repeat("x", 100))
+					if bufrw.Flush() != nil {
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}))
+			defer backend.Close()
+			// The relay server restarts after the first response, and has
+			// no data on the request stream.
+			var posts atomic.Int32
+			relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/server/response":
+					if posts.Add(1) > 1 {
+						http.Error(w, "Unknown request ID", http.StatusBadRequest)
+						return
+					}
+					w.Write([]byte("ok"))
+				case "/server/requeststream":
+					time.Sleep(10 * time.Millisecond)
+				}
+			}))
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.BackendResponseTimeout = 20 * time.Millisecond
+			var mu sync.Mutex
+			var reported []error
+			config.ErrorHandler = func(err error, id string) {
+				mu.Lock()
+				defer mu.Unlock()
+				reported = append(reported, err)
+			}
+			client := newClient(config)
+			remote := &http.Client{Transport: &http.Transport{}}
+			local := client.newLocalClient(nil)
+			pbreq := &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/stream"),
+			}
+			if tc.upgrade {
+				pbreq.Header = []*pb.HttpHeader{
+					{Name: proto.String("Connection"), Value: proto.String("Upgrade")},
+					{Name: proto.String("Upgrade"), Value: proto.String("test")},
+				}
+			}
+
+			done := make(chan struct{})
+			go func() {
+				client.handleRequest(remote, local, pbreq)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("handleRequest kept streaming after the relay server restarted")
+			}
+			remote.CloseIdleConnections()
+			local.CloseIdleConnections()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(reported) != 1 || !errors.Is(reported[0], ErrRelayRejected) {
+				t.Errorf("Reported errors %v, want one matching ErrRelayRejected", reported)
+			}
+		})
+	}
+}
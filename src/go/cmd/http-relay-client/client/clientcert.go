@@ -0,0 +1,103 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+// The attributes of the user-client's certificate that can be forwarded to
+// the backend, named like the keys of Envoy's X-Forwarded-Client-Cert header.
+var clientCertAttributes = []string{"Hash", "Cert", "Subject", "URI", "DNS"}
+
+// checkClientCertInfo returns an error if attrs contains an attribute that
+// is not in clientCertAttributes.
+func checkClientCertInfo(attrs []string) error {
+	for _, attr := range attrs {
+		known := false
+		for _, a := range clientCertAttributes {
+			known = known || attr == a
+		}
+		if !known {
+			return fmt.Errorf("unknown client certificate attribute %q, want one of %s",
+				attr, strings.Join(clientCertAttributes, ", "))
+		}
+	}
+	return nil
+}
+
+// setClientCertHeader replaces the ClientCertHeader of the backend request
+// with the attributes of the user-client's certificate listed in
+// ForwardClientCertInfo, in Envoy's XFCC format. Any value already sent by
+// the user-client is removed, so that it cannot be spoofed, even if no
+// attributes are forwarded.
+func (c *Client) setClientCertHeader(breq *pb.HttpRequest, header http.Header) {
+	header.Del(c.config.ClientCertHeader)
+	cert := breq.GetPeerCertificate()
+	if cert == nil {
+		return
+	}
+	var pairs []string
+	for _, attr := range c.config.ForwardClientCertInfo {
+		switch attr {
+		case "Hash":
+			if cert.Sha256Fingerprint != nil {
+				pairs = append(pairs, "Hash="+*cert.Sha256Fingerprint)
+			}
+		case "Cert":
+			if cert.Pem != nil {
+				pairs = append(pairs, "Cert="+xfccQuote(url.QueryEscape(*cert.Pem)))
+			}
+		case "Subject":
+			if cert.Subject != nil {
+				pairs = append(pairs, "Subject="+xfccQuote(*cert.Subject))
+			}
+		case "URI":
+			for _, uri := range cert.Uris {
+				pairs = append(pairs, "URI="+xfccValue(uri))
+			}
+		case "DNS":
+			for _, name := range cert.DnsNames {
+				pairs = append(pairs, "DNS="+xfccValue(name))
+			}
+		}
+	}
+	if len(pairs) > 0 {
+		header.Set(c.config.ClientCertHeader, strings.Join(pairs, ";"))
+	}
+}
+
+// xfccValue quotes s if it contains characters with a meaning in XFCC, which
+// separates elements with commas, pairs with semicolons, and keys from values
+// with equal signs.
+func xfccValue(s string) string {
+	if strings.ContainsAny(s, `,;="\`) {
+		return xfccQuote(s)
+	}
+	return s
+}
+
+// xfccQuote returns s as a quoted XFCC value, in which Envoy escapes double
+// quotes and backslashes with a backslash.
+func xfccQuote(s string) string {
+	return `"` + xfccEscaper.Replace(s) + `"`
+}
+
+var xfccEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
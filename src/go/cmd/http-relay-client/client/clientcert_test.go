@@ -0,0 +1,167 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestClientCertHeader(t *testing.T) {
+	cert := &pb.PeerCertificate{
+		Subject:           proto.String("CN=robot,O=Example"),
+		DnsNames:          []string{"robot.example.com", "robot"},
+		Uris:              []string{"spiffe://example.com/robot"},
+		Sha256Fingerprint: proto.String("abcd"),
+		Pem:               proto.String("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"),
+	}
+	spoofed := []*pb.HttpHeader{{
+		Name:  proto.String("X-Forwarded-Client-Cert"),
+		Value: proto.String("Subject=\"CN=admin\""),
+	}}
+
+	tests := []struct {
+		desc   string
+		attrs  []string
+		cert   *pb.PeerCertificate
+		header []*pb.HttpHeader
+		want   string
+	}{
+		{
+			desc:  "all attributes",
+			attrs: clientCertAttributes,
+			cert:  cert,
+			want: `Hash=abcd;` +
+				`Cert="-----BEGIN+CERTIFICATE-----%0AMIIB%0A-----END+CERTIFICATE-----%0A";` +
+				`Subject="CN=robot,O=Example";` +
+				`URI=spiffe://example.com/robot;` +
+				`DNS=robot.example.com;DNS=robot`,
+		},
+		{
+			desc:  "allowlist",
+			attrs: []string{"Subject", "Hash"},
+			cert:  cert,
+			want:  `Subject="CN=robot,O=Example";Hash=abcd`,
+		},
+		{
+			desc:  "absent fields",
+			attrs: []string{"Cert", "URI"},
+			cert:  &pb.PeerCertificate{Subject: proto.String("CN=robot")},
+			want:  "",
+		},
+		{
+			desc:   "spoofed header without certificate",
+			attrs:  clientCertAttributes,
+			header: spoofed,
+			want:   "",
+		},
+		{
+			desc:  "escaping",
+			attrs: []string{"Subject", "URI", "DNS"},
+			cert: &pb.PeerCertificate{
+				Subject:  proto.String(`CN=robot\, "main";O=Example,OU=a=b`),
+				Uris:     []string{"spiffe://example.com/robot;v=1"},
+				DnsNames: []string{"robot"},
+			},
+			want: `Subject="CN=robot\\, \"main\";O=Example,OU=a=b";` +
+				`URI="spiffe://example.com/robot;v=1";DNS=robot`,
+		},
+		{
+			desc:  "trailing backslash",
+			attrs: []string{"Subject", "URI"},
+			cert: &pb.PeerCertificate{
+				Subject: proto.String(`CN=robot\`),
+				Uris:    []string{`spiffe://example.com/robot\";By=spiffe://example.com/admin`},
+			},
+			want: `Subject="CN=robot\\";` +
+				`URI="spiffe://example.com/robot\\\";By=spiffe://example.com/admin"`,
+		},
+		{
+			desc:   "spoofed header with forwarding disabled",
+			attrs:  nil,
+			cert:   cert,
+			header: append(spoofed, &pb.HttpHeader{Name: proto.String("x-forwarded-client-cert"), Value: proto.String("Hash=0000")}),
+			want:   "",
+		},
+		{
+			desc:   "spoofed header with certificate",
+			attrs:  []string{"Hash"},
+			cert:   cert,
+			header: spoofed,
+			want:   "Hash=abcd",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.ForwardClientCertInfo = tc.attrs
+			client := newClient(config)
+
+			req, err := client.createBackendRequest(&pb.HttpRequest{
+				Id:              proto.String("15"),
+				Method:          proto.String("GET"),
+				Url:             proto.String("http://invalid/foo"),
+				Header:          tc.header,
+				PeerCertificate: tc.cert,
+			})
+			if err != nil {
+				t.Fatalf("createBackendRequest() failed: %v", err)
+			}
+			got := req.Header.Values("X-Forwarded-Client-Cert")
+			if tc.want == "" && len(got) != 0 {
+				t.Errorf("X-Forwarded-Client-Cert = %q, want none", got)
+			}
+			if tc.want != "" && (len(got) != 1 || got[0] != tc.want) {
+				t.Errorf("X-Forwarded-Client-Cert = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientCertHeaderIsForwardedByDefault(t *testing.T) {
+	client := newClient(DefaultClientConfig())
+	req, err := client.createBackendRequest(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/foo"),
+		Header: []*pb.HttpHeader{{
+			Name:  proto.String("X-Forwarded-Client-Cert"),
+			Value: proto.String("Subject=\"CN=admin\""),
+		}},
+		PeerCertificate: &pb.PeerCertificate{
+			Subject:           proto.String("CN=robot"),
+			Sha256Fingerprint: proto.String("abcd"),
+			Pem:               proto.String("-----BEGIN CERTIFICATE-----\n"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("createBackendRequest() failed: %v", err)
+	}
+	want := `Hash=abcd;Subject="CN=robot"`
+	if got := req.Header.Values("X-Forwarded-Client-Cert"); len(got) != 1 || got[0] != want {
+		t.Errorf("X-Forwarded-Client-Cert = %q, want %q", got, want)
+	}
+}
+
+func TestCheckClientCertInfo(t *testing.T) {
+	if err := checkClientCertInfo(clientCertAttributes); err != nil {
+		t.Errorf("checkClientCertInfo(%q) = %v, want nil", clientCertAttributes, err)
+	}
+	if err := checkClientCertInfo([]string{"Subject", "Chain"}); err == nil {
+		t.Errorf("checkClientCertInfo() accepted unknown attribute Chain")
+	}
+}
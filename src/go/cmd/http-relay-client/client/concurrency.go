@@ -0,0 +1,133 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+// requestLimiter bounds the number of requests handled concurrently, see
+// MaxConcurrentRequests. High-priority requests may also take the slots
+// reserved for them, see ReservedPrioritySlots. A nil *requestLimiter
+// imposes no limit, but still reports the number of requests in the
+// concurrentRequests gauge.
+type requestLimiter struct {
+	slots chan struct{}
+	// reserved is nil if there are no reserved slots, which blocks sending
+	// to it forever.
+	reserved chan struct{}
+}
+
+func newRequestLimiter(max, reserved int) *requestLimiter {
+	l := &requestLimiter{slots: make(chan struct{}, max)}
+	if reserved > 0 {
+		l.reserved = make(chan struct{}, reserved)
+	}
+	return l
+}
+
+// acquire blocks until a request may be handled, preferring a regular slot
+// over a reserved one. It returns whether the slot is reserved, and false if
+// stop is closed first.
+func (l *requestLimiter) acquire(stop <-chan struct{}) (reserved, ok bool) {
+	if l == nil {
+		concurrentRequests.Inc()
+		return false, true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		concurrentRequests.Inc()
+		return false, true
+	default:
+	}
+	select {
+	case l.slots <- struct{}{}:
+		concurrentRequests.Inc()
+		return false, true
+	case l.reserved <- struct{}{}:
+		concurrentRequests.Inc()
+		return true, true
+	case <-stop:
+		return false, false
+	}
+}
+
+// acquireRegular is like acquire, but only takes a regular slot.
+func (l *requestLimiter) acquireRegular(stop <-chan struct{}) bool {
+	if l == nil {
+		concurrentRequests.Inc()
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		concurrentRequests.Inc()
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// tryAcquire is like acquire, but returns false right away if the limit is
+// reached. Only high-priority requests take reserved slots.
+func (l *requestLimiter) tryAcquire(highPriority bool) (reserved, ok bool) {
+	if l == nil {
+		concurrentRequests.Inc()
+		return false, true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		concurrentRequests.Inc()
+		return false, true
+	default:
+	}
+	if !highPriority {
+		return false, false
+	}
+	select {
+	case l.reserved <- struct{}{}:
+		concurrentRequests.Inc()
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// release ends a request admitted by acquire, acquireRegular or tryAcquire,
+// in a reserved slot if reserved is true.
+func (l *requestLimiter) release(reserved bool) {
+	concurrentRequests.Dec()
+	if l == nil {
+		return
+	}
+	if reserved {
+		<-l.reserved
+	} else {
+		<-l.slots
+	}
+}
+
+// isHighPriority returns true if the relay server gave breq a priority
+// above the default.
+func isHighPriority(breq *pb.HttpRequest) bool {
+	return breq.GetPriority() > 0
+}
+
+// priorityLabel is the priority of breq for metrics and logs.
+func priorityLabel(breq *pb.HttpRequest) string {
+	if isHighPriority(breq) {
+		return "high"
+	}
+	return "normal"
+}
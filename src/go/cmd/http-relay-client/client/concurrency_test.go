@@ -0,0 +1,241 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// floodRequests is the number of requests queued by newFloodRelay, enough
+// to keep all workers busy during a test.
+const floodRequests = 1000
+
+// newFloodRelay returns a relay server that hands out a new request on every
+// poll. The requests of the polls listed in highPriority are high-priority
+// ones for /fast, the others are for /slow.
+func newFloodRelay(highPriority ...int) *relaytest.Server {
+	relay := relaytest.NewServer()
+	for i := 1; i <= floodRequests; i++ {
+		req := &pb.HttpRequest{
+			Id:     proto.String(fmt.Sprint(i)),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid/slow"),
+		}
+		if slices.Contains(highPriority, i) {
+			req.Url = proto.String("http://invalid/fast")
+			req.Priority = proto.Int32(1)
+		}
+		relay.Enqueue(req)
+	}
+	return relay
+}
+
+// floodResponses returns the responses posted to relay so far, ordered by
+// request id.
+func floodResponses(relay *relaytest.Server) []*pb.HttpResponse {
+	var responses []*pb.HttpResponse
+	for i := 1; i <= floodRequests; i++ {
+		responses = append(responses, relay.Responses(fmt.Sprint(i))...)
+	}
+	return responses
+}
+
+// slowBackend holds all requests but those for /fast until release is
+// closed, and records the peak number of concurrent requests it holds.
+type slowBackend struct {
+	*httptest.Server
+	release chan struct{}
+
+	mu           sync.Mutex
+	active, peak int
+}
+
+func newSlowBackend() *slowBackend {
+	b := &slowBackend{release: make(chan struct{})}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fast" {
+			w.Write([]byte("fast"))
+			return
+		}
+		b.mu.Lock()
+		b.active++
+		b.peak = max(b.peak, b.active)
+		b.mu.Unlock()
+		defer func() {
+			b.mu.Lock()
+			b.active--
+			b.mu.Unlock()
+		}()
+		select {
+		case <-b.release:
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("done"))
+	}))
+	return b
+}
+
+func (b *slowBackend) counts() (active, peak int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active, b.peak
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		t.Run(fmt.Sprintf("RejectWhenSaturated=%v", reject), func(t *testing.T) {
+			relay := newFloodRelay()
+			defer relay.Close()
+			backend := newSlowBackend()
+			defer backend.Close()
+			c := newDrainClient(relay.Server, backend.Server, 10*time.Second)
+			c.config.NumPendingRequests = 5
+			c.config.MaxConcurrentRequests = 3
+			c.config.RejectWhenSaturated = reject
+			c.limiter = newRequestLimiter(c.config.MaxConcurrentRequests, 0)
+
+			started := make(chan struct{})
+			go func() {
+				defer close(started)
+				c.Start()
+			}()
+			for start := time.Now(); ; time.Sleep(time.Millisecond) {
+				if active, _ := backend.counts(); active == 3 {
+					break
+				}
+				if time.Since(start) > 10*time.Second {
+					t.Fatal("Backend didn't get 3 requests")
+				}
+			}
+			// Give the workers time to exceed the limit, if they would.
+			time.Sleep(200 * time.Millisecond)
+			if _, peak := backend.counts(); peak != 3 {
+				t.Errorf("Backend handled %d requests concurrently, want 3", peak)
+			}
+			var rejected int
+			for _, resp := range floodResponses(relay) {
+				if resp.GetStatusCode() != http.StatusServiceUnavailable {
+					t.Errorf("Got response with status %d before the backend responded", resp.GetStatusCode())
+				}
+				rejected++
+			}
+			if reject && rejected == 0 {
+				t.Errorf("No request was rejected")
+			}
+			if !reject && rejected != 0 {
+				t.Errorf("%d requests were rejected, want none", rejected)
+			}
+
+			close(backend.release)
+			c.Stop()
+			select {
+			case <-started:
+			case <-time.After(10 * time.Second):
+				t.Fatal("Start() didn't return after Stop()")
+			}
+			if _, peak := backend.counts(); peak > 3 {
+				t.Errorf("Backend handled %d requests concurrently, want at most 3", peak)
+			}
+		})
+	}
+}
+
+func TestReservedPrioritySlots(t *testing.T) {
+	// The 4th request is high-priority, it's polled with the reserved slot
+	// once the 3rd request waits for a regular slot.
+	relay := newFloodRelay(4)
+	defer relay.Close()
+	backend := newSlowBackend()
+	defer backend.Close()
+	c := newDrainClient(relay.Server, backend.Server, 10*time.Second)
+	c.config.NumPendingRequests = 5
+	c.config.MaxConcurrentRequests = 2
+	c.config.ReservedPrioritySlots = 1
+	c.limiter = newRequestLimiter(c.config.MaxConcurrentRequests, c.config.ReservedPrioritySlots)
+
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		c.Start()
+	}()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if responses := relay.Responses("4"); len(responses) > 0 {
+			fast := responses[0]
+			if fast.GetStatusCode() != http.StatusOK || string(fast.Body) != "fast" {
+				t.Errorf("High-priority request got status %d and body %q, want 200 and %q", fast.GetStatusCode(), fast.Body, "fast")
+			}
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("High-priority request wasn't handled while at the concurrency limit")
+		}
+	}
+	// Low-priority requests never take the reserved slot.
+	time.Sleep(200 * time.Millisecond)
+	if active, peak := backend.counts(); active != 2 || peak != 2 {
+		t.Errorf("Backend holds %d requests with a peak of %d, want 2 and 2", active, peak)
+	}
+	for _, resp := range floodResponses(relay) {
+		if resp.GetId() != "4" {
+			t.Errorf("Got response to low-priority request %s at the concurrency limit", resp.GetId())
+		}
+	}
+
+	close(backend.release)
+	c.Stop()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Start() didn't return after Stop()")
+	}
+}
+
+func TestRequestLimiter(t *testing.T) {
+	l := newRequestLimiter(1, 1)
+	if reserved, ok := l.tryAcquire(false); !ok || reserved {
+		t.Fatalf("tryAcquire(false) = %v, %v, want a regular slot", reserved, ok)
+	}
+	if _, ok := l.tryAcquire(false); ok {
+		t.Fatalf("Low-priority request took the reserved slot")
+	}
+	if reserved, ok := l.tryAcquire(true); !ok || !reserved {
+		t.Fatalf("tryAcquire(true) = %v, %v, want the reserved slot", reserved, ok)
+	}
+	if _, ok := l.tryAcquire(true); ok {
+		t.Fatalf("tryAcquire(true) succeeded with all slots taken")
+	}
+	stop := make(chan struct{})
+	close(stop)
+	if _, ok := l.acquire(stop); ok {
+		t.Fatalf("acquire() succeeded with all slots taken")
+	}
+	l.release(true)
+	if reserved, ok := l.acquire(make(chan struct{})); !ok || !reserved {
+		t.Fatalf("acquire() = %v, %v, want the reserved slot", reserved, ok)
+	}
+	l.release(false)
+	l.release(true)
+}
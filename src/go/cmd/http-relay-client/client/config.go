@@ -0,0 +1,555 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/net/http/httpguts"
+	"sigs.k8s.io/yaml"
+)
+
+// configEnvPrefix is prepended to the upper-case field names to get the
+// environment variables that override the config file.
+const configEnvPrefix = "HTTP_RELAY_CLIENT_"
+
+// sizeFields are the ClientConfig fields holding a number of bytes (or bytes
+// per second). They accept sizes like "50KiB" in addition to plain numbers.
+var sizeFields = map[string]bool{
+	"MaxChunkSize":            true,
+	"BlockSize":               true,
+	"BatchMaxBytes":           true,
+	"MaxTrailerBytes":         true,
+	"MaxHeaderBytes":          true,
+	"MaxDecompressedBodySize": true,
+	"MaxUploadBytesPerSecond": true,
+	"RecordMaxFileBytes":      true,
+	"RecordMaxTotalBytes":     true,
+
+	"ResponseCacheMaxBytes":      true,
+	"ResponseCacheMaxEntryBytes": true,
+
+	"ResponseCompressionMinBytes": true,
+	"SpillThresholdBytes":         true,
+}
+
+var (
+	durationType     = reflect.TypeOf(time.Duration(0))
+	backendRouteType = reflect.TypeOf(BackendRoute{})
+	accessRuleType   = reflect.TypeOf(AccessRule{})
+	backendAuthType  = reflect.TypeOf(BackendAuth{})
+	stringMapType    = reflect.TypeOf(map[string]string{})
+)
+
+// LoadConfig returns the default config, overridden by the YAML file at path
+// (if path isn't empty) and then by the environment.
+//
+// The file uses the field names of ClientConfig in snake case, e.g.
+// server_name or max_idle_conns_per_host. Fields of ResponseRetryPolicy,
+// LogSampling and FaultInjection are nested under response_retry_policy,
+// log_sampling and fault_injection.
+// Durations are given as strings like "100ms", sizes as numbers of bytes or
+// strings like "50KiB". Backend routes, access rules and backend
+// authentications are lists of strings in the syntax of ParseBackendRoute,
+// ParseAccessRule and ParseBackendAuth. Unknown fields are an error.
+//
+// Each field can be overridden by the environment variable
+// HTTP_RELAY_CLIENT_<FIELD>, e.g. HTTP_RELAY_CLIENT_SERVER_NAME or
+// HTTP_RELAY_CLIENT_RESPONSE_RETRY_POLICY_MAX_RETRIES. Lists are separated by
+// commas, except for backend routes, access rules and backend
+// authentications, which contain commas themselves and are separated by
+// semicolons.
+//
+// LoadConfig doesn't validate the result, see Validate.
+func LoadConfig(path string) (ClientConfig, error) {
+	config := DefaultClientConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return ClientConfig{}, err
+		}
+		var values map[string]interface{}
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return ClientConfig{}, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := setConfigFields(reflect.ValueOf(&config).Elem(), values, ""); err != nil {
+			return ClientConfig{}, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := setConfigFromEnv(reflect.ValueOf(&config).Elem(), configEnvPrefix); err != nil {
+		return ClientConfig{}, err
+	}
+	return config, nil
+}
+
+// ConfigError is a problem with a ClientConfig, as reported by Validate.
+type ConfigError struct {
+	// Field is the name of the offending field, or of the first of the
+	// fields that contradict each other.
+	Field string
+	msg   string
+}
+
+func (e *ConfigError) Error() string {
+	return e.msg
+}
+
+// configErrorf returns a *ConfigError for field.
+func configErrorf(field, format string, a ...interface{}) error {
+	return &ConfigError{Field: field, msg: fmt.Sprintf(format, a...)}
+}
+
+// Validate checks for settings that are out of range or contradict each
+// other. It returns all problems joined into one error, each of them a
+// *ConfigError. NewClient fails and Start exits if the config isn't valid.
+func (c ClientConfig) Validate() error {
+	var errs []error
+	if c.ForceHttp2 && c.DisableHttp2 {
+		errs = append(errs, configErrorf("ForceHttp2", "ForceHttp2 and DisableHttp2 can't be used together"))
+	}
+	if c.BackendHttp2PriorKnowledge && !c.ForceHttp2 {
+		errs = append(errs, configErrorf("BackendHttp2PriorKnowledge", "BackendHttp2PriorKnowledge requires ForceHttp2"))
+	}
+	if c.MaxChunkSize <= 0 {
+		errs = append(errs, configErrorf("MaxChunkSize", "MaxChunkSize must be positive, not %d", c.MaxChunkSize))
+	}
+	if _, err := normalizeAddress(c.BackendAddress); err != nil {
+		errs = append(errs, configErrorf("BackendAddress", "BackendAddress: %v", err))
+	}
+	if _, err := normalizeAddress(c.RelayAddress); err != nil {
+		errs = append(errs, configErrorf("RelayAddress", "RelayAddress: %v", err))
+	}
+	for _, addr := range c.RelayAddresses {
+		if _, err := normalizeAddress(addr); err != nil {
+			errs = append(errs, configErrorf("RelayAddresses", "RelayAddresses: %v", err))
+		}
+	}
+	if c.RelayResolverAddress != "" {
+		if _, err := normalizeAddress(c.RelayResolverAddress); err != nil {
+			errs = append(errs, configErrorf("RelayResolverAddress", "RelayResolverAddress: %v", err))
+		}
+	}
+	if c.RelayHostOverride != "" {
+		if _, err := parseHostOverride(c.RelayHostOverride); err != nil {
+			errs = append(errs, configErrorf("RelayHostOverride", "RelayHostOverride must be an IP address, not %q", c.RelayHostOverride))
+		}
+	}
+	if c.BlockSize <= 0 {
+		errs = append(errs, configErrorf("BlockSize", "BlockSize must be positive, not %d", c.BlockSize))
+	}
+	if c.BlockSize > c.MaxChunkSize {
+		errs = append(errs, configErrorf("BlockSize", "BlockSize %d is larger than MaxChunkSize %d", c.BlockSize, c.MaxChunkSize))
+	}
+	if c.NumPendingRequests < 1 {
+		errs = append(errs, configErrorf("NumPendingRequests", "NumPendingRequests must be at least 1, not %d", c.NumPendingRequests))
+	}
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); f.Type() == durationType && f.Int() < 0 {
+			name := v.Type().Field(i).Name
+			errs = append(errs, configErrorf(name, "%s must not be negative, not %v", name, time.Duration(f.Int())))
+		}
+	}
+	if c.PreserveHost && c.BackendHostOverride != "" {
+		errs = append(errs, configErrorf("PreserveHost", "PreserveHost and BackendHostOverride can't be used together"))
+	}
+	if c.ResponseCacheMaxBytes > 0 && c.ResponseCacheMaxEntryBytes <= 0 {
+		errs = append(errs, configErrorf("ResponseCacheMaxEntryBytes", "ResponseCacheMaxEntryBytes must be positive if the response cache is enabled"))
+	}
+	for _, a := range c.BackendAuth {
+		if a.TokenFile == "" {
+			errs = append(errs, configErrorf("BackendAuth", "BackendAuth for %q has no TokenFile", a.PathPrefix))
+		}
+	}
+	if c.AccessLogPath != "" && c.AccessLogWriter != nil {
+		errs = append(errs, configErrorf("AccessLogPath", "AccessLogPath and AccessLogWriter can't be used together"))
+	}
+	if len(c.BackendDialCommand) > 0 && c.BackendDialCommand[0] == "" {
+		errs = append(errs, configErrorf("BackendDialCommand", "BackendDialCommand must start with the command to run"))
+	}
+	if c.ReservedPrioritySlots < 0 || c.ReservedPrioritySlots > 0 && c.MaxConcurrentRequests <= 0 {
+		errs = append(errs, configErrorf("ReservedPrioritySlots", "ReservedPrioritySlots must not be negative, and requires MaxConcurrentRequests, not %d", c.ReservedPrioritySlots))
+	}
+	if c.LogSampling.First < 0 || c.LogSampling.Interval < 0 {
+		errs = append(errs, configErrorf("LogSampling", "LogSampling must not be negative, not %+v", c.LogSampling))
+	}
+	if f := c.FaultInjection; f.DelayBackendMs < 0 ||
+		!validPercent(f.DropResponsePercent) || !validPercent(f.FailPollPercent) || !validPercent(f.CorruptChunkPercent) {
+		errs = append(errs, configErrorf("FaultInjection", "FaultInjection needs percentages from 0 to 100 and a non-negative delay, not %+v", c.FaultInjection))
+	}
+	if c.StartupMaxInterval <= 0 {
+		errs = append(errs, configErrorf("StartupMaxInterval", "StartupMaxInterval must be positive, not %v", c.StartupMaxInterval))
+	}
+	if c.MaxChunksInFlight < 1 {
+		errs = append(errs, configErrorf("MaxChunksInFlight", "MaxChunksInFlight must be at least 1, not %d", c.MaxChunksInFlight))
+	}
+	if c.SpillThresholdBytes < 0 {
+		errs = append(errs, configErrorf("SpillThresholdBytes", "SpillThresholdBytes must not be negative, not %d", c.SpillThresholdBytes))
+	}
+	if c.RelayPrefix != "" && (!strings.HasPrefix(c.RelayPrefix, "/") || strings.HasSuffix(c.RelayPrefix, "/")) {
+		errs = append(errs, configErrorf("RelayPrefix", "RelayPrefix %q must start with a slash and not end with one", c.RelayPrefix))
+	}
+	if len(c.RelayAddresses) > 1 && c.RelayFailoverThreshold <= 0 {
+		errs = append(errs, configErrorf("RelayFailoverThreshold", "RelayFailoverThreshold must be positive with several RelayAddresses"))
+	}
+	if c.ErrorResponseFormat != errorFormatText && c.ErrorResponseFormat != errorFormatProblemJSON {
+		errs = append(errs, configErrorf("ErrorResponseFormat", "ErrorResponseFormat must be %q or %q, not %q",
+			errorFormatText, errorFormatProblemJSON, c.ErrorResponseFormat))
+	}
+	switch c.IntegrityChecks {
+	case integrityOff, integrityVerify, integrityVerifyAndSign:
+	default:
+		errs = append(errs, configErrorf("IntegrityChecks", "IntegrityChecks must be %q, %q or %q, not %q",
+			integrityOff, integrityVerify, integrityVerifyAndSign, c.IntegrityChecks))
+	}
+	for _, codec := range c.ResponseCodecs {
+		if _, ok := bodyEncoders[codec]; !ok {
+			errs = append(errs, configErrorf("ResponseCodecs", "unsupported codec %q in ResponseCodecs", codec))
+		}
+	}
+	if len(c.ForwardClientCertInfo) > 0 && c.ClientCertHeader == "" {
+		errs = append(errs, configErrorf("ClientCertHeader", "ClientCertHeader must not be empty if ForwardClientCertInfo is set"))
+	}
+	if err := checkBackendHeaders(c.BackendHeaderAdditions, c.BackendHeaderRemovals); err != nil {
+		errs = append(errs, configErrorf("BackendHeaderAdditions", "BackendHeaderAdditions or BackendHeaderRemovals: %v", err))
+	}
+	if err := c.ResponseRetryPolicy.validate(); err != nil {
+		errs = append(errs, configErrorf("ResponseRetryPolicy", "ResponseRetryPolicy: %v", err))
+	}
+	if _, err := compileAccessRules(c.Rules); err != nil {
+		errs = append(errs, configErrorf("Rules", "Rules: %v", err))
+	}
+	if err := checkClientCertInfo(c.ForwardClientCertInfo); err != nil {
+		errs = append(errs, configErrorf("ForwardClientCertInfo", "ForwardClientCertInfo: %v", err))
+	}
+	if err := checkRelayAuth(c); err != nil {
+		errs = append(errs, configErrorf("RelayIDTokenAudience", "relay authentication: %v", err))
+	}
+	if err := checkBackendTLS(c); err != nil {
+		errs = append(errs, configErrorf("BackendTLSInsecureSkipVerify", "BackendTLSInsecureSkipVerify: %v", err))
+	}
+	for _, name := range c.BackendHeaderCase {
+		if !httpguts.ValidHeaderFieldName(name) {
+			errs = append(errs, configErrorf("BackendHeaderCase", "invalid header name %q in BackendHeaderCase", name))
+		}
+	}
+	if c.ServerName == "" {
+		errs = append(errs, configErrorf("ServerName", "ServerName must not be empty"))
+	}
+	if (c.EnablePprof || c.HealthTokenFile != "") && c.HealthAddress == "" {
+		errs = append(errs, configErrorf("HealthAddress", "HealthAddress must be set for EnablePprof or HealthTokenFile"))
+	}
+	if c.HealthAddress != "" && healthListenAddress(c.HealthAddress) == healthListenAddress(c.BackendAddress) {
+		errs = append(errs, configErrorf("HealthAddress", "HealthAddress %s is the BackendAddress, which would expose it to relayed requests", c.HealthAddress))
+	}
+	return errors.Join(errs...)
+}
+
+// configKey returns the name of a ClientConfig field in the config file, or
+// "" if the field can't be configured.
+func configKey(f reflect.StructField) string {
+	if f.Type.Kind() == reflect.Func || f.Type.Kind() == reflect.Interface || !f.IsExported() {
+		return ""
+	}
+	return snakeCase(f.Name)
+}
+
+// snakeCase converts a Go identifier to snake case, keeping initialisms
+// together: RootCAFile becomes root_ca_file, ForceHttp2 becomes force_http2.
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) ||
+				i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// setConfigFields sets the fields of the struct v from the values decoded
+// from the config file. prefix is the key of v itself, for error messages.
+func setConfigFields(v reflect.Value, values map[string]interface{}, prefix string) error {
+	fields := map[string]int{}
+	for i := 0; i < v.NumField(); i++ {
+		if key := configKey(v.Type().Field(i)); key != "" {
+			fields[key] = i
+		}
+	}
+	for key, raw := range values {
+		i, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("unknown field %q", prefix+key)
+		}
+		f := v.Field(i)
+		name := v.Type().Field(i).Name
+		if f.Kind() == reflect.Struct {
+			nested, ok := raw.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s: expected a mapping, got %v", prefix+key, raw)
+			}
+			if err := setConfigFields(f, nested, prefix+key+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := setConfigValue(f, name, raw); err != nil {
+			return fmt.Errorf("%s: %v", prefix+key, err)
+		}
+	}
+	return nil
+}
+
+// setConfigFromEnv overrides the fields of the struct v from the environment
+// variables starting with prefix.
+func setConfigFromEnv(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		key := configKey(v.Type().Field(i))
+		if key == "" {
+			continue
+		}
+		env := prefix + strings.ToUpper(key)
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			if err := setConfigFromEnv(f, env+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if err := setConfigValue(f, v.Type().Field(i).Name, s); err != nil {
+			return fmt.Errorf("%s: %v", env, err)
+		}
+	}
+	return nil
+}
+
+// setConfigValue sets the field f from raw, which is either a value decoded
+// from YAML or a string from the environment.
+func setConfigValue(f reflect.Value, name string, raw interface{}) error {
+	switch {
+	case f.Type() == durationType:
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("expected a duration like \"10s\", got %v", raw)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+	case f.Kind() == reflect.Bool:
+		switch b := raw.(type) {
+		case bool:
+			f.SetBool(b)
+		case string:
+			v, err := strconv.ParseBool(b)
+			if err != nil {
+				return err
+			}
+			f.SetBool(v)
+		default:
+			return fmt.Errorf("expected a boolean, got %v", raw)
+		}
+	case f.Kind() == reflect.Int || f.Kind() == reflect.Int64:
+		n, err := configInt(raw, sizeFields[name])
+		if err != nil {
+			return err
+		}
+		if f.OverflowInt(n) {
+			return fmt.Errorf("%d is out of range", n)
+		}
+		f.SetInt(n)
+	case f.Kind() == reflect.Float64:
+		switch n := raw.(type) {
+		case float64:
+			f.SetFloat(n)
+		case string:
+			v, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return err
+			}
+			f.SetFloat(v)
+		default:
+			return fmt.Errorf("expected a number, got %v", raw)
+		}
+	case f.Kind() == reflect.String:
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %v", raw)
+		}
+		f.SetString(s)
+	case f.Kind() == reflect.Slice:
+		items, err := configList(raw, f.Type().Elem())
+		if err != nil {
+			return err
+		}
+		list := reflect.MakeSlice(f.Type(), 0, len(items))
+		for _, s := range items {
+			var item interface{} = s
+			switch f.Type().Elem() {
+			case backendRouteType:
+				if item, err = ParseBackendRoute(s); err != nil {
+					return err
+				}
+			case accessRuleType:
+				if item, err = ParseAccessRule(s); err != nil {
+					return err
+				}
+			case backendAuthType:
+				if item, err = ParseBackendAuth(s); err != nil {
+					return err
+				}
+			}
+			list = reflect.Append(list, reflect.ValueOf(item))
+		}
+		f.Set(list)
+	case f.Type() == stringMapType:
+		m, err := configMap(raw)
+		if err != nil {
+			return err
+		}
+		f.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %v", f.Type())
+	}
+	return nil
+}
+
+// configInt returns the integer in raw. If size is set, strings with a unit
+// like "50KiB" are accepted too.
+func configInt(raw interface{}, size bool) (int64, error) {
+	switch n := raw.(type) {
+	case float64:
+		if n != float64(int64(n)) {
+			return 0, fmt.Errorf("expected an integer, got %v", n)
+		}
+		return int64(n), nil
+	case string:
+		if size {
+			return parseSize(n)
+		}
+		return strconv.ParseInt(n, 10, 64)
+	}
+	return 0, fmt.Errorf("expected an integer, got %v", raw)
+}
+
+// configList returns the strings in raw, which is either a YAML sequence or a
+// separated list from the environment.
+func configList(raw interface{}, elem reflect.Type) ([]string, error) {
+	switch l := raw.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(l))
+		for _, item := range l {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a list of strings, got %v", item)
+			}
+			items = append(items, s)
+		}
+		return items, nil
+	case string:
+		if l == "" {
+			return nil, nil
+		}
+		sep := ","
+		if elem != reflect.TypeOf("") {
+			sep = ";"
+		}
+		return strings.Split(l, sep), nil
+	}
+	return nil, fmt.Errorf("expected a list, got %v", raw)
+}
+
+// configMap returns the string map in raw, which is either a YAML mapping or
+// a comma-separated list of KEY=VALUE pairs from the environment.
+func configMap(raw interface{}) (map[string]string, error) {
+	m := map[string]string{}
+	switch l := raw.(type) {
+	case map[string]interface{}:
+		for k, v := range l {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string for %s, got %v", k, v)
+			}
+			m[k] = s
+		}
+		return m, nil
+	case string:
+		if l == "" {
+			return nil, nil
+		}
+		for _, pair := range strings.Split(l, ",") {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("expected KEY=VALUE, got %q", pair)
+			}
+			m[k] = v
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("expected a mapping, got %v", raw)
+}
+
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	// Longer suffixes first, so "KiB" isn't taken for "B".
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// parseSize parses a number of bytes with an optional unit, e.g. "1024",
+// "50KiB" or "1MB".
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSpace(s)
+	factor := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, factor = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/factor || n < math.MinInt64/factor {
+		return 0, fmt.Errorf("size %q is out of range", s)
+	}
+	return n * factor, nil
+}
@@ -0,0 +1,345 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+server_name: robot-1
+backend_address: localhost:9090
+force_http2: true
+relay_post_timeout: 100ms
+max_chunk_size: 64KiB
+block_size: 1024
+max_decompressed_body_size: 2MiB
+relay_auth_scopes: [a, b]
+backend_header_additions:
+  X-Robot-Id: "{hostname}"
+backend_routes:
+- /api/,cert.pem,key.pem
+rules:
+- deny,GET|POST,/secret/*
+backend_auth:
+- /jobs/,jwt,X-Api-Key
+response_retry_policy:
+  max_retries: 3
+  randomization_factor: 0.1
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultClientConfig()
+	if config.ServerName != "robot-1" || config.BackendAddress != "localhost:9090" || !config.ForceHttp2 {
+		t.Errorf("Scalar fields not set: %+v", config)
+	}
+	if config.RelayPostTimeout != 100*time.Millisecond {
+		t.Errorf("RelayPostTimeout = %v, want 100ms", config.RelayPostTimeout)
+	}
+	if config.MaxChunkSize != 64<<10 || config.BlockSize != 1024 || config.MaxDecompressedBodySize != 2<<20 {
+		t.Errorf("Sizes = %d, %d, %d, want %d, 1024, %d",
+			config.MaxChunkSize, config.BlockSize, config.MaxDecompressedBodySize, 64<<10, 2<<20)
+	}
+	if strings.Join(config.RelayAuthScopes, ",") != "a,b" {
+		t.Errorf("RelayAuthScopes = %v, want [a b]", config.RelayAuthScopes)
+	}
+	if config.BackendHeaderAdditions["X-Robot-Id"] != "{hostname}" {
+		t.Errorf("BackendHeaderAdditions = %v, want X-Robot-Id: {hostname}", config.BackendHeaderAdditions)
+	}
+	if len(config.BackendRoutes) != 1 || config.BackendRoutes[0].PathPrefix != "/api/" {
+		t.Errorf("BackendRoutes = %+v", config.BackendRoutes)
+	}
+	if len(config.Rules) != 1 || config.Rules[0].PathPattern != "/secret/*" {
+		t.Errorf("Rules = %+v", config.Rules)
+	}
+	if len(config.BackendAuth) != 1 || config.BackendAuth[0].Header != "X-Api-Key" {
+		t.Errorf("BackendAuth = %+v", config.BackendAuth)
+	}
+	if config.ResponseRetryPolicy.MaxRetries != 3 || config.ResponseRetryPolicy.RandomizationFactor != 0.1 {
+		t.Errorf("ResponseRetryPolicy = %+v", config.ResponseRetryPolicy)
+	}
+	if config.ResponseRetryPolicy.InitialInterval != want.ResponseRetryPolicy.InitialInterval {
+		t.Errorf("InitialInterval = %v, want default %v",
+			config.ResponseRetryPolicy.InitialInterval, want.ResponseRetryPolicy.InitialInterval)
+	}
+	if config.NumPendingRequests != want.NumPendingRequests {
+		t.Errorf("NumPendingRequests = %d, want default %d", config.NumPendingRequests, want.NumPendingRequests)
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	path := writeConfig(t, "server_name: from-file\nmax_chunk_size: 1024\n")
+	t.Setenv("HTTP_RELAY_CLIENT_SERVER_NAME", "from-env")
+	t.Setenv("HTTP_RELAY_CLIENT_BLOCK_SIZE", "10KiB")
+	t.Setenv("HTTP_RELAY_CLIENT_DISABLE_HTTP2", "true")
+	t.Setenv("HTTP_RELAY_CLIENT_REDACTED_HEADERS", "X-A,X-B")
+	t.Setenv("HTTP_RELAY_CLIENT_RESPONSE_RETRY_POLICY_MAX_INTERVAL", "3s")
+	t.Setenv("HTTP_RELAY_CLIENT_RULES", "deny,,/a;allow,,/b")
+	t.Setenv("HTTP_RELAY_CLIENT_BACKEND_HEADER_ADDITIONS", "X-A=1,X-B={server_name}")
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServerName != "from-env" {
+		t.Errorf("ServerName = %q, want from-env", config.ServerName)
+	}
+	if config.MaxChunkSize != 1024 || config.BlockSize != 10<<10 {
+		t.Errorf("MaxChunkSize, BlockSize = %d, %d, want 1024, %d", config.MaxChunkSize, config.BlockSize, 10<<10)
+	}
+	if !config.DisableHttp2 {
+		t.Error("DisableHttp2 not set from the environment")
+	}
+	if strings.Join(config.RedactedHeaders, ",") != "X-A,X-B" {
+		t.Errorf("RedactedHeaders = %v, want [X-A X-B]", config.RedactedHeaders)
+	}
+	if config.ResponseRetryPolicy.MaxInterval != 3*time.Second {
+		t.Errorf("MaxInterval = %v, want 3s", config.ResponseRetryPolicy.MaxInterval)
+	}
+	if len(config.Rules) != 2 || config.Rules[1].PathPattern != "/b" {
+		t.Errorf("Rules = %+v", config.Rules)
+	}
+	if len(config.BackendHeaderAdditions) != 2 || config.BackendHeaderAdditions["X-B"] != "{server_name}" {
+		t.Errorf("BackendHeaderAdditions = %v", config.BackendHeaderAdditions)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		desc    string
+		content string
+		want    string
+	}{
+		{"unknown field", "server_nmae: foo\n", `unknown field "server_nmae"`},
+		{"unknown nested field", "response_retry_policy:\n  retries: 3\n", `unknown field "response_retry_policy.retries"`},
+		{"hooks are not configurable", "request_hook: foo\n", `unknown field "request_hook"`},
+		{"duration without unit", "drain_timeout: 10\n", "drain_timeout"},
+		{"invalid size", "block_size: 10XB\n", "invalid size"},
+		{"fractional int", "num_pending_requests: 1.5\n", "expected an integer"},
+		{"size unit on plain int", "num_pending_requests: 1KiB\n", "num_pending_requests"},
+		{"invalid rule", "rules: [deny]\n", "rules"},
+		{"wrong type", "force_http2: [true]\n", "expected a boolean"},
+		{"invalid yaml", "server_name: [\n", "config.yaml"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, tc.content))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("LoadConfig() = %v, want error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	t.Setenv("HTTP_RELAY_CLIENT_NUM_PENDING_REQUESTS", "7")
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.NumPendingRequests != 7 {
+		t.Errorf("NumPendingRequests = %d, want 7", config.NumPendingRequests)
+	}
+
+	t.Setenv("HTTP_RELAY_CLIENT_NUM_PENDING_REQUESTS", "seven")
+	if _, err := LoadConfig(""); err == nil || !strings.Contains(err.Error(), "HTTP_RELAY_CLIENT_NUM_PENDING_REQUESTS") {
+		t.Errorf("LoadConfig() = %v, want error naming the variable", err)
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	for name, want := range map[string]string{
+		"ServerName":                   "server_name",
+		"RootCAFile":                   "root_ca_file",
+		"ForceHttp2":                   "force_http2",
+		"RelayIDTokenAudience":         "relay_id_token_audience",
+		"BackendTLSInsecureSkipVerify": "backend_tls_insecure_skip_verify",
+		"MaxIdleConnsPerHost":          "max_idle_conns_per_host",
+	} {
+		if got := snakeCase(name); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := DefaultClientConfig().Validate(); err != nil {
+		t.Errorf("Default config is invalid: %v", err)
+	}
+
+	config := DefaultClientConfig()
+	config.ForceHttp2 = true
+	config.DisableHttp2 = true
+	config.BlockSize = config.MaxChunkSize + 1
+	config.ServerName = ""
+	config.BackendHostOverride = "kubernetes.default.svc"
+	config.ErrorResponseFormat = "html"
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Validate() = nil, want error")
+	}
+	for _, want := range []string{"ForceHttp2", "BlockSize", "ServerName", "BackendHostOverride", "ErrorResponseFormat"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want it to mention %s", err, want)
+		}
+	}
+	want := []string{"ForceHttp2", "BlockSize", "PreserveHost", "ErrorResponseFormat", "ServerName"}
+	if got := configErrorFields(err); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Validate() reported fields %v, want %v", got, want)
+	}
+}
+
+// configErrorFields returns the fields of the *ConfigErrors joined in err.
+func configErrorFields(err error) []string {
+	var fields []string
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var cerr *ConfigError
+		if errors.As(err, &cerr) {
+			fields = append(fields, cerr.Field)
+		}
+	}
+	return fields
+}
+
+func TestValidateRules(t *testing.T) {
+	tests := []struct {
+		desc   string
+		modify func(*ClientConfig)
+		field  string
+	}{
+		{"http2", func(c *ClientConfig) { c.ForceHttp2, c.DisableHttp2 = true, true }, "ForceHttp2"},
+		{"prior knowledge", func(c *ClientConfig) { c.BackendHttp2PriorKnowledge = true }, "BackendHttp2PriorKnowledge"},
+		{"chunk size", func(c *ClientConfig) { c.MaxChunkSize, c.BlockSize = 0, 0 }, "MaxChunkSize"},
+		{"block size", func(c *ClientConfig) { c.BlockSize = -1 }, "BlockSize"},
+		{"block larger than chunk", func(c *ClientConfig) { c.BlockSize = c.MaxChunkSize + 1 }, "BlockSize"},
+		{"pending requests", func(c *ClientConfig) { c.NumPendingRequests = 0 }, "NumPendingRequests"},
+		{"negative timeout", func(c *ClientConfig) { c.RelayPollTimeout = -time.Second }, "RelayPollTimeout"},
+		{"negative interval", func(c *ClientConfig) { c.TLSReloadInterval = -time.Second }, "TLSReloadInterval"},
+		{"host", func(c *ClientConfig) { c.BackendHostOverride = "example.com" }, "PreserveHost"},
+		{"cache", func(c *ClientConfig) { c.ResponseCacheMaxBytes, c.ResponseCacheMaxEntryBytes = 1, 0 }, "ResponseCacheMaxEntryBytes"},
+		{"chunks in flight", func(c *ClientConfig) { c.MaxChunksInFlight = 0 }, "MaxChunksInFlight"},
+		{"spill threshold", func(c *ClientConfig) { c.SpillThresholdBytes = -1 }, "SpillThresholdBytes"},
+		{"startup interval", func(c *ClientConfig) { c.StartupMaxInterval = 0 }, "StartupMaxInterval"},
+		{"access log", func(c *ClientConfig) { c.AccessLogPath, c.AccessLogWriter = "access.log", io.Discard }, "AccessLogPath"},
+		{"prefix without leading slash", func(c *ClientConfig) { c.RelayPrefix = "relay" }, "RelayPrefix"},
+		{"prefix with trailing slash", func(c *ClientConfig) { c.RelayPrefix = "/relay/" }, "RelayPrefix"},
+		{"ipv6 backend without port", func(c *ClientConfig) { c.BackendAddress = "fd00::1" }, "BackendAddress"},
+		{"relay port", func(c *ClientConfig) { c.RelayAddress = "relay.example.com:" }, "RelayAddress"},
+		{"failover address", func(c *ClientConfig) { c.RelayAddresses = []string{"a", "fe80::1%eth0"} }, "RelayAddresses"},
+		{"failover", func(c *ClientConfig) { c.RelayAddresses = []string{"a", "b"}; c.RelayFailoverThreshold = 0 }, "RelayFailoverThreshold"},
+		{"error format", func(c *ClientConfig) { c.ErrorResponseFormat = "html" }, "ErrorResponseFormat"},
+		{"integrity checks", func(c *ClientConfig) { c.IntegrityChecks = "sign" }, "IntegrityChecks"},
+		{"relay resolver", func(c *ClientConfig) { c.RelayResolverAddress = "10.0.0.53:dns" }, "RelayResolverAddress"},
+		{"relay host override", func(c *ClientConfig) { c.RelayHostOverride = "relay.example.com" }, "RelayHostOverride"},
+		{"codec", func(c *ClientConfig) { c.ResponseCodecs = []string{"br"} }, "ResponseCodecs"},
+		{"client cert header", func(c *ClientConfig) { c.ClientCertHeader = "" }, "ClientCertHeader"},
+		{"header", func(c *ClientConfig) { c.BackendHeaderRemovals = []string{"Host"} }, "BackendHeaderAdditions"},
+		{"header case", func(c *ClientConfig) { c.BackendHeaderCase = []string{"SOAP Action"} }, "BackendHeaderCase"},
+		{"log sampling", func(c *ClientConfig) { c.LogSampling.First = -1 }, "LogSampling"},
+		{"fault percentage", func(c *ClientConfig) { c.FaultInjection.FailPollPercent = 101 }, "FaultInjection"},
+		{"fault delay", func(c *ClientConfig) { c.FaultInjection.DelayBackendMs = -1 }, "FaultInjection"},
+		{"dial command", func(c *ClientConfig) { c.BackendDialCommand = []string{"", "-W"} }, "BackendDialCommand"},
+		{"reserved slots", func(c *ClientConfig) { c.ReservedPrioritySlots = 1 }, "ReservedPrioritySlots"},
+		{"server name", func(c *ClientConfig) { c.ServerName = "" }, "ServerName"},
+		{"retry policy", func(c *ClientConfig) { c.ResponseRetryPolicy.InitialInterval = 0 }, "ResponseRetryPolicy"},
+		{"access rule", func(c *ClientConfig) { c.Rules = []AccessRule{{PathPattern: "/api/*", Action: "block"}} }, "Rules"},
+		{"client cert info", func(c *ClientConfig) { c.ForwardClientCertInfo = []string{"Chain"} }, "ForwardClientCertInfo"},
+		{"relay auth", func(c *ClientConfig) {
+			c.RelayIDTokenAudience, c.RelayAuthScopes = "https://relay.example.com", []string{"scope"}
+		}, "RelayIDTokenAudience"},
+		{"backend tls", func(c *ClientConfig) { c.BackendTLSInsecureSkipVerify, c.RootCAFile = true, "ca.pem" }, "BackendTLSInsecureSkipVerify"},
+		{"pprof", func(c *ClientConfig) { c.EnablePprof = true }, "HealthAddress"},
+		{"health on backend", func(c *ClientConfig) { c.HealthAddress = c.BackendAddress }, "HealthAddress"},
+		{"backend auth", func(c *ClientConfig) { c.BackendAuth = []BackendAuth{{PathPrefix: "/api/"}} }, "BackendAuth"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			tc.modify(&config)
+			err := config.Validate()
+			var cerr *ConfigError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("Validate() = %v, want a *ConfigError", err)
+			}
+			if cerr.Field != tc.field {
+				t.Errorf("Validate() reported field %s, want %s: %v", cerr.Field, tc.field, err)
+			}
+		})
+	}
+
+	config := DefaultClientConfig()
+	config.RelayPrefix = "/relay"
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate() with RelayPrefix /relay = %v, want nil", err)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	if c, err := NewClient(DefaultClientConfig()); c == nil || err != nil {
+		t.Errorf("NewClient(DefaultClientConfig()) = %v, %v, want client", c, err)
+	}
+
+	config := DefaultClientConfig()
+	config.ServerName = ""
+	config.RelayPrefix = "relay"
+	c, err := NewClient(config)
+	if c != nil || err == nil {
+		t.Fatalf("NewClient() = %v, %v, want error", c, err)
+	}
+	if got := configErrorFields(err); strings.Join(got, ",") != "RelayPrefix,ServerName" {
+		t.Errorf("NewClient() reported fields %v, want RelayPrefix and ServerName", got)
+	}
+	if NewClientUnchecked(config) == nil {
+		t.Error("NewClientUnchecked() = nil, want client")
+	}
+}
+
+func TestRemoteRequestTimeoutReplacesRelayTimeouts(t *testing.T) {
+	config := DefaultClientConfig()
+	config.RemoteRequestTimeout = 5 * time.Second
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.config.RelayPollTimeout != 5*time.Second || c.config.RelayPostTimeout != 5*time.Second {
+		t.Errorf("RelayPollTimeout, RelayPostTimeout = %v, %v, want 5s", c.config.RelayPollTimeout, c.config.RelayPostTimeout)
+	}
+
+	c, err = NewClient(DefaultClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.config.RelayPollTimeout != 60*time.Second || c.config.RelayPostTimeout != 60*time.Second {
+		t.Errorf("RelayPollTimeout, RelayPostTimeout = %v, %v, want the defaults", c.config.RelayPollTimeout, c.config.RelayPostTimeout)
+	}
+}
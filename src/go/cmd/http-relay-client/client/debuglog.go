@@ -0,0 +1,66 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// debugLogs returns true if debug logging is enabled, see DebugLogging.
+func (c *Client) debugLogs() bool {
+	return c.debugLogging.Load()
+}
+
+// SetDebugLogging enables or disables debug logging at runtime, overriding
+// DebugLogging. It's safe to call while requests are relayed.
+func (c *Client) SetDebugLogging(enabled bool) {
+	if c.debugLogging.Swap(enabled) != enabled {
+		slog.Info("Debug logging changed", slog.Bool("Enabled", enabled))
+	}
+}
+
+// DebugLogging returns true if debug logging is currently enabled.
+func (c *Client) DebugLogging() bool {
+	return c.debugLogs()
+}
+
+// debugLoggingState is the body of /debug/logging requests and responses.
+type debugLoggingState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// debugLoggingHandler serves /debug/logging on the health listener. GET
+// returns whether debug logging is enabled, POST with a body like
+// {"enabled":true} changes it.
+func (c *Client) debugLoggingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var state debugLoggingState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(w, "Invalid body, want {\"enabled\":true|false}: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.SetDebugLogging(state.Enabled)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(debugLoggingState{Enabled: c.debugLogs()})
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDebugLoggingIsPerClient(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	quiet := newClient(DefaultClientConfig())
+	config := DefaultClientConfig()
+	config.DebugLogging = true
+	verbose := newClient(config)
+
+	for _, c := range []*Client{quiet, verbose} {
+		logs.Reset()
+		if _, err := c.createBackendRequest(&pb.HttpRequest{
+			Id:     proto.String("15"),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid/foo"),
+		}); err != nil {
+			t.Fatalf("createBackendRequest() failed: %v", err)
+		}
+		dumped := strings.Contains(logs.String(), "DumpRequest")
+		if want := c == verbose; dumped != want {
+			t.Errorf("DebugLogging=%v: request dumped: %v, want %v", c.DebugLogging(), dumped, want)
+		}
+	}
+
+	verbose.SetDebugLogging(false)
+	if verbose.DebugLogging() || quiet.DebugLogging() {
+		t.Errorf("Debug logging still enabled after SetDebugLogging(false)")
+	}
+}
+
+func TestDebugLoggingHandler(t *testing.T) {
+	c := newClient(DefaultClientConfig())
+	h := c.healthHandler()
+
+	tests := []struct {
+		desc        string
+		method      string
+		body        string
+		wantStatus  int
+		wantBody    string
+		wantEnabled bool
+	}{
+		{"get", "GET", "", http.StatusOK, `{"enabled":false}`, false},
+		{"enable", "POST", `{"enabled":true}`, http.StatusOK, `{"enabled":true}`, true},
+		{"get enabled", "GET", "", http.StatusOK, `{"enabled":true}`, true},
+		{"invalid body", "POST", `enabled`, http.StatusBadRequest, "", true},
+		{"wrong method", "PUT", `{"enabled":false}`, http.StatusMethodNotAllowed, "", true},
+		{"disable", "POST", `{"enabled":false}`, http.StatusOK, `{"enabled":false}`, false},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, "/debug/logging", strings.NewReader(tc.body)))
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tc.desc, rec.Code, tc.wantStatus)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); tc.wantBody != "" && got != tc.wantBody {
+			t.Errorf("%s: body = %s, want %s", tc.desc, got, tc.wantBody)
+		}
+		if c.DebugLogging() != tc.wantEnabled {
+			t.Errorf("%s: DebugLogging() = %v, want %v", tc.desc, c.DebugLogging(), tc.wantEnabled)
+		}
+	}
+}
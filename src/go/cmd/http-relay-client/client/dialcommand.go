@@ -0,0 +1,115 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// requestIDKey is the context key of the ID of the request a backend
+// connection is dialed for.
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// dialBackend connects to the backend at addr, or runs the
+// BackendDialCommand for it, see dialBackendCommand.
+func (c *Client) dialBackend(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(c.config.BackendDialCommand) > 0 {
+		return c.dialBackendCommand(ctx)
+	}
+	dialer := &net.Dialer{
+		Timeout:   c.config.BackendDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// dialBackendCommand starts the BackendDialCommand with one end of a socket
+// pair as its stdin and stdout, and returns the other end, like ProxyCommand
+// of OpenSSH. Closing the connection kills the command. The command's stderr
+// is logged with the ID of the request the connection was dialed for.
+func (c *Client) dialBackendCommand(ctx context.Context) (net.Conn, error) {
+	// The socket pair must not leak into commands started concurrently
+	// before it's marked close-on-exec, see syscall.ForkLock.
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket pair for backend dial command: %w", err)
+	}
+	local := os.NewFile(uintptr(fds[0]), "backend-dial-command")
+	remote := os.NewFile(uintptr(fds[1]), "backend-dial-command")
+	defer remote.Close()
+	conn, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	args := c.config.BackendDialCommand
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = remote
+	cmd.Stdout = remote
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start backend dial command: %w", err)
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			slog.Warn("Backend dial command",
+				slog.String("ID", id), slog.String("Stderr", scanner.Text()))
+		}
+		// Reaps the command once it has exited.
+		cmd.Wait()
+	}()
+	return &commandConn{Conn: conn, process: cmd.Process}, nil
+}
+
+// commandConn is a connection to a BackendDialCommand, which is killed when
+// the connection is closed.
+type commandConn struct {
+	net.Conn
+	process *os.Process
+	once    sync.Once
+}
+
+func (c *commandConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.process.Kill() })
+	return err
+}
@@ -0,0 +1,227 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/proto"
+)
+
+// dialHelperEnv makes the test binary act as a dial command that forwards
+// its stdin and stdout to the address in it, like ssh -W.
+const dialHelperEnv = "BACKEND_DIAL_HELPER_ADDR"
+
+func TestDialCommandHelper(t *testing.T) {
+	addr := os.Getenv(dialHelperEnv)
+	if addr == "" {
+		t.Skip("Only run as dial command")
+	}
+	fmt.Fprintf(os.Stderr, "connecting to %s\n", addr)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+// helperDialCommand returns a BackendDialCommand that runs
+// TestDialCommandHelper to forward connections to addr.
+func helperDialCommand(t *testing.T, addr string) []string {
+	t.Setenv(dialHelperEnv, addr)
+	return []string{os.Args[0], "-test.run=^TestDialCommandHelper$"}
+}
+
+// catHelperEnv makes the test binary act as a dial command that echoes its
+// stdin to its stdout, like cat.
+const catHelperEnv = "BACKEND_DIAL_CAT_HELPER"
+
+func TestDialCommandCatHelper(t *testing.T) {
+	if os.Getenv(catHelperEnv) == "" {
+		t.Skip("Only run as dial command")
+	}
+	io.Copy(os.Stdout, os.Stdin)
+	os.Exit(0)
+}
+
+// catDialCommand returns a BackendDialCommand that runs
+// TestDialCommandCatHelper to echo what's written to the connection.
+func catDialCommand(t *testing.T) []string {
+	t.Setenv(catHelperEnv, "1")
+	return []string{os.Args[0], "-test.run=^TestDialCommandCatHelper$"}
+}
+
+// syncBuffer is a bytes.Buffer that can be read while logs are written to
+// it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestBackendDialCommand(t *testing.T) {
+	tests := []struct {
+		desc       string
+		forceHttp2 bool
+		wantProto  string
+	}{
+		{"HTTP/1.1", false, "HTTP/1.1"},
+		{"h2c", true, "HTTP/2.0"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			logs := &syncBuffer{}
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+
+			backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "%s %s", r.Proto, r.Host)
+			}), &http2.Server{}))
+			defer backend.Close()
+			relay := newRecordingRelay()
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			// Not resolvable, so requests only reach the backend through the
+			// command.
+			config.BackendAddress = "backend.invalid:8080"
+			config.BackendDialCommand = helperDialCommand(t, backend.Listener.Addr().String())
+			config.ForceHttp2 = tc.forceHttp2
+			client := newClient(config)
+			local := client.newLocalClient(nil)
+			defer local.CloseIdleConnections()
+
+			client.handleRequest(&http.Client{}, local, &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+
+			received := relay.responses("15")
+			if len(received) == 0 {
+				t.Fatal("Got no response")
+			}
+			if got := received[0].GetStatusCode(); got != http.StatusOK {
+				t.Fatalf("Status = %d, want %d: %s", got, http.StatusOK, received[0].Body)
+			}
+			var body string
+			for _, resp := range received {
+				body += string(resp.Body)
+			}
+			if want := tc.wantProto + " backend.invalid:8080"; body != want {
+				t.Errorf("Body = %q, want %q", body, want)
+			}
+			want := fmt.Sprintf("ID=15 Stderr=\"connecting to %s\"", backend.Listener.Addr())
+			deadline := time.Now().Add(5 * time.Second)
+			for !strings.Contains(logs.String(), want) {
+				if time.Now().After(deadline) {
+					t.Fatalf("Stderr of the dial command wasn't logged with the request ID, logs:\n%s", logs.String())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestBackendDialCommandConnections(t *testing.T) {
+	config := DefaultClientConfig()
+	config.BackendDialCommand = catDialCommand(t)
+	client := newClient(config)
+
+	// Each concurrently dialed connection talks to its own command.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := client.dialBackend(context.Background(), "tcp", "backend.invalid:8080")
+			if err != nil {
+				t.Errorf("dialBackend() failed: %v", err)
+				return
+			}
+			defer conn.Close()
+			msg := fmt.Sprintf("ping %d", i)
+			if _, err := io.WriteString(conn, msg); err != nil {
+				t.Errorf("Write() failed: %v", err)
+				return
+			}
+			got := make([]byte, len(msg))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != msg {
+				t.Errorf("Read %q, %v, want %q", got, err, msg)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	conn, err := client.dialBackend(context.Background(), "tcp", "backend.invalid:8080")
+	if err != nil {
+		t.Fatalf("dialBackend() failed: %v", err)
+	}
+	process := conn.(*commandConn).process
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !errors.Is(process.Signal(syscall.Signal(0)), os.ErrProcessDone) {
+		if time.Now().After(deadline) {
+			t.Fatal("Dial command wasn't stopped when the connection was closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackendDialCommandNotFound(t *testing.T) {
+	config := DefaultClientConfig()
+	config.BackendDialCommand = []string{"/nonexistent/dial-helper"}
+	if _, err := newClient(config).dialBackend(context.Background(), "tcp", "backend.invalid:8080"); err == nil {
+		t.Errorf("dialBackend() succeeded with a missing command")
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// doctorPollTimeout is how long Doctor waits for the relay server to answer
+// a poll. The relay server holds polls for longer, so a poll that's still
+// open by then has reached it.
+var doctorPollTimeout = time.Second
+
+// DoctorStep is the outcome of a check of Doctor.
+type DoctorStep struct {
+	// Name is the name of the check, eg "relay-dns".
+	Name string `json:"name"`
+	// Target is the relay server, backend or file that was checked.
+	Target string `json:"target"`
+	// Critical steps must pass for the client to work.
+	Critical bool          `json:"critical"`
+	OK       bool          `json:"ok"`
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// DoctorReport is the result of Doctor.
+type DoctorReport struct {
+	Steps []DoctorStep `json:"steps"`
+}
+
+// OK returns true if all critical steps passed.
+func (r DoctorReport) OK() bool {
+	for _, s := range r.Steps {
+		if s.Critical && !s.OK {
+			return false
+		}
+	}
+	return true
+}
+
+func (r DoctorReport) String() string {
+	var b strings.Builder
+	for _, s := range r.Steps {
+		result := "PASS"
+		if !s.OK && s.Critical {
+			result = "FAIL"
+		} else if !s.OK {
+			result = "WARN"
+		}
+		fmt.Fprintf(&b, "%s %s %s (%v): %s\n", result, s.Name, s.Target, s.Duration.Round(time.Millisecond), s.Detail)
+	}
+	return b.String()
+}
+
+// add appends a step with the outcome of check to the report.
+func (r *DoctorReport) add(name, target string, critical bool, check func() (string, error)) {
+	start := time.Now()
+	detail, err := check()
+	r.addResult(name, target, critical, detail, err, time.Since(start))
+}
+
+func (r *DoctorReport) addResult(name, target string, critical bool, detail string, err error, d time.Duration) {
+	if err != nil {
+		detail = err.Error()
+	}
+	r.Steps = append(r.Steps, DoctorStep{
+		Name:     name,
+		Target:   target,
+		Critical: critical,
+		OK:       err == nil,
+		Detail:   detail,
+		Duration: d,
+	})
+}
+
+// Doctor checks whether the client can reach the relay server and the
+// backend, for a quick diagnosis in the field. For each relay server, it
+// resolves its name, polls it for a request, and reports the TLS handshake of
+// the poll. It also checks that the backend answers on BackendHealthPath, and
+// that the token files of AuthenticationTokenFile and BackendAuth can be read.
+// All checks but the one of the backend, which may start later than the
+// client, are critical.
+// Doctor uses the same HTTP clients as Start. It returns an error if they
+// can't be set up. A request that the poll pulls from the relay server is
+// answered with 503 Service Unavailable.
+func (c *Client) Doctor(ctx context.Context) (DoctorReport, error) {
+	var report DoctorReport
+	if err := c.config.Validate(); err != nil {
+		return report, err
+	}
+	remote, local, err := c.newHTTPClients()
+	if err != nil {
+		return report, err
+	}
+	relays := c.config.RelayAddresses
+	if len(relays) == 0 {
+		relays = []string{c.config.RelayAddress}
+	}
+	for _, relay := range relays {
+		report.add("relay-dns", relay, true, func() (string, error) {
+			return c.lookupRelayHost(ctx, relay)
+		})
+		c.checkRelayPoll(ctx, remote, relay, &report)
+	}
+	backendURL := url.URL{
+		Scheme: c.config.BackendScheme,
+		Host:   c.config.BackendAddress,
+		Path:   c.config.BackendPath + c.config.BackendHealthPath,
+	}
+	report.add("backend", backendURL.String(), false, func() (string, error) {
+		return checkBackend(ctx, local, backendURL.String(), c.config.BackendHostOverride)
+	})
+	tokenFiles := []string{c.config.AuthenticationTokenFile}
+	for _, a := range c.config.BackendAuth {
+		tokenFiles = append(tokenFiles, a.TokenFile)
+	}
+	for _, file := range tokenFiles {
+		if file == "" {
+			continue
+		}
+		report.add("token-file", file, true, func() (string, error) {
+			token, err := os.ReadFile(file)
+			if err != nil {
+				return "", err
+			}
+			if len(strings.TrimSpace(string(token))) == 0 {
+				return "", errors.New("token file is empty")
+			}
+			return fmt.Sprintf("%d bytes", len(token)), nil
+		})
+	}
+	return report, nil
+}
+
+// lookupRelayHost resolves the host of the relay server address like the
+// connections to it do.
+func (c *Client) lookupRelayHost(ctx context.Context, address string) (string, error) {
+	if c.config.RelayHostOverride != "" {
+		return c.config.RelayHostOverride + " (RelayHostOverride)", nil
+	}
+	addrs, err := c.relayResolver().LookupHost(ctx, addressHost(address))
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(addrs, ", "), nil
+}
+
+// checkRelayPoll polls relay for a request, and adds the steps for the TLS
+// handshake and the poll to report. The relay server answers polls with 408
+// Request Timeout if there's no request, but only after a while, so a poll
+// that hasn't been answered within doctorPollTimeout passes too.
+func (c *Client) checkRelayPoll(ctx context.Context, remote *http.Client, relay string, report *DoctorReport) {
+	// The trace hooks may be called from the transport's goroutines.
+	var mu sync.Mutex
+	var tlsStart time.Time
+	var tlsDuration time.Duration
+	var tlsState *tls.ConnectionState
+	var tlsErr error
+	wroteRequest := false
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsDuration = time.Since(tlsStart)
+			tlsState, tlsErr = &state, err
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			wroteRequest = info.Err == nil
+		},
+	}
+	pollCtx, cancel := context.WithTimeout(httptrace.WithClientTrace(ctx, trace), doctorPollTimeout)
+	defer cancel()
+
+	start := time.Now()
+	detail, err := c.poll(pollCtx, remote, relay)
+	mu.Lock()
+	defer mu.Unlock()
+	if errors.Is(err, context.DeadlineExceeded) && wroteRequest {
+		detail, err = "relay server holds the poll", nil
+	}
+	pollDuration := time.Since(start)
+
+	if c.config.RelayScheme == "https" {
+		switch {
+		case tlsErr != nil:
+			report.addResult("relay-tls", relay, true, "", tlsErr, tlsDuration)
+		case tlsState == nil:
+			report.addResult("relay-tls", relay, true, "", errors.New("no TLS handshake"), tlsDuration)
+		default:
+			report.addResult("relay-tls", relay, true, certChainSummary(tlsState), nil, tlsDuration)
+		}
+	}
+	report.addResult("relay-poll", relay, true, detail, err, pollDuration)
+}
+
+// poll polls relay for a request once.
+func (c *Client) poll(ctx context.Context, remote *http.Client, relay string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.buildRelayURL(relay), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := remote.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout:
+		return "no pending requests", nil
+	case http.StatusOK:
+		breq := &pb.HttpRequest{}
+		if err := proto.Unmarshal(body, breq); err != nil {
+			return "", fmt.Errorf("failed to unmarshal request: %v", err)
+		}
+		c.requestRelays.Store(breq.GetId(), relay)
+		c.recordAffinity(breq.GetId(), resp)
+		defer c.forgetRequest(breq.GetId())
+		c.postErrorResponse(remote, breq.GetId(), http.StatusServiceUnavailable, errorShuttingDown,
+			"Relay client is running connectivity checks")
+		return fmt.Sprintf("answered pending request %s with 503", breq.GetId()), nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", fmt.Errorf("relay server denied the client (%s), check its credentials", http.StatusText(resp.StatusCode))
+	}
+	return "", fmt.Errorf("relay server responded %s: %s", http.StatusText(resp.StatusCode), body)
+}
+
+// certChainSummary describes the certificates presented by the relay server.
+func certChainSummary(state *tls.ConnectionState) string {
+	var certs []string
+	for _, cert := range state.PeerCertificates {
+		certs = append(certs, fmt.Sprintf("%s (issuer %s, expires %s)",
+			cert.Subject.CommonName, cert.Issuer.CommonName, cert.NotAfter.Format(time.DateOnly)))
+	}
+	return fmt.Sprintf("%s, %s", tls.VersionName(state.Version), strings.Join(certs, " <- "))
+}
+
+// checkBackend sends a HEAD request, or a GET request if HEAD isn't allowed,
+// to the backend, with the given Host if it's set. Any response but a server
+// error passes.
+func checkBackend(ctx context.Context, local *http.Client, backendURL, host string) (string, error) {
+	var resp *http.Response
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequestWithContext(ctx, method, backendURL, nil)
+		if err != nil {
+			return "", err
+		}
+		if host != "" {
+			req.Host = host
+		}
+		if resp, err = local.Do(req); err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			break
+		}
+	}
+	if resp.StatusCode >= 500 {
+		return "", fmt.Errorf("backend responded %s", resp.Status)
+	}
+	return "backend responded " + resp.Status, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// doctorConfig returns the config of a client for relay and backend.
+func doctorConfig(relay, backend *httptest.Server) ClientConfig {
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = relay.Listener.Addr().String()
+	config.BackendScheme = "http"
+	config.BackendAddress = backend.Listener.Addr().String()
+	config.DisableAuthForRemote = true
+	config.ResponseRetryPolicy.InitialInterval = time.Millisecond
+	return config
+}
+
+// step returns the step of report with the given name.
+func step(t *testing.T, report DoctorReport, name string) DoctorStep {
+	t.Helper()
+	for _, s := range report.Steps {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("Report has no step %s: %v", name, report)
+	return DoctorStep{}
+}
+
+func TestDoctor(t *testing.T) {
+	defer func(d time.Duration) { doctorPollTimeout = d }(doctorPollTimeout)
+	doctorPollTimeout = 100 * time.Millisecond
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	request, _ := proto.Marshal(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/"),
+	})
+
+	tests := []struct {
+		desc    string
+		relay   http.HandlerFunc
+		backend http.HandlerFunc
+		token   string
+		// failed lists the steps that fail.
+		failed []string
+		wantOK bool
+	}{
+		{
+			desc: "no pending requests",
+			relay: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "No request received within timeout", http.StatusRequestTimeout)
+			},
+			token:  token,
+			wantOK: true,
+		},
+		{
+			desc: "poll held",
+			relay: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			wantOK: true,
+		},
+		{
+			desc: "pending request",
+			relay: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/server/request" {
+					w.Write(request)
+					return
+				}
+				body, _ := io.ReadAll(r.Body)
+				resp := &pb.HttpResponse{}
+				if proto.Unmarshal(body, resp) != nil || resp.GetStatusCode() != http.StatusServiceUnavailable {
+					http.Error(w, "unexpected response", http.StatusBadRequest)
+					return
+				}
+				w.Write([]byte("ok"))
+			},
+			wantOK: true,
+		},
+		{
+			desc: "denied",
+			relay: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+			},
+			failed: []string{"relay-poll"},
+		},
+		{
+			desc: "backend error",
+			relay: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+			},
+			backend: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "starting", http.StatusServiceUnavailable)
+			},
+			failed: []string{"backend"},
+			// The backend may start after the client.
+			wantOK: true,
+		},
+		{
+			desc: "missing token file",
+			relay: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+			},
+			token:  filepath.Join(t.TempDir(), "missing"),
+			failed: []string{"token-file"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := httptest.NewServer(tc.relay)
+			defer relay.Close()
+			if tc.backend == nil {
+				tc.backend = func(w http.ResponseWriter, r *http.Request) {}
+			}
+			backend := httptest.NewServer(tc.backend)
+			defer backend.Close()
+			config := doctorConfig(relay, backend)
+			config.AuthenticationTokenFile = tc.token
+
+			report, err := newClient(config).Doctor(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range report.Steps {
+				wantFailed := false
+				for _, name := range tc.failed {
+					wantFailed = wantFailed || s.Name == name
+				}
+				if s.OK == wantFailed {
+					t.Errorf("Step %s passed: %v, want %v (%s)", s.Name, s.OK, !wantFailed, s.Detail)
+				}
+			}
+			if got := report.OK(); got != tc.wantOK {
+				t.Errorf("OK() = %v, want %v:\n%s", got, tc.wantOK, report)
+			}
+		})
+	}
+}
+
+func TestDoctorChecksRelayTLS(t *testing.T) {
+	relay := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+	}))
+	defer relay.Close()
+	var backendRequests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests.Add(1)
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer backend.Close()
+	// The relay server's certificate is trusted by the transport that
+	// newHTTPClients clones.
+	transport := http.DefaultTransport.(*http.Transport)
+	defer func(c *tls.Config) { transport.TLSClientConfig = c }(transport.TLSClientConfig)
+	transport.TLSClientConfig = relay.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+	config := doctorConfig(relay, backend)
+	config.RelayScheme = "https"
+	config.BackendHealthPath = "/healthz"
+	report, err := newClient(config).Doctor(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("OK() = false, want true:\n%s", report)
+	}
+	if s := step(t, report, "relay-tls"); !s.OK || !strings.Contains(s.Detail, "TLS 1.3") {
+		t.Errorf("TLS step = %+v, want the TLS version and certificates", s)
+	}
+	// The backend is asked again with GET if it doesn't allow HEAD.
+	if s := step(t, report, "backend"); !s.OK || !strings.HasSuffix(s.Target, "/healthz") || backendRequests.Load() != 2 {
+		t.Errorf("Backend step = %+v after %d requests, want a pass after 2", s, backendRequests.Load())
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/googlecloudrobotics/ilog"
+	"google.golang.org/protobuf/proto"
+)
+
+// Stop drains the client: workers stop polling the relay server for requests
+// right away, and Start returns once the running requests are done, or after
+// DrainTimeout. It's safe to call Stop more than once.
+func (c *Client) Stop() {
+	c.stopOnce.Do(func() {
+		slog.Info("Draining relay client", slog.Duration("Timeout", c.config.DrainTimeout))
+		close(c.stopping)
+		c.stopPolls()
+	})
+}
+
+// draining returns true once Stop was called.
+func (c *Client) draining() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep is like time.Sleep, but returns early if the client starts draining.
+func (c *Client) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-c.stopping:
+	}
+}
+
+// drain waits for the workers to exit and the requests they dispatched to
+// finish. Requests still running after DrainTimeout are ended with a final
+// response, so user-clients don't just see the connection drop.
+func (c *Client) drain(remote *http.Client) {
+	done := make(chan struct{})
+	go func() {
+		c.workerGroup.Wait()
+		c.requests.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("Relay client drained")
+	case <-time.After(c.config.DrainTimeout):
+		c.abortInFlight(remote)
+	}
+}
+
+// abortInFlight posts a final response for all requests in flight. Requests
+// which have posted a response already only get an empty final chunk, others
+// get a 503 Service Unavailable. Each response is only posted once, as the
+// client is about to exit.
+func (c *Client) abortInFlight(remote *http.Client) {
+	c.inFlight.Range(func(_, v any) bool {
+		r := v.(*inFlightRequest)
+		if !r.state.transition(phaseCancelled) {
+			return true
+		}
+		slog.Warn("Aborting request after drain timeout", slog.String("ID", r.state.id))
+		resp := &pb.HttpResponse{
+			Id:  proto.String(r.state.id),
+			Eof: proto.Bool(true),
+		}
+		if r.lastPosted.Load() == 0 {
+			resp = c.errorResponse(r.state.id, http.StatusServiceUnavailable, errorShuttingDown,
+				"Relay client is shutting down")
+		}
+		if err := c.postResponse(remote, resp); err != nil {
+			slog.Error("Failed to post final response to relay",
+				slog.String("ID", r.state.id), ilog.Err(err))
+		}
+		return true
+	})
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// newDrainRelay returns a relay server that hands out a single request and
+// then holds polls until they are cancelled.
+func newDrainRelay() *relaytest.Server {
+	relay := relaytest.NewServer()
+	relay.PollTimeout = 10 * time.Second
+	relay.Enqueue(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/logs"),
+	})
+	return relay
+}
+
+func newDrainClient(relay, backend *httptest.Server, drainTimeout time.Duration) *Client {
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.DisableAuthForRemote = true
+	config.StartupJitter = 0
+	config.UseResponseStreams = false
+	config.DrainTimeout = drainTimeout
+	return newClient(config)
+}
+
+// startAndStop starts c, stops it once the backend got the request and
+// returns the number of polls at that time.
+func startAndStop(t *testing.T, c *Client, relay *relaytest.Server, backendCalled <-chan struct{}) int {
+	t.Helper()
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		c.Start()
+	}()
+	select {
+	case <-backendCalled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Backend wasn't called")
+	}
+	// Give the worker time to start its next poll.
+	for start := time.Now(); relay.Polls() < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("Worker didn't poll again")
+		}
+	}
+	polls := relay.Polls()
+	c.Stop()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Start() didn't return after Stop()")
+	}
+	return polls
+}
+
+func TestDrainWaitsForRunningRequests(t *testing.T) {
+	relay := newDrainRelay()
+	defer relay.Close()
+	backendCalled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(backendCalled)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("last\n"))
+	}))
+	defer backend.Close()
+
+	c := newDrainClient(relay.Server, backend, 10*time.Second)
+	polls := startAndStop(t, c, relay, backendCalled)
+
+	if got := relay.Polls(); got != polls {
+		t.Errorf("Relay was polled %d times after Stop()", got-polls)
+	}
+	received := relay.Responses("15")
+	if len(received) == 0 || !received[len(received)-1].GetEof() {
+		t.Fatalf("Final chunk wasn't posted before Start() returned: %+v", received)
+	}
+	var body string
+	for _, resp := range received {
+		body += string(resp.Body)
+	}
+	if body != "first\nlast\n" {
+		t.Errorf("Relayed body = %q, want %q", body, "first\nlast\n")
+	}
+}
+
+func TestDrainTimeoutAbortsRunningRequests(t *testing.T) {
+	relay := newDrainRelay()
+	defer relay.Close()
+	backendCalled := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(backendCalled)
+		<-release
+	}))
+	defer backend.Close()
+
+	c := newDrainClient(relay.Server, backend, 100*time.Millisecond)
+	startAndStop(t, c, relay, backendCalled)
+
+	received := relay.Responses("15")
+	if len(received) != 1 {
+		t.Fatalf("Got %d responses, want 1", len(received))
+	}
+	if got := received[0].GetStatusCode(); got != http.StatusServiceUnavailable || !received[0].GetEof() {
+		t.Errorf("Got status %d (final: %t), want final %d", got, received[0].GetEof(), http.StatusServiceUnavailable)
+	}
+
+	// Let the aborted request finish, so it doesn't outlive the test.
+	close(release)
+	for start := time.Now(); len(c.Snapshot()) > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("Aborted request didn't finish")
+		}
+	}
+}
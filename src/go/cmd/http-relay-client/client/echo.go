@@ -0,0 +1,197 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// echoRequest is the JSON body of the echo backend's responses.
+type echoRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Query  string      `json:"query,omitempty"`
+	Host   string      `json:"host"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// Defaults of the echo backend's /ticker.
+const (
+	defaultTickerCount    = 10
+	defaultTickerInterval = 100 * time.Millisecond
+)
+
+// newEchoHandler returns the backend for BuiltinEchoBackend. After
+// BackendPath, it serves
+//   - /delay/{ms}: the echo, after ms milliseconds,
+//   - /status/{code}: an empty response with the status code,
+//   - /ticker: a line every 100ms, as a chunked response; the count and
+//     interval_ms query parameters change the number of lines (10) and the
+//     interval,
+//   - anything else: the request's method, path, query, host, header and
+//     body as JSON.
+func (c *Client) newEchoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(c.config.BackendPath, "/"))
+		if ms, ok := strings.CutPrefix(path, "/delay/"); ok {
+			d, err := strconv.Atoi(ms)
+			if err != nil || d < 0 {
+				http.Error(w, "Invalid delay", http.StatusBadRequest)
+				return
+			}
+			select {
+			case <-time.After(time.Duration(d) * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+			echo(w, r)
+			return
+		}
+		if code, ok := strings.CutPrefix(path, "/status/"); ok {
+			status, err := strconv.Atoi(code)
+			if err != nil || status < 200 || status > 999 {
+				http.Error(w, "Invalid status code", http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(status)
+			return
+		}
+		if path == "/ticker" {
+			ticker(w, r)
+			return
+		}
+		echo(w, r)
+	})
+}
+
+func echo(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(echoRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Host:   r.Host,
+		Header: r.Header,
+		Body:   string(body),
+	})
+}
+
+func ticker(w http.ResponseWriter, r *http.Request) {
+	count, interval := defaultTickerCount, defaultTickerInterval
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid count", http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+	if v := r.URL.Query().Get("interval_ms"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			http.Error(w, "Invalid interval_ms", http.StatusBadRequest)
+			return
+		}
+		interval = time.Duration(ms) * time.Millisecond
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		fmt.Fprintf(w, "tick %d\n", i)
+		w.(http.Flusher).Flush()
+	}
+}
+
+// newEchoTransport returns a transport that sends all requests to handler,
+// through in-memory connections, so that they're relayed like responses of
+// a real backend. The transport speaks HTTP/1.1 for both http and https
+// URLs, without TLS.
+func newEchoTransport(handler http.Handler) *http.Transport {
+	l := &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	go (&http.Server{Handler: handler}).Serve(l)
+	return &http.Transport{
+		DialContext:        l.dial,
+		DialTLSContext:     l.dial,
+		DisableCompression: true,
+	}
+}
+
+// pipeListener is a net.Listener for connections made by dial, which never
+// touch the network.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *pipeListener) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	server, client := net.Pipe()
+	var err error
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		err = net.ErrClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	server.Close()
+	client.Close()
+	return nil, err
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "echo-backend" }
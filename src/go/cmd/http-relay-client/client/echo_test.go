@@ -0,0 +1,152 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEchoBackend(t *testing.T) {
+	tests := []struct {
+		desc       string
+		method     string
+		path       string
+		body       string
+		wantStatus int32
+		// wantBody is checked unless wantEcho is set.
+		wantBody   string
+		wantEcho   *echoRequest
+		minChunks  int
+		minElapsed time.Duration
+	}{
+		{
+			desc:       "echo",
+			method:     "POST",
+			path:       "/api/things?a=b",
+			body:       "hello",
+			wantStatus: http.StatusOK,
+			wantEcho: &echoRequest{
+				Method: "POST",
+				Path:   "/base/api/things",
+				Query:  "a=b",
+				Body:   "hello",
+			},
+		},
+		{
+			desc:       "delay",
+			method:     "GET",
+			path:       "/delay/100",
+			wantStatus: http.StatusOK,
+			wantEcho:   &echoRequest{Method: "GET", Path: "/base/delay/100"},
+			minElapsed: 100 * time.Millisecond,
+		},
+		{
+			desc:       "status",
+			method:     "GET",
+			path:       "/status/418",
+			wantStatus: http.StatusTeapot,
+		},
+		{
+			desc:       "invalid status",
+			method:     "GET",
+			path:       "/status/abc",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Invalid status code\n",
+		},
+		{
+			desc:       "ticker",
+			method:     "GET",
+			path:       "/ticker?count=3&interval_ms=100",
+			wantStatus: http.StatusOK,
+			wantBody:   "tick 0\ntick 1\ntick 2\n",
+			// Each tick is posted before the next one.
+			minChunks:  3,
+			minElapsed: 200 * time.Millisecond,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := relaytest.NewServer()
+			defer relay.Close()
+			relay.Enqueue(&pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String(tc.method),
+				Url:    proto.String("http://invalid" + tc.path),
+				Body:   []byte(tc.body),
+			})
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = relay.Address()
+			config.BackendScheme = "https"
+			config.BackendAddress = "nonexistent.invalid:443"
+			config.BackendPath = "/base"
+			config.BuiltinEchoBackend = true
+			config.StartupJitter = 0
+			config.PollJitter = 0
+			config.BackendResponseTimeout = 20 * time.Millisecond
+			c := newClient(config)
+
+			start := time.Now()
+			if err := c.localProxy(&http.Client{}, c.newLocalClient(nil), &proxyWorker{}); err != nil {
+				t.Fatalf("localProxy() = %v", err)
+			}
+			c.requests.Wait()
+			elapsed := time.Since(start)
+
+			responses := relay.Responses("15")
+			if len(responses) == 0 {
+				t.Fatal("No response received")
+			}
+			if got := responses[0].GetStatusCode(); got != tc.wantStatus {
+				t.Errorf("Status = %d, want %d", got, tc.wantStatus)
+			}
+			if !responses[len(responses)-1].GetEof() {
+				t.Errorf("Last response isn't final")
+			}
+			if len(responses) < tc.minChunks {
+				t.Errorf("Got %d responses, want at least %d", len(responses), tc.minChunks)
+			}
+			if elapsed < tc.minElapsed {
+				t.Errorf("Request took %v, want at least %v", elapsed, tc.minElapsed)
+			}
+			if tc.wantEcho == nil {
+				if got := body(responses); got != tc.wantBody {
+					t.Errorf("Body = %q, want %q", got, tc.wantBody)
+				}
+				return
+			}
+			var got echoRequest
+			if err := json.Unmarshal([]byte(body(responses)), &got); err != nil {
+				t.Fatalf("Invalid echo %q: %v", body(responses), err)
+			}
+			if got.Method != tc.wantEcho.Method || got.Path != tc.wantEcho.Path ||
+				got.Query != tc.wantEcho.Query || got.Body != tc.wantEcho.Body {
+				t.Errorf("Echo = %+v, want %+v", got, tc.wantEcho)
+			}
+			if !strings.HasPrefix(got.Host, "nonexistent.invalid") {
+				t.Errorf("Echoed host %q, want the backend address", got.Host)
+			}
+		})
+	}
+}
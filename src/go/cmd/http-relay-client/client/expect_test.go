@@ -0,0 +1,132 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// rawBackend is a backend that speaks HTTP/1.1 over a raw TCP connection,
+// so that tests can assert on the exact request header it received. It
+// requires the 100-continue dance, ie it only reads the body of a request
+// with Expect: 100-continue after sending 100 Continue, and it sends an
+// interim 103 Early Hints response before the final one.
+type rawBackend struct {
+	addr   string
+	header chan string
+	body   chan string
+}
+
+func newRawBackend(t *testing.T) *rawBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	b := &rawBackend{addr: l.Addr().String(), header: make(chan string, 1), body: make(chan string, 1)}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		var header strings.Builder
+		length, expect := 0, false
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "\r\n" {
+				break
+			}
+			header.WriteString(line)
+			name, value, _ := strings.Cut(strings.TrimSpace(line), ":")
+			switch strings.ToLower(name) {
+			case "content-length":
+				length, _ = strconv.Atoi(strings.TrimSpace(value))
+			case "expect":
+				expect = strings.EqualFold(strings.TrimSpace(value), "100-continue")
+			}
+		}
+		b.header <- header.String()
+		if expect {
+			io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n")
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return
+		}
+		b.body <- string(body)
+		io.WriteString(conn, "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n")
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+	}()
+	return b
+}
+
+func TestExpectContinue(t *testing.T) {
+	backend := newRawBackend(t)
+	relay := newRecordingRelay()
+	defer relay.Close()
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = backend.addr
+	client := newClient(config)
+
+	client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("POST"),
+		Url:    proto.String("http://invalid/upload"),
+		Header: []*pb.HttpHeader{{
+			Name:  proto.String("Expect"),
+			Value: proto.String("100-Continue"),
+		}},
+		Body: []byte("large upload"),
+	})
+
+	header := <-backend.header
+	if strings.Contains(strings.ToLower(header), "expect:") {
+		t.Errorf("Backend received Expect header:\n%s", header)
+	}
+	if got := <-backend.body; got != "large upload" {
+		t.Errorf("Backend received body %q, want %q", got, "large upload")
+	}
+	received := relay.responses("15")
+	if len(received) == 0 {
+		t.Fatal("Got no response")
+	}
+	if got := received[0].GetStatusCode(); got != http.StatusOK {
+		t.Errorf("Status = %d, want %d", got, http.StatusOK)
+	}
+	var body string
+	for _, resp := range received {
+		body += string(resp.Body)
+	}
+	if body != "ok" {
+		t.Errorf("Body = %q, want %q", body, "ok")
+	}
+}
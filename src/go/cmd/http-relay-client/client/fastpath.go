@@ -0,0 +1,100 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/googlecloudrobotics/ilog"
+	"google.golang.org/protobuf/proto"
+)
+
+// isSmallResponse returns true if the backend response is known to fit into
+// a single chunk and isn't streamed. Most relayed requests (eg Kubernetes API
+// GETs) fall into this category, and reading them at once is cheaper than
+// passing them through streamBytes and buildResponses.
+func (c *Client) isSmallResponse(hresp *http.Response) bool {
+	if hresp.StatusCode == http.StatusSwitchingProtocols {
+		return false
+	}
+	if hresp.ContentLength < 0 || hresp.ContentLength > int64(c.config.MaxChunkSize) {
+		return false
+	}
+	return !isEventStream(hresp)
+}
+
+// hasNoBody returns true if the backend response to req can't have a body
+// (RFC 9110, section 6.4.1): the response to a HEAD request, 204 No Content
+// and 304 Not Modified. These are posted right away in a single chunk.
+func hasNoBody(req *http.Request, hresp *http.Response) bool {
+	if hresp.StatusCode == http.StatusSwitchingProtocols {
+		return false
+	}
+	return req.Method == http.MethodHead ||
+		hresp.StatusCode == http.StatusNoContent || hresp.StatusCode == http.StatusNotModified
+}
+
+// postsHeadersEarly returns true if the headers of the backend response should
+// be posted before its body. This lets user-clients of event streams and other
+// chunked responses act on the headers before the first event arrives.
+func (c *Client) postsHeadersEarly(hresp *http.Response) bool {
+	if !c.config.PostHeadersEarly {
+		return false
+	}
+	return isEventStream(hresp) || slices.Contains(hresp.TransferEncoding, "chunked")
+}
+
+// readSmallResponse reads the body of a small response into resp and returns
+// a channel with resp as the only and final chunk. The chunk is the same as
+// the one buildResponses would have built. Read errors are reported to state.
+func (c *Client) readSmallResponse(resp *pb.HttpResponse, hresp *http.Response, state *requestState, timer *chunkTimer) <-chan *pb.HttpResponse {
+	body, err := io.ReadAll(io.LimitReader(hresp.Body, int64(c.config.MaxChunkSize)))
+	if err != nil {
+		slog.Error("Failed to read from backend", slog.String("ID", *resp.Id), ilog.Err(err))
+		c.reportError(&backendError{err}, *resp.Id)
+		state.failStream(err)
+	}
+	if len(body) > 0 {
+		resp.Body = body
+	}
+	resp.Eof = proto.Bool(true)
+	timer.stamp(resp)
+	out := make(chan *pb.HttpResponse, 1)
+	out <- resp
+	close(out)
+	return out
+}
+
+// readEmptyResponse returns a channel with resp as the only and final chunk,
+// for a response without body. A body that the backend sent anyway is
+// discarded, so that the user-client doesn't take it for the next response
+// on its connection.
+func (c *Client) readEmptyResponse(resp *pb.HttpResponse, hresp *http.Response, timer *chunkTimer) <-chan *pb.HttpResponse {
+	n, _ := io.Copy(io.Discard, io.LimitReader(hresp.Body, int64(c.config.MaxChunkSize)))
+	if n > 0 {
+		slog.Warn("Discarding body of response that can't have one",
+			slog.String("ID", *resp.Id), slog.Int("Status", hresp.StatusCode), slog.Int64("Bytes", n))
+	}
+	resp.Eof = proto.Bool(true)
+	timer.stamp(resp)
+	out := make(chan *pb.HttpResponse, 1)
+	out <- resp
+	close(out)
+	return out
+}
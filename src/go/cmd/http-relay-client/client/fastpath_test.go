@@ -0,0 +1,243 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestIsSmallResponse(t *testing.T) {
+	tests := []struct {
+		desc          string
+		statusCode    int
+		contentLength int64
+		contentType   string
+		want          bool
+	}{
+		{"small", http.StatusOK, 100, "application/json", true},
+		{"empty", http.StatusNoContent, 0, "", true},
+		{"max chunk size", http.StatusOK, 1000, "", true},
+		{"too large", http.StatusOK, 1001, "", false},
+		{"unknown length", http.StatusOK, -1, "", false},
+		{"event stream", http.StatusOK, 100, "text/event-stream; charset=utf-8", false},
+		{"upgrade", http.StatusSwitchingProtocols, 0, "", false},
+	}
+	config := DefaultClientConfig()
+	config.MaxChunkSize = 1000
+	client := newClient(config)
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			hresp := &http.Response{
+				StatusCode:    tc.statusCode,
+				ContentLength: tc.contentLength,
+				Header:        http.Header{"Content-Type": {tc.contentType}},
+			}
+			if got := client.isSmallResponse(hresp); got != tc.want {
+				t.Errorf("isSmallResponse() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// newFixedBackend returns a client for a backend that responds with body,
+// with or without a known Content-Length.
+func newFixedBackend(body string, knownLength bool) *http.Client {
+	return &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		contentLength := int64(-1)
+		if knownLength {
+			contentLength = int64(len(body))
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			ContentLength: contentLength,
+			Body:          io.NopCloser(strings.NewReader(body)),
+			Request:       req,
+		}, nil
+	})}
+}
+
+func TestSmallResponseIsRelayedLikeChunkedResponse(t *testing.T) {
+	for _, body := range []string{"", `{"kind": "Pod"}`} {
+		relay := newRecordingRelay()
+		defer relay.Close()
+
+		config := DefaultClientConfig()
+		config.RelayScheme = "http"
+		config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+		client := newClient(config)
+		for _, id := range []string{"small", "chunked"} {
+			client.handleRequest(&http.Client{}, newFixedBackend(body, id == "small"), &pb.HttpRequest{
+				Id:     proto.String(id),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+		}
+
+		small, chunked := relay.responses("small"), relay.responses("chunked")
+		if len(small) != 1 || len(chunked) != 1 {
+			t.Fatalf("Body %q: relay received %d and %d chunks, want 1 each", body, len(small), len(chunked))
+		}
+		for _, resp := range []*pb.HttpResponse{small[0], chunked[0]} {
+			resp.Id = nil
+			resp.BackendDurationMs = nil
+			resp.ElapsedMs = nil
+			resp.ChunkIntervalMs = nil
+			resp.UploadAttempts = nil
+			resp.UploadDurationMs = nil
+		}
+		if !proto.Equal(small[0], chunked[0]) {
+			t.Errorf("Body %q: small response relayed as %v, want %v", body, small[0], chunked[0])
+		}
+	}
+}
+
+func TestResponsesWithoutBody(t *testing.T) {
+	tests := []struct {
+		desc          string
+		method        string
+		statusCode    int
+		header        http.Header
+		contentLength int64
+		body          string
+	}{
+		{
+			desc:          "head",
+			method:        http.MethodHead,
+			statusCode:    http.StatusOK,
+			header:        http.Header{"Content-Length": {"1048576"}},
+			contentLength: 1 << 20,
+		},
+		{
+			desc:          "head of chunked response",
+			method:        http.MethodHead,
+			statusCode:    http.StatusOK,
+			header:        http.Header{"Transfer-Encoding": {"chunked"}},
+			contentLength: -1,
+		},
+		{
+			desc:          "no content",
+			method:        http.MethodDelete,
+			statusCode:    http.StatusNoContent,
+			contentLength: -1,
+		},
+		{
+			desc:          "not modified",
+			method:        http.MethodGet,
+			statusCode:    http.StatusNotModified,
+			header:        http.Header{"Etag": {`"v1"`}},
+			contentLength: -1,
+		},
+		{
+			desc:          "not modified with body",
+			method:        http.MethodGet,
+			statusCode:    http.StatusNotModified,
+			header:        http.Header{"Etag": {`"v1"`}},
+			contentLength: -1,
+			body:          "HTTP/1.1 200 OK\r\n\r\nsmuggled",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := newRecordingRelay()
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendResponseTimeout = time.Second
+			client := newClient(config)
+			body := strings.NewReader(tc.body)
+			local := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode:    tc.statusCode,
+					Header:        tc.header,
+					ContentLength: tc.contentLength,
+					Body:          io.NopCloser(body),
+					Request:       req,
+				}, nil
+			})}
+
+			start := time.Now()
+			client.handleRequest(&http.Client{}, local, &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String(tc.method),
+				Url:    proto.String("http://invalid/foo"),
+			})
+			if elapsed := time.Since(start); elapsed > config.BackendResponseTimeout/2 {
+				t.Errorf("Response was relayed after %v, want right away", elapsed)
+			}
+
+			responses := relay.responses("15")
+			if len(responses) != 1 {
+				t.Fatalf("Got %d responses, want 1: %v", len(responses), responses)
+			}
+			resp := responses[0]
+			if resp.GetStatusCode() != int32(tc.statusCode) || !resp.GetEof() || len(resp.Body) != 0 {
+				t.Errorf("Got response %v, want status %d and Eof without body", resp, tc.statusCode)
+			}
+			for name, values := range tc.header {
+				found := false
+				for _, h := range resp.Header {
+					found = found || h.GetName() == name && h.GetValue() == values[0]
+				}
+				if !found {
+					t.Errorf("Header %s: %s is missing in %v", name, values[0], resp.Header)
+				}
+			}
+			if body.Len() != 0 {
+				t.Errorf("%d bytes of the backend's body weren't drained", body.Len())
+			}
+		})
+	}
+}
+
+func BenchmarkHandleRequest(b *testing.B) {
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	client := newClient(config)
+	remote := &http.Client{}
+	body := strings.Repeat("x", 4096)
+	for _, bc := range []struct {
+		name        string
+		knownLength bool
+	}{
+		{"small", true},
+		{"chunked", false},
+	} {
+		local := newFixedBackend(body, bc.knownLength)
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				client.handleRequest(remote, local, &pb.HttpRequest{
+					Id:     proto.String(bc.name),
+					Method: proto.String("GET"),
+					Url:    proto.String("http://invalid/foo"),
+				})
+			}
+		})
+	}
+}
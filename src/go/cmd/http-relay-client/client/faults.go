@@ -0,0 +1,128 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// FaultInjection makes the client misbehave on purpose, eg to verify
+// dashboards and alerts before a fleet rollout. It only applies if
+// ClientConfig.EnableFaultInjection is set too, so that a FaultInjection
+// merged into a production config by accident stays inert. Each injected
+// fault is logged with faultInjectedMsg and counted in the
+// relay_client_injected_faults_total metric.
+//
+// The response faults apply to responses posted one at a time, not to those
+// posted in batches (BatchDelay) or on a response stream.
+type FaultInjection struct {
+	// DropResponsePercent of the responses (chunks) aren't posted to the
+	// relay server, while posting them is reported as successful.
+	DropResponsePercent float64
+	// DelayBackendMs delays every backend request by this many milliseconds.
+	DelayBackendMs int
+	// FailPollPercent of the polls fail without reaching the relay server.
+	FailPollPercent float64
+	// CorruptChunkPercent of the responses with a body are posted with one
+	// byte of it inverted.
+	CorruptChunkPercent float64
+}
+
+// validPercent returns true if p is a percentage from 0 to 100.
+func validPercent(p float64) bool {
+	return p >= 0 && p <= 100
+}
+
+// faultInjectedMsg is the log message of injected faults, for grepping.
+const faultInjectedMsg = "FAULT INJECTED"
+
+// errInjectedPollFailure is the error of polls failed by FailPollPercent.
+var errInjectedPollFailure = errors.New("injected poll failure")
+
+// faultInjector implements FaultInjection. A nil *faultInjector injects
+// nothing.
+type faultInjector struct {
+	FaultInjection
+}
+
+func newFaultInjector(f FaultInjection) *faultInjector {
+	return &faultInjector{FaultInjection: f}
+}
+
+// hit returns true for percent of the calls.
+func (f *faultInjector) hit(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// injected logs and counts the injection of fault into the request with id,
+// which is empty for polls.
+func injected(fault string, id string) {
+	slog.Warn(faultInjectedMsg, slog.String("Fault", fault), slog.String("ID", id))
+	injectedFaults.WithLabelValues(fault).Inc()
+}
+
+// failPoll returns an error if the poll is to fail.
+func (f *faultInjector) failPoll() error {
+	if f == nil || !f.hit(f.FailPollPercent) {
+		return nil
+	}
+	injected("fail_poll", "")
+	return errInjectedPollFailure
+}
+
+// delayBackend waits before the backend request with id is sent, unless ctx
+// is done first.
+func (f *faultInjector) delayBackend(ctx context.Context, id string) error {
+	if f == nil || f.DelayBackendMs <= 0 {
+		return nil
+	}
+	injected("delay_backend", id)
+	t := time.NewTimer(time.Duration(f.DelayBackendMs) * time.Millisecond)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dropResponse returns true if br is not to be posted.
+func (f *faultInjector) dropResponse(br *pb.HttpResponse) bool {
+	if f == nil || !f.hit(f.DropResponsePercent) {
+		return false
+	}
+	injected("drop_response", br.GetId())
+	return true
+}
+
+// corruptChunk returns br, or a copy of it with a byte of the body inverted.
+// br itself is left intact, as it's posted again on retries.
+func (f *faultInjector) corruptChunk(br *pb.HttpResponse) *pb.HttpResponse {
+	if f == nil || len(br.Body) == 0 || !f.hit(f.CorruptChunkPercent) {
+		return br
+	}
+	injected("corrupt_chunk", br.GetId())
+	corrupt := proto.Clone(br).(*pb.HttpResponse)
+	corrupt.Body[rand.Intn(len(corrupt.Body))] ^= 0xff
+	return corrupt
+}
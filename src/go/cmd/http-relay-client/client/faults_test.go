@@ -0,0 +1,159 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+)
+
+// injectedFaultCount returns the relay_client_injected_faults_total counter
+// for fault.
+func injectedFaultCount(t *testing.T, fault string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "relay_client_injected_faults_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "fault" && l.GetValue() == fault {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestFailPollRequiresEnableFaultInjection(t *testing.T) {
+	var polls atomic.Int32
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		w.WriteHeader(http.StatusRequestTimeout)
+	}))
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.FaultInjection.FailPollPercent = 100
+	if _, err := newClient(config).getRequest(&http.Client{}, relay.URL); err != ErrTimeout {
+		t.Errorf("getRequest() = %v, want ErrTimeout without EnableFaultInjection", err)
+	}
+	if got := polls.Load(); got != 1 {
+		t.Errorf("Relay server got %d polls, want 1", got)
+	}
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	before := injectedFaultCount(t, "fail_poll")
+	config.EnableFaultInjection = true
+	if _, err := newClient(config).getRequest(&http.Client{}, relay.URL); !errors.Is(err, errInjectedPollFailure) {
+		t.Errorf("getRequest() = %v, want injected failure", err)
+	}
+	if got := polls.Load(); got != 1 {
+		t.Errorf("Relay server got %d polls, want none for the failed one", got-1)
+	}
+	if got := injectedFaultCount(t, "fail_poll") - before; got != 1 {
+		t.Errorf("Counted %v injected poll failures, want 1", got)
+	}
+	if !strings.Contains(logs.String(), faultInjectedMsg) || !strings.Contains(logs.String(), "Fault=fail_poll") {
+		t.Errorf("Logs %q lack the injected fault", logs.String())
+	}
+}
+
+func TestInjectedResponseFaults(t *testing.T) {
+	body := strings.Repeat("hello", 20)
+	tests := []struct {
+		desc   string
+		faults FaultInjection
+		fault  string
+	}{
+		{"drop response", FaultInjection{DropResponsePercent: 100}, "drop_response"},
+		{"corrupt chunk", FaultInjection{CorruptChunkPercent: 100}, "corrupt_chunk"},
+		{"delay backend", FaultInjection{DelayBackendMs: 100}, "delay_backend"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+			}))
+			defer backend.Close()
+			relay := newRecordingRelay()
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.EnableFaultInjection = true
+			config.FaultInjection = tc.faults
+			client := newClient(config)
+			before := injectedFaultCount(t, tc.fault)
+			start := time.Now()
+			client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+			elapsed := time.Since(start)
+
+			if got := injectedFaultCount(t, tc.fault) - before; got != 1 {
+				t.Errorf("Counted %v injected %s faults, want 1", got, tc.fault)
+			}
+			received := relay.responses("15")
+			switch tc.fault {
+			case "drop_response":
+				if len(received) != 0 {
+					t.Errorf("Relay server got %d responses, want none", len(received))
+				}
+				return
+			case "delay_backend":
+				if elapsed < 100*time.Millisecond {
+					t.Errorf("Request took %v, want at least the injected delay", elapsed)
+				}
+			}
+			if len(received) != 1 {
+				t.Fatalf("Relay server got %d responses, want 1", len(received))
+			}
+			got := received[0].Body
+			diff := 0
+			for i := range got {
+				if i < len(body) && got[i] != body[i] {
+					diff++
+				}
+			}
+			if want := map[bool]int{true: 1, false: 0}[tc.fault == "corrupt_chunk"]; len(got) != len(body) || diff != want {
+				t.Errorf("Relayed body %q differs from %q in %d bytes, want %d", got, body, diff, want)
+			}
+		})
+	}
+}
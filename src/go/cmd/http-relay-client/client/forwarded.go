@@ -0,0 +1,95 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+// setForwardedHeaders tells the backend about the user-client, which it would
+// otherwise only see as a request from the relay client. It sets the de-facto
+// standard X-Forwarded-For, -Proto and -Host headers, or the RFC 7239
+// Forwarded header if UseForwardedHeader is set. The user-client's address is
+// appended to the chain of any proxies in front of the relay server. The
+// scheme and host are always the ones the relay server saw, as incoming
+// X-Forwarded-Proto and -Host headers could be set by any user-client.
+func (c *Client) setForwardedHeaders(breq *pb.HttpRequest, header http.Header) {
+	addr := breq.GetRemoteAddr()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	if c.config.UseForwardedHeader {
+		var params []string
+		if addr != "" {
+			if strings.Contains(addr, ":") {
+				addr = "[" + addr + "]"
+			}
+			params = append(params, "for="+forwardedValue(addr))
+		}
+		if breq.Host != nil {
+			params = append(params, "host="+forwardedValue(*breq.Host))
+		}
+		if breq.Scheme != nil {
+			params = append(params, "proto="+forwardedValue(*breq.Scheme))
+		}
+		if len(params) > 0 {
+			appendHeader(header, "Forwarded", strings.Join(params, ";"))
+		}
+		return
+	}
+
+	if addr != "" {
+		appendHeader(header, "X-Forwarded-For", addr)
+	}
+	header.Del("X-Forwarded-Proto")
+	if breq.Scheme != nil {
+		header.Set("X-Forwarded-Proto", *breq.Scheme)
+	}
+	header.Del("X-Forwarded-Host")
+	if breq.Host != nil {
+		header.Set("X-Forwarded-Host", *breq.Host)
+	}
+}
+
+// appendHeader adds value to the comma-separated list in the given header,
+// merging multiple existing header lines into one.
+func appendHeader(header http.Header, name, value string) {
+	values := append(header.Values(name), value)
+	header.Set(name, strings.Join(values, ", "))
+}
+
+// forwardedValue returns s as a token or, if it contains other characters,
+// as a quoted string as required by RFC 7239.
+func forwardedValue(s string) string {
+	for _, r := range s {
+		if !isTokenChar(r) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+	}
+	return s
+}
+
+func isTokenChar(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSetForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		desc       string
+		useRFC7239 bool
+		remoteAddr *string
+		header     []*pb.HttpHeader
+		want       http.Header
+	}{
+		{
+			desc:       "x-forwarded",
+			remoteAddr: proto.String("192.0.2.1:1234"),
+			want: http.Header{
+				"X-Forwarded-For":   {"192.0.2.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"example.com"},
+			},
+		},
+		{
+			desc:       "appends to existing chain",
+			remoteAddr: proto.String("192.0.2.1:1234"),
+			header: []*pb.HttpHeader{
+				{Name: proto.String("X-Forwarded-For"), Value: proto.String("198.51.100.1")},
+				{Name: proto.String("X-Forwarded-For"), Value: proto.String("198.51.100.2")},
+			},
+			want: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1, 198.51.100.2, 192.0.2.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"example.com"},
+			},
+		},
+		{
+			desc:       "overwrites incoming scheme and host",
+			remoteAddr: proto.String("192.0.2.1:1234"),
+			header: []*pb.HttpHeader{
+				{Name: proto.String("X-Forwarded-Proto"), Value: proto.String("http")},
+				{Name: proto.String("X-Forwarded-Host"), Value: proto.String("evil.example")},
+				{Name: proto.String("X-Forwarded-Host"), Value: proto.String("evil2.example")},
+			},
+			want: http.Header{
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"example.com"},
+			},
+		},
+		{
+			desc: "without remote address",
+			want: http.Header{
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"example.com"},
+			},
+		},
+		{
+			desc:       "rfc 7239",
+			useRFC7239: true,
+			remoteAddr: proto.String("[2001:db8::1]:1234"),
+			header: []*pb.HttpHeader{
+				{Name: proto.String("Forwarded"), Value: proto.String("for=198.51.100.1")},
+			},
+			want: http.Header{
+				"Forwarded": {`for=198.51.100.1, for="[2001:db8::1]";host=example.com;proto=https`},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.SetForwardedHeaders = true
+			config.UseForwardedHeader = tc.useRFC7239
+			client := newClient(config)
+
+			req, err := client.createBackendRequest(&pb.HttpRequest{
+				Id:         proto.String("15"),
+				Method:     proto.String("GET"),
+				Host:       proto.String("example.com"),
+				Url:        proto.String("http://invalid/foo"),
+				Header:     tc.header,
+				RemoteAddr: tc.remoteAddr,
+				Scheme:     proto.String("https"),
+			})
+			if err != nil {
+				t.Fatalf("createBackendRequest() failed: %v", err)
+			}
+			for name, want := range tc.want {
+				if got := req.Header.Values(name); len(got) != len(want) || got[0] != want[0] {
+					t.Errorf("Header %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedHeadersAreOptIn(t *testing.T) {
+	client := newClient(DefaultClientConfig())
+	req, err := client.createBackendRequest(&pb.HttpRequest{
+		Id:         proto.String("15"),
+		Method:     proto.String("GET"),
+		Host:       proto.String("example.com"),
+		Url:        proto.String("http://invalid/foo"),
+		RemoteAddr: proto.String("192.0.2.1:1234"),
+		Scheme:     proto.String("https"),
+	})
+	if err != nil {
+		t.Fatalf("createBackendRequest() failed: %v", err)
+	}
+	for _, name := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host"} {
+		if got := req.Header.Get(name); got != "" {
+			t.Errorf("Header %s = %q, want none", name, got)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// grpcStatusHeaders carry the status of a gRPC call. They're sent as
+// trailers, except in trailers-only responses.
+var grpcStatusHeaders = []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"}
+
+// isGRPC returns true if contentType is application/grpc or one of its
+// variants, like application/grpc+proto.
+func isGRPC(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+// isGRPCWeb returns true if contentType is application/grpc-web or one of its
+// binary variants, like application/grpc-web+proto. The base64 encoded
+// application/grpc-web-text isn't framed on the wire.
+func isGRPCWeb(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/grpc-web" || strings.HasPrefix(mediaType, "application/grpc-web+")
+}
+
+// isGRPCWebResponse returns true for gRPC-Web responses whose frames can be
+// told apart in the body, ie that aren't compressed as a whole. Their chunks
+// are posted per frame, see buildResponses.
+func isGRPCWebResponse(hresp *http.Response) bool {
+	encoding := hresp.Header.Get("Content-Encoding")
+	return isGRPCWeb(hresp.Header.Get("Content-Type")) && (encoding == "" || encoding == "identity")
+}
+
+// grpcWebBoundary returns the length of the prefix of a gRPC-Web body that
+// consists of complete frames, ie what can be posted without splitting a
+// message or the trailers frame. Each frame is a flags byte and a 4 byte
+// big-endian length, followed by that many bytes.
+func grpcWebBoundary(b []byte) int {
+	end := 0
+	for len(b)-end >= 5 {
+		n := 5 + int64(binary.BigEndian.Uint32(b[end+1:end+5]))
+		if int64(len(b)-end) < n {
+			break
+		}
+		end += int(n)
+	}
+	return end
+}
+
+// setGRPCRequestHeader adds "TE: trailers" to gRPC requests. gRPC servers and
+// some proxies reject requests without it, and user-clients' TE header
+// doesn't make it past the relay server.
+func setGRPCRequestHeader(header http.Header) {
+	if isGRPC(header.Get("Content-Type")) {
+		header.Set("Te", "trailers")
+	}
+}
+
+// takeTrailersOnlyStatus removes the gRPC status from the header of a
+// trailers-only gRPC response, where the backend sends it with the headers as
+// there's no body, and returns it. The status must be relayed as trailers, as
+// the relay server sends the header before the body, and a gRPC response with
+// a status header and a body is invalid.
+func takeTrailersOnlyStatus(header http.Header) http.Header {
+	if !isGRPC(header.Get("Content-Type")) || header.Get("Grpc-Status") == "" {
+		return nil
+	}
+	status := http.Header{}
+	for _, name := range grpcStatusHeaders {
+		if values, ok := header[name]; ok {
+			status[name] = values
+			delete(header, name)
+		}
+	}
+	return status
+}
@@ -0,0 +1,352 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/grpc"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestIsGRPC(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/grpc", true},
+		{"application/grpc+proto", true},
+		{"application/grpc; charset=utf-8", true},
+		{"application/grpc-web", false},
+		{"application/json", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		if got := isGRPC(tc.contentType); got != tc.want {
+			t.Errorf("isGRPC(%q) = %v, want %v", tc.contentType, got, tc.want)
+		}
+	}
+}
+
+func TestIsGRPCWeb(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/grpc-web", true},
+		{"application/grpc-web+proto", true},
+		{"application/grpc-web+proto; charset=utf-8", true},
+		{"application/grpc-web-text", false},
+		{"application/grpc", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		if got := isGRPCWeb(tc.contentType); got != tc.want {
+			t.Errorf("isGRPCWeb(%q) = %v, want %v", tc.contentType, got, tc.want)
+		}
+	}
+}
+
+func TestGRPCWebBoundary(t *testing.T) {
+	frame := grpcFrame("hello")
+	tests := []struct {
+		desc string
+		body []byte
+		want int
+	}{
+		{"empty", nil, 0},
+		{"partial header", frame[:3], 0},
+		{"partial message", frame[:7], 0},
+		{"complete frame", frame, len(frame)},
+		{"frame and partial frame", append(grpcFrame("hello"), frame[:6]...), len(frame)},
+		{"empty message", grpcFrame(""), 5},
+		{"two frames", append(grpcFrame("hello"), frame...), 2 * len(frame)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := grpcWebBoundary(tc.body); got != tc.want {
+				t.Errorf("grpcWebBoundary(%q) = %d, want %d", tc.body, got, tc.want)
+			}
+		})
+	}
+}
+
+// grpcFrame returns msg in the gRPC length-prefixed message framing.
+func grpcFrame(msg string) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// grpcService answers UnaryCall with the request payload, and
+// StreamingOutputCall with one message per response parameter. Other
+// methods fail with a trailers-only response.
+type grpcService struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+func (s *grpcService) UnaryCall(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	return &testpb.SimpleResponse{Payload: req.Payload}, nil
+}
+
+func (s *grpcService) StreamingOutputCall(req *testpb.StreamingOutputCallRequest, stream testpb.TestService_StreamingOutputCallServer) error {
+	for _, p := range req.ResponseParameters {
+		body := bytes.Repeat([]byte("x"), int(p.Size))
+		if err := stream.Send(&testpb.StreamingOutputCallResponse{Payload: &testpb.Payload{Body: body}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newGRPCBackend starts a gRPC server with grpcService and returns its
+// address.
+func newGRPCBackend(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	testpb.RegisterTestServiceServer(server, &grpcService{})
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	return l.Addr().String()
+}
+
+// grpcMessages splits a gRPC response body into messages.
+func grpcMessages(t *testing.T, body []byte) [][]byte {
+	var msgs [][]byte
+	for len(body) > 0 {
+		if len(body) < 5 {
+			t.Fatalf("Truncated gRPC frame header %q", body)
+		}
+		n := 5 + int(binary.BigEndian.Uint32(body[1:5]))
+		if len(body) < n {
+			t.Fatalf("Truncated gRPC message, %d of %d bytes", len(body), n)
+		}
+		msgs = append(msgs, body[5:n])
+		body = body[n:]
+	}
+	return msgs
+}
+
+func TestGRPCBackend(t *testing.T) {
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = newGRPCBackend(t)
+	config.ForceHttp2 = true
+	client := newClient(config)
+
+	marshal := func(m proto.Message) []byte {
+		b, err := proto.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return grpcFrame(string(b))
+	}
+	tests := []struct {
+		desc       string
+		method     string
+		request    []byte
+		wantSizes  []int
+		wantStatus string
+	}{
+		{
+			desc:       "unary",
+			method:     "UnaryCall",
+			request:    marshal(&testpb.SimpleRequest{Payload: &testpb.Payload{Body: []byte("ping")}}),
+			wantSizes:  []int{4},
+			wantStatus: "0",
+		},
+		{
+			desc:   "server streaming",
+			method: "StreamingOutputCall",
+			request: marshal(&testpb.StreamingOutputCallRequest{ResponseParameters: []*testpb.ResponseParameters{
+				{Size: 1}, {Size: 100}, {Size: 10000},
+			}}),
+			wantSizes:  []int{1, 100, 10000},
+			wantStatus: "0",
+		},
+		{
+			desc:       "trailers-only",
+			method:     "EmptyCall",
+			request:    marshal(&testpb.Empty{}),
+			wantStatus: "12",
+		},
+	}
+	for i, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			id := string(rune('a' + i))
+			client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+				Id:     proto.String(id),
+				Method: proto.String("POST"),
+				Url:    proto.String("http://invalid/grpc.testing.TestService/" + tc.method),
+				Header: []*pb.HttpHeader{{
+					Name:  proto.String("Content-Type"),
+					Value: proto.String("application/grpc"),
+				}},
+				Body: tc.request,
+			})
+
+			received := relay.responses(id)
+			if len(received) == 0 {
+				t.Fatal("No response received")
+			}
+			if got := received[0].GetStatusCode(); got != http.StatusOK {
+				t.Errorf("Status = %d, want %d", got, http.StatusOK)
+			}
+			for _, h := range received[0].Header {
+				if strings.HasPrefix(h.GetName(), "Grpc-") {
+					t.Errorf("Response has header %s, want it as a trailer", h.GetName())
+				}
+			}
+			var body []byte
+			trailer := map[string]string{}
+			for _, resp := range received {
+				body = append(body, resp.Body...)
+				for _, h := range resp.Trailer {
+					trailer[h.GetName()] = h.GetValue()
+				}
+			}
+			if !received[len(received)-1].GetEof() {
+				t.Errorf("Last response isn't final")
+			}
+			var sizes []int
+			for _, msg := range grpcMessages(t, body) {
+				// UnaryCall and StreamingOutputCall responses both carry
+				// the payload in field 1.
+				resp := &testpb.SimpleResponse{}
+				if err := proto.Unmarshal(msg, resp); err != nil {
+					t.Fatalf("Invalid response message: %v", err)
+				}
+				sizes = append(sizes, len(resp.GetPayload().GetBody()))
+			}
+			if !reflect.DeepEqual(sizes, tc.wantSizes) {
+				t.Errorf("Got messages with payloads of %v bytes, want %v", sizes, tc.wantSizes)
+			}
+			if got := trailer["Grpc-Status"]; got != tc.wantStatus {
+				t.Errorf("Grpc-Status trailer = %q, want %q (%s)", got, tc.wantStatus, trailer["Grpc-Message"])
+			}
+		})
+	}
+}
+
+// grpcWebTrailers returns the gRPC-Web frame that carries the trailers of a
+// successful call.
+func grpcWebTrailers() []byte {
+	b := grpcFrame("grpc-status:0\r\ngrpc-message:OK\r\n")
+	b[0] = 0x80
+	return b
+}
+
+func TestGRPCWebResponseIsPostedPerFrame(t *testing.T) {
+	// A server-streaming response as sent by a gRPC-Web proxy: a small
+	// message, one larger than MaxChunkSize, and the trailers frame.
+	small := grpcFrame("\x0a\x05hello")
+	large := grpcFrame("\x0a\xc8\x01" + strings.Repeat("x", 200))
+	trailers := grpcWebTrailers()
+	payload := append(append(append([]byte{}, small...), large...), trailers...)
+	request := grpcFrame("\x0a\x04ping")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); !bytes.Equal(body, request) {
+			t.Errorf("Backend got request body %q, want %q", body, request)
+		}
+		if te := r.Header.Get("Te"); te != "" {
+			t.Errorf("Backend got TE %q, want none", te)
+		}
+		w.Header().Set("Content-Type", "application/grpc-web+proto")
+		// The frames arrive in pieces that don't match their boundaries,
+		// slowly enough for the relay client to send keep-alives.
+		rest := payload
+		for _, n := range []int{3, 20, 80, 80, 80, len(payload)} {
+			n = min(n, len(rest))
+			w.Write(rest[:n])
+			w.(http.Flusher).Flush()
+			rest = rest[n:]
+			time.Sleep(60 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.BackendResponseTimeout = 5 * time.Millisecond
+	config.MaxChunkSize = 64
+	client := newClient(config)
+	client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("POST"),
+		Url:    proto.String("http://invalid/test.Service/ServerStreaming"),
+		Header: []*pb.HttpHeader{{
+			Name:  proto.String("Content-Type"),
+			Value: proto.String("application/grpc-web+proto"),
+		}},
+		Body: request,
+	})
+
+	received := relay.responses("15")
+	if len(received) == 0 {
+		t.Fatal("No response received")
+	}
+	if got := received[0].GetStatusCode(); got != http.StatusOK {
+		t.Errorf("Status = %d, want %d", got, http.StatusOK)
+	}
+	if !received[len(received)-1].GetEof() {
+		t.Errorf("Last response isn't final")
+	}
+	var body, last []byte
+	for _, resp := range received {
+		if isKeepAlive(resp) {
+			t.Errorf("Keep-alive posted while a frame was incomplete")
+		}
+		if n := grpcWebBoundary(resp.Body); n != len(resp.Body) {
+			t.Errorf("Posted chunk %q ends with a partial frame", resp.Body)
+		}
+		if len(resp.Body) > 0 {
+			body = append(body, resp.Body...)
+			last = resp.Body
+		}
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("Body = %q, want %q", body, payload)
+	}
+	if !bytes.HasSuffix(last, trailers) {
+		t.Errorf("Last chunk %q doesn't end with the trailers frame", last)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/googlecloudrobotics/ilog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// healthHandler returns the handler for the health listener.
+func (c *Client) healthHandler() http.Handler {
+	h := http.NewServeMux()
+	h.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	})
+	h.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(clientVersion()))
+	})
+	h.Handle("/metrics", promhttp.Handler())
+	h.HandleFunc("/debug/requests", c.debugRequestsHandler)
+	h.HandleFunc("/debug/logging", c.debugLoggingHandler)
+	h.HandleFunc("/debug/relays", c.debugRelaysHandler)
+	h.HandleFunc("/debug/reset-relay-connections", c.relayResetHandler)
+	if c.config.EnablePprof {
+		// The index also serves the named profiles, eg heap, mutex and block.
+		h.HandleFunc("/debug/pprof/", pprof.Index)
+		h.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		h.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		h.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		h.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	if c.config.HealthTokenFile == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Health checks reveal nothing, and probes may not send tokens.
+		if r.URL.Path != "/healthz" && !c.healthAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// healthAuthorized returns true if r carries the bearer token in
+// HealthTokenFile. The file is read for each request, so that rotated tokens
+// are picked up.
+func (c *Client) healthAuthorized(r *http.Request) bool {
+	token, err := os.ReadFile(c.config.HealthTokenFile)
+	if err != nil {
+		slog.Error("Failed to read health listener token",
+			slog.String("File", c.config.HealthTokenFile), ilog.Err(err))
+		return false
+	}
+	want := strings.TrimSpace(string(token))
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// healthListenAddress returns the address that the health listener binds to
+// for address. An address without host, eg ":8082", binds to localhost, so
+// that the debug endpoints aren't exposed by accident.
+func healthListenAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host != "" {
+		return address
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+// setProfileRates enables the mutex and block profiles with the
+// PprofMutexProfileFraction and PprofBlockProfileRate, if EnablePprof is set.
+func (c *Client) setProfileRates() {
+	if !c.config.EnablePprof {
+		return
+	}
+	runtime.SetMutexProfileFraction(c.config.PprofMutexProfileFraction)
+	runtime.SetBlockProfileRate(c.config.PprofBlockProfileRate)
+}
+
+// serveHealth serves health checks, the client version, metrics, in-flight
+// requests, the relay servers, the debug logging toggle, the reset of the
+// relay connections and, if enabled, pprof on HealthAddress. It only returns
+// if the listener fails.
+func (c *Client) serveHealth() {
+	address := healthListenAddress(c.config.HealthAddress)
+	slog.Info("Health listener starting", slog.String("Address", address))
+	c.setProfileRates()
+	if err := http.ListenAndServe(address, c.healthHandler()); err != nil {
+		slog.Error("Health listener failed", slog.String("Address", address), ilog.Err(err))
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPprof(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		config := DefaultClientConfig()
+		config.EnablePprof = enabled
+		rec := httptest.NewRecorder()
+		newClient(config).healthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/heap", nil))
+
+		if enabled && rec.Code != http.StatusOK {
+			t.Errorf("EnablePprof=true: /debug/pprof/heap responded %d, want %d", rec.Code, http.StatusOK)
+		}
+		if !enabled && rec.Code != http.StatusNotFound {
+			t.Errorf("EnablePprof=false: /debug/pprof/heap responded %d, want %d", rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestHealthToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultClientConfig()
+	config.HealthTokenFile = tokenFile
+	config.EnablePprof = true
+	h := newClient(config).healthHandler()
+
+	tests := []struct {
+		path       string
+		auth       string
+		wantStatus int
+	}{
+		{"/healthz", "", http.StatusOK},
+		{"/metrics", "", http.StatusUnauthorized},
+		{"/metrics", "Bearer wrong", http.StatusUnauthorized},
+		{"/metrics", "secret", http.StatusUnauthorized},
+		{"/metrics", "Bearer secret", http.StatusOK},
+		{"/debug/pprof/heap", "", http.StatusUnauthorized},
+		{"/debug/pprof/heap", "Bearer secret", http.StatusOK},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s with Authorization %q responded %d, want %d", tc.path, tc.auth, rec.Code, tc.wantStatus)
+		}
+	}
+
+	if err := os.Remove(tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("/metrics without token file responded %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestHealthListenAddress(t *testing.T) {
+	tests := []struct {
+		address, want string
+	}{
+		{":8082", "localhost:8082"},
+		{"localhost:8082", "localhost:8082"},
+		{"0.0.0.0:8082", "0.0.0.0:8082"},
+		{"[::1]:8082", "[::1]:8082"},
+	}
+	for _, tc := range tests {
+		if got := healthListenAddress(tc.address); got != tc.want {
+			t.Errorf("healthListenAddress(%q) = %q, want %q", tc.address, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+// RequestSnapshot describes a request that is being relayed.
+type RequestSnapshot struct {
+	ID      string    `json:"id"`
+	TraceID string    `json:"trace_id"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Start   time.Time `json:"start"`
+	// Relay is the relay server that the request was pulled from.
+	Relay string `json:"relay"`
+	// State is the phase of the request (see requestPhase), or "Posting"
+	// while a response chunk is being posted to the relay server.
+	State         string `json:"state"`
+	BytesStreamed int64  `json:"bytes_streamed"`
+	// LastChunkPosted is zero if no chunk was posted yet.
+	LastChunkPosted time.Time `json:"last_chunk_posted,omitempty"`
+	// Priority is the priority the relay server gave the request.
+	Priority int32 `json:"priority,omitempty"`
+}
+
+// inFlightRequest is the entry of a request in Client.inFlight. Apart from
+// state, its fields are only written by handleRequest.
+type inFlightRequest struct {
+	state   *requestState
+	traceID string
+	method  string
+	relay   string
+	path    string
+	start   time.Time
+	// priority is the priority the relay server gave the request.
+	priority int32
+
+	posting       atomic.Bool
+	bytesStreamed atomic.Int64
+	// lastPosted is the time of the last posted chunk in Unix nanoseconds.
+	lastPosted atomic.Int64
+}
+
+// trackRequest adds the request to the in-flight requests. The returned
+// function removes it again.
+func (c *Client) trackRequest(state *requestState, breq *pb.HttpRequest, traceID string, start time.Time) (*inFlightRequest, func()) {
+	r := &inFlightRequest{
+		state:    state,
+		traceID:  traceID,
+		method:   breq.GetMethod(),
+		relay:    c.relayAddress(state.id),
+		start:    start,
+		priority: breq.GetPriority(),
+	}
+	if u, err := url.Parse(breq.GetUrl()); err == nil {
+		r.path = u.Path
+	}
+	c.inFlight.Store(state.id, r)
+	return r, func() { c.inFlight.Delete(state.id) }
+}
+
+// requestPriority returns the priority of the in-flight request id, or 0 if
+// it isn't tracked.
+func (c *Client) requestPriority(id string) int32 {
+	if r, ok := c.inFlight.Load(id); ok {
+		return r.(*inFlightRequest).priority
+	}
+	return 0
+}
+
+// startPosting marks that a chunk is being posted to the relay server.
+func (r *inFlightRequest) startPosting() {
+	r.posting.Store(true)
+}
+
+// posted records that the chunk resp was posted to the relay server.
+func (r *inFlightRequest) posted(resp *pb.HttpResponse) {
+	r.bytesStreamed.Add(int64(len(resp.Body)))
+	r.lastPosted.Store(time.Now().UnixNano())
+	r.posting.Store(false)
+}
+
+// logAbnormalEnd logs a summary of a request that failed or was cancelled.
+// Its last response, which would carry BackendDurationMs, may never have been
+// posted.
+func (r *inFlightRequest) logAbnormalEnd() {
+	phase := r.state.current()
+	if phase != phaseFailed && phase != phaseCancelled {
+		return
+	}
+	slog.Warn("Request ended abnormally",
+		slog.String("ID", r.state.id),
+		slog.String("State", phase.String()),
+		slog.Float64("Duration", time.Since(r.start).Seconds()),
+		slog.Int64("BytesStreamed", r.bytesStreamed.Load()),
+		slog.Int("Priority", int(r.priority)))
+}
+
+func (r *inFlightRequest) snapshot() RequestSnapshot {
+	s := RequestSnapshot{
+		ID:            r.state.id,
+		TraceID:       r.traceID,
+		Method:        r.method,
+		Relay:         r.relay,
+		Path:          r.path,
+		Start:         r.start,
+		State:         r.state.current().String(),
+		BytesStreamed: r.bytesStreamed.Load(),
+		Priority:      r.priority,
+	}
+	if r.posting.Load() {
+		s.State = "Posting"
+	}
+	if t := r.lastPosted.Load(); t != 0 {
+		s.LastChunkPosted = time.Unix(0, t)
+	}
+	return s
+}
+
+// Snapshot returns the requests that are currently relayed, oldest first.
+func (c *Client) Snapshot() []RequestSnapshot {
+	snapshots := []RequestSnapshot{}
+	c.inFlight.Range(func(_, v any) bool {
+		snapshots = append(snapshots, v.(*inFlightRequest).snapshot())
+		return true
+	})
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Start.Before(snapshots[j].Start)
+	})
+	return snapshots
+}
+
+// debugRequestsHandler serves Snapshot as JSON.
+func (c *Client) debugRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Snapshot())
+}
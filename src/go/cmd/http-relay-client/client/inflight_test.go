@@ -0,0 +1,136 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestInFlightRequests(t *testing.T) {
+	relay := newRecordingRelay()
+	defer relay.Close()
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: foo\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer backend.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.BackendResponseTimeout = 10 * time.Millisecond
+	client := newClient(config)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.handleRequest(&http.Client{}, &http.Client{}, &pb.HttpRequest{
+			Id:     proto.String("15"),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid/events?watch=true"),
+		})
+	}()
+
+	// Wait for the chunk with the first event to be posted.
+	var snapshot RequestSnapshot
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if s := client.Snapshot(); len(s) == 1 && s[0].BytesStreamed > 0 {
+			snapshot = s[0]
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the first chunk, snapshot: %+v", client.Snapshot())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if snapshot.ID != "15" || snapshot.Method != "GET" || snapshot.Path != "/events" {
+		t.Errorf("Unexpected snapshot %+v", snapshot)
+	}
+	if snapshot.TraceID == "" || snapshot.LastChunkPosted.IsZero() {
+		t.Errorf("Incomplete snapshot %+v", snapshot)
+	}
+	if snapshot.BytesStreamed != int64(len("data: foo\n\n")) {
+		t.Errorf("BytesStreamed = %d, want %d", snapshot.BytesStreamed, len("data: foo\n\n"))
+	}
+
+	rec := httptest.NewRecorder()
+	client.healthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/requests", nil))
+	var served []RequestSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatalf("Invalid /debug/requests response %q: %v", rec.Body.String(), err)
+	}
+	if len(served) != 1 || served[0].ID != "15" || served[0].TraceID != snapshot.TraceID {
+		t.Errorf("/debug/requests = %+v, want request 15", served)
+	}
+
+	close(release)
+	<-done
+	if s := client.Snapshot(); len(s) != 0 {
+		t.Errorf("Snapshot() = %+v after the request finished, want none", s)
+	}
+}
+
+func TestAbnormalEndIsLogged(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// The backend fails after the first chunk of the response was posted.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: foo\n\n"))
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		panic(http.ErrAbortHandler)
+	}))
+	defer backend.Close()
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.UseResponseStreams = false
+	client := newClient(config)
+	client.handleRequest(&http.Client{}, &http.Client{}, &pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/events"),
+	})
+
+	if !strings.Contains(logs.String(), `msg="Request ended abnormally" ID=15 State=Failed`) {
+		t.Errorf("Missing summary of the failed request in logs:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "BytesStreamed=11") {
+		t.Errorf("Summary doesn't report the 11 bytes streamed:\n%s", logs.String())
+	}
+}
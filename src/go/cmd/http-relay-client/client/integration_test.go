@@ -0,0 +1,431 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// newFakeRelayClient returns a client for the fake relay and the backend.
+// Retries are fast, so injected faults don't slow down tests.
+func newFakeRelayClient(relay *relaytest.Server, backend *httptest.Server) *Client {
+	config := fakeRelayConfig(relay)
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.DisableAuthForRemote = true
+	config.StartupJitter = 0
+	config.PollJitter = 0
+	config.ResponseRetryPolicy.InitialInterval = time.Millisecond
+	config.ResponseRetryPolicy.MaxInterval = 10 * time.Millisecond
+	return newClient(config)
+}
+
+// fakeRelayConfig returns the default config with the fake relay as the
+// relay server.
+func fakeRelayConfig(relay *relaytest.Server) ClientConfig {
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = relay.Address()
+	return config
+}
+
+// body returns the concatenated bodies of responses.
+func body(responses []*pb.HttpResponse) string {
+	var b strings.Builder
+	for _, resp := range responses {
+		b.Write(resp.Body)
+	}
+	return b.String()
+}
+
+func TestFakeRelay(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hello":
+			w.Write([]byte("hello"))
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, event := range []string{"one", "two", "three"} {
+				w.Write([]byte("data: " + event + "\n\n"))
+				w.(http.Flusher).Flush()
+				time.Sleep(150 * time.Millisecond)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		desc   string
+		path   string
+		faults map[string][]relaytest.Fault
+		// wantErr is the error returned by localProxy.
+		wantErr    error
+		wantStatus int32
+		wantBody   string
+		wantChunks int
+	}{
+		{
+			desc:       "simple request",
+			path:       "/hello",
+			wantStatus: http.StatusOK,
+			wantBody:   "hello",
+			wantChunks: 1,
+		},
+		{
+			desc:       "backend error",
+			path:       "/missing",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "404 page not found\n",
+			wantChunks: 1,
+		},
+		{
+			desc:       "streamed response",
+			path:       "/events",
+			wantStatus: http.StatusOK,
+			wantBody:   "data: one\n\ndata: two\n\ndata: three\n\n",
+			// The header, one chunk per event, and the final chunk.
+			wantChunks: 5,
+		},
+		{
+			desc: "response retried after server error",
+			path: "/hello",
+			faults: map[string][]relaytest.Fault{
+				relaytest.ResponsePath: {{StatusCode: http.StatusInternalServerError}},
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "hello",
+			wantChunks: 1,
+		},
+		{
+			desc: "response retried after dropped connection",
+			path: "/hello",
+			faults: map[string][]relaytest.Fault{
+				relaytest.ResponsePath: {{Drop: true}, {Drop: true}},
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "hello",
+			wantChunks: 1,
+		},
+		{
+			desc: "response rejected",
+			path: "/hello",
+			faults: map[string][]relaytest.Fault{
+				relaytest.ResponsePath: {{StatusCode: http.StatusBadRequest}},
+			},
+		},
+		{
+			desc: "poll timeout",
+			faults: map[string][]relaytest.Fault{
+				relaytest.RequestPath: {{StatusCode: http.StatusRequestTimeout}},
+			},
+			wantErr: ErrTimeout,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := relaytest.NewServer()
+			defer relay.Close()
+			for path, faults := range tc.faults {
+				relay.InjectFault(path, faults...)
+			}
+			if tc.path != "" {
+				relay.Enqueue(&pb.HttpRequest{
+					Id:     proto.String("15"),
+					Method: proto.String("GET"),
+					Url:    proto.String("http://invalid" + tc.path),
+				})
+			}
+			c := newFakeRelayClient(relay, backend)
+			// Response streams would bypass the injected faults.
+			c.config.UseResponseStreams = false
+			// Each event is posted before the next one arrives.
+			c.config.BackendResponseTimeout = 20 * time.Millisecond
+
+			if err := c.localProxy(&http.Client{}, &http.Client{}, &proxyWorker{}); err != tc.wantErr {
+				t.Fatalf("localProxy() = %v, want %v", err, tc.wantErr)
+			}
+			c.requests.Wait()
+
+			responses := relay.Responses("15")
+			if len(responses) != tc.wantChunks {
+				t.Fatalf("Got %d responses, want %d: %v", len(responses), tc.wantChunks, responses)
+			}
+			if tc.wantChunks == 0 {
+				return
+			}
+			if got := responses[0].GetStatusCode(); got != tc.wantStatus {
+				t.Errorf("Status = %d, want %d", got, tc.wantStatus)
+			}
+			if got := body(responses); got != tc.wantBody {
+				t.Errorf("Body = %q, want %q", got, tc.wantBody)
+			}
+			for i, resp := range responses {
+				if got, want := resp.GetEof(), i == len(responses)-1; got != want {
+					t.Errorf("Response %d has Eof %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFakeRelayRequestStream(t *testing.T) {
+	// The backend switches protocols, and echoes the first 5 bytes it gets.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Failed to hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(brw, buf); err != nil {
+			t.Errorf("Failed to read from request stream: %v", err)
+			return
+		}
+		conn.Write(buf)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		desc   string
+		faults []relaytest.Fault
+	}{
+		{"no faults", nil},
+		{"retried after server error", []relaytest.Fault{{StatusCode: http.StatusServiceUnavailable}}},
+		{"retried after dropped connection", []relaytest.Fault{{Drop: true}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := relaytest.NewServer()
+			defer relay.Close()
+			relay.InjectFault(relaytest.RequestStreamPath, tc.faults...)
+			relay.Enqueue(&pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/echo"),
+				Header: []*pb.HttpHeader{
+					{Name: proto.String("Connection"), Value: proto.String("Upgrade")},
+					{Name: proto.String("Upgrade"), Value: proto.String("echo")},
+				},
+			})
+			relay.SendRequestStream("15", []byte("he"))
+			relay.SendRequestStream("15", []byte("llo"))
+			relay.CloseRequestStream("15")
+			c := newFakeRelayClient(relay, backend)
+			c.config.UseResponseStreams = false
+
+			if err := c.localProxy(&http.Client{}, &http.Client{}, &proxyWorker{}); err != nil {
+				t.Fatal(err)
+			}
+			responses, err := relay.WaitForResponses("15", 10*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.requests.Wait()
+			if got := responses[0].GetStatusCode(); got != http.StatusSwitchingProtocols {
+				t.Errorf("Status = %d, want %d", got, http.StatusSwitchingProtocols)
+			}
+			if got := body(responses); got != "hello" {
+				t.Errorf("Body = %q, want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestFakeRelayPollFaults(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	relay := relaytest.NewServer()
+	defer relay.Close()
+	// The client polls again after the failures.
+	relay.InjectFault(relaytest.RequestPath,
+		relaytest.Fault{StatusCode: http.StatusInternalServerError},
+		relaytest.Fault{Drop: true})
+	relay.Enqueue(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/"),
+	})
+	c := newFakeRelayClient(relay, backend)
+	var mu sync.Mutex
+	var pollErrors []error
+	c.config.ErrorHandler = func(err error, id string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if id == "" {
+			pollErrors = append(pollErrors, err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Start()
+	}()
+	responses, err := relay.WaitForResponses("15", 10*time.Second)
+	c.Stop()
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := body(responses); got != "hello" {
+		t.Errorf("Body = %q, want %q", got, "hello")
+	}
+	if got := relay.Polls(); got < 3 {
+		t.Errorf("Got %d polls, want at least 3", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// The transport may retry the dropped poll by itself.
+	if len(pollErrors) == 0 {
+		t.Error("Got no reported poll errors, want at least 1")
+	}
+}
+
+func TestFakeRelayReportsRejectedResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	relay := relaytest.NewServer()
+	defer relay.Close()
+	relay.InjectFault(relaytest.ResponsePath, relaytest.Fault{StatusCode: http.StatusBadRequest})
+	relay.Enqueue(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/"),
+	})
+	c := newFakeRelayClient(relay, backend)
+	c.config.UseResponseStreams = false
+	var mu sync.Mutex
+	reported := map[string]error{}
+	c.config.ErrorHandler = func(err error, id string) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported[id] = err
+	}
+
+	if err := c.localProxy(&http.Client{}, &http.Client{}, &proxyWorker{}); err != nil {
+		t.Fatal(err)
+	}
+	c.requests.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reported) != 1 || !errors.Is(reported["15"], ErrRelayRejected) {
+		t.Errorf("Reported errors %v, want one matching ErrRelayRejected for request 15", reported)
+	}
+}
+
+// panickingTransport panics for the first panics requests, and sends the
+// others with http.DefaultTransport.
+type panickingTransport struct {
+	mu     sync.Mutex
+	panics int
+}
+
+func (p *panickingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p.mu.Lock()
+	panics := p.panics > 0
+	p.panics--
+	p.mu.Unlock()
+	if panics {
+		panic("transport bug")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestFakeRelayRecoversRequestPanic(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	relay := relaytest.NewServer()
+	defer relay.Close()
+	for _, id := range []string{"15", "16"} {
+		relay.Enqueue(&pb.HttpRequest{
+			Id:     proto.String(id),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid/"),
+		})
+	}
+	c := newFakeRelayClient(relay, backend)
+	c.config.UseResponseStreams = false
+	local := &http.Client{Transport: &panickingTransport{panics: 1}}
+
+	for i := 0; i < 2; i++ {
+		if err := c.localProxy(&http.Client{}, local, &proxyWorker{}); err != nil {
+			t.Fatal(err)
+		}
+		c.requests.Wait()
+	}
+
+	responses := relay.Responses("15")
+	if len(responses) != 1 || responses[0].GetStatusCode() != http.StatusInternalServerError {
+		t.Errorf("Got responses %v for the panicking request, want a 500 error", responses)
+	}
+	if got := body(relay.Responses("16")); got != "hello" {
+		t.Errorf("Body = %q, want %q", got, "hello")
+	}
+}
+
+func TestFakeRelayRestartsPanickedWorker(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	relay := relaytest.NewServer()
+	defer relay.Close()
+	relay.Enqueue(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/"),
+	})
+	c := newFakeRelayClient(relay, backend)
+	// The only worker panics on its first poll.
+	remote := &http.Client{Transport: &panickingTransport{panics: 1}}
+	c.startWorker(remote, &http.Client{}, false)
+
+	responses, err := relay.WaitForResponses("15", 10*time.Second)
+	c.Stop()
+	c.workerGroup.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := body(responses); got != "hello" {
+		t.Errorf("Body = %q, want %q", got, "hello")
+	}
+	if got := c.workers.Load(); got != 0 {
+		t.Errorf("%d workers left after stopping, want 0", got)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"log/slog"
+	"net/http"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+// The values of IntegrityChecks.
+const (
+	integrityOff           = "off"
+	integrityVerify        = "verify"
+	integrityVerifyAndSign = "verify-and-sign"
+)
+
+// verifyRequestBody checks the body of breq against the hash that the relay
+// server sent along, if IntegrityChecks is on. Requests without a hash, eg
+// from relay servers that don't send one, pass.
+func (c *Client) verifyRequestBody(breq *pb.HttpRequest) error {
+	if c.config.IntegrityChecks == integrityOff || breq.BodySha256 == nil {
+		return nil
+	}
+	if sum := sha256.Sum256(breq.Body); !bytes.Equal(sum[:], breq.BodySha256) {
+		slog.Warn("Rejecting request whose body doesn't match its hash",
+			slog.String("ID", breq.GetId()), slog.Int("Bytes", len(breq.Body)))
+		return &statusError{http.StatusBadRequest, errors.New("request body doesn't match its SHA-256 hash")}
+	}
+	return nil
+}
+
+// responseSigner sets the hashes that the relay server checks the bodies of
+// the responses to a request against. The hash of the whole body is updated
+// with each response, so that it's ready with the final one. A nil
+// responseSigner, as returned unless IntegrityChecks is "verify-and-sign",
+// leaves responses as they are.
+type responseSigner struct {
+	total hash.Hash
+}
+
+func (c *Client) newResponseSigner() *responseSigner {
+	if c.config.IntegrityChecks != integrityVerifyAndSign {
+		return nil
+	}
+	return &responseSigner{total: sha256.New()}
+}
+
+// sign sets the hash of the body of resp, and that of the whole body if resp
+// is the final response. The responses must be signed in order, before their
+// bodies are encoded.
+func (s *responseSigner) sign(resp *pb.HttpResponse) {
+	if s == nil {
+		return
+	}
+	sum := sha256.Sum256(resp.Body)
+	resp.BodySha256 = sum[:]
+	s.total.Write(resp.Body)
+	if resp.GetEof() {
+		resp.TotalBodySha256 = s.total.Sum(nil)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestVerifyRequestBody(t *testing.T) {
+	body := []byte(`{"kind": "Pod"}`)
+	sum := sha256.Sum256(body)
+	tampered := sha256.Sum256([]byte(`{"kind": "Secret"}`))
+	tests := []struct {
+		desc       string
+		mode       string
+		hash       []byte
+		wantStatus int
+	}{
+		{"off ignores hash", integrityOff, tampered[:], http.StatusOK},
+		{"verify passes matching hash", integrityVerify, sum[:], http.StatusOK},
+		{"verify passes request without hash", integrityVerify, nil, http.StatusOK},
+		{"verify rejects tampered body", integrityVerify, tampered[:], http.StatusBadRequest},
+		{"verify-and-sign rejects tampered body", integrityVerifyAndSign, tampered[:], http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := newRecordingRelay()
+			defer relay.Close()
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.IntegrityChecks = tc.mode
+			var backendBody []byte
+			backend := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				backendBody, _ = io.ReadAll(req.Body)
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{},
+					Body:       io.NopCloser(strings.NewReader("ok")),
+					Request:    req,
+				}, nil
+			})}
+
+			newClient(config).handleRequest(&http.Client{}, backend, &pb.HttpRequest{
+				Id:         proto.String("1"),
+				Method:     proto.String("POST"),
+				Url:        proto.String("http://invalid/foo"),
+				Body:       body,
+				BodySha256: tc.hash,
+			})
+
+			resps := relay.responses("1")
+			if len(resps) == 0 {
+				t.Fatal("Relay received no response")
+			}
+			if got := int(resps[0].GetStatusCode()); got != tc.wantStatus {
+				t.Errorf("Got status %d, want %d", got, tc.wantStatus)
+			}
+			if tc.wantStatus == http.StatusOK && !bytes.Equal(backendBody, body) {
+				t.Errorf("Backend got body %q, want %q", backendBody, body)
+			}
+			if tc.wantStatus != http.StatusOK && backendBody != nil {
+				t.Errorf("Backend got request with tampered body %q", backendBody)
+			}
+		})
+	}
+}
+
+func TestResponsesAreSigned(t *testing.T) {
+	body := strings.Repeat("0123456789abcdef", 8)
+	for _, tc := range []struct {
+		mode       string
+		wantSigned bool
+	}{
+		{integrityVerify, false},
+		{integrityVerifyAndSign, true},
+	} {
+		relay := newRecordingRelay()
+		defer relay.Close()
+		config := DefaultClientConfig()
+		config.RelayScheme = "http"
+		config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+		config.IntegrityChecks = tc.mode
+		config.BlockSize = 16
+		config.MaxChunkSize = 16
+
+		newClient(config).handleRequest(&http.Client{}, newFixedBackend(body, false), &pb.HttpRequest{
+			Id:     proto.String("1"),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid/foo"),
+		})
+
+		resps := relay.responses("1")
+		if len(resps) < 2 {
+			t.Fatalf("%s: relay received %d chunks, want several", tc.mode, len(resps))
+		}
+		var got []byte
+		for i, resp := range resps {
+			got = append(got, resp.Body...)
+			if !tc.wantSigned {
+				if resp.BodySha256 != nil || resp.TotalBodySha256 != nil {
+					t.Errorf("%s: chunk %d is signed, want no hashes", tc.mode, i)
+				}
+				continue
+			}
+			if sum := sha256.Sum256(resp.Body); !bytes.Equal(resp.BodySha256, sum[:]) {
+				t.Errorf("%s: chunk %d has hash %x, want %x", tc.mode, i, resp.BodySha256, sum)
+			}
+			if !resp.GetEof() && resp.TotalBodySha256 != nil {
+				t.Errorf("%s: intermediate chunk %d has the hash of the whole body", tc.mode, i)
+			}
+		}
+		if string(got) != body {
+			t.Fatalf("%s: relay received body %q, want %q", tc.mode, got, body)
+		}
+		last := resps[len(resps)-1]
+		if sum := sha256.Sum256(got); tc.wantSigned && !bytes.Equal(last.TotalBodySha256, sum[:]) {
+			t.Errorf("%s: final chunk has total hash %x, want %x", tc.mode, last.TotalBodySha256, sum)
+		}
+	}
+}
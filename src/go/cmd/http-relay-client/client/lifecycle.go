@@ -0,0 +1,52 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// requestGroup owns the goroutines that are started to handle a request. They
+// run with the group's context, which is cancelled once the request is done or
+// aborted, and wait only returns once all of them have returned, so that none
+// of them outlives the request.
+type requestGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newRequestGroup(parent context.Context) *requestGroup {
+	ctx, cancel := context.WithCancel(parent)
+	requestGroups.Inc()
+	return &requestGroup{ctx: ctx, cancel: cancel}
+}
+
+// Go runs f in a new goroutine of the group.
+func (g *requestGroup) Go(f func()) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		f()
+	}()
+}
+
+// wait cancels the group's context and waits for its goroutines to return.
+func (g *requestGroup) wait() {
+	g.cancel()
+	g.wg.Wait()
+	requestGroups.Dec()
+}
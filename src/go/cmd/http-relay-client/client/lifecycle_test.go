@@ -0,0 +1,272 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"go.uber.org/goleak"
+	"google.golang.org/protobuf/proto"
+)
+
+// endlessBody is a backend response body that never ends by itself. Reads
+// fail once the backend request is cancelled or the body is closed. Writes
+// are discarded, so that it can be the body of an upgraded connection.
+type endlessBody struct {
+	ctx    context.Context
+	once   sync.Once
+	closed chan struct{}
+	// failAfter makes reads fail after that many bytes if positive.
+	failAfter int
+	read      int
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	select {
+	case <-b.closed:
+		return 0, io.ErrClosedPipe
+	case <-b.ctx.Done():
+		return 0, b.ctx.Err()
+	case <-time.After(time.Millisecond):
+	}
+	if b.failAfter > 0 && b.read >= b.failAfter {
+		return 0, errors.New("backend went away")
+	}
+	n := copy(p, strings.Repeat("x", 100))
+	b.read += n
+	return n, nil
+}
+
+func (b *endlessBody) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (b *endlessBody) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+// goroutineID returns the ID of the calling goroutine.
+func goroutineID() string {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	return strings.Fields(string(buf))[1]
+}
+
+// goroutinesCreatedBy returns the stacks of the live goroutines that were
+// started by the goroutine with the given ID.
+func goroutinesCreatedBy(id string) []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	var found []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, " in goroutine "+id+"\n") {
+			found = append(found, g)
+		}
+	}
+	return found
+}
+
+func TestRequestGoroutinesEndWithRequest(t *testing.T) {
+	endless := func(status, failAfter int) roundTripperFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode:    status,
+				Header:        http.Header{"Content-Type": {"text/plain"}},
+				ContentLength: -1,
+				Body:          &endlessBody{ctx: req.Context(), closed: make(chan struct{}), failAfter: failAfter},
+				Request:       req,
+			}, nil
+		}
+	}
+	tests := []struct {
+		desc    string
+		url     string
+		upgrade bool
+		backend roundTripperFunc
+		// acceptPosts is the number of responses the relay server accepts
+		// before it rejects the rest.
+		acceptPosts int
+		window      int
+	}{
+		{
+			desc: "invalid request",
+			url:  "http://invalid/%zz",
+		},
+		{
+			desc: "backend error",
+			backend: func(*http.Request) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			},
+			acceptPosts: 1,
+		},
+		{
+			desc:        "backend read error",
+			backend:     endless(http.StatusOK, 1000),
+			acceptPosts: 100,
+		},
+		{
+			desc:        "first post rejected",
+			backend:     endless(http.StatusOK, 0),
+			acceptPosts: 0,
+		},
+		{
+			desc:        "later post rejected",
+			backend:     endless(http.StatusOK, 0),
+			acceptPosts: 3,
+		},
+		{
+			desc:        "pipelined post rejected",
+			backend:     endless(http.StatusOK, 0),
+			acceptPosts: 3,
+			window:      4,
+		},
+		{
+			desc:        "upgraded connection rejected",
+			upgrade:     true,
+			backend:     endless(http.StatusSwitchingProtocols, 0),
+			acceptPosts: 3,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			var posts atomic.Int32
+			relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				if r.URL.Path == "/server/requeststream" {
+					// The client doesn't send anything on the connection.
+					<-r.Context().Done()
+					return
+				}
+				if r.URL.Path == "/server/response" && posts.Add(1) <= int32(tc.acceptPosts) {
+					w.Write([]byte("ok"))
+					return
+				}
+				http.Error(w, "Unknown request ID", http.StatusBadRequest)
+			}))
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.MaxChunkSize = 100
+			if tc.window > 0 {
+				config.MaxChunksInFlight = tc.window
+			}
+			client := newClient(config)
+			client.sequencedResponses.Store(tc.window > 0)
+			remote := &http.Client{Transport: &http.Transport{}}
+			pbreq := &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			}
+			if tc.url != "" {
+				pbreq.Url = proto.String(tc.url)
+			}
+			if tc.upgrade {
+				pbreq.Header = []*pb.HttpHeader{
+					{Name: proto.String("Connection"), Value: proto.String("Upgrade")},
+					{Name: proto.String("Upgrade"), Value: proto.String("test")},
+				}
+			}
+
+			// goleak waits for goroutines to end, so it wouldn't notice if
+			// they only ended after handleRequest returned.
+			leaked := make(chan []string)
+			go func() {
+				id := goroutineID()
+				client.handleRequest(remote, &http.Client{Transport: tc.backend}, pbreq)
+				leaked <- goroutinesCreatedBy(id)
+			}()
+			select {
+			case found := <-leaked:
+				if len(found) > 0 {
+					t.Errorf("Goroutines outlived the request:\n%s", strings.Join(found, "\n\n"))
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("handleRequest didn't return")
+			}
+			remote.CloseIdleConnections()
+		})
+	}
+}
+
+func TestPipelineStopsWhenResponseIsAbandoned(t *testing.T) {
+	for _, upgrade := range []bool{false, true} {
+		t.Run(fmt.Sprintf("upgrade=%v", upgrade), func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			config := DefaultClientConfig()
+			config.MaxChunkSize = 100
+			config.BackendResponseTimeout = 10 * time.Millisecond
+			c := newClient(config)
+			// The body only ends when closed, so that the pipeline has to
+			// close it.
+			body := &endlessBody{ctx: context.Background(), closed: make(chan struct{})}
+			ctx, cancel := context.WithCancel(context.Background())
+			bodyChannel := make(chan []byte)
+			out := make(chan *pb.HttpResponse)
+			resp := &pb.HttpResponse{Id: proto.String("15"), StatusCode: proto.Int32(http.StatusOK)}
+			timer := newChunkTimer(time.Now())
+			go c.streamBytes(ctx, "15", body, bodyChannel, newRequestState("15"))
+			if upgrade {
+				go c.buildUpgradedResponses(ctx, bodyChannel, resp, out, timer)
+			} else {
+				go c.buildResponses(ctx, bodyChannel, resp, out, false, unframed, timer)
+			}
+
+			// Posting fails permanently after the first response, so
+			// nothing reads out anymore.
+			<-out
+			cancel()
+			select {
+			case <-body.closed:
+			case <-time.After(5 * time.Second):
+				t.Error("Backend response body wasn't closed")
+			}
+		})
+	}
+}
+
+func TestRequestGroup(t *testing.T) {
+	group := newRequestGroup(context.Background())
+	var returned atomic.Int32
+	for i := 0; i < 3; i++ {
+		group.Go(func() {
+			<-group.ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+			returned.Add(1)
+		})
+	}
+	group.wait()
+	if got := returned.Load(); got != 3 {
+		t.Errorf("%d goroutines returned before wait did, want 3", got)
+	}
+}
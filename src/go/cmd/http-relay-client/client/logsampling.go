@@ -0,0 +1,125 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/googlecloudrobotics/ilog"
+)
+
+// LogSampling limits how often identical errors are logged, so that eg a
+// backend that keeps refusing connections doesn't fill the disk with the
+// same line. Errors of a class, ie with the same message and root cause,
+// are logged for the First occurrences, then once per Interval, with the
+// number of messages suppressed since the last one as Suppressed. A class that hasn't
+// occurred for an Interval is logged at full rate again. Sampling is
+// disabled if Interval is 0. Metrics and the ErrorHandler still see every
+// error.
+type LogSampling struct {
+	First    int
+	Interval time.Duration
+}
+
+// logSampler implements LogSampling. A nil *logSampler logs every message.
+type logSampler struct {
+	first    int
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	classes map[string]*sampledClass
+}
+
+type sampledClass struct {
+	count      int
+	suppressed int
+	lastSeen   time.Time
+	lastLogged time.Time
+}
+
+func newLogSampler(s LogSampling) *logSampler {
+	return &logSampler{
+		first:    s.First,
+		interval: s.Interval,
+		now:      time.Now,
+		classes:  map[string]*sampledClass{},
+	}
+}
+
+// log logs msg with err and attrs at level, unless it's sampled out.
+func (s *logSampler) log(level slog.Level, msg string, err error, attrs ...slog.Attr) {
+	if s != nil && err != nil {
+		suppressed, ok := s.sample(msg + ": " + rootCause(err).Error())
+		if !ok {
+			return
+		}
+		if suppressed > 0 {
+			attrs = append(attrs, slog.Int("Suppressed", suppressed))
+		}
+	}
+	attrs = append(attrs, ilog.Err(err))
+	slog.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// sample returns whether a message of class should be logged, and how many
+// were suppressed since the last one that was.
+func (s *logSampler) sample(class string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	// Forget classes that went quiet, so the map doesn't grow with errors
+	// that don't repeat. Those with suppressed messages are kept to report
+	// them when they occur again.
+	for k, c := range s.classes {
+		if now.Sub(c.lastSeen) >= s.interval && c.suppressed == 0 {
+			delete(s.classes, k)
+		}
+	}
+	c, ok := s.classes[class]
+	if !ok {
+		c = &sampledClass{}
+		s.classes[class] = c
+	}
+	if now.Sub(c.lastSeen) >= s.interval {
+		c.count = 0
+	}
+	c.lastSeen = now
+	c.count++
+	if c.count > s.first && now.Sub(c.lastLogged) < s.interval {
+		c.suppressed++
+		return 0, false
+	}
+	suppressed := c.suppressed
+	c.suppressed = 0
+	c.lastLogged = now
+	return suppressed, true
+}
+
+// rootCause returns the innermost error wrapped by err, which leaves out
+// request IDs and URLs that would make each occurrence of an error unique.
+func rootCause(err error) error {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return err
+		}
+		err = next
+	}
+}
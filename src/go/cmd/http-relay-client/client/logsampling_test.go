@@ -0,0 +1,116 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLogSampler(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	s := newLogSampler(LogSampling{First: 2, Interval: time.Minute})
+	s.now = clock.now
+	refused := fmt.Errorf("request 15: %w", errRefused)
+	timeout := errors.New("timeout")
+
+	steps := []struct {
+		advance        time.Duration
+		err            error
+		wantLogged     bool
+		wantSuppressed int
+	}{
+		{0, refused, true, 0},
+		{0, fmt.Errorf("request 16: %w", errRefused), true, 0},
+		{time.Second, refused, false, 0},
+		{time.Second, refused, false, 0},
+		// Another class isn't affected.
+		{time.Second, timeout, true, 0},
+		{30 * time.Second, refused, false, 0},
+		{30 * time.Second, refused, true, 3},
+		{time.Second, refused, false, 0},
+		// Once quiet for an interval, the class logs at full rate again,
+		// after reporting what was suppressed.
+		{2 * time.Minute, refused, true, 1},
+		{time.Second, refused, true, 0},
+		{time.Second, refused, false, 0},
+	}
+	for i, step := range steps {
+		clock.advance(step.advance)
+		suppressed, logged := s.sample("BackendRequest: " + rootCause(step.err).Error())
+		if logged != step.wantLogged || suppressed != step.wantSuppressed {
+			t.Errorf("Step %d: sample() = %d, %v, want %d, %v", i, suppressed, logged, step.wantSuppressed, step.wantLogged)
+		}
+	}
+	if len(s.classes) != 1 {
+		t.Errorf("Sampler keeps %d classes, want 1 after the timeout went quiet", len(s.classes))
+	}
+}
+
+func TestLogSamplingReportsEveryError(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// A backend that refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendAddress := l.Addr().String()
+	l.Close()
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = backendAddress
+	config.LogSampling = LogSampling{First: 3, Interval: time.Hour}
+	reported := 0
+	config.ErrorHandler = func(err error, id string) {
+		reported++
+	}
+	client := newClient(config)
+
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprint(i)
+		client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+			Id:     proto.String(id),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid/foo"),
+		})
+		if received := relay.responses(id); len(received) == 0 || received[0].GetStatusCode() != http.StatusBadGateway {
+			t.Errorf("Request %s: got %v, want a 502 response", id, received)
+		}
+	}
+	if got := strings.Count(logs.String(), "msg=BackendRequest"); got != 3 {
+		t.Errorf("Logged %d backend errors, want 3:\n%s", got, logs.String())
+	}
+	if reported != 10 {
+		t.Errorf("ErrorHandler was called %d times, want 10", reported)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	relayQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "relay_client_queue_depth",
+			Help: "Number of requests queued on the relay server, as last reported by it",
+		},
+	)
+	relayPollWorkers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "relay_client_poll_workers",
+			Help: "Number of workers polling the relay server for requests",
+		},
+	)
+	workerRecycles = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "relay_client_worker_recycles_total",
+			Help: "Number of workers replaced by a fresh goroutine after WorkerRecycleInterval",
+		},
+	)
+	backendBreakerState = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "relay_client_backend_breaker_state",
+			Help: "State of the backend circuit breaker (0: closed, 1: open, 2: half-open)",
+		},
+	)
+	invalidHeaderValues = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_client_invalid_header_values_total",
+			Help: "Number of backend header values with CR, LF or NUL bytes, by action taken",
+		},
+		[]string{"action"},
+	)
+	tlsReloadFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "relay_client_tls_reload_failures_total",
+			Help: "Number of failed attempts to reload the root CAs or a client certificate",
+		},
+	)
+	concurrentRequests = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "relay_client_concurrent_requests",
+			Help: "Number of requests currently handled, see MaxConcurrentRequests",
+		},
+	)
+	responseBatchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "relay_client_response_batch_size",
+			Help:    "Number of responses posted together to the relay server, see BatchDelay",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+		},
+	)
+	uploadThrottledSeconds = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "relay_client_upload_throttled_seconds_total",
+			Help: "Time responses were held back to stay within upload rate limits, see MaxUploadBytesPerSecond",
+		},
+	)
+	responseCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_client_response_cache_lookups_total",
+			Help: "Number of cacheable requests by result: hit, miss, stale or revalidated, see ResponseCacheMaxBytes",
+		},
+		[]string{"result"},
+	)
+	responseCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "relay_client_response_cache_bytes",
+			Help: "Size of the cached responses, see ResponseCacheMaxBytes",
+		},
+	)
+	activeRelay = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "relay_client_active_relay",
+			Help: "1 for the relay server that is polled, 0 for the others, see RelayAddresses",
+		},
+		[]string{"address"},
+	)
+	recoveredPanics = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_client_recovered_panics_total",
+			Help: "Number of panics recovered in a poll worker or a request handler",
+		},
+		[]string{"goroutine"},
+	)
+	abortedStreams = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_client_aborted_streams_total",
+			Help: "Number of responses abandoned because a chunk couldn't be posted to the relay server, by reason",
+		},
+		[]string{"reason"},
+	)
+	requestsInPhase = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "relay_client_requests_in_phase",
+			Help: "Number of requests currently in each phase of handling",
+		},
+		[]string{"phase"},
+	)
+	workerLastPoll = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "relay_client_worker_last_poll_timestamp_seconds",
+			Help: "Time at which each worker last completed a poll of the relay server",
+		},
+		[]string{"worker"},
+	)
+	accessLogDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "relay_client_access_log_dropped_total",
+			Help: "Number of access log entries dropped because writing the access log fell behind",
+		},
+	)
+	spilledBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "relay_client_response_spilled_bytes_total",
+			Help: "Bytes of response bodies written to SpillDir while the relay server didn't take them",
+		},
+	)
+	resumedResponses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "relay_client_resumed_responses_total",
+			Help: "Number of aborted responses that were resumed with a Range request to the backend",
+		},
+	)
+	relayConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_client_relay_connections_total",
+			Help: "Connections to the relay server by event: new, reused from the pool, or closed",
+		},
+		[]string{"event"},
+	)
+	relayConnectionsOpen = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "relay_client_relay_connections_open",
+			Help: "Number of open connections to the relay server",
+		},
+	)
+	relayConnectionResets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_client_relay_connection_resets_total",
+			Help: "Number of times the idle connections to the relay server were closed, by reason",
+		},
+		[]string{"reason"},
+	)
+	requestsByPriority = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_client_requests_by_priority_total",
+			Help: "Number of requests handled, by the priority the relay server gave them: high or normal",
+		},
+		[]string{"priority"},
+	)
+	injectedFaults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_client_injected_faults_total",
+			Help: "Number of faults injected by FaultInjection, by fault: drop_response, delay_backend, fail_poll or corrupt_chunk",
+		},
+		[]string{"fault"},
+	)
+	requestGroups = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "relay_client_request_goroutine_groups",
+			Help: "Number of requests whose goroutines haven't all returned yet",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(relayQueueDepth)
+	prometheus.MustRegister(relayPollWorkers)
+	prometheus.MustRegister(workerRecycles)
+	prometheus.MustRegister(invalidHeaderValues)
+	prometheus.MustRegister(backendBreakerState)
+	prometheus.MustRegister(requestsInPhase)
+	prometheus.MustRegister(concurrentRequests)
+	prometheus.MustRegister(tlsReloadFailures)
+	prometheus.MustRegister(responseBatchSize)
+	prometheus.MustRegister(uploadThrottledSeconds)
+	prometheus.MustRegister(responseCacheLookups)
+	prometheus.MustRegister(responseCacheBytes)
+	prometheus.MustRegister(activeRelay)
+	prometheus.MustRegister(recoveredPanics)
+	prometheus.MustRegister(abortedStreams)
+	prometheus.MustRegister(requestGroups)
+	prometheus.MustRegister(workerLastPoll)
+	prometheus.MustRegister(accessLogDropped)
+	prometheus.MustRegister(spilledBytes)
+	prometheus.MustRegister(resumedResponses)
+	prometheus.MustRegister(relayConnections)
+	prometheus.MustRegister(relayConnectionsOpen)
+	prometheus.MustRegister(relayConnectionResets)
+	prometheus.MustRegister(requestsByPriority)
+	prometheus.MustRegister(injectedFaults)
+}
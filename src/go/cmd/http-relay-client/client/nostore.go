@@ -0,0 +1,42 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/url"
+	"strings"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+// isNoStore returns true if the path of the request matches one of the
+// NoStorePathPrefixes. The bodies of such requests and their responses must
+// not be kept beyond the request.
+func (c *Client) isNoStore(breq *pb.HttpRequest) bool {
+	if len(c.config.NoStorePathPrefixes) == 0 {
+		return false
+	}
+	u, err := url.Parse(breq.GetUrl())
+	if err != nil {
+		// Err on the side of caution, the request fails later anyway.
+		return true
+	}
+	for _, prefix := range c.config.NoStorePathPrefixes {
+		if strings.HasPrefix(u.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNoStoreRequestsAreNotRetained(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// The backend echoes the request body, either at once or streamed.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasSuffix(r.URL.Path, "/stream") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte("echo:"))
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		desc         string
+		path         string
+		wantRetained bool
+	}{
+		{"no-store", "/medical/record", false},
+		{"no-store streamed", "/medical/stream", false},
+		{"other", "/public/record", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			logs.Reset()
+			relay := newRecordingRelay()
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.NoStorePathPrefixes = []string{"/medical/"}
+			config.DebugLogging = true
+			client := newClient(config)
+			pbreq := &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("POST"),
+				Url:    proto.String("http://invalid" + tc.path),
+				Body:   []byte("patient-record"),
+			}
+			client.handleRequest(&http.Client{}, &http.Client{}, pbreq)
+
+			var body string
+			for _, resp := range relay.responses("15") {
+				body += string(resp.Body)
+			}
+			if body != "echo:patient-record" {
+				t.Errorf("Relayed body = %q, want %q", body, "echo:patient-record")
+			}
+			if retained := bytes.Contains(pbreq.Body, []byte("patient-record")); retained != tc.wantRetained {
+				t.Errorf("Request body retained = %t, want %t", retained, tc.wantRetained)
+			}
+			if strings.Contains(logs.String(), "patient-record") {
+				t.Errorf("Logs contain the request body:\n%s", logs.String())
+			}
+		})
+	}
+}
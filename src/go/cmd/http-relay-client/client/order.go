@@ -0,0 +1,56 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+var errResponseOrder = errors.New("response chunks out of order")
+
+// responseOrder tracks the chunks posted to the relay for a single request
+// and checks that they arrive in an order the relay server can reassemble:
+// the chunk carrying the status code and headers is acknowledged before any
+// other chunk is posted, and only the last chunk has Eof set.
+//
+// The invariant holds by construction in handleRequest today, but features
+// that pipeline or flush chunks early create new interleavings, so it is
+// enforced here instead of being left to convention.
+type responseOrder struct {
+	acked int
+	eof   bool
+}
+
+// check returns an error if posting resp next would violate the invariant.
+func (o *responseOrder) check(resp *pb.HttpResponse) error {
+	switch {
+	case o.eof:
+		return fmt.Errorf("%w: chunk %d posted after the final chunk", errResponseOrder, o.acked)
+	case o.acked == 0 && resp.StatusCode == nil:
+		return fmt.Errorf("%w: first chunk has no status code", errResponseOrder)
+	case o.acked > 0 && resp.StatusCode != nil:
+		return fmt.Errorf("%w: chunk %d repeats the status code", errResponseOrder, o.acked)
+	}
+	return nil
+}
+
+// acknowledged records that the relay accepted resp.
+func (o *responseOrder) acknowledged(resp *pb.HttpResponse) {
+	o.acked += 1
+	o.eof = resp.GetEof()
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestResponseOrderCheck(t *testing.T) {
+	header := &pb.HttpResponse{Id: proto.String("1"), StatusCode: proto.Int32(200)}
+	body := &pb.HttpResponse{Id: proto.String("1"), Body: []byte("x")}
+	final := &pb.HttpResponse{Id: proto.String("1"), Eof: proto.Bool(true)}
+
+	tests := []struct {
+		desc   string
+		chunks []*pb.HttpResponse
+		ok     bool
+	}{
+		{"header, body, eof", []*pb.HttpResponse{header, body, final}, true},
+		{"body first", []*pb.HttpResponse{body, final}, false},
+		{"repeated header", []*pb.HttpResponse{header, header}, false},
+		{"chunk after eof", []*pb.HttpResponse{header, final, body}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			var order responseOrder
+			var err error
+			for _, resp := range tc.chunks {
+				if err = order.check(resp); err != nil {
+					break
+				}
+				order.acknowledged(resp)
+			}
+			if tc.ok && err != nil {
+				t.Errorf("check() = %v, want nil", err)
+			}
+			if !tc.ok && !errors.Is(err, errResponseOrder) {
+				t.Errorf("check() = %v, want %v", err, errResponseOrder)
+			}
+		})
+	}
+}
+
+var orderSeed = flag.Int64("order_seed", 1, "Seed for the random responses of TestResponseOrderingProperty")
+
+// TestResponseOrderingProperty runs concurrent requests against a backend
+// that writes randomly sized pieces with random pauses, and checks that the
+// relay receives each response as a header chunk followed by body chunks,
+// with Eof set exactly on the last one. Run it with -order_seed to try other
+// responses.
+func TestResponseOrderingProperty(t *testing.T) {
+	t.Logf("Seed: %d", *orderSeed)
+	rnd := rand.New(rand.NewSource(*orderSeed))
+
+	const numRequests = 16
+	bodies := make([][]byte, numRequests)
+	pieces := make([][]int, numRequests)
+	for i := range bodies {
+		n := rnd.Intn(2000)
+		bodies[i] = make([]byte, n)
+		rnd.Read(bodies[i])
+		for n > 0 {
+			p := 1 + rnd.Intn(n)
+			pieces[i] = append(pieces[i], p)
+			n -= p
+		}
+	}
+	pauses := make([]time.Duration, 0, 1024)
+	for i := 0; i < cap(pauses); i++ {
+		pauses = append(pauses, time.Duration(rnd.Intn(15))*time.Millisecond)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(http.StatusOK)
+		off := 0
+		for j, p := range pieces[i] {
+			time.Sleep(pauses[(i*31+j)%len(pauses)])
+			w.Write(bodies[i][off : off+p])
+			w.(http.Flusher).Flush()
+			off += p
+		}
+	}))
+	defer backend.Close()
+
+	var mu sync.Mutex
+	received := map[string][]*pb.HttpResponse{}
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		resp := &pb.HttpResponse{}
+		if err := proto.Unmarshal(body, resp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received[resp.GetId()] = append(received[resp.GetId()], resp)
+		mu.Unlock()
+		w.Write([]byte("ok"))
+	}))
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.BackendResponseTimeout = time.Duration(1+rnd.Intn(5)) * time.Millisecond
+	config.MaxChunkSize = 1 + rnd.Intn(256)
+	client := newClient(config)
+	local := client.newLocalClient(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client.handleRequest(&http.Client{}, local, &pb.HttpRequest{
+				Id:     proto.String(strconv.Itoa(i)),
+				Method: proto.String("GET"),
+				Url:    proto.String(fmt.Sprintf("http://invalid/%d", i)),
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < numRequests; i++ {
+		chunks := received[strconv.Itoa(i)]
+		if len(chunks) == 0 {
+			t.Errorf("Request %d: no chunks received", i)
+			continue
+		}
+		var body []byte
+		for j, resp := range chunks {
+			if hasStatus := resp.StatusCode != nil; hasStatus != (j == 0) {
+				t.Errorf("Request %d: chunk %d has status code: %v", i, j, hasStatus)
+			}
+			if eof := resp.GetEof(); eof != (j == len(chunks)-1) {
+				t.Errorf("Request %d: chunk %d of %d has Eof: %v", i, j, len(chunks), eof)
+			}
+			body = append(body, resp.Body...)
+		}
+		if !bytes.Equal(body, bodies[i]) {
+			t.Errorf("Request %d: received %d body bytes, want %d", i, len(body), len(bodies[i]))
+		}
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"log/slog"
+	"runtime/debug"
+)
+
+// logPanic logs a panic recovered in goroutine, with the stack of the
+// panicking goroutine, and counts it. It must be called from the deferred
+// function that recovered.
+func logPanic(goroutine, id string, p any) {
+	slog.Error("Recovered from panic",
+		slog.String("Goroutine", goroutine),
+		slog.String("ID", id),
+		slog.Any("Panic", p),
+		slog.String("Stack", string(debug.Stack())))
+	recoveredPanics.WithLabelValues(goroutine).Inc()
+}
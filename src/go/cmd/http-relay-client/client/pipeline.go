@@ -0,0 +1,98 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// The relay server sets this header on /server/request responses if it puts
+// the responses to a request back in order by their sequence number.
+const sequencedResponsesHeader = "X-Relay-Sequenced-Responses"
+
+// recordSequencedResponseSupport stores whether the relay server advertised
+// support for sequenced responses in its response header.
+func (c *Client) recordSequencedResponseSupport(header http.Header) {
+	c.sequencedResponses.Store(header.Get(sequencedResponsesHeader) != "")
+}
+
+// responsePipeline posts the chunks of a response to the relay server, up to
+// window of them at once. Posting one chunk at a time caps the throughput at
+// a chunk per round trip to the relay server, which is low on slow links.
+//
+// If the window is larger than 1, each chunk carries its sequence number, so
+// that the relay server can put them back in order. Posts still end in the
+// order they were started from the caller's point of view: next returns the
+// oldest one.
+type responsePipeline struct {
+	group   *requestGroup
+	window  int
+	started int
+	pending []*pipelinedPost
+}
+
+// pipelinedPost is a chunk that is being posted. body is the uncompressed
+// body of resp, which the post may replace with the compressed one.
+type pipelinedPost struct {
+	resp *pb.HttpResponse
+	body []byte
+	err  chan error
+}
+
+// newResponsePipeline returns a pipeline for the chunks of a response. More
+// than one chunk is posted at once only if they're posted one by one, rather
+// than on the response stream or in batches. The posts run in group.
+func (c *Client) newResponsePipeline(stream *responseStream, group *requestGroup) *responsePipeline {
+	window := 1
+	if stream == nil && c.batcher == nil && c.sequencedResponses.Load() {
+		window = max(c.config.MaxChunksInFlight, 1)
+	}
+	return &responsePipeline{group: group, window: window}
+}
+
+// post starts posting resp with send. With a window of 1, it's posted before
+// post returns.
+func (p *responsePipeline) post(resp *pb.HttpResponse, body []byte, send func() error) {
+	post := &pipelinedPost{resp: resp, body: body, err: make(chan error, 1)}
+	if p.window > 1 {
+		resp.Sequence = proto.Int64(int64(p.started))
+		p.group.Go(func() { post.err <- send() })
+	} else {
+		post.err <- send()
+	}
+	p.started++
+	p.pending = append(p.pending, post)
+}
+
+// full returns true if the oldest post has to end before the next can start.
+func (p *responsePipeline) full() bool {
+	return len(p.pending) >= p.window
+}
+
+// busy returns true if any post hasn't been returned by next yet.
+func (p *responsePipeline) busy() bool {
+	return len(p.pending) > 0
+}
+
+// next waits for the oldest post to end, and returns its chunk, the
+// uncompressed body, and the error of the post.
+func (p *responsePipeline) next() (*pb.HttpResponse, []byte, error) {
+	post := p.pending[0]
+	p.pending = p.pending[1:]
+	return post.resp, post.body, <-post.err
+}
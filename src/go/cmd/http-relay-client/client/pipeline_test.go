@@ -0,0 +1,191 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func newPipelineClient(relay *relaytest.Server, window int, sequenced bool) *Client {
+	config := fakeRelayConfig(relay)
+	config.MaxChunksInFlight = window
+	client := newClient(config)
+	client.sequencedResponses.Store(sequenced)
+	return client
+}
+
+func TestPipelinedPosting(t *testing.T) {
+	body := strings.Repeat("0123456789abcdef", 64<<10)
+	for _, tc := range []struct {
+		desc          string
+		window        int
+		sequenced     bool
+		wantInFlight  int
+		wantSequences bool
+	}{
+		{desc: "default", window: 1, sequenced: true, wantInFlight: 1},
+		{desc: "unsupported by relay", window: 4, sequenced: false, wantInFlight: 1},
+		{desc: "pipelined", window: 4, sequenced: true, wantInFlight: 4, wantSequences: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := relaytest.NewServer()
+			defer relay.Close()
+			relay.ResponseLatency, relay.ResponseJitter = time.Millisecond, 5*time.Millisecond
+			client := newPipelineClient(relay, tc.window, tc.sequenced)
+
+			client.handleRequest(&http.Client{}, newFixedBackend(body, false), &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+
+			responses := relay.Responses("15")
+			sort.SliceStable(responses, func(i, j int) bool {
+				return responses[i].GetSequence() < responses[j].GetSequence()
+			})
+			maxInFlight := relay.MaxConcurrentPosts()
+			if maxInFlight > tc.wantInFlight || tc.wantInFlight > 1 && maxInFlight < 2 {
+				t.Errorf("Up to %d concurrent posts, want up to %d", maxInFlight, tc.wantInFlight)
+			}
+			var got strings.Builder
+			// Pipelined chunks are posted from closures, which must each post
+			// their own chunk.
+			posted := map[int64]int{}
+			for i, resp := range responses {
+				posted[resp.GetSequence()]++
+				if tc.wantSequences && resp.GetSequence() != int64(i) {
+					t.Errorf("Response %d has sequence %d, want %d", i, resp.GetSequence(), i)
+				}
+				if !tc.wantSequences && resp.Sequence != nil {
+					t.Errorf("Response %d has sequence %d, want none", i, resp.GetSequence())
+				}
+				if (i == 0) != (resp.StatusCode != nil) {
+					t.Errorf("Response %d has status code %v", i, resp.StatusCode)
+				}
+				if (i == len(responses)-1) != resp.GetEof() {
+					t.Errorf("Response %d has eof %v", i, resp.GetEof())
+				}
+				got.Write(resp.Body)
+			}
+			if got.String() != body {
+				t.Errorf("Reassembled body has %d bytes, want %d", got.Len(), len(body))
+			}
+			for i := 0; tc.wantSequences && i < len(responses); i++ {
+				if n := posted[int64(i)]; n != 1 {
+					t.Errorf("Chunk %d posted %d times, want once", i, n)
+				}
+			}
+			if last := responses[len(responses)-1]; last.GetChunkIndex() != int32(len(responses)-1) {
+				t.Errorf("Final response has chunk index %d, want %d", last.GetChunkIndex(), len(responses)-1)
+			}
+		})
+	}
+}
+
+func TestPipelinedPostingAbortsOnError(t *testing.T) {
+	var mu sync.Mutex
+	posts, active := 0, 0
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		resp := &pb.HttpResponse{}
+		proto.Unmarshal(body, resp)
+		mu.Lock()
+		posts++
+		active++
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		// The relay server forgot about the request after the third chunk.
+		if resp.GetSequence() >= 2 {
+			http.Error(w, "Duplicate or invalid request ID", http.StatusBadRequest)
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.MaxChunksInFlight = 4
+	var reported []error
+	config.ErrorHandler = func(err error, id string) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported = append(reported, err)
+	}
+	client := newClient(config)
+	client.sequencedResponses.Store(true)
+
+	client.handleRequest(&http.Client{}, newFixedBackend(strings.Repeat("x", 1<<20), false), &pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/foo"),
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if active != 0 {
+		t.Errorf("%d posts still running after handleRequest returned, want 0", active)
+	}
+	// The chunks after the rejected one that were already posted can't be
+	// taken back, but no more are posted.
+	if posts > 2+config.MaxChunksInFlight {
+		t.Errorf("Got %d posts, want at most %d", posts, 2+config.MaxChunksInFlight)
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], ErrRelayRejected) {
+		t.Errorf("Reported errors %v, want one ErrRelayRejected", reported)
+	}
+}
+
+// BenchmarkPipelinedPosting measures the throughput of relaying a response
+// to a relay server with a round trip time of 10ms, depending on the number
+// of chunks posted at once.
+func BenchmarkPipelinedPosting(b *testing.B) {
+	relay := relaytest.NewServer()
+	defer relay.Close()
+	relay.ResponseLatency = 10 * time.Millisecond
+	body := strings.Repeat("x", 1<<20)
+	for _, window := range []int{1, 2, 4, 8} {
+		client := newPipelineClient(relay, window, true)
+		b.Run(fmt.Sprintf("window=%d", window), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				client.handleRequest(&http.Client{}, newFixedBackend(body, false), &pb.HttpRequest{
+					Id:     proto.String("15"),
+					Method: proto.String("GET"),
+					Url:    proto.String("http://invalid/foo"),
+				})
+			}
+		})
+	}
+}
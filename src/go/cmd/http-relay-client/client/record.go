@@ -0,0 +1,286 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/googlecloudrobotics/ilog"
+	"google.golang.org/protobuf/proto"
+)
+
+// Suffixes of the files a recording consists of. The request is written as a
+// binary HttpRequest proto, the response as JSON.
+const (
+	recordRequestSuffix  = ".request.pb"
+	recordResponseSuffix = ".response.json"
+)
+
+// Recording is an exchange relayed by a client with RecordDir set, as loaded
+// by LoadRecording. The values of sensitive headers are redacted, and bodies
+// are truncated to RecordMaxFileBytes.
+type Recording struct {
+	Request  *pb.HttpRequest
+	Response RecordedResponse
+}
+
+// RecordedResponse is the response to a recorded request, with the bodies of
+// all chunks posted to the relay server concatenated.
+type RecordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Trailer    http.Header `json:"trailer,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+	// Chunks is the number of responses posted, including keep-alives.
+	Chunks int `json:"chunks"`
+	// Truncated is set if Body was cut off at RecordMaxFileBytes.
+	Truncated bool `json:"truncated,omitempty"`
+	// Complete is set if the final chunk was posted.
+	Complete   bool      `json:"complete"`
+	RecordedAt time.Time `json:"recorded_at"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// LoadRecording loads the recording of the request with the given id from
+// dir, eg to replay captured traffic in a regression test.
+func LoadRecording(dir, id string) (*Recording, error) {
+	base := filepath.Join(dir, recordingName(id))
+	data, err := os.ReadFile(base + recordRequestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recording{Request: &pb.HttpRequest{}}
+	if err := proto.Unmarshal(data, r.Request); err != nil {
+		return nil, fmt.Errorf("invalid recorded request %s: %v", id, err)
+	}
+	if data, err = os.ReadFile(base + recordResponseSuffix); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.Response); err != nil {
+		return nil, fmt.Errorf("invalid recorded response %s: %v", id, err)
+	}
+	return r, nil
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// recordingName returns the base name of the files for request id.
+func recordingName(id string) string {
+	return unsafeFileNameChars.ReplaceAllString(id, "_")
+}
+
+// recorder writes the exchanges of the client to RecordDir, and evicts the
+// oldest recordings once they take up more than RecordMaxTotalBytes.
+type recorder struct {
+	c *Client
+	// mu serializes writing and evicting recordings.
+	mu sync.Mutex
+}
+
+// recording collects the exchange of a single request.
+type recording struct {
+	rec   *recorder
+	id    string
+	req   *pb.HttpRequest
+	resp  RecordedResponse
+	start time.Time
+}
+
+// startRecording returns the recording of breq, or nil if breq isn't
+// recorded. Requests matching NoStorePathPrefixes are never recorded.
+func (c *Client) startRecording(breq *pb.HttpRequest, noStore bool) *recording {
+	if c.recorder == nil || noStore || !c.isRecorded(breq) {
+		return nil
+	}
+	req := proto.Clone(breq).(*pb.HttpRequest)
+	req.Header = c.redactRecordedHeader(req.Header)
+	if len(req.Body) > c.config.RecordMaxFileBytes {
+		req.Body = req.Body[:c.config.RecordMaxFileBytes]
+	}
+	return &recording{rec: c.recorder, id: breq.GetId(), req: req, start: time.Now()}
+}
+
+// isRecorded returns true if the path of breq starts with one of the
+// RecordPathPrefixes, or if there are none.
+func (c *Client) isRecorded(breq *pb.HttpRequest) bool {
+	if len(c.config.RecordPathPrefixes) == 0 {
+		return true
+	}
+	u, err := url.Parse(breq.GetUrl())
+	if err != nil {
+		return false
+	}
+	for _, prefix := range c.config.RecordPathPrefixes {
+		if strings.HasPrefix(u.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactRecordedHeader returns a copy of header with the values of sensitive
+// headers redacted, like in logs.
+func (c *Client) redactRecordedHeader(header []*pb.HttpHeader) []*pb.HttpHeader {
+	h := c.redactHeader(pbHeader(header))
+	r := make([]*pb.HttpHeader, 0, len(header))
+	for name, vs := range h {
+		for _, v := range vs {
+			r = append(r, &pb.HttpHeader{Name: proto.String(name), Value: proto.String(v)})
+		}
+	}
+	return r
+}
+
+// add records a response posted to the relay server. It's a no-op on a nil
+// recording.
+func (r *recording) add(resp *pb.HttpResponse) {
+	if r == nil {
+		return
+	}
+	c := r.rec.c
+	r.resp.Chunks++
+	if resp.StatusCode != nil {
+		r.resp.StatusCode = int(resp.GetStatusCode())
+		r.resp.Header = c.redactHeader(pbHeader(resp.Header))
+	}
+	if len(resp.Trailer) > 0 {
+		r.resp.Trailer = c.redactHeader(pbHeader(resp.Trailer))
+	}
+	room := c.config.RecordMaxFileBytes - len(r.resp.Body)
+	if len(resp.Body) > room {
+		r.resp.Truncated = true
+	}
+	r.resp.Body = append(r.resp.Body, resp.Body[:min(len(resp.Body), max(room, 0))]...)
+	if resp.GetEof() {
+		r.resp.Complete = true
+	}
+}
+
+func pbHeader(header []*pb.HttpHeader) http.Header {
+	h := http.Header{}
+	for _, kv := range header {
+		h.Add(kv.GetName(), kv.GetValue())
+	}
+	return h
+}
+
+// finish writes the recording to RecordDir. Errors are logged, as recording
+// is best-effort. It's a no-op on a nil recording.
+func (r *recording) finish() {
+	if r == nil {
+		return
+	}
+	r.resp.RecordedAt = r.start
+	r.resp.DurationMs = time.Since(r.start).Milliseconds()
+	if err := r.rec.write(r); err != nil {
+		slog.Warn("Failed to record request", slog.String("ID", r.id), ilog.Err(err))
+	}
+}
+
+func (rec *recorder) write(r *recording) error {
+	dir := rec.c.config.RecordDir
+	reqData, err := proto.Marshal(r.req)
+	if err != nil {
+		return err
+	}
+	respData, err := json.Marshal(&r.resp)
+	if err != nil {
+		return err
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	base := filepath.Join(dir, recordingName(r.id))
+	if err := os.WriteFile(base+recordRequestSuffix, reqData, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+recordResponseSuffix, respData, 0600); err != nil {
+		return err
+	}
+	return rec.evict()
+}
+
+// evict removes the oldest recordings while all of them together are larger
+// than RecordMaxTotalBytes.
+func (rec *recorder) evict() error {
+	dir := rec.c.config.RecordDir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	type stored struct {
+		name     string
+		size     int64
+		modified time.Time
+	}
+	byName := map[string]*stored{}
+	var total int64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), recordRequestSuffix)
+		if !ok {
+			if name, ok = strings.CutSuffix(e.Name(), recordResponseSuffix); !ok {
+				continue
+			}
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		s := byName[name]
+		if s == nil {
+			s = &stored{name: name}
+			byName[name] = s
+		}
+		s.size += info.Size()
+		if info.ModTime().After(s.modified) {
+			s.modified = info.ModTime()
+		}
+		total += info.Size()
+	}
+	if total <= rec.c.config.RecordMaxTotalBytes {
+		return nil
+	}
+	recordings := make([]*stored, 0, len(byName))
+	for _, s := range byName {
+		recordings = append(recordings, s)
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].modified.Before(recordings[j].modified)
+	})
+	for _, s := range recordings {
+		if total <= rec.c.config.RecordMaxTotalBytes {
+			break
+		}
+		base := filepath.Join(dir, s.name)
+		os.Remove(base + recordRequestSuffix)
+		os.Remove(base + recordResponseSuffix)
+		total -= s.size
+	}
+	return nil
+}
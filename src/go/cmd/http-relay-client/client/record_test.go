@@ -0,0 +1,154 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRecording(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=response-cookie")
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("echo:"))
+		w.Write(body)
+		w.Header().Set("X-Checksum", "1234")
+	}))
+	defer backend.Close()
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	dir := t.TempDir()
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.RecordDir = dir
+	config.RecordPathPrefixes = []string{"/api/"}
+	config.NoStorePathPrefixes = []string{"/api/secret"}
+	client := newClient(config)
+
+	for id, path := range map[string]string{"recorded/1": "/api/foo", "2": "/other", "3": "/api/secret"} {
+		client.handleRequest(&http.Client{}, &http.Client{}, &pb.HttpRequest{
+			Id:     proto.String(id),
+			Method: proto.String("POST"),
+			Url:    proto.String("http://invalid" + path),
+			Header: []*pb.HttpHeader{{
+				Name:  proto.String("Authorization"),
+				Value: proto.String("Bearer secret"),
+			}},
+			Body: []byte("hello"),
+		})
+	}
+
+	r, err := LoadRecording(dir, "recorded/1")
+	if err != nil {
+		t.Fatalf("LoadRecording() failed: %v", err)
+	}
+	if got := r.Request.GetUrl(); got != "http://invalid/api/foo" {
+		t.Errorf("Recorded URL = %q, want http://invalid/api/foo", got)
+	}
+	if string(r.Request.Body) != "hello" {
+		t.Errorf("Recorded request body = %q, want hello", r.Request.Body)
+	}
+	for _, h := range r.Request.Header {
+		if strings.Contains(h.GetValue(), "secret") {
+			t.Errorf("Recorded request header %s isn't redacted", h.GetName())
+		}
+	}
+	resp := r.Response
+	if resp.StatusCode != http.StatusOK || string(resp.Body) != "echo:hello" || !resp.Complete || resp.Truncated {
+		t.Errorf("Recorded response = %+v, want complete 200 with body echo:hello", resp)
+	}
+	if got := resp.Header.Get("Set-Cookie"); strings.Contains(got, "response-cookie") {
+		t.Errorf("Recorded Set-Cookie = %q, want it redacted", got)
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "1234" {
+		t.Errorf("Recorded trailer X-Checksum = %q, want 1234", got)
+	}
+
+	for _, id := range []string{"2", "3"} {
+		if _, err := LoadRecording(dir, id); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("LoadRecording(%q) = %v, want not recorded", id, err)
+		}
+	}
+}
+
+func TestRecordingLimits(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultClientConfig()
+	config.RecordDir = dir
+	config.RecordMaxFileBytes = 8
+	client := newClient(config)
+
+	record := func(id string) {
+		rec := client.startRecording(&pb.HttpRequest{
+			Id:   proto.String(id),
+			Url:  proto.String("http://invalid/foo"),
+			Body: []byte("0123456789"),
+		}, false)
+		rec.add(&pb.HttpResponse{Id: proto.String(id), StatusCode: proto.Int32(200), Body: []byte("01234")})
+		rec.add(&pb.HttpResponse{Id: proto.String(id), Body: []byte("56789"), Eof: proto.Bool(true)})
+		rec.finish()
+		// Eviction goes by modification time.
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	record("1")
+	r, err := LoadRecording(dir, "1")
+	if err != nil {
+		t.Fatalf("LoadRecording() failed: %v", err)
+	}
+	if string(r.Request.Body) != "01234567" || string(r.Response.Body) != "01234567" || !r.Response.Truncated {
+		t.Errorf("Recorded bodies %q and %q (truncated: %v), want both truncated to 8 bytes",
+			r.Request.Body, r.Response.Body, r.Response.Truncated)
+	}
+
+	// Make room for two recordings only.
+	var size int64
+	for _, suffix := range []string{recordRequestSuffix, recordResponseSuffix} {
+		info, err := os.Stat(filepath.Join(dir, "1"+suffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+	client.config.RecordMaxTotalBytes = 2*size + size/2
+	record("2")
+	record("3")
+	if _, err := LoadRecording(dir, "1"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Oldest recording wasn't evicted: %v", err)
+	}
+	for _, id := range []string{"2", "3"} {
+		if _, err := LoadRecording(dir, id); err != nil {
+			t.Errorf("LoadRecording(%q) failed: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// proxyWorker is the state of a localProxyWorker that matters for recycling.
+type proxyWorker struct {
+	// slot identifies the worker, it's nil outside of localProxyWorker.
+	slot    *workerSlot
+	started time.Time
+	// inFlight is the number of requests dispatched by the worker that are
+	// still being handled.
+	inFlight atomic.Int32
+}
+
+// workerRecycler decides when idle workers are replaced by fresh goroutines,
+// see WorkerRecycleInterval. Only one worker is recycled at a time: the next
+// recycle waits until the replacement of the last one has polled the relay.
+type workerRecycler struct {
+	interval time.Duration
+	now      func() time.Time
+	busy     atomic.Bool
+}
+
+func newWorkerRecycler(interval time.Duration) *workerRecycler {
+	return &workerRecycler{interval: interval, now: time.Now}
+}
+
+func (r *workerRecycler) newWorker() *proxyWorker {
+	return &proxyWorker{started: r.now()}
+}
+
+// tryRecycle returns true if w has been running for longer than the interval
+// and has no requests in flight, and no other recycle is in progress. The
+// caller must then replace w and call done once the replacement has polled.
+func (r *workerRecycler) tryRecycle(w *proxyWorker) bool {
+	if r.now().Sub(w.started) < r.interval || w.inFlight.Load() > 0 {
+		return false
+	}
+	return r.busy.CompareAndSwap(false, true)
+}
+
+// done ends the recycle claimed by tryRecycle.
+func (r *workerRecycler) done() {
+	r.busy.Store(false)
+}
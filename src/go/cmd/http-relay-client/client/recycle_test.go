@@ -0,0 +1,120 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWorkerRecyclerCadence(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	r := newWorkerRecycler(time.Minute)
+	r.now = clock.now
+
+	w := r.newWorker()
+	for i := 0; i < 3; i++ {
+		clock.advance(59 * time.Second)
+		if r.tryRecycle(w) {
+			t.Fatalf("Worker %d recycled after 59s", i)
+		}
+		clock.advance(time.Second)
+		if !r.tryRecycle(w) {
+			t.Fatalf("Worker %d not recycled after 1m", i)
+		}
+		r.done()
+		w = r.newWorker()
+	}
+}
+
+func TestWorkerRecyclerOneAtATime(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	r := newWorkerRecycler(time.Minute)
+	r.now = clock.now
+
+	w1, w2 := r.newWorker(), r.newWorker()
+	clock.advance(time.Hour)
+	if !r.tryRecycle(w1) {
+		t.Fatal("First worker not recycled")
+	}
+	if r.tryRecycle(w2) {
+		t.Fatal("Second worker recycled while the first recycle is in progress")
+	}
+	r.done()
+	if !r.tryRecycle(w2) {
+		t.Fatal("Second worker not recycled after the first recycle is done")
+	}
+}
+
+func TestWorkerRecyclerWaitsForInFlightRequests(t *testing.T) {
+	relayed := false
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/server/request" {
+			return
+		}
+		if relayed {
+			http.Error(w, "No request received within timeout", http.StatusRequestTimeout)
+			return
+		}
+		relayed = true
+		b, _ := proto.Marshal(&pb.HttpRequest{
+			Id:     proto.String("15"),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid/foo"),
+		})
+		w.Write(b)
+	}))
+	defer relay.Close()
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.WorkerRecycleInterval = time.Minute
+	c := newClient(config)
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	c.recycler.now = clock.now
+
+	w := c.recycler.newWorker()
+	if err := c.localProxy(&http.Client{}, &http.Client{}, w); err != nil {
+		t.Fatalf("localProxy() failed: %v", err)
+	}
+	clock.advance(time.Hour)
+	if c.recycler.tryRecycle(w) {
+		t.Fatal("Worker recycled with a request in flight")
+	}
+	close(release)
+	for start := time.Now(); w.inFlight.Load() != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("Request did not finish")
+		}
+	}
+	if !c.recycler.tryRecycle(w) {
+		t.Fatal("Worker not recycled after its request finished")
+	}
+}
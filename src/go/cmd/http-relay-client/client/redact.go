@@ -0,0 +1,66 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Headers whose values are never written to logs, in addition to
+// ClientConfig.RedactedHeaders.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redacted replaces a sensitive value in log output.
+func redacted(value string) string {
+	return fmt.Sprintf("[REDACTED len=%d]", len(value))
+}
+
+// redactHeader returns a copy of header that is safe to log, with the values
+// of sensitive headers redacted.
+func (c *Client) redactHeader(header http.Header) http.Header {
+	r := header.Clone()
+	for _, names := range [][]string{redactedHeaders, c.config.RedactedHeaders, c.backendAuthHeaders()} {
+		for _, name := range names {
+			vs := r.Values(name)
+			if len(vs) == 0 {
+				continue
+			}
+			rvs := make([]string, len(vs))
+			for i, v := range vs {
+				rvs[i] = redacted(v)
+			}
+			r[http.CanonicalHeaderKey(name)] = rvs
+		}
+	}
+	return r
+}
+
+// redactRequest returns a shallow copy of req with redacted headers for
+// httputil.DumpRequest.
+func (c *Client) redactRequest(req *http.Request) *http.Request {
+	r := *req
+	r.Header = c.redactHeader(req.Header)
+	return &r
+}
+
+// redactResponse returns a shallow copy of resp with redacted headers and
+// trailers for httputil.DumpResponse.
+func (c *Client) redactResponse(resp *http.Response) *http.Response {
+	r := *resp
+	r.Header = c.redactHeader(resp.Header)
+	r.Trailer = c.redactHeader(resp.Trailer)
+	return &r
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRedactHeader(t *testing.T) {
+	config := DefaultClientConfig()
+	config.RedactedHeaders = []string{"x-api-key"}
+	client := newClient(config)
+
+	header := http.Header{
+		"Authorization": {"Bearer secret"},
+		"Cookie":        {"a=1", "b=2"},
+		"X-Api-Key":     {"key"},
+		"Accept":        {"*/*"},
+	}
+	got := client.redactHeader(header)
+	want := http.Header{
+		"Authorization": {"[REDACTED len=13]"},
+		"Cookie":        {"[REDACTED len=3]", "[REDACTED len=3]"},
+		"X-Api-Key":     {"[REDACTED len=3]"},
+		"Accept":        {"*/*"},
+	}
+	for name := range want {
+		if strings.Join(got[name], ",") != strings.Join(want[name], ",") {
+			t.Errorf("redactHeader()[%s] = %q, want %q", name, got[name], want[name])
+		}
+	}
+	if header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("redactHeader() modified its argument")
+	}
+}
+
+func TestDebugLogsAreRedacted(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token-from-file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=response-cookie")
+		w.Write([]byte("body"))
+	}))
+	defer backend.Close()
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Not a valid proto, but containing a credential.
+		w.Write([]byte("\xff\xffAuthorization: Bearer raw-secret"))
+	}))
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.AuthenticationTokenFile = tokenFile
+	config.DebugLogging = true
+	client := newClient(config)
+	req, err := client.createBackendRequest(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/foo"),
+		Header: []*pb.HttpHeader{{
+			Name:  proto.String("Cookie"),
+			Value: proto.String("session=request-cookie"),
+		}},
+	})
+	if err != nil {
+		t.Fatalf("createBackendRequest() failed: %v", err)
+	}
+	_, hresp, err := client.makeBackendRequest(req.Context(), &http.Client{}, req, "15")
+	if err != nil {
+		t.Fatalf("makeBackendRequest() failed: %v", err)
+	}
+	io.Copy(io.Discard, hresp.Body)
+	hresp.Body.Close()
+	_, err = client.getRequest(&http.Client{}, relay.URL)
+	if err == nil {
+		t.Fatal("getRequest() succeeded for an invalid request")
+	}
+	slog.Error("getRequest", slog.String("Error", err.Error()))
+
+	for _, secret := range []string{"token-from-file", "request-cookie", "response-cookie", "raw-secret"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("Logs contain %q:\n%s", secret, logs.String())
+		}
+	}
+	if !strings.Contains(logs.String(), "[REDACTED len=") {
+		t.Errorf("Logs don't contain redacted values:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/idtoken"
+)
+
+// defaultRelayAuthScope is used for relay authentication if RelayAuthScopes
+// is empty.
+const defaultRelayAuthScope = "https://www.googleapis.com/auth/cloud-platform.read-only"
+
+// Token sources for relay authentication. Tests replace them with fakes.
+var (
+	defaultTokenSource = google.DefaultTokenSource
+	idTokenSource      = newIDTokenSource
+)
+
+// newIDTokenSource returns a source of ID tokens for audience from the
+// default credentials, be they a service account key, the metadata server,
+// or impersonated or external account credentials.
+func newIDTokenSource(ctx context.Context, audience string) (oauth2.TokenSource, error) {
+	return idtoken.NewTokenSource(ctx, audience)
+}
+
+// checkRelayAuth returns an error if both an ID token audience and OAuth
+// scopes are configured for relay authentication, or if a token file is
+// combined with either of them or with disabled authentication.
+func checkRelayAuth(config ClientConfig) error {
+	if config.RelayIDTokenAudience != "" && len(config.RelayAuthScopes) > 0 {
+		return errors.New("an ID token audience and OAuth scopes for relay authentication are mutually exclusive")
+	}
+	if config.RelayAuthenticationTokenFile != "" {
+		if config.RelayIDTokenAudience != "" || len(config.RelayAuthScopes) > 0 {
+			return errors.New("a token file for relay authentication excludes the default credentials' ID token audience and OAuth scopes")
+		}
+		if config.DisableAuthForRemote {
+			return errors.New("a token file for relay authentication can't be used with relay authentication disabled")
+		}
+	}
+	return nil
+}
+
+// newRelayAuthClient wraps remote to authenticate to the relay server with
+// the default credentials: with an ID token for RelayIDTokenAudience if set
+// (eg when the relay server is behind Identity-Aware Proxy), or else with an
+// access token for RelayAuthScopes. Requests are sent with remote's
+// transport, so its settings are kept.
+func (c *Client) newRelayAuthClient(remote *http.Client) (*http.Client, error) {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, c.newTokenClient(remote))
+	var ts oauth2.TokenSource
+	var err error
+	if c.config.RelayIDTokenAudience != "" {
+		ts, err = idTokenSource(ctx, c.config.RelayIDTokenAudience)
+	} else {
+		scopes := c.config.RelayAuthScopes
+		if len(scopes) == 0 {
+			scopes = []string{defaultRelayAuthScope}
+		}
+		ts, err = defaultTokenSource(ctx, scopes...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &idleClosingTransport{
+			RoundTripper: &oauth2.Transport{
+				Source: oauth2.ReuseTokenSource(nil, ts),
+				Base:   remote.Transport,
+			},
+			base: remote.Transport,
+		},
+	}, nil
+}
+
+// idleClosingTransport passes CloseIdleConnections on to base, which
+// oauth2.Transport doesn't, so that the idle connections to the relay server
+// can be closed through the authenticated client.
+type idleClosingTransport struct {
+	http.RoundTripper
+	base http.RoundTripper
+}
+
+func (t *idleClosingTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
+
+// newTokenClient returns the client used to fetch relay authentication
+// tokens: remote, or with TokenEndpointDirect, a client that doesn't use a
+// proxy.
+func (c *Client) newTokenClient(remote *http.Client) *http.Client {
+	if !c.config.TokenEndpointDirect {
+		return remote
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	return &http.Client{Transport: transport}
+}
+
+// newRelayTokenFileClient wraps remote to authenticate to the relay server
+// with the bearer token in RelayAuthenticationTokenFile. Requests are sent
+// with remote's transport, so its settings are kept.
+func (c *Client) newRelayTokenFileClient(remote *http.Client) *http.Client {
+	return &http.Client{
+		Transport: &tokenFileTransport{
+			path: c.config.RelayAuthenticationTokenFile,
+			base: remote.Transport,
+		},
+	}
+}
+
+// tokenFileTransport sets the bearer token read from a file on each request.
+type tokenFileTransport struct {
+	path string
+	base http.RoundTripper
+}
+
+func (t *tokenFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := readTokenFile(t.path)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	// RoundTrippers must not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+func (t *tokenFileTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
+
+// readTokenFile returns the token in the file at path, without the trailing
+// newline that editors and Kubernetes secrets often add.
+func readTokenFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read relay authentication token: %v", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("relay authentication token file %s is empty", path)
+	}
+	return token, nil
+}
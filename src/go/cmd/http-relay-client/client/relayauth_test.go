@@ -0,0 +1,351 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"golang.org/x/oauth2"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeTokenSources replaces the relay token sources with fakes that record
+// the requested scopes and audience, and the client for token fetches.
+type fakeTokenSources struct {
+	scopes   []string
+	audience string
+	client   *http.Client
+}
+
+func newFakeTokenSources(t *testing.T) *fakeTokenSources {
+	f := &fakeTokenSources{}
+	origDefault, origID := defaultTokenSource, idTokenSource
+	t.Cleanup(func() { defaultTokenSource, idTokenSource = origDefault, origID })
+	defaultTokenSource = func(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+		f.scopes = scopes
+		f.client, _ = ctx.Value(oauth2.HTTPClient).(*http.Client)
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "access-token"}), nil
+	}
+	idTokenSource = func(ctx context.Context, audience string) (oauth2.TokenSource, error) {
+		f.audience = audience
+		f.client, _ = ctx.Value(oauth2.HTTPClient).(*http.Client)
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "id-token"}), nil
+	}
+	return f
+}
+
+func TestRelayAuthClient(t *testing.T) {
+	tests := []struct {
+		desc         string
+		scopes       []string
+		audience     string
+		wantScopes   string
+		wantAudience string
+		wantToken    string
+	}{
+		{"default", nil, "", defaultRelayAuthScope, "", "access-token"},
+		{"scopes", []string{"scope-a", "scope-b"}, "", "scope-a,scope-b", "", "access-token"},
+		{"audience", nil, "iap-client-id", "", "iap-client-id", "id-token"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			tokens := newFakeTokenSources(t)
+			var auth string
+			relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				auth = r.Header.Get("Authorization")
+			}))
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayAuthScopes = tc.scopes
+			config.RelayIDTokenAudience = tc.audience
+			remote, err := newClient(config).newRelayAuthClient(&http.Client{})
+			if err != nil {
+				t.Fatalf("newRelayAuthClient() failed: %v", err)
+			}
+			resp, err := remote.Get(relay.URL)
+			if err != nil {
+				t.Fatalf("Request to relay failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if got := strings.Join(tokens.scopes, ","); got != tc.wantScopes {
+				t.Errorf("Requested scopes %q, want %q", got, tc.wantScopes)
+			}
+			if tokens.audience != tc.wantAudience {
+				t.Errorf("Requested audience %q, want %q", tokens.audience, tc.wantAudience)
+			}
+			if want := "Bearer " + tc.wantToken; auth != want {
+				t.Errorf("Authorization = %q, want %q", auth, want)
+			}
+		})
+	}
+}
+
+// recordingTransport records the Authorization header of the requests it
+// sends.
+type recordingTransport struct {
+	auth []string
+}
+
+func (r *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.auth = append(r.auth, req.Header.Get("Authorization"))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRelayAuthClientWrapsRemoteTransport(t *testing.T) {
+	tokens := newFakeTokenSources(t)
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer relay.Close()
+
+	transport := &recordingTransport{}
+	remote := &http.Client{Transport: transport}
+	authClient, err := newClient(DefaultClientConfig()).newRelayAuthClient(remote)
+	if err != nil {
+		t.Fatalf("newRelayAuthClient() failed: %v", err)
+	}
+	resp, err := authClient.Get(relay.URL)
+	if err != nil {
+		t.Fatalf("Request to relay failed: %v", err)
+	}
+	resp.Body.Close()
+
+	// The token is added before the request reaches our transport.
+	if len(transport.auth) != 1 || transport.auth[0] != "Bearer access-token" {
+		t.Errorf("Remote transport saw Authorization %q, want [%q]", transport.auth, "Bearer access-token")
+	}
+	if tokens.client != remote {
+		t.Errorf("Tokens are not fetched with the remote client")
+	}
+}
+
+func TestTokenEndpointDirect(t *testing.T) {
+	tokens := newFakeTokenSources(t)
+	remote := &http.Client{Transport: &recordingTransport{}}
+	config := DefaultClientConfig()
+	config.TokenEndpointDirect = true
+	if _, err := newClient(config).newRelayAuthClient(remote); err != nil {
+		t.Fatalf("newRelayAuthClient() failed: %v", err)
+	}
+	if tokens.client == nil || tokens.client == remote {
+		t.Fatalf("Tokens are fetched with the remote client")
+	}
+	transport, ok := tokens.client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Token client transport is %T, want *http.Transport", tokens.client.Transport)
+	}
+	if transport.Proxy != nil {
+		t.Errorf("Token client uses a proxy")
+	}
+}
+
+func TestCheckRelayAuth(t *testing.T) {
+	config := DefaultClientConfig()
+	if err := checkRelayAuth(config); err != nil {
+		t.Errorf("Default config rejected: %v", err)
+	}
+	config.RelayAuthScopes = []string{"scope"}
+	config.RelayIDTokenAudience = "audience"
+	if err := checkRelayAuth(config); err == nil {
+		t.Errorf("Expected error for both scopes and audience")
+	}
+}
+
+func TestCheckRelayAuthTokenFile(t *testing.T) {
+	for _, modify := range []func(*ClientConfig){
+		func(c *ClientConfig) { c.RelayAuthScopes = []string{"scope"} },
+		func(c *ClientConfig) { c.RelayIDTokenAudience = "audience" },
+		func(c *ClientConfig) { c.DisableAuthForRemote = true },
+	} {
+		config := DefaultClientConfig()
+		config.RelayAuthenticationTokenFile = "token"
+		if err := checkRelayAuth(config); err != nil {
+			t.Errorf("Token file rejected: %v", err)
+		}
+		modify(&config)
+		if err := checkRelayAuth(config); err == nil {
+			t.Errorf("Expected error for token file with %+v", config)
+		}
+	}
+}
+
+func TestRelayAuthenticationTokenFile(t *testing.T) {
+	tokens := newFakeTokenSources(t)
+	var mu sync.Mutex
+	auth := map[string]string{}
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth[r.URL.Path] = r.Header.Get("Authorization")
+		mu.Unlock()
+		io.Copy(io.Discard, r.Body)
+		switch r.URL.Path {
+		case "/server/request":
+			body, _ := proto.Marshal(&pb.HttpRequest{Id: proto.String("15")})
+			w.Write(body)
+		case "/server/response":
+			w.Write([]byte("ok"))
+		case "/server/requeststream":
+			w.Write([]byte("data"))
+		}
+	}))
+	defer relay.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.RelayAuthenticationTokenFile = tokenFile
+	client := newClient(config)
+	remote, _, err := client.newHTTPClients()
+	if err != nil {
+		t.Fatalf("newHTTPClients() failed: %v", err)
+	}
+	relayCalls := func() error {
+		if _, err := client.getRequest(remote, client.buildRelayURL(config.RelayAddress)); err != nil {
+			return err
+		}
+		if err := client.postResponse(remote, &pb.HttpResponse{Id: proto.String("15")}); err != nil {
+			return err
+		}
+		_, _, err := client.copyRequestStream(context.Background(), remote, relay.URL+"/server/requeststream?id=15", "15", io.Discard)
+		return err
+	}
+
+	for _, token := range []string{"secret-1", "secret-2"} {
+		if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := relayCalls(); err != nil {
+			t.Fatalf("Relay calls failed: %v", err)
+		}
+		mu.Lock()
+		for _, path := range []string{"/server/request", "/server/response", "/server/requeststream"} {
+			if got, want := auth[path], "Bearer "+token; got != want {
+				t.Errorf("Authorization for %s = %q, want %q", path, got, want)
+			}
+		}
+		mu.Unlock()
+	}
+	if tokens.client != nil {
+		t.Errorf("Default credentials were used with a token file")
+	}
+
+	if err := os.Remove(tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := relayCalls(); err == nil {
+		t.Errorf("Relay calls succeeded without token file")
+	}
+}
+
+func TestIDTokenSourceWithServiceAccountKey(t *testing.T) {
+	// The token endpoint returns the signed assertion as ID token, so the
+	// test can inspect its claims.
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"id_token": r.FormValue("assertion")})
+	}))
+	defer tokenServer.Close()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "relay-client@example.iam.gserviceaccount.com",
+		"private_key_id": "1",
+		"private_key": string(pem.EncodeToMemory(&pem.Block{
+			Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})),
+		"token_uri": tokenServer.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(credentials, keyFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credentials)
+
+	ts, err := newIDTokenSource(context.Background(), "iap-client-id")
+	if err != nil {
+		t.Fatalf("newIDTokenSource() failed: %v", err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token() failed: %v", err)
+	}
+	parts := strings.Split(token.AccessToken, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Token %q is not a JWT", token.AccessToken)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if got := claims["target_audience"]; got != "iap-client-id" {
+		t.Errorf("target_audience = %v, want %q", got, "iap-client-id")
+	}
+}
+
+func TestIDTokenSourceWithMetadataServer(t *testing.T) {
+	metadataServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/identity" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("id-token-for-" + r.URL.Query().Get("audience")))
+	}))
+	defer metadataServer.Close()
+	// Without a key file, the default credentials come from the metadata
+	// server, eg on GKE with workload identity.
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(metadataServer.URL, "http://"))
+
+	ts, err := newIDTokenSource(context.Background(), "iap-client-id")
+	if err != nil {
+		t.Fatalf("newIDTokenSource() failed: %v", err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token() failed: %v", err)
+	}
+	if want := "id-token-for-iap-client-id"; token.AccessToken != want {
+		t.Errorf("Token = %q, want %q", token.AccessToken, want)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// Reasons for closing the idle connections to the relay server, as used in
+// the relay_client_relay_connection_resets_total metric.
+const (
+	resetManual       = "manual"
+	resetPollFailures = "poll_failures"
+	resetStuckWorker  = "stuck_worker"
+)
+
+// relayConnTransport counts the connections that requests to the relay
+// server get from the pool, and passes CloseIdleConnections on to base.
+type relayConnTransport struct {
+	base http.RoundTripper
+}
+
+func (t *relayConnTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				relayConnections.WithLabelValues("reused").Inc()
+			} else {
+				relayConnections.WithLabelValues("new").Inc()
+			}
+		},
+	}
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+func (t *relayConnTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
+
+// closeIdleConnections closes the idle connections of t, if it has any.
+func closeIdleConnections(t http.RoundTripper) {
+	if t, ok := t.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// countClosedConns wraps dial so that closing the connections it returns is
+// counted.
+func countClosedConns(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		relayConnectionsOpen.Inc()
+		return &countedConn{Conn: conn}, nil
+	}
+}
+
+// countedConn counts its closing once.
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		relayConnections.WithLabelValues("closed").Inc()
+		relayConnectionsOpen.Dec()
+	})
+	return c.Conn.Close()
+}
+
+// ResetRelayConnections closes the idle connections to the relay server, so
+// that the next calls don't use a connection that has gone stale, eg because
+// the robot switched networks. It's a no-op before Start.
+func (c *Client) ResetRelayConnections() {
+	if remote := c.remote.Load(); remote != nil {
+		c.resetRelayConnections(remote, resetManual)
+	}
+}
+
+// resetRelayConnections closes the idle connections of remote.
+func (c *Client) resetRelayConnections(remote *http.Client, reason string) {
+	slog.Info("Closing idle connections to the relay server", slog.String("Reason", reason))
+	relayConnectionResets.WithLabelValues(reason).Inc()
+	remote.CloseIdleConnections()
+}
+
+// recordPollOutcome closes the idle connections to the relay server once
+// ResetConnectionsAfterPollFailures consecutive polls failed to reach it.
+func (c *Client) recordPollOutcome(remote *http.Client, err error) {
+	if c.config.ResetConnectionsAfterPollFailures <= 0 {
+		return
+	}
+	if !isRelayUnreachable(err) {
+		c.pollFailures.Store(0)
+		return
+	}
+	// Polls of several workers can fail at once, but only one of them
+	// resets the connections.
+	n := c.pollFailures.Add(1)
+	if n >= int32(c.config.ResetConnectionsAfterPollFailures) && c.pollFailures.CompareAndSwap(n, 0) {
+		c.resetRelayConnections(remote, resetPollFailures)
+	}
+}
+
+// relayResetHandler closes the idle connections to the relay server on POST,
+// for a network manager to call when the network changes.
+func (c *Client) relayResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c.ResetRelayConnections()
+	w.WriteHeader(http.StatusNoContent)
+}
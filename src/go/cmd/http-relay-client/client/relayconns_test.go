@@ -0,0 +1,197 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// relayConnectionCount returns the relay_client_relay_connections_total
+// counter for event.
+func relayConnectionCount(t *testing.T, event string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "relay_client_relay_connections_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "event" && l.GetValue() == event {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestRelayConnectionStats(t *testing.T) {
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer relay.Close()
+	config := DefaultClientConfig()
+	config.DisableAuthForRemote = true
+	c := newClient(config)
+	remote, _, err := c.newHTTPClients()
+	if err != nil {
+		t.Fatalf("newHTTPClients() failed: %v", err)
+	}
+	c.remote.Store(remote)
+	get := func() {
+		t.Helper()
+		resp, err := remote.Get(relay.URL)
+		if err != nil {
+			t.Fatalf("Request to relay failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	// Other tests may use relay connections in the background, so the
+	// counters are only checked for a minimum increase.
+	newConns, reused, closed := relayConnectionCount(t, "new"), relayConnectionCount(t, "reused"), relayConnectionCount(t, "closed")
+	get()
+	get()
+	if got := relayConnectionCount(t, "new") - newConns; got < 1 {
+		t.Errorf("New connections increased by %v, want at least 1", got)
+	}
+	if got := relayConnectionCount(t, "reused") - reused; got < 1 {
+		t.Errorf("Reused connections increased by %v, want at least 1", got)
+	}
+	c.ResetRelayConnections()
+	if got := relayConnectionCount(t, "closed") - closed; got < 1 {
+		t.Errorf("Closed connections increased by %v, want at least 1", got)
+	}
+}
+
+// idleCountingTransport counts the calls of CloseIdleConnections, and fails
+// requests if err is set.
+type idleCountingTransport struct {
+	err    error
+	closed atomic.Int32
+}
+
+func (t *idleCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (t *idleCountingTransport) CloseIdleConnections() {
+	t.closed.Add(1)
+}
+
+func TestResetConnectionsAfterPollFailures(t *testing.T) {
+	config := DefaultClientConfig()
+	config.ResetConnectionsAfterPollFailures = 3
+	c := newClient(config)
+	transport := &idleCountingTransport{}
+	remote := &http.Client{Transport: transport}
+	unreachable := &url.Error{Op: "Get", URL: "https://relay.invalid", Err: errors.New("connection reset by peer")}
+
+	for i, tc := range []struct {
+		err        error
+		wantResets int32
+	}{
+		{unreachable, 0},
+		{unreachable, 0},
+		// A poll reaching the relay server starts the count over.
+		{ErrTimeout, 0},
+		{unreachable, 0},
+		{unreachable, 0},
+		{unreachable, 1},
+		{unreachable, 1},
+		{nil, 1},
+		{unreachable, 1},
+		{unreachable, 1},
+		{unreachable, 2},
+	} {
+		c.recordPollOutcome(remote, tc.err)
+		if got := transport.closed.Load(); got != tc.wantResets {
+			t.Fatalf("After poll %d, idle connections were closed %d times, want %d", i, got, tc.wantResets)
+		}
+	}
+}
+
+func TestAuthenticatedRelayClientsCloseIdleConnections(t *testing.T) {
+	newFakeTokenSources(t)
+	for _, tc := range []struct {
+		desc   string
+		modify func(*ClientConfig)
+	}{
+		{"default credentials", func(c *ClientConfig) {}},
+		{"token file", func(c *ClientConfig) { c.RelayAuthenticationTokenFile = "token" }},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			tc.modify(&config)
+			c := newClient(config)
+			transport := &idleCountingTransport{}
+			var remote *http.Client
+			if config.RelayAuthenticationTokenFile != "" {
+				remote = c.newRelayTokenFileClient(&http.Client{Transport: transport})
+			} else {
+				var err error
+				if remote, err = c.newRelayAuthClient(&http.Client{Transport: transport}); err != nil {
+					t.Fatalf("newRelayAuthClient() failed: %v", err)
+				}
+			}
+			c.remote.Store(remote)
+			c.ResetRelayConnections()
+			if got := transport.closed.Load(); got != 1 {
+				t.Errorf("Idle connections were closed %d times, want 1", got)
+			}
+		})
+	}
+}
+
+func TestRelayResetHandler(t *testing.T) {
+	c := newClient(DefaultClientConfig())
+	transport := &idleCountingTransport{}
+	c.remote.Store(&http.Client{Transport: transport})
+	health := httptest.NewServer(c.healthHandler())
+	defer health.Close()
+
+	resp, err := http.Get(health.URL + "/debug/reset-relay-connections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET got status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+	resp, err = http.Post(health.URL+"/debug/reset-relay-connections", "", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("POST got status %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if got := transport.closed.Load(); got != 1 {
+		t.Errorf("Idle connections were closed %d times, want 1", got)
+	}
+}
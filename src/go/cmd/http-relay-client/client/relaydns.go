@@ -0,0 +1,81 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// parseHostOverride parses RelayHostOverride, an IPv4 or IPv6 address with
+// optional brackets.
+func parseHostOverride(s string) (netip.Addr, error) {
+	return netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
+
+// relayResolver returns the resolver for the hostnames of the relay servers,
+// see RelayResolverAddress.
+func (c *Client) relayResolver() *net.Resolver {
+	if c.config.RelayResolverAddress == "" {
+		return net.DefaultResolver
+	}
+	server := c.config.RelayResolverAddress
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(addressHost(server), "53")
+	}
+	return &net.Resolver{
+		// Only the pure Go resolver supports Dial.
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// newRelayDialer returns the DialContext for the connections to the relay
+// servers, which uses RelayResolverAddress and RelayHostOverride, or dial if
+// neither is set. The host override only applies to the relay servers, not
+// to a proxy in between.
+func (c *Client) newRelayDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.config.RelayResolverAddress == "" && c.config.RelayHostOverride == "" {
+		return dial
+	}
+	// These are the settings of http.DefaultTransport.
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  c.relayResolver(),
+	}
+	override, err := parseHostOverride(c.config.RelayHostOverride)
+	if err != nil {
+		// Validate reports it, unless it's unset.
+		return dialer.DialContext
+	}
+	relayHosts := map[string]bool{addressHost(c.config.RelayAddress): true}
+	for _, relay := range c.config.RelayAddresses {
+		relayHosts[addressHost(relay)] = true
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil && relayHosts[host] {
+			addr = net.JoinHostPort(override.String(), port)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newDNSStub starts a DNS server that resolves every name to ip, and returns
+// its address and the number of queries it answered.
+func newDNSStub(t *testing.T, ip [4]byte) (string, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	queries := &atomic.Int32{}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req dnsmessage.Message
+			if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+				continue
+			}
+			queries.Add(1)
+			q := req.Questions[0]
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.ID, Response: true, Authoritative: true},
+				Questions: req.Questions,
+			}
+			if q.Type == dnsmessage.TypeA {
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: ip},
+				}}
+			}
+			out, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(out, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), queries
+}
+
+func TestRelayResolverAddress(t *testing.T) {
+	relay, _ := newTLSRelay(t, false, func(w http.ResponseWriter, r *http.Request) {})
+	resolver, queries := newDNSStub(t, [4]byte{127, 0, 0, 1})
+	_, port, _ := net.SplitHostPort(relay.Listener.Addr().String())
+
+	config := DefaultClientConfig()
+	config.DisableAuthForRemote = true
+	// The certificate of the test server is valid for example.com, which
+	// resolves elsewhere with the system's resolver.
+	config.RelayAddress = net.JoinHostPort("example.com", port)
+	config.RelayResolverAddress = resolver
+	c := newClient(config)
+	remote, _, err := c.newHTTPClients()
+	if err != nil {
+		t.Fatalf("newHTTPClients() failed: %v", err)
+	}
+	defer remote.CloseIdleConnections()
+
+	resp, err := remote.Get("https://" + config.RelayAddress + "/")
+	if err != nil {
+		t.Fatalf("Request to relay failed: %v", err)
+	}
+	resp.Body.Close()
+	if queries.Load() == 0 {
+		t.Error("Relay hostname wasn't resolved with RelayResolverAddress")
+	}
+}
+
+func TestRelayHostOverride(t *testing.T) {
+	var serverName atomic.Value
+	relay, _ := newTLSRelay(t, false, func(w http.ResponseWriter, r *http.Request) {
+		serverName.Store(r.TLS.ServerName)
+	})
+	_, port, _ := net.SplitHostPort(relay.Listener.Addr().String())
+
+	for _, tc := range []struct {
+		host    string
+		wantErr string
+	}{
+		{"example.com", ""},
+		// The certificate is still verified against the hostname.
+		{"relay.invalid", "certificate is valid for"},
+	} {
+		config := DefaultClientConfig()
+		config.DisableAuthForRemote = true
+		config.RelayAddress = net.JoinHostPort(tc.host, port)
+		config.RelayHostOverride = "127.0.0.1"
+		c := newClient(config)
+		remote, _, err := c.newHTTPClients()
+		if err != nil {
+			t.Fatalf("newHTTPClients() failed: %v", err)
+		}
+		resp, err := remote.Get("https://" + config.RelayAddress + "/")
+		remote.CloseIdleConnections()
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Request to %s returned error %v, want %q", tc.host, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", tc.host, err)
+		}
+		resp.Body.Close()
+		if got := serverName.Load(); got != tc.host {
+			t.Errorf("Relay server got SNI %q, want %q", got, tc.host)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// Error responses of the relay client describe the class of the error in
+// this header, so users can tell them apart from responses of the backend.
+const relayErrorHeader = "X-Relay-Error"
+
+// The classes of errors reported in relayErrorHeader.
+const (
+	// errorBackendUnavailable: the backend couldn't be reached (502 Bad
+	// Gateway), or is known to be down (503 Service Unavailable).
+	errorBackendUnavailable = "backend-unavailable"
+	// errorBackendTimeout: the backend didn't respond in time (504 Gateway
+	// Timeout).
+	errorBackendTimeout = "backend-timeout"
+	// errorInvalidRequest: the request can't be passed to the backend.
+	errorInvalidRequest = "invalid-request"
+	// errorForbidden: the request was denied by policy (403 Forbidden).
+	errorForbidden = "forbidden"
+	// errorOverloaded: the relay client handles too many requests (503
+	// Service Unavailable).
+	errorOverloaded = "overloaded"
+	// errorShuttingDown: the relay client stopped before the request was
+	// done (503 Service Unavailable).
+	errorShuttingDown = "shutting-down"
+	// errorInternal: anything else, eg a misconfigured relay client (500
+	// Internal Server Error).
+	errorInternal = "internal"
+)
+
+// The values of ErrorResponseFormat.
+const (
+	errorFormatText        = "text"
+	errorFormatProblemJSON = "problem+json"
+)
+
+// problemDetails is the body of error responses in the problem+json format,
+// see RFC 7807.
+type problemDetails struct {
+	Type           string `json:"type"`
+	Title          string `json:"title"`
+	Status         int    `json:"status"`
+	Detail         string `json:"detail"`
+	RelayRequestID string `json:"relayRequestId"`
+}
+
+// errorResponse returns the final response for a request that failed with
+// the given status code and error class. The message is its body, or its
+// detail in the problem+json format.
+func (c *Client) errorResponse(id string, statusCode int, class, message string) *pb.HttpResponse {
+	contentType, body := "text/plain", []byte(message)
+	if c.config.ErrorResponseFormat == errorFormatProblemJSON {
+		contentType = "application/problem+json"
+		// Marshaling strings and ints can't fail.
+		body, _ = json.Marshal(problemDetails{
+			Type:           "urn:http-relay:error:" + class,
+			Title:          http.StatusText(statusCode),
+			Status:         statusCode,
+			Detail:         message,
+			RelayRequestID: id,
+		})
+	}
+	return &pb.HttpResponse{
+		Id:         proto.String(id),
+		StatusCode: proto.Int32(int32(statusCode)),
+		Header: []*pb.HttpHeader{{
+			Name:  proto.String("Content-Type"),
+			Value: proto.String(contentType),
+		}, {
+			Name:  proto.String(relayErrorHeader),
+			Value: proto.String(class),
+		}},
+		Body: body,
+		Eof:  proto.Bool(true),
+	}
+}
+
+// classifyBackendError returns the status code and error class of the error
+// response for a failed backend request.
+func classifyBackendError(err error) (int, string) {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout, errorBackendTimeout
+	}
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &opErr) || errors.As(err, &dnsErr) || errors.As(err, &certErr) {
+		return http.StatusBadGateway, errorBackendUnavailable
+	}
+	return http.StatusInternalServerError, errorInternal
+}
+
+// backendError is reported to the ErrorHandler for failed backend requests.
+// It matches ErrBackendUnavailable, and ErrTimeout if the backend didn't
+// respond in time.
+type backendError struct {
+	err error
+}
+
+func (e *backendError) Error() string {
+	return "backend request failed: " + e.err.Error()
+}
+
+func (e *backendError) Unwrap() error {
+	return e.err
+}
+
+func (e *backendError) Is(target error) bool {
+	switch target {
+	case ErrBackendUnavailable:
+		return true
+	case ErrTimeout:
+		_, class := classifyBackendError(e.err)
+		return class == errorBackendTimeout
+	}
+	return false
+}
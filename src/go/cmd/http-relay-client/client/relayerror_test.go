@@ -0,0 +1,251 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// timeoutError is a net.Error that timed out, like the error of an
+// http.Client with a Timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout awaiting response headers" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyBackendError(t *testing.T) {
+	// Errors as returned by http.Client.Do.
+	urlError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://localhost:8080/foo", Err: err}
+	}
+	tests := []struct {
+		desc       string
+		err        error
+		wantStatus int
+		wantClass  string
+	}{
+		{
+			desc: "connection refused",
+			err: urlError(&net.OpError{Op: "dial", Net: "tcp",
+				Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}),
+			wantStatus: http.StatusBadGateway,
+			wantClass:  errorBackendUnavailable,
+		},
+		{
+			desc:       "unknown host",
+			err:        urlError(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "backend"}}),
+			wantStatus: http.StatusBadGateway,
+			wantClass:  errorBackendUnavailable,
+		},
+		{
+			desc:       "invalid certificate",
+			err:        urlError(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}),
+			wantStatus: http.StatusBadGateway,
+			wantClass:  errorBackendUnavailable,
+		},
+		{
+			desc:       "context deadline",
+			err:        urlError(context.DeadlineExceeded),
+			wantStatus: http.StatusGatewayTimeout,
+			wantClass:  errorBackendTimeout,
+		},
+		{
+			desc:       "client timeout",
+			err:        urlError(timeoutError{}),
+			wantStatus: http.StatusGatewayTimeout,
+			wantClass:  errorBackendTimeout,
+		},
+		{
+			desc:       "dial timeout",
+			err:        urlError(&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}),
+			wantStatus: http.StatusGatewayTimeout,
+			wantClass:  errorBackendTimeout,
+		},
+		{
+			desc:       "other error",
+			err:        fmt.Errorf("invalid header value: %w", errors.New("contains CR")),
+			wantStatus: http.StatusInternalServerError,
+			wantClass:  errorInternal,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			status, class := classifyBackendError(tc.err)
+			if status != tc.wantStatus || class != tc.wantClass {
+				t.Errorf("classifyBackendError(%v) = %d, %q, want %d, %q", tc.err, status, class, tc.wantStatus, tc.wantClass)
+			}
+		})
+	}
+}
+
+func TestBackendErrorStatus(t *testing.T) {
+	// A backend that accepts connections but never responds.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	tests := []struct {
+		desc       string
+		address    string
+		wantStatus int32
+		wantClass  string
+		// wantTimeout is whether the reported error matches ErrTimeout.
+		wantTimeout bool
+	}{
+		{"refused", "localhost:1", http.StatusBadGateway, errorBackendUnavailable, false},
+		{"timeout", listener.Addr().String(), http.StatusGatewayTimeout, errorBackendTimeout, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = relay.Listener.Addr().String()
+			config.BackendScheme = "http"
+			config.BackendAddress = tc.address
+			var reported []error
+			config.ErrorHandler = func(err error, id string) {
+				if id != tc.desc {
+					t.Errorf("Error reported for request %q, want %q", id, tc.desc)
+				}
+				reported = append(reported, err)
+			}
+			client := newClient(config)
+			local := client.newLocalClient(nil)
+			local.Timeout = 100 * time.Millisecond
+			client.handleRequest(&http.Client{}, local, &pb.HttpRequest{
+				Id:     proto.String(tc.desc),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+
+			received := relay.responses(tc.desc)
+			if len(received) != 1 {
+				t.Fatalf("Got %d responses, want 1", len(received))
+			}
+			if got := received[0].GetStatusCode(); got != tc.wantStatus {
+				t.Errorf("Status = %d, want %d", got, tc.wantStatus)
+			}
+			var class string
+			for _, h := range received[0].Header {
+				if h.GetName() == relayErrorHeader {
+					class = h.GetValue()
+				}
+			}
+			if class != tc.wantClass {
+				t.Errorf("%s = %q, want %q", relayErrorHeader, class, tc.wantClass)
+			}
+			if len(reported) != 1 {
+				t.Fatalf("Got %d reported errors, want 1: %v", len(reported), reported)
+			}
+			if !errors.Is(reported[0], ErrBackendUnavailable) {
+				t.Errorf("Reported error %v doesn't match ErrBackendUnavailable", reported[0])
+			}
+			if got := errors.Is(reported[0], ErrTimeout); got != tc.wantTimeout {
+				t.Errorf("Reported error %v matches ErrTimeout: %v, want %v", reported[0], got, tc.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestErrorResponseFormat(t *testing.T) {
+	relay := newRecordingRelay()
+	defer relay.Close()
+	tests := []struct {
+		format          string
+		wantContentType string
+		wantBody        func(t *testing.T, body []byte)
+	}{
+		{errorFormatText, "text/plain", func(t *testing.T, body []byte) {
+			if !strings.HasPrefix(string(body), "Backend request failed") {
+				t.Errorf("Body = %q, want the error message", body)
+			}
+		}},
+		{errorFormatProblemJSON, "application/problem+json", func(t *testing.T, body []byte) {
+			var got problemDetails
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("Body %q isn't JSON: %v", body, err)
+			}
+			want := problemDetails{
+				Type:           "urn:http-relay:error:" + errorBackendUnavailable,
+				Title:          "Bad Gateway",
+				Status:         http.StatusBadGateway,
+				RelayRequestID: errorFormatProblemJSON,
+			}
+			if !strings.HasPrefix(got.Detail, "Backend request failed") {
+				t.Errorf("Detail = %q, want the error message", got.Detail)
+			}
+			got.Detail = ""
+			if got != want {
+				t.Errorf("Body = %+v, want %+v", got, want)
+			}
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.format, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = relay.Listener.Addr().String()
+			config.BackendScheme = "http"
+			config.BackendAddress = "localhost:1"
+			config.ErrorResponseFormat = tc.format
+			client := newClient(config)
+			client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+				Id:     proto.String(tc.format),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+
+			received := relay.responses(tc.format)
+			if len(received) != 1 {
+				t.Fatalf("Got %d responses, want 1", len(received))
+			}
+			if got := received[0].GetStatusCode(); got != http.StatusBadGateway {
+				t.Errorf("Status = %d, want %d", got, http.StatusBadGateway)
+			}
+			var contentType string
+			for _, h := range received[0].Header {
+				if h.GetName() == "Content-Type" {
+					contentType = h.GetValue()
+				}
+			}
+			if contentType != tc.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", contentType, tc.wantContentType)
+			}
+			tc.wantBody(t, received[0].Body)
+		})
+	}
+}
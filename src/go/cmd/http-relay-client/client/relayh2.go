@@ -0,0 +1,117 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+// errRelayHTTP1 is returned by relayH2Transport.dialTLS if the relay server
+// didn't choose HTTP/2 with ALPN.
+var errRelayHTTP1 = errors.New("relay server doesn't offer HTTP/2 with ALPN")
+
+// relayH2Transport sends the requests to the relay server over HTTP/2 for
+// RelayHttp2Multiplexing. Unlike the HTTP/2 support of http.Transport, which
+// adds a connection to the pool for every request that is made while no
+// connection is established yet, http2.Transport only dials once and then
+// opens a stream on that connection for every request. If the relay server
+// doesn't negotiate HTTP/2, all requests fall back to the pool of h1.
+type relayH2Transport struct {
+	h2 *http2.Transport
+	h1 *http.Transport
+	// http1 is set once the relay server didn't negotiate HTTP/2.
+	http1 atomic.Bool
+}
+
+// newRelayH2Transport returns a relayH2Transport that shares the TLS config,
+// the dialer and the timeouts of h1.
+func (c *Client) newRelayH2Transport(h1 *http.Transport) *relayH2Transport {
+	t := &relayH2Transport{h1: h1}
+	t.h2 = &http2.Transport{
+		DialTLSContext:  t.dialTLS,
+		IdleConnTimeout: c.config.IdleConnTimeout,
+		ReadIdleTimeout: c.config.ReadIdleTimeout,
+	}
+	if h1.TLSClientConfig != nil {
+		t.h2.TLSClientConfig = h1.TLSClientConfig.Clone()
+	}
+	return t
+}
+
+// dialTLS connects to the relay server with the dialer of h1, so that the
+// connection is counted like the ones of the pool, and fails with
+// errRelayHTTP1 if the relay server didn't choose HTTP/2.
+func (t *relayH2Transport) dialTLS(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	dial := t.h1.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.h1.TLSHandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.h1.TLSHandshakeTimeout)
+		defer cancel()
+	}
+	cfg = cfg.Clone()
+	cfg.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		tlsConn.Close()
+		return nil, errRelayHTTP1
+	}
+	return tlsConn, nil
+}
+
+func (t *relayH2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.http1.Load() || req.URL.Scheme != "https" {
+		return t.h1.RoundTrip(req)
+	}
+	if t.h1.Proxy != nil {
+		if proxy, err := t.h1.Proxy(req); err != nil || proxy != nil {
+			return t.h1.RoundTrip(req)
+		}
+	}
+	resp, err := t.h2.RoundTrip(req)
+	if !errors.Is(err, errRelayHTTP1) {
+		return resp, err
+	}
+	if t.http1.CompareAndSwap(false, true) {
+		slog.Warn("Relay server doesn't support HTTP/2, falling back to HTTP/1.1 connections",
+			slog.String("Host", req.URL.Host))
+	}
+	// http2.Transport neither reads nor closes the body if it can't get a
+	// connection, so the request can be sent as it is.
+	return t.h1.RoundTrip(req)
+}
+
+func (t *relayH2Transport) CloseIdleConnections() {
+	t.h2.CloseIdleConnections()
+	t.h1.CloseIdleConnections()
+}
@@ -0,0 +1,182 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+)
+
+// openRelayConnections returns the relay_client_relay_connections_open
+// gauge.
+func openRelayConnections(t *testing.T) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == "relay_client_relay_connections_open" {
+			return f.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+// newTLSRelay starts a relay server with handler that speaks HTTP/2 if h2
+// is set. Its certificate is trusted by the transport that newHTTPClients
+// clones, and conns counts the connections it accepted.
+func newTLSRelay(t *testing.T, h2 bool, handler http.HandlerFunc) (relay *httptest.Server, conns *atomic.Int32) {
+	t.Helper()
+	conns = &atomic.Int32{}
+	relay = httptest.NewUnstartedServer(handler)
+	relay.EnableHTTP2 = h2
+	relay.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	relay.StartTLS()
+	t.Cleanup(relay.Close)
+	transport := http.DefaultTransport.(*http.Transport)
+	cfg := transport.TLSClientConfig
+	t.Cleanup(func() { transport.TLSClientConfig = cfg })
+	transport.TLSClientConfig = relay.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	return relay, conns
+}
+
+func multiplexingConfig(relay *httptest.Server) ClientConfig {
+	config := DefaultClientConfig()
+	config.RelayScheme = "https"
+	config.RelayAddress = relay.Listener.Addr().String()
+	config.DisableAuthForRemote = true
+	config.RelayHttp2Multiplexing = true
+	return config
+}
+
+func TestRelayHttp2MultiplexingSharesOneConnection(t *testing.T) {
+	const numPolls = 3
+	polls := make(chan struct{}, numPolls)
+	release := make(chan struct{})
+	var http1 atomic.Bool
+	relay, conns := newTLSRelay(t, true, func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http1.Store(true)
+		}
+		if r.URL.Path == "/server/request" {
+			polls <- struct{}{}
+			<-release
+			w.WriteHeader(http.StatusRequestTimeout)
+		}
+	})
+	c := newClient(multiplexingConfig(relay))
+	remote, _, err := c.newHTTPClients()
+	if err != nil {
+		t.Fatalf("newHTTPClients() failed: %v", err)
+	}
+	defer remote.CloseIdleConnections()
+	open := openRelayConnections(t)
+
+	pollErrs := make(chan error, numPolls)
+	for i := 0; i < numPolls; i++ {
+		go func() {
+			_, err := c.getRequest(remote, c.buildRelayURL(c.config.RelayAddress))
+			pollErrs <- err
+		}()
+	}
+	for i := 0; i < numPolls; i++ {
+		select {
+		case <-polls:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Only %d of %d polls reached the relay server", i, numPolls)
+		}
+	}
+	// The chunk is posted while all polls are pending.
+	if err := c.postResponse(remote, &pb.HttpResponse{Id: proto.String("1"), Body: []byte("chunk")}); err != nil {
+		t.Errorf("postResponse() failed while polling: %v", err)
+	}
+	if got := openRelayConnections(t) - open; got < 1 {
+		t.Errorf("Open relay connections increased by %v, want at least 1", got)
+	}
+	close(release)
+	for i := 0; i < numPolls; i++ {
+		if err := <-pollErrs; !errors.Is(err, ErrTimeout) {
+			t.Errorf("getRequest() returned %v, want %v", err, ErrTimeout)
+		}
+	}
+
+	if got := conns.Load(); got != 1 {
+		t.Errorf("Relay server accepted %d connections, want 1", got)
+	}
+	if http1.Load() {
+		t.Error("Relay server got HTTP/1.1 requests, want HTTP/2 only")
+	}
+}
+
+func TestRelayHttp2MultiplexingFallsBackToHttp1(t *testing.T) {
+	var http2 atomic.Bool
+	relay, _ := newTLSRelay(t, false, func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			http2.Store(true)
+		}
+		if r.URL.Path == "/server/request" {
+			w.WriteHeader(http.StatusRequestTimeout)
+		}
+	})
+	c := newClient(multiplexingConfig(relay))
+	remote, _, err := c.newHTTPClients()
+	if err != nil {
+		t.Fatalf("newHTTPClients() failed: %v", err)
+	}
+	defer remote.CloseIdleConnections()
+
+	// The first request fails over to HTTP/1.1, the others go there directly.
+	for i := 0; i < 2; i++ {
+		if _, err := c.getRequest(remote, c.buildRelayURL(c.config.RelayAddress)); !errors.Is(err, ErrTimeout) {
+			t.Errorf("getRequest() returned %v, want %v", err, ErrTimeout)
+		}
+		if err := c.postResponse(remote, &pb.HttpResponse{Id: proto.String("1"), Body: []byte("chunk")}); err != nil {
+			t.Errorf("postResponse() failed: %v", err)
+		}
+	}
+	if http2.Load() {
+		t.Error("Relay server without HTTP/2 got HTTP/2 requests")
+	}
+}
+
+// TestRelayH2TransportFallsBackWithBody checks that a request body is sent
+// over HTTP/1.1 when the relay server turns out not to speak HTTP/2.
+func TestRelayH2TransportFallsBackWithBody(t *testing.T) {
+	relay, _ := newTLSRelay(t, false, func(w http.ResponseWriter, r *http.Request) {})
+	c := newClient(multiplexingConfig(relay))
+	transport := c.newRelayH2Transport(http.DefaultTransport.(*http.Transport).Clone())
+	defer transport.CloseIdleConnections()
+
+	if err := c.postResponse(&http.Client{Transport: transport}, &pb.HttpResponse{Id: proto.String("1"), Body: []byte("chunk")}); err != nil {
+		t.Errorf("postResponse() failed: %v", err)
+	}
+	if !transport.http1.Load() {
+		t.Error("Transport didn't fall back to HTTP/1.1")
+	}
+}
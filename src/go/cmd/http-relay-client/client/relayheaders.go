@@ -0,0 +1,53 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// relayClientIDHeader carries RelayClientID on the calls to the relay server.
+const relayClientIDHeader = "X-Relay-Client-Id"
+
+// relayHeaderTransport identifies the client on all calls to the relay
+// server, with the User-Agent and X-Relay-Client-Id headers.
+type relayHeaderTransport struct {
+	base      http.RoundTripper
+	userAgent string
+	clientID  string
+}
+
+func (c *Client) newRelayHeaderTransport(base http.RoundTripper) *relayHeaderTransport {
+	userAgent := c.config.RelayUserAgent
+	if userAgent == "" {
+		userAgent = fmt.Sprintf("http-relay-client/%s (%s)", clientVersion(), c.config.ServerName)
+	}
+	return &relayHeaderTransport{base: base, userAgent: userAgent, clientID: c.config.RelayClientID}
+}
+
+func (t *relayHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	if t.clientID != "" {
+		req.Header.Set(relayClientIDHeader, t.clientID)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func (t *relayHeaderTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
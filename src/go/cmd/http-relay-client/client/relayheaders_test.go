@@ -0,0 +1,96 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRelayHeaders(t *testing.T) {
+	tests := []struct {
+		desc          string
+		userAgent     string
+		clientID      string
+		wantUserAgent string
+	}{
+		{"default", "", "", "http-relay-client/" + clientVersion() + " (robot-1)"},
+		{"configured", "fleet-agent/2.0", "robot-1-serial-1234", "fleet-agent/2.0"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			var mu sync.Mutex
+			userAgents, clientIDs := map[string][]string{}, map[string][]string{}
+			relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				userAgents[r.URL.Path] = r.Header.Values("User-Agent")
+				clientIDs[r.URL.Path] = r.Header.Values(relayClientIDHeader)
+				mu.Unlock()
+				io.Copy(io.Discard, r.Body)
+				switch r.URL.Path {
+				case "/server/request":
+					body, _ := proto.Marshal(&pb.HttpRequest{Id: proto.String("15")})
+					w.Write(body)
+				case "/server/response":
+					w.Write([]byte("ok"))
+				case "/server/requeststream":
+					w.Write([]byte("data"))
+				}
+			}))
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.ServerName = "robot-1"
+			config.DisableAuthForRemote = true
+			config.RelayUserAgent = tc.userAgent
+			config.RelayClientID = tc.clientID
+			client := newClient(config)
+			remote, _, err := client.newHTTPClients()
+			if err != nil {
+				t.Fatalf("newHTTPClients() failed: %v", err)
+			}
+			if _, err := client.getRequest(remote, client.buildRelayURL(config.RelayAddress)); err != nil {
+				t.Fatalf("getRequest() failed: %v", err)
+			}
+			if err := client.postResponse(remote, &pb.HttpResponse{Id: proto.String("15")}); err != nil {
+				t.Fatalf("postResponse() failed: %v", err)
+			}
+			if _, _, err := client.copyRequestStream(context.Background(), remote, relay.URL+"/server/requeststream?id=15", "15", io.Discard); err != nil {
+				t.Fatalf("copyRequestStream() failed: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, path := range []string{"/server/request", "/server/response", "/server/requeststream"} {
+				if got := userAgents[path]; len(got) != 1 || got[0] != tc.wantUserAgent {
+					t.Errorf("User-Agent for %s = %q, want %q", path, got, tc.wantUserAgent)
+				}
+				if got := strings.Join(clientIDs[path], ","); got != tc.clientID {
+					t.Errorf("%s for %s = %q, want %q", relayClientIDHeader, path, got, tc.clientID)
+				}
+			}
+		})
+	}
+}
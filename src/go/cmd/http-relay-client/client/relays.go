@@ -0,0 +1,188 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// relayPool tracks the health of the relay servers in RelayAddresses. Polls
+// go to the active relay server, which is the first one in the list that
+// hasn't failed. After threshold consecutive connection errors, the next one
+// becomes active. While a relay server other than the first one is active,
+// every reprobeInterval one poll goes to the first one, which becomes active
+// again if it succeeds.
+type relayPool struct {
+	addresses       []string
+	threshold       int
+	reprobeInterval time.Duration
+	now             func() time.Time
+
+	mu     sync.Mutex
+	active int
+	// failures counts the consecutive connection errors of the active relay
+	// server.
+	failures int
+	// since is when the active relay server took over, or was last probed.
+	since   time.Time
+	probing bool
+}
+
+func newRelayPool(addresses []string, threshold int, reprobeInterval time.Duration) *relayPool {
+	p := &relayPool{
+		addresses:       addresses,
+		threshold:       threshold,
+		reprobeInterval: reprobeInterval,
+		now:             time.Now,
+	}
+	p.setActive(0)
+	return p
+}
+
+// pollAddress returns the relay server to poll next.
+func (p *relayPool) pollAddress() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active > 0 && !p.probing && p.now().Sub(p.since) >= p.reprobeInterval {
+		p.probing = true
+		p.since = p.now()
+		return p.addresses[0]
+	}
+	return p.addresses[p.active]
+}
+
+// activeAddress returns the active relay server.
+func (p *relayPool) activeAddress() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addresses[p.active]
+}
+
+// record updates the pool with the outcome of a call to the relay server at
+// address. It's a no-op on a nil pool.
+func (p *relayPool) record(address string, err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	failed := isRelayUnreachable(err)
+	i := slices.Index(p.addresses, address)
+	if p.probing && i == 0 {
+		p.probing = false
+		if !failed {
+			slog.Info("Preferred relay server is reachable again", slog.String("Address", address))
+			p.setActive(0)
+		}
+		return
+	}
+	if i != p.active {
+		// A late outcome for a relay server that isn't active anymore.
+		return
+	}
+	if !failed {
+		p.failures = 0
+		return
+	}
+	p.failures++
+	if p.failures >= p.threshold && len(p.addresses) > 1 {
+		next := (p.active + 1) % len(p.addresses)
+		slog.Warn("Relay server unreachable, failing over",
+			slog.String("Address", address), slog.String("Next", p.addresses[next]))
+		p.setActive(next)
+	}
+}
+
+func (p *relayPool) setActive(i int) {
+	p.active = i
+	p.failures = 0
+	p.since = p.now()
+	for j, address := range p.addresses {
+		v := 0.0
+		if j == i {
+			v = 1
+		}
+		activeRelay.WithLabelValues(address).Set(v)
+	}
+}
+
+// isRelayUnreachable returns true if err means that the relay server couldn't
+// be reached, as opposed to an error response. Cancelled calls don't count.
+func isRelayUnreachable(err error) bool {
+	var uerr *url.Error
+	return errors.As(err, &uerr) && !errors.Is(err, context.Canceled)
+}
+
+// pollRelay returns the relay server to poll next.
+func (c *Client) pollRelay() string {
+	if c.relays == nil {
+		return c.config.RelayAddress
+	}
+	return c.relays.pollAddress()
+}
+
+// relayAddress returns the relay server that request id was pulled from.
+// Only that relay server knows the request, so all responses must go there.
+func (c *Client) relayAddress(id string) string {
+	if address, ok := c.requestRelays.Load(id); ok {
+		return address.(string)
+	}
+	if c.relays == nil {
+		return c.config.RelayAddress
+	}
+	return c.relays.activeAddress()
+}
+
+// RelayStatus describes a relay server of the client.
+type RelayStatus struct {
+	Address string `json:"address"`
+	Active  bool   `json:"active"`
+	// Failures is the number of consecutive connection errors of the active
+	// relay server.
+	Failures int `json:"failures"`
+}
+
+// RelayStatus returns the relay servers of the client, in the order of
+// preference.
+func (c *Client) RelayStatus() []RelayStatus {
+	p := c.relays
+	if p == nil {
+		return []RelayStatus{{Address: c.config.RelayAddress, Active: true}}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := make([]RelayStatus, len(p.addresses))
+	for i, address := range p.addresses {
+		status[i] = RelayStatus{Address: address, Active: i == p.active}
+		if i == p.active {
+			status[i].Failures = p.failures
+		}
+	}
+	return status
+}
+
+// debugRelaysHandler serves RelayStatus as JSON.
+func (c *Client) debugRelaysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.RelayStatus())
+}
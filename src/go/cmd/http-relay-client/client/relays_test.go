@@ -0,0 +1,154 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+var errUnreachable = &url.Error{Op: "Get", URL: "https://a/server/request", Err: errors.New("connection refused")}
+
+func TestRelayPool(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	p := newRelayPool([]string{"a", "b"}, 2, time.Minute)
+	p.now = clock.now
+
+	p.record("a", errUnreachable)
+	p.record("a", NewRelayServerError("relay server responded Internal Server Error"))
+	if got := p.pollAddress(); got != "a" {
+		t.Fatalf("Relay after one connection error = %q, want a", got)
+	}
+	p.record("a", errUnreachable)
+	p.record("a", errUnreachable)
+	if got := p.pollAddress(); got != "b" {
+		t.Fatalf("Relay after two connection errors = %q, want b", got)
+	}
+	// Late outcomes of the previous relay server don't matter.
+	p.record("a", nil)
+	if got := p.pollAddress(); got != "b" {
+		t.Fatalf("Relay after late success = %q, want b", got)
+	}
+
+	clock.advance(time.Minute)
+	if got := p.pollAddress(); got != "a" {
+		t.Fatalf("Probed relay = %q, want a", got)
+	}
+	if got := p.pollAddress(); got != "b" {
+		t.Fatalf("Relay while probing = %q, want b", got)
+	}
+	p.record("a", errUnreachable)
+	if got := p.pollAddress(); got != "b" {
+		t.Fatalf("Relay after failed probe = %q, want b", got)
+	}
+
+	clock.advance(time.Minute)
+	if got := p.pollAddress(); got != "a" {
+		t.Fatalf("Probed relay = %q, want a", got)
+	}
+	p.record("a", nil)
+	if got := p.pollAddress(); got != "a" {
+		t.Fatalf("Relay after successful probe = %q, want a", got)
+	}
+}
+
+func TestRelayPoolSingleAddress(t *testing.T) {
+	p := newRelayPool([]string{"a"}, 1, time.Minute)
+	p.record("a", errUnreachable)
+	if got := p.pollAddress(); got != "a" {
+		t.Errorf("Relay = %q, want a", got)
+	}
+}
+
+func TestFakeRelayFailover(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	dead := relaytest.NewServer()
+	dead.Close()
+	relay := relaytest.NewServer()
+	defer relay.Close()
+	relay.Enqueue(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/"),
+	})
+	c := newFakeRelayClient(relay, backend)
+	c.config.RelayAddresses = []string{dead.Address(), relay.Address()}
+	c.relays = newRelayPool(c.config.RelayAddresses, 2, time.Minute)
+
+	if err := c.localProxy(&http.Client{}, &http.Client{}, &proxyWorker{}); err != nil {
+		t.Fatal(err)
+	}
+	c.requests.Wait()
+	if got := body(relay.Responses("15")); got != "hello" {
+		t.Errorf("Body = %q, want %q", got, "hello")
+	}
+
+	rec := httptest.NewRecorder()
+	c.healthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/relays", nil))
+	var status []RelayStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 2 || status[0].Active || !status[1].Active {
+		t.Errorf("Relay status = %+v, want the second relay server active", status)
+	}
+}
+
+func TestResponsesGoToRelayOfRequest(t *testing.T) {
+	first := relaytest.NewServer()
+	defer first.Close()
+	second := relaytest.NewServer()
+	defer second.Close()
+	var c *Client
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The client fails over while the request is handled.
+		c.relays.mu.Lock()
+		c.relays.setActive(1)
+		c.relays.mu.Unlock()
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	first.Enqueue(&pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/"),
+	})
+	c = newFakeRelayClient(first, backend)
+	c.config.RelayAddresses = []string{first.Address(), second.Address()}
+	c.relays = newRelayPool(c.config.RelayAddresses, 1, time.Minute)
+
+	if err := c.localProxy(&http.Client{}, &http.Client{}, &proxyWorker{}); err != nil {
+		t.Fatal(err)
+	}
+	c.requests.Wait()
+	if got := body(first.Responses("15")); got != "hello" {
+		t.Errorf("Body posted to first relay server = %q, want %q", got, "hello")
+	}
+	if got := second.Responses("15"); len(got) != 0 {
+		t.Errorf("Second relay server got responses %v, want none", got)
+	}
+}
@@ -0,0 +1,497 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package relaytest provides a fake http-relay-server to test the relay
+// client against. Tests enqueue the requests that the client pulls, and
+// inspect the responses it posts back. Faults can be injected into each of
+// the endpoints.
+package relaytest
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+// The endpoints of the relay server used by the relay client.
+const (
+	RequestPath        = "/server/request"
+	ResponsePath       = "/server/response"
+	ResponsesPath      = "/server/responses"
+	RequestStreamPath  = "/server/requeststream"
+	ResponseStreamPath = "/server/responsestream"
+)
+
+// Fault replaces the regular handling of a call to an endpoint.
+type Fault struct {
+	// StatusCode is the status of the error response, if Drop is false.
+	StatusCode int
+	// Drop closes the connection without a response.
+	Drop bool
+	// Header is added to the error response, eg for Retry-After.
+	Header http.Header
+}
+
+// Server is a fake relay server. Unlike the real one, it accepts responses
+// for any request id.
+type Server struct {
+	*httptest.Server
+
+	// PollTimeout is how long calls to RequestPath and RequestStreamPath
+	// wait for data, before they answer with 408 Request Timeout and an empty
+	// response respectively.
+	PollTimeout time.Duration
+	// DropResponseStreamAfter makes response streams break after this many
+	// responses, if positive: the next response is dropped without
+	// acknowledgement, and the stream is reset.
+	DropResponseStreamAfter int
+	// LoseResponseStreamAckAfter is like DropResponseStreamAfter, but the
+	// response is recorded before the stream is reset, as if only its
+	// acknowledgement was lost.
+	LoseResponseStreamAckAfter int
+	// ResponseLatency delays the answer to each call to ResponsePath, plus
+	// a random jitter of up to ResponseJitter, like a relay server on a
+	// slow link.
+	ResponseLatency, ResponseJitter time.Duration
+	// MaxResponseBytes makes calls to ResponsePath and ResponsesPath with
+	// larger bodies fail with 413 Request Entity Too Large, if positive.
+	MaxResponseBytes int
+	// DisableBatches makes calls to ResponsesPath fail with 404 Not Found,
+	// like relay servers that don't accept batched responses.
+	DisableBatches bool
+
+	mu        sync.Mutex
+	requests  []*pb.HttpRequest
+	responses map[string][]*pb.HttpResponse
+	batches   [][]*pb.HttpResponse
+	forget    map[string]int
+	streams   map[string]*requestStream
+	faults    map[string][]Fault
+	calls     map[string]int
+	// posting and maxPosting are the current and peak number of calls to
+	// ResponsePath in progress.
+	posting, maxPosting int
+	// changed is closed and replaced on every change of the fields above.
+	changed chan struct{}
+}
+
+// requestStream is the data that the user-client sends after its request.
+type requestStream struct {
+	chunks [][]byte
+	closed bool
+}
+
+// NewServer starts a fake relay server. It serves HTTP/1.1 and HTTP/2
+// cleartext, which response streams need. Callers should call Close when
+// finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		PollTimeout: 100 * time.Millisecond,
+		responses:   map[string][]*pb.HttpResponse{},
+		streams:     map[string]*requestStream{},
+		faults:      map[string][]Fault{},
+		calls:       map[string]int{},
+		forget:      map[string]int{},
+		changed:     make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(RequestPath, s.withFaults(s.serverRequest))
+	mux.HandleFunc(ResponsePath, s.withFaults(s.serverResponse))
+	mux.HandleFunc(ResponsesPath, s.withFaults(s.serverResponses))
+	mux.HandleFunc(RequestStreamPath, s.withFaults(s.serverRequestStream))
+	mux.HandleFunc(ResponseStreamPath, s.withFaults(s.serverResponseStream))
+	s.Server = httptest.NewServer(h2c.NewHandler(mux, &http2.Server{}))
+	return s
+}
+
+// Address returns the host:port of the server, as used for the client's
+// RelayAddress.
+func (s *Server) Address() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// H2CClient returns a client that talks HTTP/2 cleartext to the server.
+func (s *Server) H2CClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+// Enqueue adds requests to the queue that the client pulls from.
+func (s *Server) Enqueue(reqs ...*pb.HttpRequest) {
+	s.update(func() {
+		s.requests = append(s.requests, reqs...)
+	})
+}
+
+// SendRequestStream adds data to the request stream of request id.
+func (s *Server) SendRequestStream(id string, data []byte) {
+	s.update(func() {
+		stream := s.stream(id)
+		stream.chunks = append(stream.chunks, data)
+	})
+}
+
+// CloseRequestStream ends the request stream of request id. Once the client
+// pulled all data, further calls get 410 Gone.
+func (s *Server) CloseRequestStream(id string) {
+	s.update(func() {
+		s.stream(id).closed = true
+	})
+}
+
+// InjectFault makes the next calls to the endpoint at path fail, one call
+// per fault.
+func (s *Server) InjectFault(path string, faults ...Fault) {
+	s.update(func() {
+		s.faults[path] = append(s.faults[path], faults...)
+	})
+}
+
+// ForgetRequest makes the server reject further responses for request id
+// once it accepted afterBytes of body for it, as if it had restarted.
+func (s *Server) ForgetRequest(id string, afterBytes int) {
+	s.update(func() {
+		s.forget[id] = afterBytes
+	})
+}
+
+// Polls returns the number of calls to RequestPath so far, including failed
+// ones.
+func (s *Server) Polls() int {
+	return s.Calls(RequestPath)
+}
+
+// Calls returns the number of calls to the endpoint at path so far,
+// including failed ones.
+func (s *Server) Calls(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[path]
+}
+
+// Responses returns the responses posted or streamed for request id so far,
+// in order.
+func (s *Server) Responses(id string) []*pb.HttpResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*pb.HttpResponse{}, s.responses[id]...)
+}
+
+// MaxConcurrentPosts returns the peak number of concurrent calls to
+// ResponsePath so far.
+func (s *Server) MaxConcurrentPosts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxPosting
+}
+
+// Batches returns the batches posted to ResponsesPath so far, in order,
+// including any rejected responses in them.
+func (s *Server) Batches() [][]*pb.HttpResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]*pb.HttpResponse{}, s.batches...)
+}
+
+// WaitForResponses waits until the final response for request id was
+// posted, and returns all responses posted for it.
+func (s *Server) WaitForResponses(id string, timeout time.Duration) ([]*pb.HttpResponse, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		responses := append([]*pb.HttpResponse{}, s.responses[id]...)
+		changed := s.changed
+		s.mu.Unlock()
+		if n := len(responses); n > 0 && responses[n-1].GetEof() {
+			return responses, nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return responses, fmt.Errorf("no final response for request %q within %v", id, timeout)
+		}
+	}
+}
+
+// update runs f with the lock held, and wakes up waiters.
+func (s *Server) update(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// tooLarge answers with 413 Request Entity Too Large and returns true if
+// body exceeds MaxResponseBytes.
+func (s *Server) tooLarge(w http.ResponseWriter, body []byte) bool {
+	if s.MaxResponseBytes <= 0 || len(body) <= s.MaxResponseBytes {
+		return false
+	}
+	http.Error(w, "Response too large", http.StatusRequestEntityTooLarge)
+	return true
+}
+
+// accept records resp, unless its request was forgotten.
+func (s *Server) accept(resp *pb.HttpResponse) error {
+	var err error
+	s.update(func() {
+		id := resp.GetId()
+		if afterBytes, ok := s.forget[id]; ok {
+			received := 0
+			for _, r := range s.responses[id] {
+				received += len(r.Body)
+			}
+			if received >= afterBytes {
+				// This is the error of the real relay server.
+				err = fmt.Errorf("Duplicate or invalid request ID %s", id)
+				return
+			}
+		}
+		s.responses[id] = append(s.responses[id], resp)
+	})
+	return err
+}
+
+// stream returns the request stream of request id, creating it if needed.
+// The lock must be held.
+func (s *Server) stream(id string) *requestStream {
+	stream, ok := s.streams[id]
+	if !ok {
+		stream = &requestStream{}
+		s.streams[id] = stream
+	}
+	return stream
+}
+
+// wait waits until next returns true, or PollTimeout has passed. It returns
+// whether next returned true. next is called with the lock held.
+func (s *Server) wait(r *http.Request, next func() bool) bool {
+	deadline := time.After(s.PollTimeout)
+	for {
+		s.mu.Lock()
+		ok := next()
+		changed := s.changed
+		s.mu.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+func (s *Server) withFaults(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var fault *Fault
+		s.update(func() {
+			s.calls[r.URL.Path]++
+			if faults := s.faults[r.URL.Path]; len(faults) > 0 {
+				fault = &faults[0]
+				s.faults[r.URL.Path] = faults[1:]
+			}
+		})
+		if fault == nil {
+			h(w, r)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		if fault.Drop {
+			// Aborting the handler closes the connection.
+			panic(http.ErrAbortHandler)
+		}
+		for k, v := range fault.Header {
+			w.Header()[k] = v
+		}
+		http.Error(w, "Injected fault", fault.StatusCode)
+	}
+}
+
+func (s *Server) serverRequest(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("server") == "" {
+		http.Error(w, "Missing server query parameter", http.StatusBadRequest)
+		return
+	}
+	var req *pb.HttpRequest
+	found := s.wait(r, func() bool {
+		if len(s.requests) == 0 {
+			return false
+		}
+		req, s.requests = s.requests[0], s.requests[1:]
+		return true
+	})
+	if !found {
+		http.Error(w, "No request received within timeout", http.StatusRequestTimeout)
+		return
+	}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.google.protobuf;proto=cloudrobotics.http_relay.v1alpha1.HttpRequest")
+	w.Write(body)
+}
+
+func (s *Server) serverResponse(w http.ResponseWriter, r *http.Request) {
+	s.update(func() {
+		s.posting++
+		s.maxPosting = max(s.maxPosting, s.posting)
+	})
+	defer s.update(func() {
+		s.posting--
+	})
+	delay := s.ResponseLatency
+	if s.ResponseJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(s.ResponseJitter)))
+	}
+	time.Sleep(delay)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.tooLarge(w, body) {
+		return
+	}
+	resp := &pb.HttpResponse{}
+	if err := proto.Unmarshal(body, resp); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.accept(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
+}
+
+func (s *Server) serverResponses(w http.ResponseWriter, r *http.Request) {
+	if s.DisableBatches {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.tooLarge(w, body) {
+		return
+	}
+	batch := &pb.HttpResponses{}
+	if err := proto.Unmarshal(body, batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.update(func() {
+		s.batches = append(s.batches, batch.Response)
+	})
+	// Each response is acknowledged with a line.
+	w.Header().Set("Content-Type", "text/plain")
+	for _, resp := range batch.Response {
+		if err := s.accept(resp); err != nil {
+			fmt.Fprintf(w, "%v\n", err)
+			continue
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
+
+func (s *Server) serverRequestStream(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing id query parameter", http.StatusBadRequest)
+		return
+	}
+	var data []byte
+	var gone bool
+	s.wait(r, func() bool {
+		stream := s.stream(id)
+		if len(stream.chunks) > 0 {
+			data, stream.chunks = stream.chunks[0], stream.chunks[1:]
+			return true
+		}
+		gone = stream.closed
+		return gone
+	})
+	if gone {
+		// Like the real relay server, 410 Gone ends the stream.
+		http.Error(w, "No ongoing request with id "+id, http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-data")
+	w.Write(data)
+}
+
+func (s *Server) serverResponseStream(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing id query parameter", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	in := bufio.NewReader(r.Body)
+	for n := 0; ; n++ {
+		resp := &pb.HttpResponse{}
+		if err := (protodelim.UnmarshalOptions{MaxSize: -1}).UnmarshalFrom(in, resp); err != nil {
+			return
+		}
+		if resp.GetId() != id {
+			fmt.Fprintf(w, "response for %q on stream for %q\n", resp.GetId(), id)
+			return
+		}
+		if n == s.DropResponseStreamAfter && n > 0 {
+			// Aborting the handler resets the stream.
+			panic(http.ErrAbortHandler)
+		}
+		if err := s.accept(resp); err != nil {
+			fmt.Fprintf(w, "%v\n", err)
+			return
+		}
+		if n == s.LoseResponseStreamAckAfter && n > 0 {
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte("ok\n"))
+		w.(http.Flusher).Flush()
+	}
+}
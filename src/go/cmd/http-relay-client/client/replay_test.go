@@ -0,0 +1,379 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"go.uber.org/goleak"
+	"google.golang.org/protobuf/proto"
+)
+
+// trafficShape describes a relayed request without its payload: the sizes
+// and timing of what the user-client and the backend send. Shapes are
+// replayed by TestReplayTrafficShapes with generated payloads.
+type trafficShape struct {
+	Description string `json:"description"`
+	Request     struct {
+		Method      string `json:"method"`
+		HeaderCount int    `json:"header_count"`
+		BodyBytes   int    `json:"body_bytes"`
+		// Upgrade requests switch protocols, and StreamChunks are then
+		// sent to the backend, which echoes them.
+		Upgrade      bool         `json:"upgrade"`
+		StreamChunks []chunkShape `json:"stream_chunks"`
+	} `json:"request"`
+	Response struct {
+		Status       int          `json:"status"`
+		HeaderCount  int          `json:"header_count"`
+		TrailerCount int          `json:"trailer_count"`
+		Chunks       []chunkShape `json:"chunks"`
+	} `json:"response"`
+}
+
+// namedShape is a trafficShape with the name of its file.
+type namedShape struct {
+	name  string
+	shape *trafficShape
+}
+
+// chunkShape is a write of Bytes bytes after a pause of DelayMs.
+type chunkShape struct {
+	Bytes   int `json:"bytes"`
+	DelayMs int `json:"delay_ms"`
+}
+
+// maxReplayHeapGrowth bounds the heap growth while replaying a shape. It's
+// well below the size of the large downloads, which must be streamed.
+const maxReplayHeapGrowth = 16 << 20
+
+// payloadByte returns the byte at offset i of a generated payload. The
+// period is prime, so that reordered chunks are detected.
+func payloadByte(i int) byte {
+	return byte(i % 251)
+}
+
+func payload(offset, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = payloadByte(offset + i)
+	}
+	return b
+}
+
+func totalBytes(chunks []chunkShape) int {
+	n := 0
+	for _, c := range chunks {
+		n += c.Bytes
+	}
+	return n
+}
+
+// loadTrafficShapes loads the shapes in testdata/shapes, sorted by name.
+func loadTrafficShapes(t *testing.T) []namedShape {
+	t.Helper()
+	files, err := filepath.Glob("testdata/shapes/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("No traffic shapes found in testdata/shapes")
+	}
+	var shapes []namedShape
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shape := &trafficShape{}
+		if err := json.Unmarshal(data, shape); err != nil {
+			t.Fatalf("Invalid traffic shape %s: %v", f, err)
+		}
+		shapes = append(shapes, namedShape{strings.TrimSuffix(filepath.Base(f), ".json"), shape})
+	}
+	return shapes
+}
+
+// shapeBackend returns a backend that checks the request against shape and
+// responds as described by it.
+func shapeBackend(t *testing.T, shape *trafficShape) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || len(body) != shape.Request.BodyBytes {
+			t.Errorf("Backend received %d body bytes (error: %v), want %d", len(body), err, shape.Request.BodyBytes)
+		}
+		for i := 0; i < shape.Request.HeaderCount; i++ {
+			if r.Header.Get(fmt.Sprintf("X-Shape-%d", i)) == "" {
+				t.Errorf("Backend didn't receive request header X-Shape-%d", i)
+			}
+		}
+
+		if shape.Request.Upgrade {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Failed to hijack connection: %v", err)
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: shape\r\n")
+			for i := 0; i < shape.Response.HeaderCount; i++ {
+				fmt.Fprintf(rw, "X-Shape-%d: %d\r\n", i, i)
+			}
+			fmt.Fprintf(rw, "\r\n")
+			rw.Flush()
+			// Echo the request stream.
+			want := int64(totalBytes(shape.Request.StreamChunks))
+			if _, err := io.CopyN(rw, rw, want); err != nil {
+				t.Errorf("Backend failed to echo the request stream: %v", err)
+			}
+			rw.Flush()
+			return
+		}
+
+		for i := 0; i < shape.Response.HeaderCount; i++ {
+			w.Header().Set(fmt.Sprintf("X-Shape-%d", i), fmt.Sprint(i))
+		}
+		for i := 0; i < shape.Response.TrailerCount; i++ {
+			w.Header().Add("Trailer", fmt.Sprintf("X-Shape-Trailer-%d", i))
+		}
+		w.WriteHeader(shape.Response.Status)
+		offset := 0
+		for _, c := range shape.Response.Chunks {
+			time.Sleep(time.Duration(c.DelayMs) * time.Millisecond)
+			w.Write(payload(offset, c.Bytes))
+			w.(http.Flusher).Flush()
+			offset += c.Bytes
+		}
+		for i := 0; i < shape.Response.TrailerCount; i++ {
+			w.Header().Set(fmt.Sprintf("X-Shape-Trailer-%d", i), fmt.Sprint(i))
+		}
+	})
+}
+
+// shapeRelay is a fake relay server that serves the request stream of a
+// shape and checks the posted responses on the fly, without keeping them.
+type shapeRelay struct {
+	shape *trafficShape
+
+	mu        sync.Mutex
+	streamed  int
+	responses int
+	status    int32
+	headers   int
+	trailers  int
+	bodyBytes int
+	eof       bool
+	errors    []string
+}
+
+func (r *shapeRelay) errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *shapeRelay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/server/requeststream":
+		r.mu.Lock()
+		i := r.streamed
+		r.streamed++
+		r.mu.Unlock()
+		chunks := r.shape.Request.StreamChunks
+		if i >= len(chunks) {
+			http.Error(w, "No ongoing request", http.StatusGone)
+			return
+		}
+		time.Sleep(time.Duration(chunks[i].DelayMs) * time.Millisecond)
+		w.Write(payload(totalBytes(chunks[:i]), chunks[i].Bytes))
+	case "/server/response":
+		body, _ := io.ReadAll(req.Body)
+		resp := &pb.HttpResponse{}
+		if err := proto.Unmarshal(body, resp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.check(resp)
+		w.Write([]byte("ok"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// check verifies the invariants of the response stream: the status comes
+// first, the final chunk last, and the body is complete and in order.
+func (r *shapeRelay) check(resp *pb.HttpResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.eof {
+		r.errorf("response %d posted after the final response", r.responses)
+	}
+	if (r.responses == 0) != (resp.StatusCode != nil) {
+		r.errorf("response %d has status %d, want it on the first response only", r.responses, resp.GetStatusCode())
+	}
+	r.responses++
+	if resp.StatusCode != nil {
+		r.status = resp.GetStatusCode()
+	}
+	for _, h := range resp.Header {
+		if strings.HasPrefix(h.GetName(), "X-Shape-") {
+			r.headers++
+		}
+	}
+	for _, h := range resp.Trailer {
+		if strings.HasPrefix(h.GetName(), "X-Shape-Trailer-") {
+			r.trailers++
+		}
+	}
+	for i, b := range resp.Body {
+		if b != payloadByte(r.bodyBytes+i) {
+			r.errorf("body byte %d is %d, want %d", r.bodyBytes+i, b, payloadByte(r.bodyBytes+i))
+			break
+		}
+	}
+	r.bodyBytes += len(resp.Body)
+	r.eof = r.eof || resp.GetEof()
+}
+
+// heapSampler records the peak heap size while running.
+type heapSampler struct {
+	stop chan struct{}
+	done chan struct{}
+	base uint64
+	peak uint64
+}
+
+func startHeapSampler() *heapSampler {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s := &heapSampler{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		base: m.HeapInuse,
+		peak: m.HeapInuse,
+	}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				runtime.ReadMemStats(&m)
+				s.peak = max(s.peak, m.HeapInuse)
+			}
+		}
+	}()
+	return s
+}
+
+// growth stops the sampler and returns the peak heap growth.
+func (s *heapSampler) growth() uint64 {
+	close(s.stop)
+	<-s.done
+	return s.peak - s.base
+}
+
+func replayTrafficShape(t *testing.T, shape *trafficShape) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	backend := httptest.NewServer(shapeBackend(t, shape))
+	defer backend.Close()
+	relay := &shapeRelay{shape: shape}
+	relayServer := httptest.NewServer(relay)
+	defer relayServer.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relayServer.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.BackendResponseTimeout = 5 * time.Millisecond
+	config.ResponseRetryPolicy.InitialInterval = time.Millisecond
+	client := newClient(config)
+
+	pbreq := &pb.HttpRequest{
+		Id:     proto.String("replay"),
+		Method: proto.String(shape.Request.Method),
+		Url:    proto.String("http://invalid/replay"),
+		Body:   payload(0, shape.Request.BodyBytes),
+	}
+	for i := 0; i < shape.Request.HeaderCount; i++ {
+		pbreq.Header = append(pbreq.Header, &pb.HttpHeader{
+			Name:  proto.String(fmt.Sprintf("X-Shape-%d", i)),
+			Value: proto.String(fmt.Sprint(i)),
+		})
+	}
+	if shape.Request.Upgrade {
+		pbreq.Header = append(pbreq.Header,
+			&pb.HttpHeader{Name: proto.String("Connection"), Value: proto.String("Upgrade")},
+			&pb.HttpHeader{Name: proto.String("Upgrade"), Value: proto.String("shape")})
+	}
+
+	remoteTransport := &http.Transport{}
+	defer remoteTransport.CloseIdleConnections()
+	heap := startHeapSampler()
+	client.handleRequest(&http.Client{Transport: remoteTransport}, client.newLocalClient(nil), pbreq)
+	if growth := heap.growth(); growth > maxReplayHeapGrowth {
+		t.Errorf("Heap grew by %d bytes, want at most %d", growth, maxReplayHeapGrowth)
+	}
+
+	wantBytes := totalBytes(shape.Response.Chunks)
+	if shape.Request.Upgrade {
+		wantBytes = totalBytes(shape.Request.StreamChunks)
+	}
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	for _, e := range relay.errors {
+		t.Error(e)
+	}
+	if int(relay.status) != shape.Response.Status {
+		t.Errorf("Status = %d, want %d", relay.status, shape.Response.Status)
+	}
+	if !relay.eof {
+		t.Errorf("No final response received")
+	}
+	if relay.bodyBytes != wantBytes {
+		t.Errorf("Relayed %d body bytes, want %d", relay.bodyBytes, wantBytes)
+	}
+	if relay.headers != shape.Response.HeaderCount {
+		t.Errorf("Relayed %d headers, want %d", relay.headers, shape.Response.HeaderCount)
+	}
+	if relay.trailers != shape.Response.TrailerCount {
+		t.Errorf("Relayed %d trailers, want %d", relay.trailers, shape.Response.TrailerCount)
+	}
+}
+
+func TestReplayTrafficShapes(t *testing.T) {
+	for _, s := range loadTrafficShapes(t) {
+		t.Run(s.name, func(t *testing.T) {
+			replayTrafficShape(t, s.shape)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+// The relay server lists the codecs that it can undo for response bodies in
+// this header on /server/request responses, eg "zstd, gzip".
+const bodyCodecsHeader = "X-Relay-Body-Codecs"
+
+// zstdEncoder compresses response bodies. EncodeAll is safe for concurrent
+// use. It only fails for invalid options.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+
+// bodyEncoders are the codecs that ResponseCodecs can list.
+var bodyEncoders = map[string]func([]byte) ([]byte, error){
+	"gzip": func(b []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+	"zstd": func(b []byte) ([]byte, error) {
+		return zstdEncoder.EncodeAll(b, nil), nil
+	},
+}
+
+// compressedMediaTypes are compressed formats that aren't covered by the
+// prefixes and suffixes in isCompressedContent.
+var compressedMediaTypes = map[string]bool{
+	"application/gzip":   true,
+	"application/x-gzip": true,
+	"application/zip":    true,
+	"application/zstd":   true,
+}
+
+// recordBodyCodecs stores the codecs of ResponseCodecs that the relay server
+// advertised support for in its response header.
+func (c *Client) recordBodyCodecs(header http.Header) {
+	if len(c.config.ResponseCodecs) == 0 {
+		return
+	}
+	supported := map[string]bool{}
+	for _, codec := range strings.Split(header.Get(bodyCodecsHeader), ",") {
+		supported[strings.TrimSpace(codec)] = true
+	}
+	codecs := []string{}
+	for _, codec := range c.config.ResponseCodecs {
+		if supported[codec] {
+			codecs = append(codecs, codec)
+		}
+	}
+	c.bodyCodecs.Store(&codecs)
+}
+
+// responseCodec returns the codec for the body of hresp, or "" if it's posted
+// as it is.
+func (c *Client) responseCodec(hresp *http.Response) string {
+	codecs := c.bodyCodecs.Load()
+	if codecs == nil || len(*codecs) == 0 || isCompressedContent(hresp.Header) {
+		return ""
+	}
+	return (*codecs)[0]
+}
+
+// isCompressedContent returns true for response bodies that wouldn't get
+// much smaller with another round of compression.
+func isCompressedContent(header http.Header) bool {
+	if ce := header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasSuffix(mediaType, "+gzip"),
+		strings.HasSuffix(mediaType, "+zip"),
+		strings.HasSuffix(mediaType, "+zstd"):
+		return true
+	}
+	return compressedMediaTypes[mediaType]
+}
+
+// encodeBody compresses the body of resp with codec, unless the body is
+// smaller than ResponseCompressionMinBytes or doesn't get smaller. It returns
+// the uncompressed body, which the caller puts back once resp is posted, so
+// that everything else sees the body as it came from the backend.
+func (c *Client) encodeBody(codec string, resp *pb.HttpResponse) []byte {
+	body := resp.Body
+	if codec == "" || len(body) < c.config.ResponseCompressionMinBytes {
+		return body
+	}
+	encoded, err := bodyEncoders[codec](body)
+	if err != nil || len(encoded) >= len(body) {
+		return body
+	}
+	resp.Body = encoded
+	resp.BodyCodec = proto.String(codec)
+	return body
+}
@@ -0,0 +1,226 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRecordBodyCodecs(t *testing.T) {
+	tests := []struct {
+		desc      string
+		preferred []string
+		header    string
+		want      string
+	}{
+		{"shared codec", []string{"zstd", "gzip"}, "zstd, gzip", "zstd"},
+		{"client preference wins", []string{"gzip", "zstd"}, "zstd, gzip", "gzip"},
+		{"only gzip on server", []string{"zstd", "gzip"}, "gzip", "gzip"},
+		{"old server", []string{"zstd", "gzip"}, "", ""},
+		{"disabled", nil, "zstd, gzip", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.ResponseCodecs = tc.preferred
+			client := newClient(config)
+			client.recordBodyCodecs(http.Header{bodyCodecsHeader: {tc.header}})
+			hresp := &http.Response{Header: http.Header{"Content-Type": {"application/json"}}}
+			if got := client.responseCodec(hresp); got != tc.want {
+				t.Errorf("responseCodec() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsCompressedContent(t *testing.T) {
+	tests := []struct {
+		contentType     string
+		contentEncoding string
+		want            bool
+	}{
+		{"application/json", "", false},
+		{"text/plain; charset=utf-8", "", false},
+		{"image/svg+xml", "", false},
+		{"text/plain", "identity", false},
+		{"text/plain", "gzip", true},
+		{"image/png", "", true},
+		{"video/mp4", "", true},
+		{"audio/ogg", "", true},
+		{"application/vnd.foo+gzip", "", true},
+		{"application/zip", "", true},
+		{"", "", false},
+	}
+	for _, tc := range tests {
+		header := http.Header{}
+		if tc.contentType != "" {
+			header.Set("Content-Type", tc.contentType)
+		}
+		if tc.contentEncoding != "" {
+			header.Set("Content-Encoding", tc.contentEncoding)
+		}
+		if got := isCompressedContent(header); got != tc.want {
+			t.Errorf("isCompressedContent(%q, %q) = %v, want %v", tc.contentType, tc.contentEncoding, got, tc.want)
+		}
+	}
+}
+
+func TestEncodeBody(t *testing.T) {
+	compressible := []byte(strings.Repeat("x", 2000))
+	random := make([]byte, 2000)
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := []struct {
+		desc      string
+		codec     string
+		body      []byte
+		wantCodec string
+	}{
+		{"zstd", "zstd", compressible, "zstd"},
+		{"gzip", "gzip", compressible, "gzip"},
+		{"no codec", "", compressible, ""},
+		{"below threshold", "zstd", compressible[:1023], ""},
+		{"incompressible", "zstd", random, ""},
+	}
+	config := DefaultClientConfig()
+	client := newClient(config)
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			resp := &pb.HttpResponse{Body: tc.body}
+			body := client.encodeBody(tc.codec, resp)
+			if !bytes.Equal(body, tc.body) {
+				t.Errorf("encodeBody() returned a different body")
+			}
+			if got := resp.GetBodyCodec(); got != tc.wantCodec {
+				t.Errorf("BodyCodec = %q, want %q", got, tc.wantCodec)
+			}
+			if tc.wantCodec == "" && !bytes.Equal(resp.Body, tc.body) {
+				t.Errorf("Body was changed without a codec")
+			}
+			if tc.wantCodec != "" && len(resp.Body) >= len(tc.body) {
+				t.Errorf("Encoded body has %d bytes, want less than %d", len(resp.Body), len(tc.body))
+			}
+		})
+	}
+}
+
+func TestResponseBodyIsCompressedWithNegotiatedCodec(t *testing.T) {
+	tests := []struct {
+		desc        string
+		contentType string
+		wantCodec   string
+	}{
+		{"json", "application/json", "zstd"},
+		{"image", "image/png", ""},
+	}
+	body := strings.Repeat(`{"level":"info","msg":"hello"}`+"\n", 200)
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				w.Write([]byte(body))
+			}))
+			defer backend.Close()
+			relay := newRecordingRelay()
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.ResponseCodecs = []string{"zstd", "gzip"}
+			client := newClient(config)
+			client.recordBodyCodecs(http.Header{bodyCodecsHeader: {"zstd, gzip"}})
+			client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+
+			var got []byte
+			for _, resp := range relay.responses("15") {
+				if resp.GetBodyCodec() != tc.wantCodec && len(resp.Body) > 0 {
+					t.Errorf("BodyCodec = %q, want %q", resp.GetBodyCodec(), tc.wantCodec)
+				}
+				chunk := resp.Body
+				if resp.GetBodyCodec() == "zstd" {
+					var err error
+					if chunk, err = zstdDecoder.DecodeAll(chunk, nil); err != nil {
+						t.Fatalf("Failed to decode body: %v", err)
+					}
+				}
+				got = append(got, chunk...)
+			}
+			if string(got) != body {
+				t.Errorf("Relayed body has %d bytes, want %d", len(got), len(body))
+			}
+		})
+	}
+}
+
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// benchmarkPayloads are samples of the bodies that are worth compressing,
+// and one that isn't.
+func benchmarkPayloads() map[string][]byte {
+	type logEntry struct {
+		Time     string            `json:"time"`
+		Level    string            `json:"level"`
+		Message  string            `json:"msg"`
+		Labels   map[string]string `json:"labels"`
+		Duration float64           `json:"duration"`
+	}
+	r := rand.New(rand.NewSource(1))
+	var logs bytes.Buffer
+	enc := json.NewEncoder(&logs)
+	for i := 0; logs.Len() < 256<<10; i++ {
+		enc.Encode(logEntry{
+			Time:     fmt.Sprintf("2024-05-01T12:%02d:%02d.%06dZ", i/3600%60, i/60%60, r.Intn(1000000)),
+			Level:    []string{"info", "warning", "error"}[r.Intn(3)],
+			Message:  fmt.Sprintf("Handled request %d", r.Intn(1000)),
+			Labels:   map[string]string{"robot": fmt.Sprintf("robot-%d", r.Intn(10)), "app": "relay"},
+			Duration: r.Float64(),
+		})
+	}
+	binary := make([]byte, 256<<10)
+	r.Read(binary)
+	return map[string][]byte{"json": logs.Bytes(), "binary": binary}
+}
+
+func BenchmarkEncodeBody(b *testing.B) {
+	for name, payload := range benchmarkPayloads() {
+		for _, codec := range []string{"gzip", "zstd"} {
+			b.Run(name+"/"+codec, func(b *testing.B) {
+				b.SetBytes(int64(len(payload)))
+				var encoded []byte
+				for i := 0; i < b.N; i++ {
+					encoded, _ = bodyEncoders[codec](payload)
+				}
+				b.ReportMetric(float64(len(payload))/float64(len(encoded)), "ratio")
+			})
+		}
+	}
+}
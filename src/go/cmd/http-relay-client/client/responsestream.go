@@ -0,0 +1,210 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/googlecloudrobotics/ilog"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+// The relay server sets this header on /server/request responses if it
+// accepts responses on /server/responsestream.
+const responseStreamHeader = "X-Relay-Response-Stream"
+
+// recordResponseStreamSupport stores whether the relay server advertised
+// support for response streams in its response header.
+func (c *Client) recordResponseStreamSupport(header http.Header) {
+	c.responseStreams.Store(header.Get(responseStreamHeader) != "")
+}
+
+// responseStream sends the responses to a request to the relay server in a
+// single long-lived POST, instead of posting each chunk separately. This
+// saves the overhead of a full HTTP exchange per chunk. Each response is
+// written as a length-delimited message, and the relay server acknowledges it
+// with a line in its response body.
+//
+// A response that was received by the relay server but not acknowledged is
+// sent again if the caller falls back to posting. If the relay server
+// supports sequenced responses, all responses sent through the stream, or
+// posted in its place, carry a sequence number, so that it drops the
+// duplicate. Otherwise, its body reaches the user-client twice.
+type responseStream struct {
+	id      string
+	timeout time.Duration
+	cancel  context.CancelFunc
+	body    *io.PipeWriter
+	resp    *http.Response
+	acks    *bufio.Reader
+	// failed is set once the stream is unusable.
+	failed bool
+	// sequenced is true if the responses are numbered, and sequence is the
+	// number of the next one.
+	sequenced bool
+	sequence  int64
+}
+
+// openResponseStream starts the POST for the response stream of request id.
+// The lifetime of the stream isn't limited; instead, opening the stream and
+// each acknowledgement are limited to RelayPostTimeout.
+func (c *Client) openResponseStream(remote *http.Client, id string) (*responseStream, error) {
+	streamURL := (&url.URL{
+		Scheme:   c.config.RelayScheme,
+		Host:     c.relayAddress(id),
+		Path:     c.config.RelayPrefix + "/server/responsestream",
+		RawQuery: "id=" + url.QueryEscape(id),
+	}).String()
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, "POST", streamURL, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.google.protobuf;proto=cloudrobotics.http_relay.v1alpha1.HttpResponse;delimited=true")
+	req.Header.Set(clientVersionHeader, clientVersion())
+	c.affinity(id).apply(req)
+
+	stop := cancelAfter(c.config.RelayPostTimeout, cancel)
+	resp, err := remote.Do(req)
+	stop()
+	if err != nil {
+		cancel()
+		pw.CloseWithError(err)
+		return nil, fmt.Errorf("couldn't open response stream: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		cancel()
+		pw.Close()
+		return nil, NewRelayServerError(fmt.Sprintf("relay server responded %s: %s", http.StatusText(resp.StatusCode), body))
+	}
+	return &responseStream{
+		id:        id,
+		timeout:   c.config.RelayPostTimeout,
+		cancel:    cancel,
+		body:      pw,
+		resp:      resp,
+		acks:      bufio.NewReader(resp.Body),
+		sequenced: c.sequencedResponses.Load(),
+	}, nil
+}
+
+// cancelAfter calls cancel once timeout has passed, unless timeout is zero.
+// It returns a function that stops the timer.
+func cancelAfter(timeout time.Duration, cancel context.CancelFunc) func() bool {
+	if timeout <= 0 {
+		return func() bool { return false }
+	}
+	return time.AfterFunc(timeout, cancel).Stop
+}
+
+// send writes resp to the stream and waits for the relay server to
+// acknowledge it. If the relay server rejected resp, the error is wrapped
+// with backoff.Permanent, as posting it instead would fail in the same way.
+func (s *responseStream) send(resp *pb.HttpResponse) error {
+	defer cancelAfter(s.timeout, s.cancel)()
+	if _, err := protodelim.MarshalTo(s.body, resp); err != nil {
+		return fmt.Errorf("couldn't write to response stream: %v", err)
+	}
+	ack, err := s.acks.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("couldn't read acknowledgement from response stream: %v", err)
+	}
+	if ack = strings.TrimSuffix(ack, "\n"); ack != "ok" {
+		return backoff.Permanent(NewRelayServerError("relay server rejected response: " + ack))
+	}
+	return nil
+}
+
+// close ends the stream, after which the relay server finishes the POST.
+func (s *responseStream) close() {
+	if s.failed {
+		return
+	}
+	s.failed = true
+	s.body.Close()
+	stop := cancelAfter(s.timeout, s.cancel)
+	io.Copy(io.Discard, s.resp.Body)
+	stop()
+	s.resp.Body.Close()
+	s.cancel()
+}
+
+// abort tears down the stream after an error.
+func (s *responseStream) abort(err error) {
+	if s.failed {
+		return
+	}
+	s.failed = true
+	s.cancel()
+	s.body.CloseWithError(err)
+	s.resp.Body.Close()
+}
+
+// sendResponse sends resp on stream, if it's usable, or posts it to the relay
+// server otherwise, in a batch if batching is enabled. If the stream fails,
+// it's aborted, and resp and all further responses are posted instead. If a
+// batch fails, resp is posted on its own.
+func (c *Client) sendResponse(remote *http.Client, stream *responseStream, resp *pb.HttpResponse, notify backoff.Notify) error {
+	if stream != nil && stream.sequenced {
+		resp.Sequence = proto.Int64(stream.sequence)
+		stream.sequence++
+	}
+	if stream != nil && !stream.failed {
+		if !isKeepAlive(resp) {
+			resp.UploadAttempts = proto.Int32(1)
+			resp.UploadDurationMs = proto.Int64(0)
+		}
+		err := stream.send(resp)
+		if err == nil {
+			return nil
+		}
+		stream.abort(err)
+		var perr *backoff.PermanentError
+		if errors.As(err, &perr) {
+			return perr.Err
+		}
+		slog.Warn("Response stream failed, posting responses instead",
+			slog.String("ID", stream.id), ilog.Err(err))
+	}
+	if (stream == nil || stream.failed) && c.batcher != nil && c.responseBatches.Load() {
+		err := c.batcher.send(remote, resp)
+		if err == nil {
+			return nil
+		}
+		var perr *backoff.PermanentError
+		if errors.As(err, &perr) {
+			return perr.Err
+		}
+		slog.Warn("Failed to post response batch, posting response on its own",
+			slog.String("ID", resp.GetId()), ilog.Err(err))
+	}
+	return c.postResponseWithRetry(remote, resp, notify)
+}
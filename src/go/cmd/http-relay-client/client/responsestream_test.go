@@ -0,0 +1,149 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestResponseStream(t *testing.T) {
+	const chunks = 5
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < chunks; i++ {
+			w.Write([]byte(strings.Repeat("x", 10)))
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		desc         string
+		failAfter    int
+		wantStreamed int
+	}{
+		{"all chunks streamed", 0, -1},
+		{"fallback to posting mid-stream", 2, 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			relay := relaytest.NewServer()
+			defer relay.Close()
+			relay.DropResponseStreamAfter = tc.failAfter
+
+			config := fakeRelayConfig(relay)
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.BackendResponseTimeout = 10 * time.Millisecond
+			config.ResponseRetryPolicy.InitialInterval = time.Millisecond
+			client := newClient(config)
+			client.responseStreams.Store(true)
+			client.handleRequest(relay.H2CClient(), client.newLocalClient(nil), &pb.HttpRequest{
+				Id:     proto.String("1"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+
+			responses := relay.Responses("1")
+			eof := len(responses) > 0 && responses[len(responses)-1].GetEof()
+			if want := strings.Repeat("x", 10*chunks); body(responses) != want || !eof {
+				t.Errorf("Relayed body = %q (final: %v), want %q (final: true)", body(responses), eof, want)
+			}
+			// The fake relay accepts all posts, so the others were streamed.
+			posted := relay.Calls(relaytest.ResponsePath)
+			streamed := len(responses) - posted
+			if tc.wantStreamed < 0 {
+				if posted != 0 {
+					t.Errorf("%d responses posted, want all streamed", posted)
+				}
+			} else if streamed != tc.wantStreamed || posted == 0 {
+				t.Errorf("%d responses streamed and %d posted, want %d streamed and the rest posted",
+					streamed, posted, tc.wantStreamed)
+			}
+		})
+	}
+}
+
+func TestResponseStreamFallbackIsSequenced(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write([]byte(strconv.Itoa(i)))
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	relay := relaytest.NewServer()
+	defer relay.Close()
+	relay.LoseResponseStreamAckAfter = 2
+
+	config := fakeRelayConfig(relay)
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.BackendResponseTimeout = 10 * time.Millisecond
+	config.ResponseRetryPolicy.InitialInterval = time.Millisecond
+	client := newClient(config)
+	client.responseStreams.Store(true)
+	client.sequencedResponses.Store(true)
+	client.handleRequest(relay.H2CClient(), client.newLocalClient(nil), &pb.HttpRequest{
+		Id:     proto.String("1"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/foo"),
+	})
+
+	// The response whose acknowledgement was lost is posted again with the
+	// same sequence number, which the relay server drops.
+	responses := relay.Responses("1")
+	var delivered []*pb.HttpResponse
+	for _, resp := range responses {
+		if resp.Sequence == nil {
+			t.Fatalf("Response without sequence number: %v", resp)
+		}
+		if seq := resp.GetSequence(); seq == int64(len(delivered)) {
+			delivered = append(delivered, resp)
+		} else if seq > int64(len(delivered)) {
+			t.Fatalf("Response %d arrived before response %d", seq, len(delivered))
+		}
+	}
+	if len(delivered) != len(responses)-1 {
+		t.Errorf("Got %d responses and %d distinct ones, want one duplicate", len(responses), len(delivered))
+	}
+	eof := len(delivered) > 0 && delivered[len(delivered)-1].GetEof()
+	if got := body(delivered); got != "01234" || !eof {
+		t.Errorf("Relayed body = %q (final: %v), want %q (final: true)", got, eof, "01234")
+	}
+}
+
+func TestRecordResponseStreamSupport(t *testing.T) {
+	c := newClient(DefaultClientConfig())
+	c.recordResponseStreamSupport(http.Header{responseStreamHeader: {"1"}})
+	if !c.responseStreams.Load() {
+		t.Errorf("Response streams not enabled by %s header", responseStreamHeader)
+	}
+	c.recordResponseStreamSupport(http.Header{})
+	if c.responseStreams.Load() {
+		t.Errorf("Response streams still enabled without %s header", responseStreamHeader)
+	}
+}
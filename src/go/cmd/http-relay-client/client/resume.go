@@ -0,0 +1,146 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// resumedFromHeader is set on the 206 Partial Content response to a resumed
+// request, with the offset in the body that the response starts at.
+const resumedFromHeader = "X-Relay-Resumed-From"
+
+// resumePoint is where an aborted response stopped.
+type resumePoint struct {
+	// offset is the number of body bytes that the relay server accepted.
+	offset int64
+	// ifRange is the validator that the rest of the body must match, an
+	// ETag or a Last-Modified date.
+	ifRange string
+	expires time.Time
+}
+
+// resumePoints remembers where aborted responses stopped, by request, for
+// ResumeWindow.
+type resumePoints struct {
+	window time.Duration
+	mu     sync.Mutex
+	points map[string]resumePoint
+}
+
+func newResumePoints(window time.Duration) *resumePoints {
+	return &resumePoints{window: window, points: map[string]resumePoint{}}
+}
+
+// put remembers that the response for key stopped at offset, and forgets
+// the points that expired.
+func (r *resumePoints) put(key string, offset int64, ifRange string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for k, p := range r.points {
+		if now.After(p.expires) {
+			delete(r.points, k)
+		}
+	}
+	r.points[key] = resumePoint{offset: offset, ifRange: ifRange, expires: now.Add(r.window)}
+}
+
+// take returns and forgets the point for key, unless it expired.
+func (r *resumePoints) take(key string) (resumePoint, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.points[key]
+	delete(r.points, key)
+	if !ok || time.Now().After(p.expires) {
+		return resumePoint{}, false
+	}
+	return p, true
+}
+
+// resumeKey identifies requests for the same body.
+func resumeKey(pbreq *pb.HttpRequest) string {
+	return pbreq.GetMethod() + " " + pbreq.GetUrl()
+}
+
+// resumeRequest turns req into a Range request for the rest of the body, if
+// the response to the same request was aborted within ResumeWindow. It
+// returns the offset in the body that the response will start at, or 0. The
+// If-Range header makes the backend send the whole body instead, if it
+// changed in the meantime.
+func (c *Client) resumeRequest(pbreq *pb.HttpRequest, req *http.Request) int64 {
+	if c.resume == nil || req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return 0
+	}
+	p, ok := c.resume.take(resumeKey(pbreq))
+	if !ok {
+		return 0
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", p.offset))
+	req.Header.Set("If-Range", p.ifRange)
+	return p.offset
+}
+
+// resumedResponse marks resp as the continuation of an aborted response from
+// offset, if the backend sent only the rest of the body. It returns the
+// offset of the body of resp, which is 0 if the backend sent all of it.
+func (c *Client) resumedResponse(id string, offset int64, resp *pb.HttpResponse, hresp *http.Response) int64 {
+	if offset == 0 || hresp.StatusCode != http.StatusPartialContent {
+		return 0
+	}
+	slog.Info("Resuming aborted response",
+		slog.String("ID", id), slog.Int64("Offset", offset))
+	resumedResponses.Inc()
+	resp.Header = append(resp.Header, &pb.HttpHeader{
+		Name:  proto.String(resumedFromHeader),
+		Value: proto.String(fmt.Sprint(offset)),
+	})
+	return offset
+}
+
+// recordResumePoint remembers where the response hresp to pbreq stopped, if
+// it's resumable. offset is where its body started, sentBytes is how much of
+// the body the relay server accepted.
+func (c *Client) recordResumePoint(pbreq *pb.HttpRequest, req *http.Request, hresp *http.Response, offset, sentBytes int64) {
+	if c.resume == nil || sentBytes == 0 || req.Method != http.MethodGet || hresp.Uncompressed {
+		return
+	}
+	switch {
+	case offset == 0 && hresp.StatusCode == http.StatusOK && req.Header.Get("Range") == "":
+		if hresp.Header.Get("Accept-Ranges") != "bytes" {
+			return
+		}
+	case offset > 0 && hresp.StatusCode == http.StatusPartialContent:
+	default:
+		return
+	}
+	// If-Range needs a strong ETag or a date.
+	ifRange := hresp.Header.Get("ETag")
+	if ifRange == "" || strings.HasPrefix(ifRange, "W/") {
+		ifRange = hresp.Header.Get("Last-Modified")
+	}
+	if ifRange == "" {
+		return
+	}
+	c.resume.put(resumeKey(pbreq), offset+sentBytes, ifRange)
+}
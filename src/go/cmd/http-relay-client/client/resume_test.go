@@ -0,0 +1,134 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestResumeAbortedResponse(t *testing.T) {
+	content := make([]byte, 100<<10)
+	rand.Read(content)
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc        string
+		window      time.Duration
+		wait        time.Duration
+		changedBody bool
+		wantRange   bool
+		wantResumed bool
+	}{
+		{desc: "resumed", window: time.Minute, wantRange: true, wantResumed: true},
+		{desc: "disabled", window: 0},
+		{desc: "expired", window: time.Millisecond, wait: 10 * time.Millisecond},
+		// The backend ignores the Range, as If-Range doesn't match anymore.
+		{desc: "changed body", window: time.Minute, changedBody: true, wantRange: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			var mu sync.Mutex
+			var ranges []string
+			changed := false
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				modified := modTime
+				if changed {
+					modified = modTime.Add(time.Hour)
+				}
+				mu.Unlock()
+				http.ServeContent(w, r, "firmware.bin", modified, bytes.NewReader(content))
+			}))
+			defer backend.Close()
+			relay := relaytest.NewServer()
+			defer relay.Close()
+			// The relay server restarts in the middle of the first response.
+			relay.ForgetRequest("1", 30<<10)
+
+			config := fakeRelayConfig(relay)
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.MaxChunkSize = 10 << 10
+			config.BlockSize = 10 << 10
+			config.ResumeWindow = tc.window
+			client := newClient(config)
+			request := func(id string) {
+				client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+					Id:     proto.String(id),
+					Method: proto.String("GET"),
+					Url:    proto.String("http://invalid/firmware.bin"),
+				})
+			}
+
+			request("1")
+			time.Sleep(tc.wait)
+			mu.Lock()
+			changed = tc.changedBody
+			mu.Unlock()
+			request("2")
+
+			delivered := []byte(body(relay.Responses("1")))
+			if len(delivered) == 0 || len(delivered) == len(content) {
+				t.Fatalf("Relay accepted %d bytes of the first response, want it to be interrupted", len(delivered))
+			}
+			second := relay.Responses("2")
+			if len(second) == 0 {
+				t.Fatal("Got no response to the second request")
+			}
+			var resumedFrom string
+			for _, h := range second[0].Header {
+				if h.GetName() == resumedFromHeader {
+					resumedFrom = h.GetValue()
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := ranges[1] != ""; got != tc.wantRange {
+				t.Errorf("Second request has Range %q, want one: %v", ranges[1], tc.wantRange)
+			}
+			if !tc.wantResumed {
+				if second[0].GetStatusCode() != http.StatusOK || resumedFrom != "" {
+					t.Errorf("Got status %d and %s %q, want a full response",
+						second[0].GetStatusCode(), resumedFromHeader, resumedFrom)
+				}
+				if got := body(second); got != string(content) {
+					t.Errorf("Second response has %d bytes, not the full body", len(got))
+				}
+				return
+			}
+			if second[0].GetStatusCode() != http.StatusPartialContent {
+				t.Errorf("Status = %d, want %d", second[0].GetStatusCode(), http.StatusPartialContent)
+			}
+			if want := strconv.Itoa(len(delivered)); resumedFrom != want {
+				t.Errorf("%s = %q, want %q", resumedFromHeader, resumedFrom, want)
+			}
+			if stitched := append(delivered, body(second)...); !bytes.Equal(stitched, content) {
+				t.Errorf("Stitched body has %d bytes, not the %d of the backend in order", len(stitched), len(content))
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// RetryPolicy configures exponential backoff for retrying calls to the relay
+// server. The interval between retries starts at InitialInterval and doubles
+// up to MaxInterval, randomized by +/- RandomizationFactor. Retrying stops
+// after MaxRetries retries or once MaxElapsedTime has passed. A negative
+// MaxRetries or zero MaxElapsedTime disables the respective limit.
+type RetryPolicy struct {
+	InitialInterval     time.Duration
+	MaxInterval         time.Duration
+	MaxRetries          int
+	RandomizationFactor float64
+	MaxElapsedTime      time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialInterval: time.Second,
+		MaxInterval:     10 * time.Second,
+		MaxRetries:      10,
+		// Keeps a fleet of clients from retrying in lockstep after a relay
+		// server restart.
+		RandomizationFactor: 0.5,
+		MaxElapsedTime:      0,
+	}
+}
+
+func (p RetryPolicy) validate() error {
+	if p.InitialInterval <= 0 {
+		return fmt.Errorf("initial interval must be positive, got %v", p.InitialInterval)
+	}
+	if p.MaxInterval < p.InitialInterval {
+		return fmt.Errorf("max interval %v is less than initial interval %v", p.MaxInterval, p.InitialInterval)
+	}
+	if p.RandomizationFactor < 0 || p.RandomizationFactor > 1 {
+		return fmt.Errorf("randomization factor must be in [0, 1], got %v", p.RandomizationFactor)
+	}
+	return nil
+}
+
+// backOff returns a new backoff.BackOff that implements the policy.
+func (p RetryPolicy) backOff() backoff.BackOff {
+	var b backoff.BackOff = &backoff.ExponentialBackOff{
+		InitialInterval:     p.InitialInterval,
+		RandomizationFactor: p.RandomizationFactor,
+		Multiplier:          2,
+		MaxInterval:         p.MaxInterval,
+		MaxElapsedTime:      p.MaxElapsedTime,
+		Clock:               backoff.SystemClock,
+	}
+	if p.MaxRetries >= 0 {
+		b = backoff.WithMaxRetries(b, uint64(p.MaxRetries))
+	}
+	return b
+}
+
+// hintedBackOff is a backoff.BackOff whose next interval can be set by the
+// relay server, see RelayServerError.retryAfter. Such intervals are capped at
+// maxInterval and still count towards the retry limits of the policy.
+type hintedBackOff struct {
+	backoff.BackOff
+	maxInterval time.Duration
+	hint        time.Duration
+}
+
+func (p RetryPolicy) hintedBackOff() *hintedBackOff {
+	return &hintedBackOff{BackOff: p.backOff(), maxInterval: p.MaxInterval}
+}
+
+// observe takes the interval before the next retry from err, if it has one.
+func (b *hintedBackOff) observe(err error) {
+	b.hint = 0
+	var rerr *RelayServerError
+	if errors.As(err, &rerr) {
+		b.hint = rerr.retryAfter
+	}
+}
+
+func (b *hintedBackOff) NextBackOff() time.Duration {
+	d := b.BackOff.NextBackOff()
+	if d != backoff.Stop && b.hint > 0 {
+		d = min(b.hint, b.maxInterval)
+	}
+	b.hint = 0
+	return d
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header value,
+// given in seconds or as an HTTP date. It returns 0 if the value is missing or
+// invalid, or the date has passed.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(min(secs, math.MaxInt64/int64(time.Second))) * time.Second
+	}
+	t, err := http.ParseTime(v)
+	if err != nil || !t.After(now) {
+		return 0
+	}
+	return t.Sub(now)
+}
@@ -0,0 +1,309 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRetryPolicyBackOff(t *testing.T) {
+	p := RetryPolicy{
+		InitialInterval:     100 * time.Millisecond,
+		MaxInterval:         400 * time.Millisecond,
+		MaxRetries:          4,
+		RandomizationFactor: 0.5,
+	}
+	b := p.backOff()
+	b.Reset()
+	for i, base := range []time.Duration{100, 200, 400, 400} {
+		base *= time.Millisecond
+		if got := b.NextBackOff(); got < base/2 || got > base*3/2 {
+			t.Errorf("Retry %d: interval = %v, want %v +/- 50%%", i+1, got, base)
+		}
+	}
+	if got := b.NextBackOff(); got != backoff.Stop {
+		t.Errorf("Interval after MaxRetries = %v, want Stop", got)
+	}
+
+	p.MaxRetries = -1
+	b = p.backOff()
+	b.Reset()
+	for i := 0; i < 100; i++ {
+		if b.NextBackOff() == backoff.Stop {
+			t.Fatalf("Retry %d: got Stop with unlimited retries", i+1)
+		}
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	tests := []struct {
+		desc   string
+		modify func(p *RetryPolicy)
+		ok     bool
+	}{
+		{"default", func(p *RetryPolicy) {}, true},
+		{"no initial interval", func(p *RetryPolicy) { p.InitialInterval = 0 }, false},
+		{"max below initial interval", func(p *RetryPolicy) { p.MaxInterval = p.InitialInterval / 2 }, false},
+		{"randomization factor above 1", func(p *RetryPolicy) { p.RandomizationFactor = 1.5 }, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := DefaultRetryPolicy()
+			tc.modify(&p)
+			if err := p.validate(); (err == nil) != tc.ok {
+				t.Errorf("validate() = %v, want ok: %v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestPostErrorResponseRetries(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	var received *pb.HttpResponse
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts += 1
+		if attempts <= 2 {
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received = &pb.HttpResponse{}
+		if err := proto.Unmarshal(body, received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.ResponseRetryPolicy.InitialInterval = time.Millisecond
+	client := newClient(config)
+	client.postErrorResponse(&http.Client{}, "15", http.StatusBadGateway, errorBackendUnavailable, "Backend unavailable")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("Relay received %d attempts, want 3", attempts)
+	}
+	if received == nil || string(received.Body) != "Backend unavailable" {
+		t.Errorf("Relay received %v, want the error response", received)
+	}
+}
+
+func TestUploadAttemptsAreReported(t *testing.T) {
+	timeSince = time.Since
+
+	var mu sync.Mutex
+	attempts := 0
+	var received []*pb.HttpResponse
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		resp := &pb.HttpResponse{}
+		if err := proto.Unmarshal(body, resp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		attempts += 1
+		// Fail the first two attempts to post the response chunk.
+		if resp.StatusCode != nil && attempts <= 2 {
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, resp)
+		w.Write([]byte("ok"))
+	}))
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.ResponseRetryPolicy.InitialInterval = 10 * time.Millisecond
+	config.ResponseRetryPolicy.RandomizationFactor = 0
+	client := newClient(config)
+
+	// A keep-alive followed by the response.
+	keepAlive := &pb.HttpResponse{Id: proto.String("15")}
+	if err := client.postResponseWithRetry(&http.Client{}, keepAlive, nil); err != nil {
+		t.Fatalf("Failed to post keep-alive: %v", err)
+	}
+	resp := &pb.HttpResponse{
+		Id:         proto.String("15"),
+		StatusCode: proto.Int32(http.StatusOK),
+		Body:       []byte("body"),
+		Eof:        proto.Bool(true),
+	}
+	mu.Lock()
+	attempts = 0
+	mu.Unlock()
+	if err := client.postResponseWithRetry(&http.Client{}, resp, nil); err != nil {
+		t.Fatalf("Failed to post response: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("Relay received %d messages, want 2", len(received))
+	}
+	if got := received[0]; got.UploadAttempts != nil || got.UploadDurationMs != nil {
+		t.Errorf("Keep-alive has upload attempts %v and duration %v, want none",
+			got.UploadAttempts, got.UploadDurationMs)
+	}
+	got := received[1]
+	if got.GetUploadAttempts() != 3 {
+		t.Errorf("Upload attempts = %d, want 3", got.GetUploadAttempts())
+	}
+	// The retries waited for 10ms and 20ms.
+	if d := got.GetUploadDurationMs(); d < 30 || d > 5000 {
+		t.Errorf("Upload duration = %dms, want at least 30ms", d)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"0", 0},
+		{"-1", 0},
+		{"soon", 0},
+		{"Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second},
+		{"Wed, 01 May 2024 11:59:00 GMT", 0},
+	}
+	for _, tc := range tests {
+		if got := parseRetryAfter(tc.value, now); got != tc.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestHintedBackOff(t *testing.T) {
+	p := RetryPolicy{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     time.Second,
+		MaxRetries:      3,
+	}
+	b := p.hintedBackOff()
+	b.Reset()
+	b.observe(NewRelayServerError("unavailable"))
+	if got := b.NextBackOff(); got != 100*time.Millisecond {
+		t.Errorf("Interval without hint = %v, want 100ms", got)
+	}
+	b.observe(&RelayServerError{msg: "unavailable", retryAfter: 500 * time.Millisecond})
+	if got := b.NextBackOff(); got != 500*time.Millisecond {
+		t.Errorf("Interval with hint = %v, want 500ms", got)
+	}
+	b.observe(&RelayServerError{msg: "unavailable", retryAfter: time.Hour})
+	if got := b.NextBackOff(); got != time.Second {
+		t.Errorf("Interval with long hint = %v, want MaxInterval", got)
+	}
+	b.observe(&RelayServerError{msg: "unavailable", retryAfter: 500 * time.Millisecond})
+	if got := b.NextBackOff(); got != backoff.Stop {
+		t.Errorf("Interval after MaxRetries = %v, want Stop", got)
+	}
+}
+
+// newUnavailableRelay returns a relay server that responds to the first
+// failures posts with status and header, and accepts all further posts.
+func newUnavailableRelay(t *testing.T, failures, status int, header http.Header) *relaytest.Server {
+	relay := relaytest.NewServer()
+	t.Cleanup(relay.Close)
+	for i := 0; i < failures; i++ {
+		relay.InjectFault(relaytest.ResponsePath, relaytest.Fault{StatusCode: status, Header: header})
+	}
+	return relay
+}
+
+func TestPostResponseHonorsRetryAfter(t *testing.T) {
+	relay := newUnavailableRelay(t, 1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"1"}})
+
+	config := fakeRelayConfig(relay)
+	config.ResponseRetryPolicy.InitialInterval = 10 * time.Millisecond
+	config.ResponseRetryPolicy.RandomizationFactor = 0
+	client := newClient(config)
+
+	start := time.Now()
+	resp := &pb.HttpResponse{Id: proto.String("15"), StatusCode: proto.Int32(http.StatusOK)}
+	if err := client.postResponseWithRetry(&http.Client{}, resp, nil); err != nil {
+		t.Fatalf("Failed to post response: %v", err)
+	}
+	if got := relay.Calls(relaytest.ResponsePath); got != 2 {
+		t.Errorf("Relay received %d attempts, want 2", got)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("Response was posted after %v, want at least the Retry-After of 1s", d)
+	}
+}
+
+func TestPostResponseCapsRetryAfter(t *testing.T) {
+	retryAfter := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	relay := newUnavailableRelay(t, 2, http.StatusServiceUnavailable, http.Header{"Retry-After": {retryAfter}})
+
+	config := fakeRelayConfig(relay)
+	config.ResponseRetryPolicy.InitialInterval = 10 * time.Millisecond
+	config.ResponseRetryPolicy.MaxInterval = 50 * time.Millisecond
+	client := newClient(config)
+
+	start := time.Now()
+	resp := &pb.HttpResponse{Id: proto.String("15"), StatusCode: proto.Int32(http.StatusOK)}
+	if err := client.postResponseWithRetry(&http.Client{}, resp, nil); err != nil {
+		t.Fatalf("Failed to post response: %v", err)
+	}
+	if got := relay.Calls(relaytest.ResponsePath); got != 3 {
+		t.Errorf("Relay received %d attempts, want 3", got)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > 5*time.Second {
+		t.Errorf("Response was posted after %v, want about 2x MaxInterval", d)
+	}
+}
+
+func TestPostResponseRetriesBadGatewayQuickly(t *testing.T) {
+	relay := newUnavailableRelay(t, 1, http.StatusBadGateway, nil)
+
+	config := fakeRelayConfig(relay)
+	config.ResponseRetryPolicy.InitialInterval = 10 * time.Millisecond
+	client := newClient(config)
+
+	err := client.postResponse(&http.Client{}, &pb.HttpResponse{Id: proto.String("15")})
+	var rerr *RelayServerError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("postResponse() = %v, want a RelayServerError", err)
+	}
+	if rerr.retryAfter != 10*time.Millisecond {
+		t.Errorf("Retry after %v, want InitialInterval", rerr.retryAfter)
+	}
+}
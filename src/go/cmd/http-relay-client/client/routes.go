@@ -0,0 +1,138 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+// maxBackendTLSIdentities bounds the number of distinct client certificates
+// that can be configured through BackendRoutes. Each identity gets its own
+// transport and connection pool.
+const maxBackendTLSIdentities = 16
+
+// BackendRoute overrides how the backend is contacted for relayed requests
+// whose path starts with PathPrefix. Like for BackendAuth, the prefix only
+// matches whole segments of the cleaned path. If several routes match, the
+// one with the longest PathPrefix wins.
+type BackendRoute struct {
+	PathPrefix string
+
+	// ClientCertFile and ClientKeyFile select the TLS client certificate
+	// presented to the backend for requests on this route.
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+// tlsIdentity returns the key under which the route's backend client is
+// stored, or "" if the route doesn't use a client certificate.
+func (r *BackendRoute) tlsIdentity() string {
+	if r.ClientCertFile == "" && r.ClientKeyFile == "" {
+		return ""
+	}
+	return r.ClientCertFile + "\x00" + r.ClientKeyFile
+}
+
+// ParseBackendRoute parses a route given as "PATH_PREFIX,CERT_FILE,KEY_FILE".
+func ParseBackendRoute(s string) (BackendRoute, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return BackendRoute{}, fmt.Errorf("expected PATH_PREFIX,CERT_FILE,KEY_FILE, got %q", s)
+	}
+	return BackendRoute{
+		PathPrefix:     parts[0],
+		ClientCertFile: parts[1],
+		ClientKeyFile:  parts[2],
+	}, nil
+}
+
+// matchBackendRoute returns the route with the longest PathPrefix matching
+// path, or nil if no route matches.
+func (c *Client) matchBackendRoute(path string) *BackendRoute {
+	path = cleanPath(path)
+	var match *BackendRoute
+	for i := range c.config.BackendRoutes {
+		r := &c.config.BackendRoutes[i]
+		if path != r.PathPrefix && !strings.HasPrefix(path, strings.TrimSuffix(r.PathPrefix, "/")+"/") {
+			continue
+		}
+		if match == nil || len(r.PathPrefix) > len(match.PathPrefix) {
+			match = r
+		}
+	}
+	return match
+}
+
+// newRouteClients creates one backend client per distinct TLS identity in
+// BackendRoutes. Routes sharing a certificate share a transport (and hence a
+// connection pool), while connections authenticated with one certificate are
+// never reused for a route using a different one.
+func (c *Client) newRouteClients(tlsConfig *tls.Config) (map[string]*http.Client, error) {
+	clients := make(map[string]*http.Client)
+	for _, r := range c.config.BackendRoutes {
+		id := r.tlsIdentity()
+		if id == "" {
+			continue
+		}
+		if _, ok := clients[id]; ok {
+			continue
+		}
+		if r.ClientCertFile == "" || r.ClientKeyFile == "" {
+			return nil, fmt.Errorf("route %q: client cert and key file must be set together", r.PathPrefix)
+		}
+		if len(clients) == maxBackendTLSIdentities {
+			return nil, fmt.Errorf("too many distinct client certificates in backend routes (max %d)", maxBackendTLSIdentities)
+		}
+		cert, err := loadClientCert(r.ClientCertFile, r.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: failed to load client certificate: %v", r.PathPrefix, err)
+		}
+		c.tlsReloaders = append(c.tlsReloaders, cert)
+		routeTLSConfig := &tls.Config{}
+		if tlsConfig != nil {
+			routeTLSConfig = tlsConfig.Clone()
+		}
+		// The certificate is reloaded by watchTLS.
+		routeTLSConfig.GetClientCertificate = cert.getClientCertificate
+		clients[id] = c.newLocalClient(routeTLSConfig)
+	}
+	return clients, nil
+}
+
+// backendClient returns the client to use for breq: the client of the
+// matching route if it has a TLS identity, local otherwise.
+func (c *Client) backendClient(local *http.Client, breq *pb.HttpRequest) *http.Client {
+	if len(c.routeClients) == 0 {
+		return local
+	}
+	u, err := url.Parse(breq.GetUrl())
+	if err != nil {
+		return local
+	}
+	r := c.matchBackendRoute(u.Path)
+	if r == nil {
+		return local
+	}
+	if rc, ok := c.routeClients[r.tlsIdentity()]; ok {
+		return rc
+	}
+	return local
+}
@@ -0,0 +1,247 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// testCertificate is a self-signed client certificate written to disk.
+type testCertificate struct {
+	certFile, keyFile string
+	pool              *x509.CertPool
+}
+
+func newTestCertificate(t *testing.T, commonName string) testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	dir := t.TempDir()
+	tc := testCertificate{
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+		pool:     pool,
+	}
+	if err := os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+// newClientCertServer starts a TLS server which only accepts clients
+// presenting a certificate from pool and responds with the client's CN.
+func newClientCertServer(pool *x509.CertPool) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	srv.StartTLS()
+	return srv
+}
+
+func TestBackendRoutesPresentRouteCertificate(t *testing.T) {
+	certA := newTestCertificate(t, "tenant-a")
+	certB := newTestCertificate(t, "tenant-b")
+	srvA := newClientCertServer(certA.pool)
+	defer srvA.Close()
+	srvB := newClientCertServer(certB.pool)
+	defer srvB.Close()
+
+	config := DefaultClientConfig()
+	config.BackendRoutes = []BackendRoute{
+		{PathPrefix: "/a/", ClientCertFile: certA.certFile, ClientKeyFile: certA.keyFile},
+		{PathPrefix: "/b/", ClientCertFile: certB.certFile, ClientKeyFile: certB.keyFile},
+	}
+	c := newClient(config)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(srvA.Certificate())
+	tlsConfig := &tls.Config{RootCAs: rootCAs}
+	var err error
+	if c.routeClients, err = c.newRouteClients(tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	local := c.newLocalClient(tlsConfig)
+
+	get := func(path string, srv *httptest.Server) (string, error) {
+		breq := &pb.HttpRequest{Url: proto.String("http://invalid" + path)}
+		resp, err := c.backendClient(local, breq).Get(srv.URL + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	tests := []struct {
+		path    string
+		srv     *httptest.Server
+		wantCN  string
+		wantErr bool
+	}{
+		{"/a/foo", srvA, "tenant-a", false},
+		{"/b/foo", srvB, "tenant-b", false},
+		// The certificate of one route must never be presented on the other.
+		{"/a/foo", srvB, "", true},
+		{"/b/foo", srvA, "", true},
+		// Requests outside of any route present no certificate.
+		{"/c/foo", srvA, "", true},
+		// Routes are matched on the cleaned path.
+		{"/a/../b/foo", srvB, "tenant-b", false},
+		{"/a/../b/foo", srvA, "", true},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s on %s", tc.path, tc.srv.URL), func(t *testing.T) {
+			cn, err := get(tc.path, tc.srv)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected TLS failure, got response from %q", cn)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if cn != tc.wantCN {
+				t.Errorf("Backend saw client certificate %q, want %q", cn, tc.wantCN)
+			}
+		})
+	}
+}
+
+func TestMatchBackendRoutePrefersLongestPrefix(t *testing.T) {
+	config := DefaultClientConfig()
+	config.BackendRoutes = []BackendRoute{
+		{PathPrefix: "/api/"},
+		{PathPrefix: "/api/v1/secrets"},
+		{PathPrefix: "/"},
+	}
+	c := newClient(config)
+	tests := map[string]string{
+		"/api/v1/secrets/foo": "/api/v1/secrets",
+		"/api/v1/pods":        "/api/",
+		"/healthz":            "/",
+	}
+	for path, want := range tests {
+		if r := c.matchBackendRoute(path); r == nil || r.PathPrefix != want {
+			t.Errorf("matchBackendRoute(%q) = %+v, want prefix %q", path, r, want)
+		}
+	}
+}
+
+func TestMatchBackendRouteMatchesWholeSegments(t *testing.T) {
+	config := DefaultClientConfig()
+	config.BackendRoutes = []BackendRoute{
+		{PathPrefix: "/tenant-a"},
+		{PathPrefix: "/tenant-b/"},
+	}
+	c := newClient(config)
+	tests := map[string]string{
+		"/tenant-a":               "/tenant-a",
+		"/tenant-a/x":             "/tenant-a",
+		"/tenant-b/x":             "/tenant-b/",
+		"/tenant-ab/x":            "",
+		"/tenant-bc/x":            "",
+		"/tenant-a/../tenant-b/x": "/tenant-b/",
+		"/tenant-b/../tenant-ab":  "",
+	}
+	for path, want := range tests {
+		r := c.matchBackendRoute(path)
+		got := ""
+		if r != nil {
+			got = r.PathPrefix
+		}
+		if got != want {
+			t.Errorf("matchBackendRoute(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestNewRouteClientsValidatesRoutes(t *testing.T) {
+	cert := newTestCertificate(t, "tenant")
+
+	config := DefaultClientConfig()
+	config.BackendRoutes = []BackendRoute{{PathPrefix: "/a/", ClientCertFile: cert.certFile}}
+	if _, err := newClient(config).newRouteClients(nil); err == nil {
+		t.Errorf("Expected error for route without key file")
+	}
+
+	config.BackendRoutes = []BackendRoute{{PathPrefix: "/a/", ClientCertFile: cert.certFile, ClientKeyFile: "/does/not/exist"}}
+	if _, err := newClient(config).newRouteClients(nil); err == nil {
+		t.Errorf("Expected error for unreadable key file")
+	}
+
+	config.BackendRoutes = nil
+	for i := 0; i <= maxBackendTLSIdentities; i++ {
+		c := newTestCertificate(t, fmt.Sprintf("tenant-%d", i))
+		config.BackendRoutes = append(config.BackendRoutes, BackendRoute{
+			PathPrefix:     fmt.Sprintf("/%d/", i),
+			ClientCertFile: c.certFile,
+			ClientKeyFile:  c.keyFile,
+		})
+	}
+	if _, err := newClient(config).newRouteClients(nil); err == nil {
+		t.Errorf("Expected error for more than %d client certificates", maxBackendTLSIdentities)
+	}
+}
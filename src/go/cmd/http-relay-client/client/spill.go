@@ -0,0 +1,233 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/googlecloudrobotics/ilog"
+	"google.golang.org/protobuf/proto"
+)
+
+// spillFilePattern is the name of the files in SpillDir, as passed to
+// os.CreateTemp.
+const spillFilePattern = "relay-spill-*"
+
+// removeStaleSpills removes the spill files in dir that were left behind by
+// a client that didn't shut down cleanly.
+func removeStaleSpills(dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, spillFilePattern))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			slog.Warn("Failed to remove stale spill file", slog.String("File", f), ilog.Err(err))
+		}
+	}
+	if len(files) > 0 {
+		slog.Info("Removed stale spill files", slog.String("Dir", dir), slog.Int("Count", len(files)))
+	}
+}
+
+// spilledChunk is a chunk waiting to be posted. If offset is -1, the body is
+// in resp, otherwise it's size bytes at offset in the spill file.
+type spilledChunk struct {
+	resp   *pb.HttpResponse
+	offset int64
+	size   int
+}
+
+// responseSpill queues the chunks of a response that the relay server hasn't
+// taken yet. Once the bodies in memory add up to threshold, further bodies
+// are appended to a file in dir instead. The file is created on the first
+// spill, emptied whenever no chunk in it is waiting anymore, and removed by
+// close.
+type responseSpill struct {
+	dir       string
+	threshold int64
+	queue     []spilledChunk
+	// memBytes is the size of the queued bodies in memory, spilled the
+	// number of queued chunks whose body is on disk.
+	memBytes int64
+	spilled  int
+	file     *os.File
+	// fileBytes is the size of the data in file, including chunks that have
+	// been taken already.
+	fileBytes int64
+	// failed is set once writing to file failed. Bodies aren't spilled
+	// anymore then, see accepts.
+	failed bool
+}
+
+func newResponseSpill(dir string, threshold int64) *responseSpill {
+	return &responseSpill{dir: dir, threshold: threshold}
+}
+
+// accepts returns false if push would take memory beyond the threshold
+// because spilling failed. The caller stops reading from the backend then.
+func (s *responseSpill) accepts() bool {
+	return !s.failed || s.memBytes < s.threshold
+}
+
+// len returns the number of queued chunks.
+func (s *responseSpill) len() int {
+	return len(s.queue)
+}
+
+// push queues resp, spilling its body to disk if there's too much in memory
+// already. If that fails, the body is kept in memory and the error returned.
+func (s *responseSpill) push(resp *pb.HttpResponse) error {
+	size := len(resp.Body)
+	if s.failed || size == 0 || s.memBytes+int64(size) <= s.threshold {
+		s.queue = append(s.queue, spilledChunk{resp: resp, offset: -1})
+		s.memBytes += int64(size)
+		return nil
+	}
+	if err := s.write(resp.Body); err != nil {
+		s.failed = true
+		s.queue = append(s.queue, spilledChunk{resp: resp, offset: -1})
+		s.memBytes += int64(size)
+		return err
+	}
+	resp.Body = nil
+	s.queue = append(s.queue, spilledChunk{resp: resp, offset: s.fileBytes, size: size})
+	s.fileBytes += int64(size)
+	s.spilled++
+	spilledBytes.Add(float64(size))
+	return nil
+}
+
+// write appends body to the spill file, creating it if needed.
+func (s *responseSpill) write(body []byte) error {
+	if s.file == nil {
+		f, err := os.CreateTemp(s.dir, spillFilePattern)
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+	_, err := s.file.WriteAt(body, s.fileBytes)
+	return err
+}
+
+// pop removes the oldest chunk from the queue and returns it with its body.
+func (s *responseSpill) pop() (*pb.HttpResponse, error) {
+	chunk := s.queue[0]
+	s.queue[0] = spilledChunk{}
+	s.queue = s.queue[1:]
+	if chunk.offset < 0 {
+		s.memBytes -= int64(len(chunk.resp.Body))
+		return chunk.resp, nil
+	}
+	body := make([]byte, chunk.size)
+	if _, err := s.file.ReadAt(body, chunk.offset); err != nil {
+		return nil, fmt.Errorf("failed to read spilled response body: %w", err)
+	}
+	chunk.resp.Body = body
+	if s.spilled--; s.spilled == 0 {
+		// Start over, so that the file doesn't grow for as long as the
+		// response takes.
+		if err := s.file.Truncate(0); err == nil {
+			s.fileBytes = 0
+		}
+	}
+	return chunk.resp, nil
+}
+
+// close drops the queue and removes the spill file.
+func (s *responseSpill) close() {
+	s.queue = nil
+	if s.file == nil {
+		return
+	}
+	name := s.file.Name()
+	s.file.Close()
+	if err := os.Remove(name); err != nil {
+		slog.Warn("Failed to remove spill file", slog.String("File", name), ilog.Err(err))
+	}
+	s.file = nil
+}
+
+// spillResponses passes the chunks from in on to the returned channel, in
+// order. Instead of waiting while the relay server doesn't take them, eg
+// while it's unreachable, it keeps reading from in, so that the backend can
+// finish the response, and spills the chunks to SpillDir once there are more
+// than SpillThresholdBytes of them. It runs in group, and removes the spill
+// file when the request ends.
+func (c *Client) spillResponses(group *requestGroup, id string, in <-chan *pb.HttpResponse, state *requestState) <-chan *pb.HttpResponse {
+	out := make(chan *pb.HttpResponse)
+	group.Go(func() {
+		defer close(out)
+		s := newResponseSpill(c.config.SpillDir, c.config.SpillThresholdBytes)
+		defer s.close()
+		// Once the request ends, buildResponses still has to be able to
+		// finish.
+		defer func() {
+			for range in {
+			}
+		}()
+
+		pending := in
+		var next *pb.HttpResponse
+		for pending != nil || next != nil || s.len() > 0 {
+			if next == nil && s.len() > 0 {
+				var err error
+				if next, err = s.pop(); err != nil {
+					// The rest of the body is lost, so end it like a body
+					// that the backend failed to send.
+					slog.Error("Failed to read spilled response", slog.String("ID", id), ilog.Err(err))
+					c.reportError(err, id)
+					state.failStream(err)
+					select {
+					case out <- &pb.HttpResponse{Id: proto.String(id), Eof: proto.Bool(true)}:
+					case <-group.ctx.Done():
+					}
+					return
+				}
+			}
+			var recv <-chan *pb.HttpResponse
+			if s.accepts() {
+				recv = pending
+			}
+			var send chan<- *pb.HttpResponse
+			if next != nil {
+				send = out
+			}
+			select {
+			case resp, ok := <-recv:
+				if !ok {
+					pending = nil
+					continue
+				}
+				if next == nil && s.len() == 0 {
+					next = resp
+				} else if err := s.push(resp); err != nil {
+					slog.Warn("Failed to spill response, waiting for the relay server instead",
+						slog.String("ID", id), ilog.Err(err))
+				}
+			case send <- next:
+				next = nil
+			case <-group.ctx.Done():
+				return
+			}
+		}
+	})
+	return out
+}
@@ -0,0 +1,253 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// spillFiles returns the names of the files in dir.
+func spillFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestResponseSpill(t *testing.T) {
+	dir := t.TempDir()
+	s := newResponseSpill(dir, 10)
+	defer s.close()
+	chunk := func(body string) *pb.HttpResponse {
+		return &pb.HttpResponse{Id: proto.String("15"), Body: []byte(body)}
+	}
+	pop := func(want string) {
+		t.Helper()
+		resp, err := s.pop()
+		if err != nil {
+			t.Fatalf("pop() failed: %v", err)
+		}
+		if string(resp.Body) != want {
+			t.Errorf("pop() = %q, want %q", resp.Body, want)
+		}
+	}
+
+	// Memory and disk chunks are mixed, and come out in order.
+	for _, body := range []string{"aaaa", "bbbb", "cccc", "", "dddd"} {
+		if err := s.push(chunk(body)); err != nil {
+			t.Fatalf("push(%q) failed: %v", body, err)
+		}
+	}
+	if s.memBytes != 8 || s.spilled != 2 {
+		t.Errorf("%d bytes in memory and %d chunks on disk, want 8 and 2", s.memBytes, s.spilled)
+	}
+	pop("aaaa")
+	pop("bbbb")
+	if err := s.push(chunk("eeee")); err != nil {
+		t.Fatal(err)
+	}
+	pop("cccc")
+	pop("")
+	pop("dddd")
+	// The file is emptied once no chunk in it is waiting.
+	if s.fileBytes != 0 {
+		t.Errorf("Spill file has %d bytes after it was drained, want 0", s.fileBytes)
+	}
+	if err := s.push(chunk("ffff")); err != nil {
+		t.Fatal(err)
+	}
+	pop("eeee")
+	pop("ffff")
+	if s.len() != 0 || s.memBytes != 0 {
+		t.Errorf("Queue has %d chunks and %d bytes in memory after it was drained", s.len(), s.memBytes)
+	}
+
+	s.close()
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Errorf("Spill files %v are left after close()", files)
+	}
+}
+
+func TestResponseSpillWriteFailure(t *testing.T) {
+	s := newResponseSpill(filepath.Join(t.TempDir(), "missing"), 4)
+	defer s.close()
+	for _, body := range []string{"aaaa", "bbbb"} {
+		if err := s.push(&pb.HttpResponse{Body: []byte(body)}); body == "bbbb" && err == nil {
+			t.Errorf("push() = nil, want error for missing spill dir")
+		}
+	}
+	// The chunk is kept in memory, but no more are taken.
+	if s.accepts() {
+		t.Errorf("accepts() = true with %d bytes in memory after a failed spill", s.memBytes)
+	}
+	for _, want := range []string{"aaaa", "bbbb"} {
+		if resp, err := s.pop(); err != nil || string(resp.Body) != want {
+			t.Errorf("pop() = %q, %v, want %q", resp.GetBody(), err, want)
+		}
+	}
+	if !s.accepts() {
+		t.Errorf("accepts() = false after the queue was drained")
+	}
+}
+
+func TestRemoveStaleSpills(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"relay-spill-123", "relay-spill-456", "other"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removeStaleSpills(dir)
+	if files := spillFiles(t, dir); len(files) != 1 || files[0] != "other" {
+		t.Errorf("Files after removeStaleSpills() = %v, want [other]", files)
+	}
+}
+
+func TestSpillRemovedOnAbort(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultClientConfig()
+	config.SpillDir = dir
+	config.SpillThresholdBytes = 4
+	client := newClient(config)
+	group := newRequestGroup(context.Background())
+	in := make(chan *pb.HttpResponse)
+	client.spillResponses(group, "15", in, newRequestState("15"))
+	// Nothing takes the chunks, so the third is spilled. Sending the fourth
+	// means that the third has been handled.
+	for i := 0; i < 4; i++ {
+		in <- &pb.HttpResponse{Id: proto.String("15"), Body: []byte("data")}
+	}
+	if files := spillFiles(t, dir); len(files) != 1 {
+		t.Errorf("Spill files = %v, want one", files)
+	}
+	close(in)
+	group.wait()
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Errorf("Spill files %v are left after the request was aborted", files)
+	}
+}
+
+// drainSignalingBody closes drained once the body has been read to the end.
+type drainSignalingBody struct {
+	io.Reader
+	drained chan struct{}
+	once    sync.Once
+}
+
+func (b *drainSignalingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.once.Do(func() { close(b.drained) })
+	}
+	return n, err
+}
+
+func (b *drainSignalingBody) Close() error { return nil }
+
+func TestSpilledResponse(t *testing.T) {
+	var want strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&want, "%06d\n", i)
+	}
+	backendBody := &drainSignalingBody{Reader: strings.NewReader(want.String()), drained: make(chan struct{})}
+	backend := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{},
+			ContentLength: -1,
+			Body:          backendBody,
+			Request:       req,
+		}, nil
+	})}
+
+	// The relay server doesn't take any chunk until released.
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var got []byte
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		data, _ := io.ReadAll(r.Body)
+		resp := &pb.HttpResponse{}
+		if err := proto.Unmarshal(data, resp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		got = append(got, resp.Body...)
+		mu.Unlock()
+	}))
+	defer relay.Close()
+	releaseRelay := sync.OnceFunc(func() { close(release) })
+	defer releaseRelay()
+
+	dir := t.TempDir()
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.MaxChunkSize = 1024
+	config.BlockSize = 1024
+	config.SpillDir = dir
+	config.SpillThresholdBytes = 8 * 1024
+	client := newClient(config)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.handleRequest(&http.Client{}, backend, &pb.HttpRequest{
+			Id:     proto.String("15"),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid/logs"),
+		})
+	}()
+
+	// The backend finishes while the relay server doesn't take anything.
+	select {
+	case <-backendBody.drained:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Backend body wasn't read while the relay server was blocked")
+	}
+	if files := spillFiles(t, dir); len(files) != 1 {
+		t.Errorf("Spill files = %v, want one", files)
+	}
+	releaseRelay()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if string(got) != want.String() {
+		t.Errorf("Relayed body differs from the backend's: got %d bytes, want %d", len(got), want.Len())
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Errorf("Spill files %v are left after the request", files)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+)
+
+// isEventStream returns true for Server-Sent Events responses. Their chunks
+// are posted per event, see buildResponses.
+func isEventStream(hresp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(hresp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// eventBoundary returns the length of the prefix of an event stream that
+// consists of complete events and comment lines, ie what can be posted
+// without splitting an event. Comments outside of events are the keep-alives
+// of SSE servers, which must reach the user-client promptly too.
+func eventBoundary(b []byte) int {
+	end := 0
+	inEvent := false
+	for pos := 0; ; {
+		i := bytes.IndexByte(b[pos:], '\n')
+		if i < 0 {
+			return end
+		}
+		line := bytes.TrimSuffix(b[pos:pos+i], []byte("\r"))
+		pos += i + 1
+		switch {
+		case len(line) == 0:
+			// A blank line terminates the event.
+			end = pos
+			inEvent = false
+		case line[0] == ':' && !inEvent:
+			end = pos
+		default:
+			inEvent = true
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEventBoundary(t *testing.T) {
+	tests := []struct {
+		desc   string
+		stream string
+		want   int
+	}{
+		{"empty", "", 0},
+		{"incomplete event", "data: foo\n", 0},
+		{"complete event", "data: foo\n\n", 11},
+		{"crlf", "data: foo\r\n\r\n", 13},
+		{"event and partial event", "data: foo\n\ndata: b", 11},
+		{"keep-alive", ": ping\n", 7},
+		{"keep-alive after event", "data: foo\n\n: ping\n", 18},
+		{"comment in event", "data: foo\n: note\n", 0},
+		{"incomplete keep-alive", ": pi", 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := eventBoundary([]byte(tc.stream)); got != tc.want {
+				t.Errorf("eventBoundary(%q) = %d, want %d", tc.stream, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEventStreamIsPostedPerEvent(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, write := range []string{
+			"data: one\n",
+			"\n",
+			": keep-alive\n",
+			"data: two\n\ndata: three\n\nid: 4\n",
+			"data: four\n\n",
+		} {
+			w.Write([]byte(write))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	// Without events, the stream would be posted in one chunk.
+	config.BackendResponseTimeout = 10 * time.Second
+	client := newClient(config)
+	client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/events"),
+	})
+
+	chunks := []string{}
+	for _, resp := range relay.responses("15") {
+		if len(resp.Body) > 0 {
+			chunks = append(chunks, string(resp.Body))
+		}
+	}
+	want := []string{
+		"data: one\n\n",
+		": keep-alive\n",
+		"data: two\n\ndata: three\n\n",
+		"id: 4\ndata: four\n\n",
+	}
+	if strings.Join(chunks, "|") != strings.Join(want, "|") {
+		t.Errorf("Posted chunks %q, want %q", chunks, want)
+	}
+}
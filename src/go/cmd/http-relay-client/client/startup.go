@@ -0,0 +1,73 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/googlecloudrobotics/ilog"
+)
+
+// Initial delay between the startup polls, see awaitRelay.
+const startupInitialInterval = time.Second
+
+// awaitRelay polls the relay server until a poll succeeds, which includes a
+// poll that times out without a request. Failed polls are retried with
+// exponential backoff up to StartupMaxInterval, instead of the worker's
+// retries and restarts, which would delay the client for long if the network
+// isn't up yet. It fails if StartupDeadline passes first, and returns early
+// if the client is stopped.
+func (c *Client) awaitRelay(remote, local *http.Client) error {
+	c.awaitingRelay.Store(true)
+	defer c.awaitingRelay.Store(false)
+	start := time.Now()
+	delay := min(startupInitialInterval, c.config.StartupMaxInterval)
+	w := &proxyWorker{}
+	for attempt := 1; !c.draining(); attempt++ {
+		err := c.localProxy(remote, local, w)
+		if err == nil || errors.Is(err, ErrTimeout) {
+			if attempt > 1 {
+				slog.Info("Connected to relay server",
+					slog.Int("Attempts", attempt), slog.Duration("Elapsed", time.Since(start)))
+			}
+			return nil
+		}
+		c.reportError(err, "")
+		elapsed := time.Since(start)
+		if c.config.StartupDeadline > 0 && elapsed >= c.config.StartupDeadline {
+			return fmt.Errorf("relay server unreachable after %d attempts in %v: %w", attempt, elapsed.Round(time.Millisecond), err)
+		}
+		// Log less often the longer the relay server is unreachable.
+		if attempt&(attempt-1) == 0 {
+			slog.Warn("Relay server unreachable, retrying",
+				slog.Int("Attempt", attempt), slog.Duration("Delay", delay), ilog.Err(err))
+		} else if c.debugLogs() {
+			slog.Info("Relay server unreachable, retrying",
+				slog.Int("Attempt", attempt), slog.Duration("Delay", delay), ilog.Err(err))
+		}
+		wait := delay + jitter(delay/2)
+		if c.config.StartupDeadline > 0 {
+			// The last attempt is made at the deadline.
+			wait = min(wait, c.config.StartupDeadline-elapsed)
+		}
+		c.sleep(wait)
+		delay = min(2*delay, c.config.StartupMaxInterval)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// unusedAddress returns an address on which connections are refused.
+func unusedAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func newStartupClient(address string, deadline time.Duration) *Client {
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = address
+	config.DisableAuthForRemote = true
+	config.StartupJitter = 0
+	config.StartupMaxInterval = 20 * time.Millisecond
+	config.StartupDeadline = deadline
+	return newClient(config)
+}
+
+func TestStartupWaitsForRelay(t *testing.T) {
+	address := unusedAddress(t)
+	c := newStartupClient(address, 0)
+	started := make(chan error, 1)
+	go func() {
+		started <- c.Start()
+	}()
+
+	// The relay server comes up once the client has been refused for a
+	// while, like at boot.
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case err := <-started:
+		t.Fatalf("Start() = %v while the relay server was unreachable", err)
+	default:
+	}
+	var polls atomic.Int32
+	relay := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		http.Error(w, "No request received within timeout", http.StatusRequestTimeout)
+	}))
+	relay.Listener.Close()
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", address, err)
+	}
+	relay.Listener = l
+	relay.Start()
+	defer relay.Close()
+
+	// The workers poll once the startup poll succeeded.
+	for start := time.Now(); polls.Load() < 3; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("Client polled the relay server %d times after it came up, want at least 3", polls.Load())
+		}
+	}
+	c.Stop()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("Start() = %v, want nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Start() didn't return after Stop()")
+	}
+}
+
+func TestStartupDeadline(t *testing.T) {
+	c := newStartupClient(unusedAddress(t), 200*time.Millisecond)
+	started := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		started <- c.Start()
+	}()
+	select {
+	case err := <-started:
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("Start() = %v, want connection refused", err)
+		}
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("Start() gave up after %v, before the deadline", elapsed)
+		}
+	case <-time.After(10 * time.Second):
+		c.Stop()
+		t.Fatal("Start() didn't give up after StartupDeadline")
+	}
+}
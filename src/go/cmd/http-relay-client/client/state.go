@@ -0,0 +1,239 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestPhase is a step in the lifecycle of a relayed request.
+type requestPhase int
+
+const (
+	// phaseReceived: the request was pulled from the relay server.
+	phaseReceived requestPhase = iota
+	// phaseBackendDialing: the request is sent to the backend, waiting for
+	// the response header.
+	phaseBackendDialing
+	// phaseStreaming: the response is posted to the relay server in chunks.
+	phaseStreaming
+	// phaseFinalizing: the last chunk of the response is being posted.
+	phaseFinalizing
+	// phaseDone: the complete response was posted.
+	phaseDone
+	// phaseFailed: the request was aborted because of an error. The relay
+	// server may or may not have received an error response.
+	phaseFailed
+	// phaseCancelled: the request was abandoned before completion.
+	phaseCancelled
+)
+
+var phaseNames = map[requestPhase]string{
+	phaseReceived:       "Received",
+	phaseBackendDialing: "BackendDialing",
+	phaseStreaming:      "Streaming",
+	phaseFinalizing:     "Finalizing",
+	phaseDone:           "Done",
+	phaseFailed:         "Failed",
+	phaseCancelled:      "Cancelled",
+}
+
+func (p requestPhase) String() string {
+	if name, ok := phaseNames[p]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+func (p requestPhase) terminal() bool {
+	return p >= phaseDone
+}
+
+// validTransitions lists the phases that can follow each non-terminal phase.
+// Any phase can be left for phaseFailed or phaseCancelled.
+var validTransitions = map[requestPhase][]requestPhase{
+	phaseReceived:       {phaseBackendDialing},
+	phaseBackendDialing: {phaseStreaming},
+	phaseStreaming:      {phaseFinalizing},
+	phaseFinalizing:     {phaseDone},
+}
+
+func validTransition(from, to requestPhase) bool {
+	if from.terminal() {
+		return false
+	}
+	if to == phaseFailed || to == phaseCancelled {
+		return true
+	}
+	for _, p := range validTransitions[from] {
+		if p == to {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidTransition is called for transitions that aren't allowed by
+// validTransitions. Tests replace it to panic instead.
+var invalidTransition = func(id string, from, to requestPhase) {
+	slog.Error("Invalid request state transition",
+		slog.String("ID", id),
+		slog.String("From", from.String()),
+		slog.String("To", to.String()))
+}
+
+// requestState tracks the phase of a request. handleRequest and the
+// goroutines it starts all report their progress here, so it's safe for
+// concurrent use.
+type requestState struct {
+	id string
+	// noStore is set for requests matching NoStorePathPrefixes. Features
+	// that keep request or response data around must skip these requests.
+	noStore bool
+	// debug, if set, enables logging of every transition.
+	debug *atomic.Bool
+	// streaming is set for responses of unknown length and upgraded
+	// connections, which may last long.
+	streaming bool
+
+	mu    sync.Mutex
+	phase requestPhase
+	// streamErr is the error that ended reading the backend's response body.
+	streamErr error
+	// expired is set once the response exceeded its maximum duration, see
+	// MaxStreamDuration, and timedOut once reading its body ended because
+	// of that.
+	expired, timedOut bool
+	// status and bytes are the status code of the response and the number
+	// of body bytes posted to the relay server.
+	status int
+	bytes  int64
+}
+
+func newRequestState(id string) *requestState {
+	requestsInPhase.WithLabelValues(phaseReceived.String()).Inc()
+	return &requestState{id: id, phase: phaseReceived}
+}
+
+// current returns the current phase of the request.
+func (s *requestState) current() requestPhase {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.phase
+}
+
+// transition moves the request to the given phase. Once the request has
+// reached a terminal phase, further transitions are ignored, as concurrent
+// goroutines may each report the end of the request. It returns whether the
+// transition took place.
+func (s *requestState) transition(to requestPhase) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.phase.terminal() {
+		return false
+	}
+	if !validTransition(s.phase, to) {
+		invalidTransition(s.id, s.phase, to)
+		return false
+	}
+	if s.debug != nil && s.debug.Load() {
+		slog.Info("Request state transition",
+			slog.String("ID", s.id),
+			slog.String("From", s.phase.String()),
+			slog.String("To", to.String()))
+	}
+	requestsInPhase.WithLabelValues(s.phase.String()).Dec()
+	if !to.terminal() {
+		requestsInPhase.WithLabelValues(to.String()).Inc()
+	}
+	s.phase = to
+	return true
+}
+
+// failStream records that reading the backend's response body failed with
+// err, so the response is truncated, and fails the request.
+func (s *requestState) failStream(err error) {
+	s.mu.Lock()
+	s.streamErr = err
+	s.mu.Unlock()
+	s.transition(phaseFailed)
+}
+
+// streamError returns the error passed to failStream, if any.
+func (s *requestState) streamError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streamErr
+}
+
+// expire records that the response exceeded its maximum duration, before
+// its backend request is cancelled.
+func (s *requestState) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expired = true
+}
+
+// endedByTimeout returns true if the response expired, in which case
+// reading its body failed because the backend request was cancelled, and
+// records that the body was cut short.
+func (s *requestState) endedByTimeout() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timedOut = s.expired
+	return s.timedOut
+}
+
+// streamTimedOut returns true if the body was cut short because the response
+// exceeded its maximum duration.
+func (s *requestState) streamTimedOut() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.timedOut
+}
+
+// respond records the status code of the response to the request.
+func (s *requestState) respond(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// sent records that n body bytes were posted to the relay server.
+func (s *requestState) sent(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytes += int64(n)
+}
+
+// response returns the status code of the response, or 0 if there is none
+// yet, and the number of body bytes posted.
+func (s *requestState) response() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status, s.bytes
+}
+
+// requestFinished logs the end of a request once handleRequest returns, see
+// logAccess for the access log. Tests replace it to inspect the final state.
+var requestFinished = func(s *requestState, start time.Time) {
+	slog.Debug("Request finished",
+		slog.String("ID", s.id),
+		slog.String("State", s.current().String()),
+		slog.Float64("Duration", time.Since(start).Seconds()))
+}
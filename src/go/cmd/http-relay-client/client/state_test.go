@@ -0,0 +1,224 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"go.uber.org/goleak"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMain(m *testing.M) {
+	// Invalid transitions are bugs, so make them fail the tests.
+	invalidTransition = func(id string, from, to requestPhase) {
+		panic(fmt.Sprintf("request %s: invalid transition from %v to %v", id, from, to))
+	}
+	os.Exit(m.Run())
+}
+
+var allPhases = []requestPhase{
+	phaseReceived,
+	phaseBackendDialing,
+	phaseStreaming,
+	phaseFinalizing,
+	phaseDone,
+	phaseFailed,
+	phaseCancelled,
+}
+
+func TestValidTransition(t *testing.T) {
+	want := map[requestPhase][]requestPhase{
+		phaseReceived:       {phaseBackendDialing, phaseFailed, phaseCancelled},
+		phaseBackendDialing: {phaseStreaming, phaseFailed, phaseCancelled},
+		phaseStreaming:      {phaseFinalizing, phaseFailed, phaseCancelled},
+		phaseFinalizing:     {phaseDone, phaseFailed, phaseCancelled},
+	}
+	for _, from := range allPhases {
+		for _, to := range allPhases {
+			wantValid := false
+			for _, p := range want[from] {
+				wantValid = wantValid || p == to
+			}
+			if got := validTransition(from, to); got != wantValid {
+				t.Errorf("validTransition(%v, %v) = %v, want %v", from, to, got, wantValid)
+			}
+		}
+	}
+}
+
+func TestRequestStateInvalidTransitionPanics(t *testing.T) {
+	s := newRequestState("1")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("transition(%v) from %v didn't panic", phaseDone, phaseReceived)
+		}
+	}()
+	s.transition(phaseDone)
+}
+
+func TestRequestStateIgnoresTransitionsAfterEnd(t *testing.T) {
+	for _, end := range []requestPhase{phaseDone, phaseFailed, phaseCancelled} {
+		t.Run(end.String(), func(t *testing.T) {
+			s := newRequestState("1")
+			for _, p := range []requestPhase{phaseBackendDialing, phaseStreaming, phaseFinalizing, end} {
+				if !s.transition(p) {
+					t.Fatalf("transition(%v) = false, want true", p)
+				}
+			}
+			for _, p := range allPhases {
+				if s.transition(p) {
+					t.Errorf("transition(%v) after %v = true, want false", p, end)
+				}
+			}
+			if got := s.current(); got != end {
+				t.Errorf("current() = %v, want %v", got, end)
+			}
+		})
+	}
+}
+
+func TestRequestStateConcurrentFailures(t *testing.T) {
+	s := newRequestState("1")
+	s.transition(phaseBackendDialing)
+	s.transition(phaseStreaming)
+
+	// Only the first goroutine to report the end of the request wins.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.transition(phaseFailed) {
+				mu.Lock()
+				won += 1
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Errorf("%d transitions to %v took place, want 1", won, phaseFailed)
+	}
+}
+
+func TestHandleRequestFinalState(t *testing.T) {
+	tests := []struct {
+		desc    string
+		backend http.HandlerFunc
+		hookErr error
+		refused bool
+		want    requestPhase
+	}{
+		{
+			desc: "small response",
+			backend: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("body"))
+			},
+			want: phaseDone,
+		},
+		{
+			desc: "streamed response",
+			backend: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("chunk"))
+				w.(http.Flusher).Flush()
+				w.Write([]byte("chunk"))
+			},
+			want: phaseDone,
+		},
+		{
+			desc: "request hook error",
+			backend: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("body"))
+			},
+			hookErr: ErrForbidden,
+			want:    phaseFailed,
+		},
+		{
+			desc:    "backend refused",
+			refused: true,
+			want:    phaseFailed,
+		},
+		{
+			desc: "backend read error",
+			backend: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("chunk"))
+				w.(http.Flusher).Flush()
+				resetConnection(t, w)
+			},
+			want: phaseFailed,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			relay := newRecordingRelay()
+			defer relay.Close()
+			backend := httptest.NewServer(tc.backend)
+			defer backend.Close()
+			if tc.refused {
+				backend.Close()
+			}
+
+			var got requestPhase
+			oldRequestFinished := requestFinished
+			requestFinished = func(s *requestState, _ time.Time) {
+				got = s.current()
+			}
+			defer func() { requestFinished = oldRequestFinished }()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			if tc.hookErr != nil {
+				config.RequestHook = func(ctx context.Context, req *http.Request) error {
+					return tc.hookErr
+				}
+			}
+			client := newClient(config)
+			remote := &http.Client{Transport: &http.Transport{}}
+			local := client.newLocalClient(nil)
+			client.handleRequest(remote, local, &pb.HttpRequest{
+				Id:     proto.String("1"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+			remote.CloseIdleConnections()
+			local.CloseIdleConnections()
+
+			if got != tc.want {
+				t.Errorf("Final state = %v, want %v", got, tc.want)
+			}
+			if len(relay.responses("1")) == 0 {
+				t.Errorf("No response received")
+			}
+		})
+	}
+}
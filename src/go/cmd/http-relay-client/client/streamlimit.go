@@ -0,0 +1,53 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// maxStreamDuration returns how long hresp may be streamed, or 0 if there's
+// no limit.
+func (c *Client) maxStreamDuration(hresp *http.Response) time.Duration {
+	if hresp.StatusCode == http.StatusSwitchingProtocols {
+		return c.config.MaxUpgradedStreamDuration
+	}
+	return c.config.MaxStreamDuration
+}
+
+// limitStreamDuration ends the response hresp to request id once it has been
+// streamed for longer than maxStreamDuration. Then it cancels the backend
+// request with cancelBackend, or closes the connection of an upgraded one,
+// which cancelling doesn't affect. The body read so far is posted with a
+// final chunk carrying the streamTimeoutTrailer. It returns a function that
+// lifts the limit, or nil if there's none.
+func (c *Client) limitStreamDuration(id string, hresp *http.Response, state *requestState, cancelBackend func()) func() bool {
+	limit := c.maxStreamDuration(hresp)
+	if limit <= 0 {
+		return nil
+	}
+	timer := time.AfterFunc(limit, func() {
+		slog.Warn("Ending response that exceeded the maximum stream duration",
+			slog.String("ID", id), slog.Duration("Limit", limit))
+		state.expire()
+		cancelBackend()
+		if hresp.StatusCode == http.StatusSwitchingProtocols {
+			hresp.Body.Close()
+		}
+	})
+	return timer.Stop
+}
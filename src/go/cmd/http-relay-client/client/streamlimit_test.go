@@ -0,0 +1,172 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"go.uber.org/goleak"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMaxStreamDuration(t *testing.T) {
+	tests := []struct {
+		desc      string
+		upgrade   bool
+		wantLimit string
+	}{
+		{"streamed response", false, "200ms"},
+		{"upgraded connection", true, "300ms"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			// The backend sends until the relay client hangs up.
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tc.upgrade {
+					for r.Context().Err() == nil {
+						w.Write([]byte("x"))
+						w.(http.Flusher).Flush()
+						time.Sleep(10 * time.Millisecond)
+					}
+					return
+				}
+				conn, bufrw, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Errorf("Hijack failed: %v", err)
+					return
+				}
+				defer conn.Close()
+				bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+				for {
+					bufrw.WriteString("x")
+					if bufrw.Flush() != nil {
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}))
+			defer backend.Close()
+			// The relay server records the responses, and has no data on
+			// the request stream.
+			var mu sync.Mutex
+			var received []*pb.HttpResponse
+			relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/server/response":
+					body, _ := io.ReadAll(r.Body)
+					resp := &pb.HttpResponse{}
+					if err := proto.Unmarshal(body, resp); err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					mu.Lock()
+					received = append(received, resp)
+					mu.Unlock()
+					w.Write([]byte("ok"))
+				case "/server/requeststream":
+					time.Sleep(10 * time.Millisecond)
+				}
+			}))
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.BackendResponseTimeout = 20 * time.Millisecond
+			config.MaxStreamDuration = 200 * time.Millisecond
+			config.MaxUpgradedStreamDuration = 300 * time.Millisecond
+			client := newClient(config)
+			remote := &http.Client{Transport: &http.Transport{}}
+			local := client.newLocalClient(nil)
+			pbreq := &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/stream"),
+			}
+			if tc.upgrade {
+				pbreq.Header = []*pb.HttpHeader{
+					{Name: proto.String("Connection"), Value: proto.String("Upgrade")},
+					{Name: proto.String("Upgrade"), Value: proto.String("test")},
+				}
+			}
+
+			done := make(chan struct{})
+			go func() {
+				client.handleRequest(remote, local, pbreq)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("handleRequest kept streaming after the maximum stream duration")
+			}
+			remote.CloseIdleConnections()
+			local.CloseIdleConnections()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(received) == 0 {
+				t.Fatal("No response received")
+			}
+			final := received[len(received)-1]
+			if !final.GetEof() {
+				t.Fatalf("Last response %v isn't final", final)
+			}
+			if final.StreamError != nil {
+				t.Errorf("Final response has StreamError %q", final.GetStreamError())
+			}
+			var limit []string
+			for _, h := range final.Trailer {
+				if h.GetName() == streamTimeoutTrailer {
+					limit = append(limit, h.GetValue())
+				}
+			}
+			if len(limit) != 1 || limit[0] != tc.wantLimit {
+				t.Errorf("Final response trailers %v, want %s: %s", final.Trailer, streamTimeoutTrailer, tc.wantLimit)
+			}
+			var body []byte
+			for _, resp := range received {
+				body = append(body, resp.Body...)
+			}
+			if len(body) == 0 || len(bytes.Trim(body, "x")) != 0 {
+				t.Errorf("Relayed body %q, want what the backend sent", body)
+			}
+		})
+	}
+}
+
+func TestMaxStreamDurationExemptsUpgrades(t *testing.T) {
+	config := DefaultClientConfig()
+	config.MaxStreamDuration = time.Minute
+	client := newClient(config)
+	if got := client.maxStreamDuration(&http.Response{StatusCode: http.StatusOK}); got != time.Minute {
+		t.Errorf("maxStreamDuration(200) = %v, want %v", got, time.Minute)
+	}
+	if got := client.maxStreamDuration(&http.Response{StatusCode: http.StatusSwitchingProtocols}); got != 0 {
+		t.Errorf("maxStreamDuration(101) = %v, want no limit", got)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+// The relay server may set this header on a relayed request to limit the
+// upload of its response to the given number of bytes per second. It's not
+// passed on to the backend.
+const rateLimitHeader = "X-Relay-Rate-Limit"
+
+// The clock of the upload limiters. Tests replace it with a fake one.
+var (
+	throttleNow   = time.Now
+	throttleSleep = time.Sleep
+)
+
+// tokenBucket paces uploads to a number of bytes per second, allowing bursts
+// of up to a second's worth of bytes. It's safe for concurrent use, so one
+// bucket can limit the uploads of all workers.
+type tokenBucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   throttleNow(),
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller has
+// to wait before uploading them. The bucket goes into debt for uploads larger
+// than what it holds, so chunks larger than the burst size are paced too.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := throttleNow()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttleUpload waits until the body of resp may be uploaded according to
+// MaxUploadBytesPerSecond and the request's own limit, which may be nil.
+// Both buckets are charged, so the longer wait applies.
+func (c *Client) throttleUpload(request *tokenBucket, resp *pb.HttpResponse) {
+	n := len(resp.Body)
+	if n == 0 {
+		return
+	}
+	var wait time.Duration
+	if c.uploadLimiter != nil {
+		wait = c.uploadLimiter.reserve(n)
+	}
+	if request != nil {
+		wait = max(wait, request.reserve(n))
+	}
+	if wait > 0 {
+		uploadThrottledSeconds.Add(wait.Seconds())
+		throttleSleep(wait)
+	}
+}
+
+// requestUploadLimiter returns a token bucket for the rate limit that the
+// relay server set for the request with rateLimitHeader, or nil if it didn't.
+func requestUploadLimiter(breq *pb.HttpRequest) *tokenBucket {
+	for _, h := range breq.Header {
+		if http.CanonicalHeaderKey(h.GetName()) != rateLimitHeader {
+			continue
+		}
+		limit, err := strconv.Atoi(h.GetValue())
+		if err != nil || limit <= 0 {
+			slog.Warn("Ignoring invalid rate limit from relay server",
+				slog.String("ID", breq.GetId()), slog.String("Value", h.GetValue()))
+			return nil
+		}
+		return newTokenBucket(limit)
+	}
+	return nil
+}
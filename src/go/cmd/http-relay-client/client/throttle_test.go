@@ -0,0 +1,122 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// useFakeThrottleClock makes the upload limiters sleep on clock, and restores
+// the real clock when the test ends.
+func useFakeThrottleClock(t *testing.T, clock *fakeClock) {
+	t.Helper()
+	throttleNow, throttleSleep = clock.now, clock.advance
+	t.Cleanup(func() { throttleNow, throttleSleep = time.Now, time.Sleep })
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	useFakeThrottleClock(t, clock)
+	b := newTokenBucket(100)
+
+	// The bucket starts full.
+	if d := b.reserve(100); d != 0 {
+		t.Errorf("reserve(100) on a full bucket = %v, want 0", d)
+	}
+	if d := b.reserve(50); d != 500*time.Millisecond {
+		t.Errorf("reserve(50) on an empty bucket = %v, want 500ms", d)
+	}
+	clock.advance(500 * time.Millisecond)
+	// Chunks larger than a second's worth are paced as well.
+	if d := b.reserve(300); d != 3*time.Second {
+		t.Errorf("reserve(300) = %v, want 3s", d)
+	}
+	// Idle time refills the bucket, but only up to a second's worth.
+	clock.advance(time.Minute)
+	if d := b.reserve(150); d != 500*time.Millisecond {
+		t.Errorf("reserve(150) after a minute = %v, want 500ms", d)
+	}
+}
+
+func TestUploadThrottling(t *testing.T) {
+	const size = 1 << 20
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get(rateLimitHeader); v != "" {
+			t.Errorf("Backend got %s header %q, want none", rateLimitHeader, v)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write(make([]byte, size))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		desc         string
+		clientLimit  int
+		requestLimit string
+		// The first second's worth of bytes is sent without waiting.
+		wantMin, wantMax time.Duration
+	}{
+		{"client limit", 100 << 10, "", 9 * time.Second, 11 * time.Second},
+		{"request limit", 0, "102400", 9 * time.Second, 11 * time.Second},
+		{"stricter limit applies", 1 << 20, "102400", 9 * time.Second, 11 * time.Second},
+		{"no limit", 0, "", 0, 0},
+		{"invalid request limit", 0, "fast", 0, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			start := time.Unix(1000, 0)
+			clock := &fakeClock{t: start}
+			useFakeThrottleClock(t, clock)
+			relay := newRecordingRelay()
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.MaxUploadBytesPerSecond = tc.clientLimit
+			client := newClient(config)
+			pbreq := &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/snapshot.jpg"),
+			}
+			if tc.requestLimit != "" {
+				pbreq.Header = []*pb.HttpHeader{{
+					Name:  proto.String(rateLimitHeader),
+					Value: proto.String(tc.requestLimit),
+				}}
+			}
+			client.handleRequest(&http.Client{}, &http.Client{}, pbreq)
+
+			if got := len(body(relay.responses("15"))); got != size {
+				t.Errorf("Relayed %d bytes, want %d", got, size)
+			}
+			if d := clock.t.Sub(start); d < tc.wantMin || d > tc.wantMax {
+				t.Errorf("Upload took %v, want between %v and %v", d, tc.wantMin, tc.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/googlecloudrobotics/ilog"
+)
+
+// tlsReloader is TLS material that is reloaded from disk while the client is
+// running, so that rotated certificates are picked up without a restart.
+// Connections that are already established are unaffected, new handshakes
+// use the fresh material.
+type tlsReloader interface {
+	// reload re-reads the files and returns true if they changed. On error,
+	// the old material is kept.
+	reload() (bool, error)
+	String() string
+}
+
+// reloadingRootCAs holds the root CAs from a PEM file.
+type reloadingRootCAs struct {
+	file string
+	data []byte
+	pool atomic.Pointer[x509.CertPool]
+}
+
+func loadRootCAs(file string) (*reloadingRootCAs, error) {
+	r := &reloadingRootCAs{file: file}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *reloadingRootCAs) reload() (bool, error) {
+	data, err := os.ReadFile(r.file)
+	if err != nil {
+		return false, fmt.Errorf("failed to read CA file: %v", err)
+	}
+	if bytes.Equal(data, r.data) {
+		return false, nil
+	}
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(data); !ok {
+		return false, errors.New("no certs found")
+	}
+	r.data = data
+	r.pool.Store(pool)
+	return true, nil
+}
+
+func (r *reloadingRootCAs) String() string {
+	return r.file
+}
+
+// verifyConnection verifies the backend's certificate chain against the
+// current root CAs, as crypto/tls would do with tls.Config.RootCAs.
+func (r *reloadingRootCAs) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("backend presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         r.pool.Load(),
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// reloadingCert holds a client certificate and its key from PEM files.
+type reloadingCert struct {
+	certFile, keyFile string
+	certData, keyData []byte
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+func loadClientCert(certFile, keyFile string) (*reloadingCert, error) {
+	r := &reloadingCert{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *reloadingCert) reload() (bool, error) {
+	certData, err := os.ReadFile(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyData, err := os.ReadFile(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(certData, r.certData) && bytes.Equal(keyData, r.keyData) {
+		return false, nil
+	}
+	// This fails if only one of the files has been rotated yet, in which
+	// case the next reload picks up the new pair.
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return false, err
+	}
+	r.certData, r.keyData = certData, keyData
+	r.cert.Store(&cert)
+	return true, nil
+}
+
+func (r *reloadingCert) String() string {
+	return r.certFile
+}
+
+func (r *reloadingCert) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// newRootCATLSConfig returns the TLS config for backends verified against
+// RootCAFile. The roots are reloaded by watchTLS, so they are checked in
+// VerifyConnection instead of being set once in RootCAs.
+func (c *Client) newRootCATLSConfig() (*tls.Config, error) {
+	roots, err := loadRootCAs(c.config.RootCAFile)
+	if err != nil {
+		return nil, err
+	}
+	c.tlsReloaders = append(c.tlsReloaders, roots)
+	backendHost := addressHost(c.config.BackendAddress)
+	return &tls.Config{
+		// The default verification is replaced by VerifyConnection.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if cs.ServerName == "" {
+				// IP addresses aren't sent as server name, but are
+				// verified like crypto/tls would.
+				cs.ServerName = backendHost
+			}
+			return roots.verifyConnection(cs)
+		},
+	}, nil
+}
+
+// reloadTLS reloads all TLS material once.
+func (c *Client) reloadTLS() {
+	for _, r := range c.tlsReloaders {
+		changed, err := r.reload()
+		if err != nil {
+			slog.Error("Failed to reload TLS material, keeping the old one",
+				slog.String("File", r.String()), ilog.Err(err))
+			tlsReloadFailures.Inc()
+			continue
+		}
+		if changed {
+			slog.Info("Reloaded TLS material", slog.String("File", r.String()))
+		}
+	}
+}
+
+// watchTLS reloads the TLS material every TLSReloadInterval.
+func (c *Client) watchTLS() {
+	ticker := time.NewTicker(c.config.TLSReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.reloadTLS()
+	}
+}
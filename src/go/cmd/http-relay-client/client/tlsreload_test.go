@@ -0,0 +1,206 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestServerCert returns a CA certificate in PEM format and a server
+// certificate issued by it for 127.0.0.1, or for dnsNames if given.
+func newTestServerCert(t *testing.T, name string, dnsNames ...string) ([]byte, tls.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + " CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDer)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+	}
+	if len(dnsNames) == 0 {
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})
+	return caPEM, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func getBody(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestRootCAFileIsReloaded(t *testing.T) {
+	caA, certA := newTestServerCert(t, "backend-a")
+	caB, certB := newTestServerCert(t, "backend-b")
+
+	var serverCert atomic.Pointer[tls.Certificate]
+	serverCert.Store(&certA)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	// httptest's default certificate would take precedence over
+	// GetCertificate, so TLS is set up here.
+	srv.Listener = tls.NewListener(srv.Listener, &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return serverCert.Load(), nil
+		},
+	})
+	srv.Start()
+	defer srv.Close()
+	url := "https://" + srv.Listener.Addr().String()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, caA, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultClientConfig()
+	config.RootCAFile = caFile
+	config.BackendAddress = srv.Listener.Addr().String()
+	c := newClient(config)
+	tlsConfig, err := c.newRootCATLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := c.newLocalClient(tlsConfig)
+
+	if _, err := getBody(local, url); err != nil {
+		t.Fatalf("Request with the initial root CA failed: %v", err)
+	}
+
+	// The backend's certificate is rotated to one from a new CA.
+	serverCert.Store(&certB)
+	srv.CloseClientConnections()
+	if _, err := getBody(local, url); err == nil {
+		t.Fatalf("Request succeeded although the new CA isn't trusted yet")
+	}
+
+	if err := os.WriteFile(caFile, caB, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.reloadTLS()
+	if _, err := getBody(local, url); err != nil {
+		t.Fatalf("Request after reloading the root CA failed: %v", err)
+	}
+
+	// A broken file is ignored.
+	if err := os.WriteFile(caFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.reloadTLS()
+	srv.CloseClientConnections()
+	if _, err := getBody(local, url); err != nil {
+		t.Errorf("Request after failed reload failed: %v", err)
+	}
+}
+
+func TestClientCertificateIsReloaded(t *testing.T) {
+	certA := newTestCertificate(t, "tenant-a")
+	certB := newTestCertificate(t, "tenant-b")
+	pool := certA.pool.Clone()
+	pemB, err := os.ReadFile(certB.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.AppendCertsFromPEM(pemB)
+	srv := newClientCertServer(pool)
+	defer srv.Close()
+
+	config := DefaultClientConfig()
+	config.BackendRoutes = []BackendRoute{
+		{PathPrefix: "/a/", ClientCertFile: certA.certFile, ClientKeyFile: certA.keyFile},
+	}
+	c := newClient(config)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(srv.Certificate())
+	tlsConfig := &tls.Config{RootCAs: rootCAs}
+	if c.routeClients, err = c.newRouteClients(tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	client := c.backendClient(c.newLocalClient(tlsConfig), &pb.HttpRequest{Url: proto.String("http://invalid/a/foo")})
+
+	if cn, err := getBody(client, srv.URL+"/a/foo"); err != nil || cn != "tenant-a" {
+		t.Fatalf("Backend saw client certificate %q (error: %v), want %q", cn, err, "tenant-a")
+	}
+
+	// Rotate the certificate in place.
+	for _, f := range [][2]string{{certB.certFile, certA.certFile}, {certB.keyFile, certA.keyFile}} {
+		data, err := os.ReadFile(f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f[1], data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.reloadTLS()
+	srv.CloseClientConnections()
+	if cn, err := getBody(client, srv.URL+"/a/foo"); err != nil || cn != "tenant-b" {
+		t.Errorf("Backend saw client certificate %q (error: %v), want %q", cn, err, "tenant-b")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+)
+
+func addServiceName(span *trace.Span) {
+	relayClientAttr := trace.StringAttribute("service.name", "http-relay-client")
+	span.AddAttributes(relayClientAttr)
+}
+
+// startSpan starts the span name as a child of the one in ctx. If
+// DisableTracing is set, it returns ctx and a nil span, whose methods do
+// nothing.
+func (c *Client) startSpan(ctx context.Context, name string) (context.Context, *trace.Span) {
+	if c.config.DisableTracing {
+		return ctx, nil
+	}
+	ctx, span := trace.StartSpan(ctx, name)
+	addServiceName(span)
+	return ctx, span
+}
+
+// startRequestSpan starts the span of handling req, as a child of the span
+// of the user-client's request, if it was passed on in the header. Like
+// startSpan, it returns a nil span if DisableTracing is set.
+func (c *Client) startRequestSpan(req *http.Request) (context.Context, *trace.Span) {
+	ctx := req.Context()
+	if c.config.DisableTracing {
+		return ctx, nil
+	}
+	f := &tracecontext.HTTPFormat{}
+	sctx, ok := f.SpanContextFromRequest(req)
+	if !ok {
+		return c.startSpan(ctx, "Recv."+req.URL.Path)
+	}
+	ctx, span := trace.StartSpanWithRemoteParent(ctx, "Recv."+req.URL.Path, sctx)
+	addServiceName(span)
+	return ctx, span
+}
+
+// traceID returns the trace ID of span, or "" if there's no span.
+func traceID(span *trace.Span) string {
+	if span == nil {
+		return ""
+	}
+	return span.SpanContext().TraceID.String()
+}
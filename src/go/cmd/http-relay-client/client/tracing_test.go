@@ -0,0 +1,96 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"go.opencensus.io/plugin/ochttp"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDisableTracing(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable=%v", disable), func(t *testing.T) {
+			var traceparent string
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				traceparent = r.Header.Get("Traceparent")
+				w.Write([]byte("ok"))
+			}))
+			defer backend.Close()
+			relay := newRecordingRelay()
+			defer relay.Close()
+
+			config := DefaultClientConfig()
+			config.RelayScheme = "http"
+			config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+			config.BackendScheme = "http"
+			config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+			config.DisableTracing = disable
+			client := newClient(config)
+			local := client.newLocalClient(nil)
+			if _, wrapped := local.Transport.(*ochttp.Transport); wrapped == disable {
+				t.Errorf("Backend transport is %T", local.Transport)
+			}
+			client.handleRequest(&http.Client{}, local, &pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/foo"),
+			})
+
+			if received := relay.responses("15"); len(received) != 1 || string(received[0].Body) != "ok" {
+				t.Errorf("Relay server got %v, want the backend's response", received)
+			}
+			if disable && traceparent != "" {
+				t.Errorf("Backend got Traceparent %q, want none", traceparent)
+			}
+			if !disable && traceparent == "" {
+				t.Errorf("Backend got no Traceparent")
+			}
+		})
+	}
+}
+
+// BenchmarkDisableTracing measures the cost of tracing on the fast path for
+// small responses.
+func BenchmarkDisableTracing(b *testing.B) {
+	relay := newRecordingRelay()
+	defer relay.Close()
+	for _, disable := range []bool{false, true} {
+		config := DefaultClientConfig()
+		config.RelayScheme = "http"
+		config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+		config.BuiltinEchoBackend = true
+		config.DisableTracing = disable
+		client := newClient(config)
+		remote := &http.Client{}
+		local := client.newLocalClient(nil)
+		b.Run(fmt.Sprintf("disable=%v", disable), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				client.handleRequest(remote, local, &pb.HttpRequest{
+					Id:     proto.String("15"),
+					Method: proto.String("GET"),
+					Url:    proto.String("http://invalid/foo"),
+				})
+			}
+		})
+	}
+}
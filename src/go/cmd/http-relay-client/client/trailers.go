@@ -0,0 +1,147 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// The trailer that marks a response whose trailers were cut by
+// limitTrailers. Its value is the number of dropped trailers.
+const trailersTruncatedHeader = "X-Relay-Trailers-Truncated"
+
+// The trailer that marks a response whose body was cut short because reading
+// it from the backend failed. Its value is the error. Relay servers that know
+// StreamError abort the response instead, older ones pass it on.
+const streamErrorTrailer = "X-Relay-Stream-Error"
+
+// The trailer that marks a response whose body was cut short because it
+// exceeded MaxStreamDuration or MaxUpgradedStreamDuration. Its value is the
+// limit.
+const streamTimeoutTrailer = "X-Relay-Stream-Timeout"
+
+// The header that marks a response whose headers were cut by limitHeaders.
+// Its value is the number of dropped headers.
+const headersTruncatedHeader = "X-Relay-Headers-Truncated"
+
+// limitHeaders drops the largest headers until the names and values of the
+// rest take up at most MaxHeaderBytes, so that a backend sending a
+// pathological header doesn't push the first response chunk over the relay's
+// size limit. It returns the kept headers, in their original order, and the
+// number of dropped ones.
+func (c *Client) limitHeaders(header []*pb.HttpHeader) ([]*pb.HttpHeader, int) {
+	size := func(h *pb.HttpHeader) int {
+		return len(h.GetName()) + len(h.GetValue())
+	}
+	total := 0
+	for _, h := range header {
+		total += size(h)
+	}
+	if c.config.MaxHeaderBytes <= 0 || total <= c.config.MaxHeaderBytes {
+		return header, 0
+	}
+	bySize := append([]*pb.HttpHeader(nil), header...)
+	sort.SliceStable(bySize, func(i, j int) bool {
+		return size(bySize[i]) > size(bySize[j])
+	})
+	dropped := map[*pb.HttpHeader]bool{}
+	for _, h := range bySize {
+		if total <= c.config.MaxHeaderBytes {
+			break
+		}
+		dropped[h] = true
+		total -= size(h)
+	}
+	kept := []*pb.HttpHeader{}
+	for _, h := range header {
+		if !dropped[h] {
+			kept = append(kept, h)
+		}
+	}
+	return kept, len(dropped)
+}
+
+// truncatedHeadersMarker returns the header that reports dropped headers.
+func truncatedHeadersMarker(dropped int) *pb.HttpHeader {
+	return &pb.HttpHeader{
+		Name:  proto.String(headersTruncatedHeader),
+		Value: proto.String(strconv.Itoa(dropped)),
+	}
+}
+
+// limitTrailers keeps at most MaxTrailerCount trailers with at most
+// MaxTrailerBytes of names and values in total, so that a misbehaving backend
+// can't push the final response chunk over the relay's size limit after the
+// whole body has been streamed. The gRPC status is kept preferentially as
+// clients can't interpret the response without it. It returns the kept
+// trailers and the number of dropped ones.
+func (c *Client) limitTrailers(trailer []*pb.HttpHeader) ([]*pb.HttpHeader, int) {
+	priority := func(h *pb.HttpHeader) int {
+		switch http.CanonicalHeaderKey(h.GetName()) {
+		case "Grpc-Status":
+			return 0
+		case "Grpc-Message":
+			return 1
+		}
+		return 2
+	}
+	sorted := append([]*pb.HttpHeader(nil), trailer...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if pi, pj := priority(sorted[i]), priority(sorted[j]); pi != pj {
+			return pi < pj
+		}
+		return sorted[i].GetName() < sorted[j].GetName()
+	})
+
+	kept := []*pb.HttpHeader{}
+	size := 0
+	for _, h := range sorted {
+		n := len(h.GetName()) + len(h.GetValue())
+		if len(kept) >= c.config.MaxTrailerCount || size+n > c.config.MaxTrailerBytes {
+			continue
+		}
+		kept = append(kept, h)
+		size += n
+	}
+	return kept, len(trailer) - len(kept)
+}
+
+// truncatedTrailersMarker returns the trailer that reports dropped trailers.
+func truncatedTrailersMarker(dropped int) *pb.HttpHeader {
+	return &pb.HttpHeader{
+		Name:  proto.String(trailersTruncatedHeader),
+		Value: proto.String(strconv.Itoa(dropped)),
+	}
+}
+
+func streamErrorMarker(err error) *pb.HttpHeader {
+	return &pb.HttpHeader{
+		Name:  proto.String(streamErrorTrailer),
+		Value: proto.String(err.Error()),
+	}
+}
+
+func streamTimeoutMarker(limit time.Duration) *pb.HttpHeader {
+	return &pb.HttpHeader{
+		Name:  proto.String(streamTimeoutTrailer),
+		Value: proto.String(limit.String()),
+	}
+}
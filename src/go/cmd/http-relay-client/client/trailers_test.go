@@ -0,0 +1,248 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func trailerNames(trailer []*pb.HttpHeader) []string {
+	names := []string{}
+	for _, h := range trailer {
+		names = append(names, h.GetName())
+	}
+	return names
+}
+
+func TestLimitTrailers(t *testing.T) {
+	header := func(name, value string) *pb.HttpHeader {
+		return &pb.HttpHeader{Name: proto.String(name), Value: proto.String(value)}
+	}
+	tests := []struct {
+		desc        string
+		maxCount    int
+		maxBytes    int
+		trailer     []*pb.HttpHeader
+		want        []string
+		wantDropped int
+	}{
+		{
+			desc:     "within limits",
+			maxCount: 10,
+			maxBytes: 1000,
+			trailer:  []*pb.HttpHeader{header("X-B", "b"), header("X-A", "a")},
+			want:     []string{"X-A", "X-B"},
+		},
+		{
+			desc:     "count exceeded",
+			maxCount: 3,
+			maxBytes: 1000,
+			trailer: []*pb.HttpHeader{
+				header("X-D", "d"), header("X-C", "c"), header("Grpc-Message", "oops"),
+				header("X-B", "b"), header("Grpc-Status", "13"),
+			},
+			want:        []string{"Grpc-Status", "Grpc-Message", "X-B"},
+			wantDropped: 2,
+		},
+		{
+			desc:     "bytes exceeded",
+			maxCount: 10,
+			maxBytes: 100,
+			trailer: []*pb.HttpHeader{
+				header("X-Huge", strings.Repeat("x", 1000)), header("Grpc-Status", "0"), header("X-Small", "s"),
+			},
+			want:        []string{"Grpc-Status", "X-Small"},
+			wantDropped: 1,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.MaxTrailerCount = tc.maxCount
+			config.MaxTrailerBytes = tc.maxBytes
+			client := newClient(config)
+
+			kept, dropped := client.limitTrailers(tc.trailer)
+			if got := trailerNames(kept); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("limitTrailers() kept %q, want %q", got, tc.want)
+			}
+			if dropped != tc.wantDropped {
+				t.Errorf("limitTrailers() dropped %d, want %d", dropped, tc.wantDropped)
+			}
+		})
+	}
+}
+
+func TestOversizedTrailersAreTruncated(t *testing.T) {
+	// A gRPC backend that sends many trailers.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte("body"))
+		w.(http.Flusher).Flush()
+		for i := 0; i < 100; i++ {
+			w.Header().Set(fmt.Sprintf("%sX-Trailer-%04d", http.TrailerPrefix, i), "value")
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	}))
+	defer backend.Close()
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	config.MaxTrailerCount = 10
+	client := newClient(config)
+	client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("POST"),
+		Url:    proto.String("http://invalid/foo"),
+	})
+
+	received := relay.responses("15")
+	if len(received) == 0 {
+		t.Fatal("No response received")
+	}
+	final := received[len(received)-1]
+	got := map[string]string{}
+	for _, h := range final.Trailer {
+		got[h.GetName()] = h.GetValue()
+	}
+	if len(final.Trailer) != 11 {
+		t.Errorf("Final chunk has %d trailers, want 10 and the marker: %q", len(final.Trailer), trailerNames(final.Trailer))
+	}
+	if got["Grpc-Status"] != "0" || got["Grpc-Message"] != "done" {
+		t.Errorf("gRPC status trailers were not retained: %v", got)
+	}
+	if got[trailersTruncatedHeader] != "92" {
+		t.Errorf("%s = %q, want %q", trailersTruncatedHeader, got[trailersTruncatedHeader], "92")
+	}
+}
+
+func TestLimitHeaders(t *testing.T) {
+	header := func(name string, size int) *pb.HttpHeader {
+		return &pb.HttpHeader{Name: proto.String(name), Value: proto.String(strings.Repeat("x", size))}
+	}
+	tests := []struct {
+		desc        string
+		max         int
+		header      []*pb.HttpHeader
+		wantNames   []string
+		wantDropped int
+	}{
+		{
+			desc:      "under the limit",
+			max:       100,
+			header:    []*pb.HttpHeader{header("A", 10), header("B", 10)},
+			wantNames: []string{"A", "B"},
+		},
+		{
+			desc:      "no limit",
+			max:       0,
+			header:    []*pb.HttpHeader{header("A", 1000)},
+			wantNames: []string{"A"},
+		},
+		{
+			desc:        "largest header is dropped",
+			max:         100,
+			header:      []*pb.HttpHeader{header("A", 10), header("B", 200), header("C", 10)},
+			wantNames:   []string{"A", "C"},
+			wantDropped: 1,
+		},
+		{
+			desc:        "drops until the rest fit",
+			max:         50,
+			header:      []*pb.HttpHeader{header("A", 30), header("B", 40), header("C", 20)},
+			wantNames:   []string{"C"},
+			wantDropped: 2,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultClientConfig()
+			config.MaxHeaderBytes = tc.max
+			c := newClient(config)
+			kept, dropped := c.limitHeaders(tc.header)
+			if got := trailerNames(kept); strings.Join(got, ",") != strings.Join(tc.wantNames, ",") {
+				t.Errorf("limitHeaders() kept %q, want %q", got, tc.wantNames)
+			}
+			if dropped != tc.wantDropped {
+				t.Errorf("limitHeaders() dropped %d, want %d", dropped, tc.wantDropped)
+			}
+		})
+	}
+}
+
+func TestOversizedHeaderIsDropped(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Set-Cookie", "huge="+strings.Repeat("x", 2<<20))
+		w.Write([]byte("body"))
+	}))
+	defer backend.Close()
+	relay := newRecordingRelay()
+	defer relay.Close()
+
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	config.BackendScheme = "http"
+	config.BackendAddress = strings.TrimPrefix(backend.URL, "http://")
+	client := newClient(config)
+	client.handleRequest(&http.Client{}, client.newLocalClient(nil), &pb.HttpRequest{
+		Id:     proto.String("16"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/foo"),
+	})
+
+	received := relay.responses("16")
+	if len(received) == 0 {
+		t.Fatal("No response received")
+	}
+	first := received[0]
+	if first.GetStatusCode() != http.StatusOK {
+		t.Errorf("Status code = %d, want %d", first.GetStatusCode(), http.StatusOK)
+	}
+	got := map[string]string{}
+	for _, h := range first.Header {
+		got[h.GetName()] = h.GetValue()
+	}
+	if _, ok := got["Set-Cookie"]; ok {
+		t.Error("Oversized Set-Cookie header was relayed")
+	}
+	if got["Content-Type"] != "text/plain" {
+		t.Errorf("Content-Type = %q, want %q", got["Content-Type"], "text/plain")
+	}
+	if got[headersTruncatedHeader] != "1" {
+		t.Errorf("%s = %q, want %q", headersTruncatedHeader, got[headersTruncatedHeader], "1")
+	}
+	var body []byte
+	for _, r := range received {
+		body = append(body, r.Body...)
+	}
+	if string(body) != "body" {
+		t.Errorf("Body = %q, want %q", body, "body")
+	}
+}
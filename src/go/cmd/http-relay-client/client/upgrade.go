@@ -0,0 +1,169 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+// buildUpgradedResponses replaces buildResponses for upgraded connections,
+// eg kubectl exec or port-forward. These are interactive, so bytes from the
+// backend are passed on as soon as they arrive, instead of being accumulated
+// for BackendResponseTimeout. Bytes that arrived while the previous response
+// was being posted are coalesced, up to MaxChunkSize. The 101 response is
+// passed on right away, and keep-alives are sent as often as by
+// buildResponses. Like buildResponses, it stops once ctx is done.
+func (c *Client) buildUpgradedResponses(ctx context.Context, in <-chan []byte, resp *pb.HttpResponse, out chan<- *pb.HttpResponse, timer *chunkTimer) {
+	defer close(out)
+	id := resp.Id
+	timer.stamp(resp)
+	if !emit(ctx, out, resp) {
+		return
+	}
+
+	keepAliveInterval := 30 * c.config.BackendResponseTimeout
+	keepAlive := time.NewTimer(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case b, more := <-in:
+			resp := &pb.HttpResponse{Id: id, Body: b}
+		coalesce:
+			for more && len(resp.Body) < c.config.MaxChunkSize {
+				select {
+				case b, more = <-in:
+					resp.Body = append(resp.Body, b...)
+				default:
+					break coalesce
+				}
+			}
+			if !more {
+				if c.debugLogs() {
+					slog.Info("Posting final upgraded response to relay",
+						slog.String("ID", *id), slog.Int("ByteCount", len(resp.Body)))
+				}
+				resp.Eof = proto.Bool(true)
+				timer.stamp(resp)
+				emit(ctx, out, resp)
+				return
+			}
+			timer.stamp(resp)
+			if !emit(ctx, out, resp) {
+				return
+			}
+		case <-keepAlive.C:
+			if !emit(ctx, out, &pb.HttpResponse{Id: id}) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		keepAlive.Reset(keepAliveInterval)
+	}
+}
+
+// upgradeCheckTimeout limits checkUpgradeSupport.
+const upgradeCheckTimeout = 10 * time.Second
+
+// checkUpgradeSupport checks that local and the route clients can relay
+// upgraded connections, by switching protocols with an in-process server.
+// handleRequest needs the body of a 101 response to be writable, which it
+// isn't if the client has a Timeout or a transport wraps the body without
+// preserving io.Writer. Without this check, that only shows up when someone
+// runs kubectl exec.
+func (c *Client) checkUpgradeSupport(local *http.Client) error {
+	if c.config.ForceHttp2 || c.config.BuiltinEchoBackend {
+		// HTTP/2 has no 101 responses, and the echo backend doesn't upgrade.
+		return nil
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen for upgrade check: %w", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(switchProtocols)}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		server.Serve(ln)
+	}()
+	defer func() {
+		server.Close()
+		<-served
+	}()
+
+	url := "http://" + ln.Addr().String()
+	if err := checkUpgrade(local, url); err != nil {
+		return err
+	}
+	for id, client := range c.routeClients {
+		if err := checkUpgrade(client, url); err != nil {
+			return fmt.Errorf("route client %q: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// checkUpgrade sends an upgrade request to url, which must switch protocols,
+// and checks that the response body is writable.
+func checkUpgrade(client *http.Client, url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", upgradeCheckProtocol)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upgrade request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("upgrade request got status %d, want 101", resp.StatusCode)
+	}
+	if _, ok := resp.Body.(io.WriteCloser); !ok {
+		return fmt.Errorf("body of 101 response is a non-writable %T (is http.Client.Timeout set?)", resp.Body)
+	}
+	return nil
+}
+
+// upgradeCheckProtocol is the protocol that checkUpgrade switches to.
+const upgradeCheckProtocol = "relay-client-upgrade-check"
+
+// switchProtocols answers upgrade requests of checkUpgrade with a 101
+// response, and closes the connection right away.
+func switchProtocols(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != upgradeCheckProtocol {
+		http.Error(w, "unexpected upgrade request", http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + upgradeCheckProtocol + "\r\n\r\n")
+	rw.Flush()
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client/relaytest"
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// newEchoBackend returns a backend that upgrades every connection and echoes
+// what it receives, like a shell behind kubectl exec. It closes the
+// connection after echoing a newline.
+func newEchoBackend(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Failed to hijack connection: %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		buf := make([]byte, 64)
+		for {
+			n, err := rw.Read(buf)
+			conn.Write(buf[:n])
+			if err != nil || bytes.IndexByte(buf[:n], '\n') >= 0 {
+				return
+			}
+		}
+	}))
+}
+
+// waitForBody waits until the bodies of the responses to request id add up to
+// want.
+func waitForBody(t *testing.T, relay *relaytest.Server, id, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := body(relay.Responses(id))
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Relayed body = %q, want %q", got, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUpgradedConnectionLatency(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+	relay := relaytest.NewServer()
+	defer relay.Close()
+	c := newFakeRelayClient(relay, backend)
+	// The echo must not wait for the accumulation of response chunks.
+	c.config.BackendResponseTimeout = 2 * time.Second
+
+	done := make(chan struct{})
+	go func() {
+		c.handleRequest(http.DefaultClient, c.newLocalClient(nil), &pb.HttpRequest{
+			Id:     proto.String("exec"),
+			Method: proto.String("GET"),
+			Url:    proto.String("http://invalid/exec"),
+			Header: []*pb.HttpHeader{
+				{Name: proto.String("Connection"), Value: proto.String("Upgrade")},
+				{Name: proto.String("Upgrade"), Value: proto.String("echo")},
+			},
+		})
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(relay.Responses("exec")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("No 101 response within 5s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := relay.Responses("exec")[0].GetStatusCode(); got != http.StatusSwitchingProtocols {
+		t.Fatalf("Status = %d, want 101", got)
+	}
+
+	typed := ""
+	for _, key := range strings.Split("ls -l", "") {
+		start := time.Now()
+		relay.SendRequestStream("exec", []byte(key))
+		typed += key
+		waitForBody(t, relay, "exec", typed)
+		if d := time.Since(start); d >= time.Second {
+			t.Errorf("Echo of %q took %v, want well below BackendResponseTimeout", key, d)
+		}
+	}
+
+	relay.SendRequestStream("exec", []byte("\n"))
+	typed += "\n"
+	responses, err := relay.WaitForResponses("exec", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := body(responses); got != typed {
+		t.Errorf("Relayed body = %q, want %q", got, typed)
+	}
+	<-done
+}
+
+func TestCheckUpgradeSupport(t *testing.T) {
+	config := DefaultClientConfig()
+	config.DisableAuthForRemote = true
+	client := newClient(config)
+	_, local, err := client.newHTTPClients()
+	if err != nil {
+		t.Fatalf("newHTTPClients() failed: %v", err)
+	}
+	// The body of a 101 response stays writable through ochttp.Transport.
+	if err := client.checkUpgradeSupport(local); err != nil {
+		t.Errorf("checkUpgradeSupport() = %v, want nil", err)
+	}
+
+	// http.Client wraps the body to enforce the timeout.
+	local.Timeout = time.Minute
+	if err := client.checkUpgradeSupport(local); err == nil || !strings.Contains(err.Error(), "non-writable") {
+		t.Errorf("checkUpgradeSupport() with client timeout = %v, want non-writable body error", err)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// Version identifies the build of the relay client. It can be set with
+// -ldflags "-X github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client.Version=...",
+// otherwise it's derived from the Go build info.
+var Version = ""
+
+// The relay client reports its version to the relay server in this query
+// parameter on polls and in this header on posted responses.
+const (
+	clientVersionParam  = "client_version"
+	clientVersionHeader = "X-Relay-Client-Version"
+)
+
+var clientVersion = sync.OnceValue(func() string {
+	if Version != "" {
+		return Version
+	}
+	return versionFromBuildInfo(debug.ReadBuildInfo())
+})
+
+// versionFromBuildInfo returns the module version if the client was built as a
+// dependency, or else the VCS revision it was built from.
+func versionFromBuildInfo(info *debug.BuildInfo, ok bool) string {
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	revision, modified := "", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "unknown"
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
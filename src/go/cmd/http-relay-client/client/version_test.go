@@ -0,0 +1,113 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestVersionFromBuildInfo(t *testing.T) {
+	tests := []struct {
+		desc string
+		info *debug.BuildInfo
+		ok   bool
+		want string
+	}{
+		{
+			desc: "no build info",
+			want: "unknown",
+		},
+		{
+			desc: "module version",
+			info: &debug.BuildInfo{Main: debug.Module{Version: "v0.1.2"}},
+			ok:   true,
+			want: "v0.1.2",
+		},
+		{
+			desc: "vcs revision",
+			info: &debug.BuildInfo{
+				Main:     debug.Module{Version: "(devel)"},
+				Settings: []debug.BuildSetting{{Key: "vcs.revision", Value: "abc123"}},
+			},
+			ok:   true,
+			want: "abc123",
+		},
+		{
+			desc: "modified vcs revision",
+			info: &debug.BuildInfo{
+				Main: debug.Module{Version: "(devel)"},
+				Settings: []debug.BuildSetting{
+					{Key: "vcs.revision", Value: "abc123"},
+					{Key: "vcs.modified", Value: "true"},
+				},
+			},
+			ok:   true,
+			want: "abc123-dirty",
+		},
+		{
+			desc: "no version",
+			info: &debug.BuildInfo{Main: debug.Module{Version: "(devel)"}},
+			ok:   true,
+			want: "unknown",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := versionFromBuildInfo(tc.info, tc.ok); got != tc.want {
+				t.Errorf("versionFromBuildInfo() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientVersionIsReported(t *testing.T) {
+	c := newClient(DefaultClientConfig())
+	relayURL, err := url.Parse(c.buildRelayURL("localhost:8081"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := relayURL.Query().Get(clientVersionParam); got != clientVersion() {
+		t.Errorf("Relay URL has %s=%q, want %q", clientVersionParam, got, clientVersion())
+	}
+
+	var header string
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(clientVersionHeader)
+	}))
+	defer relay.Close()
+	c.config.RelayScheme = "http"
+	c.config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+	if err := c.postResponse(&http.Client{}, &pb.HttpResponse{Id: proto.String("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if header != clientVersion() {
+		t.Errorf("%s header = %q, want %q", clientVersionHeader, header, clientVersion())
+	}
+
+	rec := httptest.NewRecorder()
+	c.healthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	if got := rec.Body.String(); got != clientVersion() {
+		t.Errorf("/version = %q, want %q", got, clientVersion())
+	}
+}
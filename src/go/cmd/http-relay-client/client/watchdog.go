@@ -0,0 +1,155 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A worker whose poll has been running for stuckPollFactor times
+// RelayPollTimeout is considered stuck, eg on a dead connection.
+const stuckPollFactor = 3
+
+// workerSlot identifies a localProxyWorker in logs and metrics. The slots of
+// exited workers are reused, so that the number of metric labels is bounded by
+// MaxPendingRequests. The replacement of a recycled or panicked worker keeps
+// the slot of its predecessor.
+type workerSlot struct {
+	index int
+	label string
+	// polling is the start of the running poll in unix nanoseconds, or 0
+	// between polls.
+	polling atomic.Int64
+	// warned is true once the watchdog has reported the running poll.
+	warned atomic.Bool
+	// used is guarded by workerSlots.mu.
+	used bool
+}
+
+// workerSlots hands out the workerSlots.
+type workerSlots struct {
+	mu    sync.Mutex
+	slots []*workerSlot
+}
+
+// acquire returns the free slot with the lowest index.
+func (s *workerSlots) acquire() *workerSlot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, slot := range s.slots {
+		if !slot.used {
+			slot.used = true
+			return slot
+		}
+	}
+	slot := &workerSlot{index: len(s.slots), label: strconv.Itoa(len(s.slots)), used: true}
+	s.slots = append(s.slots, slot)
+	return slot
+}
+
+// release frees the slot of a worker that exited.
+func (s *workerSlots) release(slot *workerSlot) {
+	workerLastPoll.DeleteLabelValues(slot.label)
+	slot.polling.Store(0)
+	slot.warned.Store(false)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot.used = false
+}
+
+// inUse returns the slots of the running workers.
+func (s *workerSlots) inUse() []*workerSlot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var used []*workerSlot
+	for _, slot := range s.slots {
+		if slot.used {
+			used = append(used, slot)
+		}
+	}
+	return used
+}
+
+// attr returns the log attribute of the worker, or an empty one, which isn't
+// logged, for polls outside of workers, like the startup poll.
+func (slot *workerSlot) attr() slog.Attr {
+	if slot == nil {
+		return slog.Attr{}
+	}
+	return slog.Int("Worker", slot.index)
+}
+
+// pollStarted and pollDone bracket each poll of the worker. They're no-ops on
+// a nil slot.
+func (slot *workerSlot) pollStarted() {
+	if slot != nil {
+		slot.polling.Store(time.Now().UnixNano())
+	}
+}
+
+func (slot *workerSlot) pollDone() {
+	if slot == nil {
+		return
+	}
+	slot.polling.Store(0)
+	slot.warned.Store(false)
+	workerLastPoll.WithLabelValues(slot.label).SetToCurrentTime()
+}
+
+// watchWorkers runs checkWorkers until the client is stopped.
+func (c *Client) watchWorkers(remote *http.Client) {
+	ticker := time.NewTicker(c.config.RelayPollTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.checkWorkers(remote, time.Now())
+		case <-c.stopping:
+			return
+		}
+	}
+}
+
+// checkWorkers warns once about each poll that has been running for too long,
+// see stuckPollFactor, and then closes the idle connections to the relay
+// server if ResetStuckWorkerConnections is set. It returns the indices of the
+// stuck workers.
+func (c *Client) checkWorkers(remote *http.Client, now time.Time) []int {
+	var stuck []int
+	reset := false
+	limit := stuckPollFactor * c.config.RelayPollTimeout
+	for _, slot := range c.workerSlots.inUse() {
+		started := slot.polling.Load()
+		if started == 0 || now.Sub(time.Unix(0, started)) < limit {
+			continue
+		}
+		stuck = append(stuck, slot.index)
+		if slot.warned.Swap(true) {
+			continue
+		}
+		slog.Warn("Worker hasn't completed its poll of the relay server",
+			slot.attr(), slog.Duration("Since", now.Sub(time.Unix(0, started)).Round(time.Millisecond)))
+		reset = c.config.ResetStuckWorkerConnections
+	}
+	if reset {
+		c.resetRelayConnections(remote, resetStuckWorker)
+	}
+	return stuck
+}
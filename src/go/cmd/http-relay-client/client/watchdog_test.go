@@ -0,0 +1,117 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerSlots(t *testing.T) {
+	var slots workerSlots
+	a, b := slots.acquire(), slots.acquire()
+	if a.index != 0 || b.index != 1 {
+		t.Fatalf("Got slots %d and %d, want 0 and 1", a.index, b.index)
+	}
+	slots.release(a)
+	if got := slots.inUse(); len(got) != 1 || got[0] != b {
+		t.Errorf("Slots in use after release: %v, want only 1", got)
+	}
+	if c := slots.acquire(); c != a {
+		t.Errorf("Got slot %d, want the released slot 0", c.index)
+	}
+}
+
+// hangingTransport answers polls with a timeout. If hang is set, the next
+// poll blocks until release is closed, ignoring the request's context like a
+// poll stuck on a dead connection.
+type hangingTransport struct {
+	hang    atomic.Bool
+	release chan struct{}
+	closed  atomic.Int32
+}
+
+func (t *hangingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.hang.CompareAndSwap(true, false) {
+		<-t.release
+	}
+	time.Sleep(time.Millisecond)
+	return &http.Response{
+		StatusCode: http.StatusRequestTimeout,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("No request received within timeout")),
+		Request:    req,
+	}, nil
+}
+
+func (t *hangingTransport) CloseIdleConnections() {
+	t.closed.Add(1)
+}
+
+func TestWatchdogReportsStuckWorker(t *testing.T) {
+	config := DefaultClientConfig()
+	config.RelayScheme = "http"
+	config.RelayAddress = "relay.invalid"
+	config.NumPendingRequests = 2
+	config.RelayPollTimeout = 20 * time.Millisecond
+	config.StartupJitter = 0
+	config.PollJitter = 0
+	config.ResetStuckWorkerConnections = true
+	c := newClient(config)
+	transport := &hangingTransport{release: make(chan struct{})}
+	transport.hang.Store(true)
+	remote := &http.Client{Transport: transport}
+	for i := 0; i < config.NumPendingRequests; i++ {
+		c.startWorker(remote, &http.Client{}, false)
+	}
+	defer func() {
+		c.Stop()
+		close(transport.release)
+		c.workerGroup.Wait()
+	}()
+
+	var stuck []int
+	for start := time.Now(); len(stuck) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("No stuck worker reported")
+		}
+		stuck = c.checkWorkers(remote, time.Now())
+	}
+	if len(stuck) != 1 {
+		t.Errorf("Stuck workers %v, want exactly one", stuck)
+	}
+	if got := transport.closed.Load(); got != 1 {
+		t.Errorf("Idle connections were closed %d times, want 1", got)
+	}
+	// The other worker keeps polling.
+	for _, slot := range c.workerSlots.inUse() {
+		if slot.index != stuck[0] {
+			if started := slot.polling.Load(); started != 0 && time.Since(time.Unix(0, started)) > config.RelayPollTimeout {
+				t.Errorf("Worker %d is stuck as well", slot.index)
+			}
+		}
+	}
+	// A worker is only reported once per poll.
+	if got := c.checkWorkers(remote, time.Now()); len(got) != 1 || got[0] != stuck[0] {
+		t.Errorf("Stuck workers %v, want %v", got, stuck)
+	}
+	if got := transport.closed.Load(); got != 1 {
+		t.Errorf("Idle connections were closed %d times, want 1", got)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The relay server reports the number of requests waiting for a relay client
+// in this header on /server/request responses.
+const queueDepthHeader = "X-Relay-Queue-Depth"
+
+// recordQueueDepth stores the queue depth reported in the relay server's
+// response header. If the header is missing, the depth becomes unknown (-1),
+// which disables scaling of the worker pool.
+func (c *Client) recordQueueDepth(header http.Header) {
+	v := header.Get(queueDepthHeader)
+	if v == "" {
+		c.queueDepth.Store(-1)
+		return
+	}
+	depth, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || depth < 0 {
+		slog.Warn("Ignoring invalid queue depth from relay server", slog.String("Value", v))
+		c.queueDepth.Store(-1)
+		return
+	}
+	c.queueDepth.Store(depth)
+	relayQueueDepth.Set(float64(depth))
+}
+
+// startWorker starts a localProxyWorker. Workers started with surplus=true
+// exit once the relay server reports an empty queue, all workers exit once
+// the client is drained.
+func (c *Client) startWorker(remote, local *http.Client, surplus bool) {
+	relayPollWorkers.Set(float64(c.workers.Add(1)))
+	c.workerGroup.Add(1)
+	go c.localProxyWorker(remote, local, c.workerSlots.acquire(), surplus, false)
+}
+
+// scaleWorkers adjusts the worker pool to the last reported queue depth. It
+// starts one surplus worker per queued request, up to MaxPendingRequests
+// workers in total, so bursts are picked up quickly. Surplus workers still
+// take a slot of MaxConcurrentRequests, which isn't adapted to the depth: the
+// depth is only reported on polls, so a limit lowered while the queue is
+// empty could keep workers from polling and never learn that it grew again.
+// It returns false if the calling surplus worker should exit because the
+// queue is empty.
+func (c *Client) scaleWorkers(remote, local *http.Client, surplus bool) bool {
+	depth := c.queueDepth.Load()
+	if depth < 0 {
+		return true
+	}
+	if depth == 0 {
+		if surplus {
+			relayPollWorkers.Set(float64(c.workers.Add(-1)))
+			return false
+		}
+		return true
+	}
+	for ; depth > 0; depth-- {
+		n := c.workers.Load()
+		if n >= int32(c.config.MaxPendingRequests) {
+			break
+		}
+		if !c.workers.CompareAndSwap(n, n+1) {
+			// Another worker changed the pool concurrently, retry.
+			depth++
+			continue
+		}
+		relayPollWorkers.Set(float64(n + 1))
+		c.workerGroup.Add(1)
+		go c.localProxyWorker(remote, local, c.workerSlots.acquire(), true, false)
+	}
+	return true
+}
+
+// jitter returns a random duration in [0, max), or 0 if max is not positive.
+// Each call draws independently, so workers of the same client are
+// desynchronized from each other as well.
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// idlePollBaseInterval is the delay before the first poll once the relay
+// server has had no requests for IdleTimeoutsBeforeBackoff polls. It doubles
+// with every further timeout, up to MaxIdlePollInterval.
+var idlePollBaseInterval = time.Second
+
+// idleBackoff spaces out the polls of a worker while the relay server has no
+// requests for it.
+type idleBackoff struct {
+	after    int
+	max      time.Duration
+	timeouts int
+}
+
+// next returns the delay before the next poll, given the result of the last
+// one. Anything but a timeout ends the backoff.
+func (b *idleBackoff) next(err error) time.Duration {
+	if !errors.Is(err, ErrTimeout) {
+		b.timeouts = 0
+		return 0
+	}
+	b.timeouts++
+	if b.max <= 0 || b.timeouts < b.after {
+		return 0
+	}
+	d := idlePollBaseInterval
+	for i := b.after; i < b.timeouts && d < b.max; i++ {
+		d *= 2
+	}
+	d = min(d, b.max)
+	// Idle clients that went quiet together drift apart.
+	return d/2 + jitter(d/2)
+}
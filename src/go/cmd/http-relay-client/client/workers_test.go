@@ -0,0 +1,272 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGetRequestRecordsQueueDepth(t *testing.T) {
+	depth := ""
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if depth != "" {
+			w.Header().Set(queueDepthHeader, depth)
+		}
+		http.Error(w, "No request received within timeout", http.StatusRequestTimeout)
+	}))
+	defer relay.Close()
+	c := newClient(DefaultClientConfig())
+
+	tests := []struct {
+		header string
+		want   int64
+	}{
+		{"7", 7},
+		{"0", 0},
+		{"", -1},
+		{"-3", -1},
+		{"many", -1},
+	}
+	for _, tc := range tests {
+		depth = tc.header
+		if _, err := c.getRequest(&http.Client{}, relay.URL); err != ErrTimeout {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if got := c.queueDepth.Load(); got != tc.want {
+			t.Errorf("Queue depth after header %q = %d, want %d", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestScaleWorkersKeepsBaseWorkers(t *testing.T) {
+	c := newClient(DefaultClientConfig())
+	c.workers.Store(1)
+	c.queueDepth.Store(0)
+	if !c.scaleWorkers(nil, nil, false) {
+		t.Errorf("Base worker was asked to exit on empty queue")
+	}
+	c.queueDepth.Store(-1)
+	if !c.scaleWorkers(nil, nil, true) {
+		t.Errorf("Surplus worker was asked to exit with unknown queue depth")
+	}
+	if got := c.workers.Load(); got != 1 {
+		t.Errorf("Worker count = %d, want 1", got)
+	}
+}
+
+func TestWorkerPoolFollowsQueueDepth(t *testing.T) {
+	config := DefaultClientConfig()
+	config.MaxPendingRequests = 4
+	config.PollJitter = 0
+	c := newClient(config)
+
+	// The relay reports a long queue for the first polls and an empty queue
+	// afterwards. It records the largest pool size it has seen.
+	var mu sync.Mutex
+	polls, maxWorkers := 0, int32(0)
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		polls++
+		depth := 0
+		if polls <= 50 {
+			depth = 10
+		}
+		if n := c.workers.Load(); n > maxWorkers {
+			maxWorkers = n
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		w.Header().Set(queueDepthHeader, strconv.Itoa(depth))
+		http.Error(w, "No request received within timeout", http.StatusRequestTimeout)
+	}))
+	defer relay.Close()
+	c.config.RelayScheme = "http"
+	c.config.RelayAddress = strings.TrimPrefix(relay.URL, "http://")
+
+	// Only start a surplus worker, so the pool shrinks to zero once the queue
+	// is empty and no goroutines outlive the test.
+	c.startWorker(&http.Client{}, &http.Client{}, true)
+	for start := time.Now(); c.workers.Load() != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("Pool did not shrink, %d workers still running", c.workers.Load())
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxWorkers != 4 {
+		t.Errorf("Pool grew to %d workers, want %d", maxWorkers, 4)
+	}
+}
+
+func TestJitterRange(t *testing.T) {
+	if got := jitter(0); got != 0 {
+		t.Errorf("jitter(0) = %v, want 0", got)
+	}
+	const limit = time.Second
+	lo, hi := limit, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		d := jitter(limit)
+		if d < 0 || d >= limit {
+			t.Fatalf("jitter(%v) = %v, want in [0, %v)", limit, d, limit)
+		}
+		lo, hi = min(lo, d), max(hi, d)
+	}
+	// The samples should cover the whole range.
+	if lo > limit/10 || hi < limit*9/10 {
+		t.Errorf("jitter(%v) samples span [%v, %v], want most of [0, %v)", limit, lo, hi, limit)
+	}
+}
+
+func TestStartupJitterDesynchronizesWorkers(t *testing.T) {
+	// Each worker of a client draws its own startup delay, so they don't
+	// poll in lockstep either.
+	const workers = 8
+	const limit = 5 * time.Second
+	seen := map[time.Duration]bool{}
+	lo, hi := limit, time.Duration(0)
+	for i := 0; i < workers; i++ {
+		d := jitter(limit)
+		seen[d] = true
+		lo, hi = min(lo, d), max(hi, d)
+	}
+	if len(seen) != workers {
+		t.Errorf("%d workers got only %d distinct startup delays", workers, len(seen))
+	}
+	if hi-lo < limit/10 {
+		t.Errorf("Startup delays span only %v, want them spread over %v", hi-lo, limit)
+	}
+}
+
+func TestIdleBackoff(t *testing.T) {
+	defer func(d time.Duration) { idlePollBaseInterval = d }(idlePollBaseInterval)
+	idlePollBaseInterval = 10 * time.Millisecond
+	b := &idleBackoff{after: 2, max: 80 * time.Millisecond}
+
+	steps := []struct {
+		err    error
+		lo, hi time.Duration
+	}{
+		{ErrTimeout, 0, 0},
+		{ErrTimeout, 5 * time.Millisecond, 10 * time.Millisecond},
+		{ErrTimeout, 10 * time.Millisecond, 20 * time.Millisecond},
+		{ErrTimeout, 20 * time.Millisecond, 40 * time.Millisecond},
+		{ErrTimeout, 40 * time.Millisecond, 80 * time.Millisecond},
+		{ErrTimeout, 40 * time.Millisecond, 80 * time.Millisecond},
+		// A request resets the backoff.
+		{nil, 0, 0},
+		{ErrTimeout, 0, 0},
+		{ErrTimeout, 5 * time.Millisecond, 10 * time.Millisecond},
+		// So does an error.
+		{ErrForbidden, 0, 0},
+		{ErrTimeout, 0, 0},
+	}
+	for i, s := range steps {
+		d := b.next(s.err)
+		if d < s.lo || d > s.hi || (s.hi > 0 && d == s.hi) {
+			t.Errorf("Step %d: next(%v) = %v, want in [%v, %v)", i, s.err, d, s.lo, s.hi)
+		}
+	}
+
+	b = &idleBackoff{after: 2}
+	for i := 0; i < 5; i++ {
+		if d := b.next(ErrTimeout); d != 0 {
+			t.Errorf("next() = %v without MaxIdlePollInterval, want 0", d)
+		}
+	}
+}
+
+func TestIdlePollCadence(t *testing.T) {
+	defer func(d time.Duration) { idlePollBaseInterval = d }(idlePollBaseInterval)
+	idlePollBaseInterval = 20 * time.Millisecond
+
+	// The relay has no work except for the 7th poll of the worker. The first
+	// poll is Start's, see awaitRelay.
+	var mu sync.Mutex
+	var polls []time.Time
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/server/request" {
+			return
+		}
+		mu.Lock()
+		polls = append(polls, time.Now())
+		n := len(polls) - 1
+		mu.Unlock()
+		switch {
+		case n == 7:
+			b, _ := proto.Marshal(&pb.HttpRequest{
+				Id:     proto.String("15"),
+				Method: proto.String("GET"),
+				Url:    proto.String("http://invalid/"),
+			})
+			w.Write(b)
+		case n > 9:
+			<-r.Context().Done()
+		default:
+			http.Error(w, "No request received within timeout", http.StatusRequestTimeout)
+		}
+	}))
+	defer relay.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	c := newDrainClient(relay, backend, time.Second)
+	c.config.PollJitter = 0
+	c.config.IdleTimeoutsBeforeBackoff = 2
+	c.config.MaxIdlePollInterval = 160 * time.Millisecond
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		c.Start()
+	}()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(polls) - 1
+		mu.Unlock()
+		if n >= 10 {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("Got %d polls, want 10", n)
+		}
+	}
+	c.Stop()
+	<-started
+
+	mu.Lock()
+	defer mu.Unlock()
+	gap := func(i int) time.Duration { return polls[i+2].Sub(polls[i+1]) }
+	// The delay grows from the 2nd timeout on, up to the max.
+	for i, lo := range []time.Duration{0, 10, 20, 40, 80, 80} {
+		if got := gap(i); got < lo*time.Millisecond {
+			t.Errorf("Poll %d came %v after the previous one, want at least %v", i+2, got, lo*time.Millisecond)
+		}
+	}
+	// After a request, polling resumes right away.
+	for i := 6; i < 8; i++ {
+		if got := gap(i); got >= 40*time.Millisecond {
+			t.Errorf("Poll %d came %v after the previous one, want no backoff", i+2, got)
+		}
+	}
+}
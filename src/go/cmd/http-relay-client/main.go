@@ -21,9 +21,14 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"contrib.go.opencensus.io/exporter/stackdriver"
 	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client"
@@ -32,7 +37,9 @@ import (
 )
 
 var (
-	config client.ClientConfig
+	config     client.ClientConfig
+	configFile string
+	check      bool
 
 	stackdriverProjectID string
 	logLevel             int
@@ -53,33 +60,360 @@ func init() {
 	flag.BoolVar(&config.PreserveHost, "preserve_host", config.PreserveHost,
 		"Preserve Host header of the original request for "+
 			"compatibility with cross-origin request checks.")
+	flag.StringVar(&config.BackendHealthPath, "backend_health_path", config.BackendHealthPath,
+		"Path, after backend_path, at which --check expects the backend to respond")
+	flag.StringVar(&config.BackendHostOverride, "backend_host_override", config.BackendHostOverride,
+		"Host header and TLS server name for all backend requests (requires --preserve_host=false)")
+	flag.StringVar(&config.BackendTLSServerName, "backend_tls_server_name", config.BackendTLSServerName,
+		"TLS server name for SNI and certificate verification of https backends, without changing the Host header")
+	flag.Func("backend_dial_command",
+		"Command, with space-separated arguments, whose stdin and stdout are used as connection to the backend "+
+			"instead of dialing backend_address, eg \"ssh -W localhost:8080 bastion\"",
+		func(s string) error {
+			config.BackendDialCommand = strings.Fields(s)
+			return nil
+		})
+	flag.StringVar(&config.ErrorResponseFormat, "error_response_format", config.ErrorResponseFormat,
+		"Format of the relay client's error responses: text or problem+json")
+	flag.BoolVar(&config.BuiltinEchoBackend, "builtin_echo_backend", config.BuiltinEchoBackend,
+		"Answer requests with a builtin echo backend instead of backend_address, to test the relay")
+	flag.BoolVar(&config.RequireUpgradeSupport, "require_upgrade_support", config.RequireUpgradeSupport,
+		"Exit at startup if the backend client can't relay upgraded connections, eg kubectl exec, instead of logging an error")
+	flag.DurationVar(&config.BackendDialTimeout, "backend_dial_timeout", config.BackendDialTimeout,
+		"Timeout for connecting to the backend (0 for no limit)")
+	flag.DurationVar(&config.BackendTLSHandshakeTimeout, "backend_tls_handshake_timeout", config.BackendTLSHandshakeTimeout,
+		"Timeout for the TLS handshake with the backend (0 for no limit)")
+	flag.DurationVar(&config.BackendResponseHeaderTimeout, "backend_response_header_timeout", config.BackendResponseHeaderTimeout,
+		"Respond with 504 if the backend doesn't send the response headers within this time (0 for no limit)")
+	flag.DurationVar(&config.MaxStreamDuration, "max_stream_duration", config.MaxStreamDuration,
+		"End responses that are streamed from the backend for longer than this (0 for no limit)")
+	flag.DurationVar(&config.MaxUpgradedStreamDuration, "max_upgraded_stream_duration", config.MaxUpgradedStreamDuration,
+		"End upgraded connections, eg kubectl exec, that are open for longer than this (0 for no limit)")
+	flag.IntVar(&config.BackendBreakerThreshold, "backend_breaker_threshold", config.BackendBreakerThreshold,
+		"Answer requests with 503 without contacting the backend after this many consecutive "+
+			"connection failures (0 to disable)")
+	flag.DurationVar(&config.BackendBreakerWindow, "backend_breaker_window", config.BackendBreakerWindow,
+		"Window in which --backend_breaker_threshold connection failures open the circuit breaker")
+	flag.DurationVar(&config.BackendBreakerCooldown, "backend_breaker_cooldown", config.BackendBreakerCooldown,
+		"Time after which an open circuit breaker lets a probe request through to the backend")
+	flag.BoolVar(&config.DecompressRequestBodies, "decompress_request_bodies", config.DecompressRequestBodies,
+		"Decompress request bodies compressed by the relay server, instead of passing "+
+			"them to the backend with a Content-Encoding header")
+	flag.Int64Var(&config.MaxDecompressedBodySize, "max_decompressed_body_size", config.MaxDecompressedBodySize,
+		"Max size in bytes of a decompressed request body")
+	flag.IntVar(&config.MaxDecompressionRatio, "max_decompression_ratio", config.MaxDecompressionRatio,
+		"Max ratio of decompressed to compressed request body size (0 for no limit)")
+	flag.BoolVar(&config.SetForwardedHeaders, "set_forwarded_headers", config.SetForwardedHeaders,
+		"Pass the original client address, scheme and host to the backend in "+
+			"X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers")
+	flag.BoolVar(&config.UseForwardedHeader, "use_forwarded_header", config.UseForwardedHeader,
+		"With --set_forwarded_headers, use the RFC 7239 Forwarded header instead")
+	flag.Func("forward_client_cert_info",
+		"Comma-separated attributes of the original client's TLS certificate "+
+			"(Hash, Cert, Subject, URI, DNS) to pass to the backend in --client_cert_header "+
+			"(empty to pass none)",
+		func(s string) error {
+			config.ForwardClientCertInfo = nil
+			if s != "" {
+				config.ForwardClientCertInfo = strings.Split(s, ",")
+			}
+			return nil
+		})
+	flag.StringVar(&config.ClientCertHeader, "client_cert_header", config.ClientCertHeader,
+		"Header for the original client's certificate, in Envoy's XFCC format")
+	flag.Func("backend_header_addition",
+		"Header given as NAME=VALUE to set on all backend requests, where VALUE can use "+
+			"{request_id}, {server_name}, {hostname} and {timestamp_rfc3339} (can be repeated)",
+		func(s string) error {
+			name, value, ok := strings.Cut(s, "=")
+			if !ok {
+				return fmt.Errorf("expected NAME=VALUE, got %q", s)
+			}
+			if config.BackendHeaderAdditions == nil {
+				config.BackendHeaderAdditions = map[string]string{}
+			}
+			config.BackendHeaderAdditions[name] = value
+			return nil
+		})
+	flag.Func("backend_header_removals",
+		"Comma-separated headers to remove from all backend requests, before "+
+			"--backend_header_addition is applied",
+		func(s string) error {
+			config.BackendHeaderRemovals = strings.Split(s, ",")
+			return nil
+		})
+	flag.BoolVar(&config.PreserveHeaderCase, "preserve_header_case", config.PreserveHeaderCase,
+		"Send request header names to HTTP/1 backends spelled as relayed instead of canonicalized")
+	flag.Func("backend_header_case",
+		"Comma-separated header names to send to HTTP/1 backends with exactly this "+
+			"spelling, eg SOAPAction",
+		func(s string) error {
+			config.BackendHeaderCase = strings.Split(s, ",")
+			return nil
+		})
+	flag.Func("backend_route",
+		"Backend route given as PATH_PREFIX,CERT_FILE,KEY_FILE: requests whose path "+
+			"starts with PATH_PREFIX present this client certificate to the backend (can be repeated)",
+		func(s string) error {
+			route, err := client.ParseBackendRoute(s)
+			if err != nil {
+				return err
+			}
+			config.BackendRoutes = append(config.BackendRoutes, route)
+			return nil
+		})
+	flag.Func("backend_auth",
+		"Backend authentication given as PATH_PREFIX,TOKEN_FILE[,HEADER[,SCHEME]]: requests whose path "+
+			"starts with PATH_PREFIX send the token in TOKEN_FILE to the backend in HEADER (default: Authorization), "+
+			"after SCHEME (default: Bearer for Authorization), instead of the one in authentication_token_file (can be repeated)",
+		func(s string) error {
+			auth, err := client.ParseBackendAuth(s)
+			if err != nil {
+				return err
+			}
+			config.BackendAuth = append(config.BackendAuth, auth)
+			return nil
+		})
+	flag.Func("access_rule",
+		"Access rule given as ACTION,METHODS,PATH_PATTERN, e.g. deny,,^/api/v1/secrets(/|$): "+
+			"ACTION is allow or deny, METHODS a |-separated list (empty for any), PATH_PATTERN a "+
+			"glob, or a regexp if starting with ^. The first matching rule applies (can be repeated)",
+		func(s string) error {
+			rule, err := client.ParseAccessRule(s)
+			if err != nil {
+				return err
+			}
+			config.Rules = append(config.Rules, rule)
+			return nil
+		})
+	flag.StringVar(&config.AccessDeniedMessage, "access_denied_message", config.AccessDeniedMessage,
+		"Message of the 403 response to requests denied by --access_rule")
 	flag.StringVar(&config.RelayScheme, "relay_scheme", config.RelayScheme,
 		"Connection scheme (http, https) for connection from relay "+
 			"client to relay server")
 	flag.StringVar(&config.RelayAddress, "relay_address", config.RelayAddress,
 		"Hostname of the relay server as seen by the relay client")
+	flag.Func("relay_addresses",
+		"Comma-separated hostnames of relay servers in the order of preference, replaces relay_address",
+		func(s string) error {
+			config.RelayAddresses = strings.Split(s, ",")
+			return nil
+		})
+	flag.IntVar(&config.RelayFailoverThreshold, "relay_failover_threshold", config.RelayFailoverThreshold,
+		"Fail over to the next of relay_addresses after this many consecutive connection errors")
+	flag.DurationVar(&config.RelayReprobeInterval, "relay_reprobe_interval", config.RelayReprobeInterval,
+		"How often to check whether the first of relay_addresses is back after a failover")
+	flag.StringVar(&config.RelayResolverAddress, "relay_resolver_address", config.RelayResolverAddress,
+		"DNS server (host:port) to resolve the relay server's hostname with, instead of the system's")
+	flag.StringVar(&config.RelayHostOverride, "relay_host_override", config.RelayHostOverride,
+		"IP address to connect to the relay server at, instead of the one of its hostname, which is still used for TLS")
+	flag.DurationVar(&config.RelayPollTimeout, "relay_poll_timeout", config.RelayPollTimeout,
+		"Timeout for polling the relay server for the next request (0 for no limit)")
+	flag.DurationVar(&config.RelayPostTimeout, "relay_post_timeout", config.RelayPostTimeout,
+		"Timeout for posting a response or reading the request stream (0 for no limit)")
 	flag.StringVar(&config.RelayPrefix, "relay_prefix", config.RelayPrefix,
 		"Path prefix for the relay server")
 	flag.StringVar(&config.ServerName, "server_name", config.ServerName,
 		"Fetch requests from the relay server for this server name")
+	flag.StringVar(&config.RelayUserAgent, "relay_user_agent", config.RelayUserAgent,
+		"User-Agent of the calls to the relay server (default: http-relay-client/<version> (<server_name>))")
+	flag.StringVar(&config.RelayClientID, "relay_client_id", config.RelayClientID,
+		"Stable identifier of this client, sent in the X-Relay-Client-Id header of the calls to the relay server")
 	flag.StringVar(&config.AuthenticationTokenFile, "authentication_token_file", config.AuthenticationTokenFile,
 		"File with authentication token for backend requests")
 	flag.StringVar(&config.RootCAFile, "root_ca_file", config.RootCAFile,
 		"File with root CA cert for SSL")
+	flag.BoolVar(&config.BackendTLSInsecureSkipVerify, "backend_tls_insecure_skip_verify", config.BackendTLSInsecureSkipVerify,
+		"Don't verify the backend's TLS certificate (for development only, can't be used with --root_ca_file)")
+	flag.Func("relay_auth_scopes",
+		"Comma-separated OAuth scopes for authentication to the relay server "+
+			"(default: https://www.googleapis.com/auth/cloud-platform.read-only)",
+		func(s string) error {
+			config.RelayAuthScopes = strings.Split(s, ",")
+			return nil
+		})
+	flag.StringVar(&config.RelayIDTokenAudience, "relay_id_token_audience", config.RelayIDTokenAudience,
+		"Authenticate to the relay server with an ID token for this audience instead of "+
+			"an access token (e.g. the OAuth client ID of Identity-Aware Proxy)")
+	flag.StringVar(&config.RelayAuthenticationTokenFile, "relay_authentication_token_file", config.RelayAuthenticationTokenFile,
+		"File with a bearer token to authenticate to the relay server with, instead of "+
+			"the default credentials (e.g. for a reverse proxy in front of it)")
+	flag.BoolVar(&config.TokenEndpointDirect, "token_endpoint_direct", config.TokenEndpointDirect,
+		"Fetch relay authentication tokens without the proxy used for the relay server")
+	flag.DurationVar(&config.TLSReloadInterval, "tls_reload_interval", config.TLSReloadInterval,
+		"How often to reload the root CA file and backend client certificates (0 to disable)")
 	flag.IntVar(&config.MaxChunkSize, "max_chunk_size", config.MaxChunkSize,
 		"Max size of data in bytes to accumulate before sending to the peer")
 	flag.IntVar(&config.BlockSize, "block_size", config.BlockSize,
 		"Size of i/o buffer in bytes")
+	flag.BoolVar(&config.UseResponseStreams, "use_response_streams", config.UseResponseStreams,
+		"Send the chunks of streamed responses in a single request, if the relay server supports it")
+	flag.DurationVar(&config.BatchDelay, "batch_delay", config.BatchDelay,
+		"Hold back responses for this long to post them together with responses to other "+
+			"requests, if the relay server supports it (0 to disable)")
+	flag.IntVar(&config.BatchMaxBytes, "batch_max_bytes", config.BatchMaxBytes,
+		"Post a batch of responses before batch_delay once it reaches this size")
+	flag.IntVar(&config.MaxChunksInFlight, "max_chunks_in_flight", config.MaxChunksInFlight,
+		"Post up to this many chunks of a response at once, if the relay server supports it")
+	flag.StringVar(&config.SpillDir, "spill_dir", config.SpillDir,
+		"Directory to keep the chunks of responses in while the relay server doesn't take them, "+
+			"instead of pausing the backend (default: disabled)")
+	flag.Int64Var(&config.SpillThresholdBytes, "spill_threshold_bytes", config.SpillThresholdBytes,
+		"Keep up to this many bytes of waiting chunks per response in memory before writing them to spill_dir")
+	flag.DurationVar(&config.ResumeWindow, "resume_window", config.ResumeWindow,
+		"Resume aborted GET responses with a Range request to the backend if the request is relayed again within this time (0 to disable)")
+	flag.Func("response_codecs",
+		"Comma-separated codecs (zstd, gzip) to compress response bodies with on the way to the relay server, "+
+			"in the order of preference",
+		func(s string) error {
+			config.ResponseCodecs = strings.Split(s, ",")
+			return nil
+		})
+	flag.IntVar(&config.ResponseCompressionMinBytes, "response_compression_min_bytes", config.ResponseCompressionMinBytes,
+		"Don't compress response chunks smaller than this")
+	flag.StringVar(&config.IntegrityChecks, "integrity_checks", config.IntegrityChecks,
+		"Check request bodies against the hashes sent by the relay server (verify), and also send hashes of "+
+			"response bodies (verify-and-sign), or not (off)")
+	flag.BoolVar(&config.PostHeadersEarly, "post_headers_early", config.PostHeadersEarly,
+		"Post the headers of event streams and chunked responses before the first body chunk")
+	flag.IntVar(&config.MaxUploadBytesPerSecond, "max_upload_bytes_per_second", config.MaxUploadBytesPerSecond,
+		"Limit the rate at which response bodies are posted to the relay server, over all requests (0 for no limit)")
+	flag.DurationVar(&config.ResponseRetryPolicy.InitialInterval, "response_retry_initial_interval",
+		config.ResponseRetryPolicy.InitialInterval,
+		"Initial interval between retries of posting a response to the relay")
+	flag.DurationVar(&config.ResponseRetryPolicy.MaxInterval, "response_retry_max_interval",
+		config.ResponseRetryPolicy.MaxInterval,
+		"Max interval between retries of posting a response to the relay")
+	flag.IntVar(&config.ResponseRetryPolicy.MaxRetries, "response_retry_max_retries",
+		config.ResponseRetryPolicy.MaxRetries,
+		"Max number of retries of posting a response to the relay (negative for no limit)")
+	flag.Float64Var(&config.ResponseRetryPolicy.RandomizationFactor, "response_retry_randomization_factor",
+		config.ResponseRetryPolicy.RandomizationFactor,
+		"Randomization factor in [0, 1] for the intervals between retries of posting a response")
+	flag.DurationVar(&config.ResponseRetryPolicy.MaxElapsedTime, "response_retry_max_elapsed_time",
+		config.ResponseRetryPolicy.MaxElapsedTime,
+		"Stop retrying to post a response to the relay after this time (0 for no limit)")
+	flag.IntVar(&config.MaxTrailerCount, "max_trailer_count", config.MaxTrailerCount,
+		"Max number of backend response trailers to relay")
+	flag.IntVar(&config.MaxTrailerBytes, "max_trailer_bytes", config.MaxTrailerBytes,
+		"Max total size in bytes of the names and values of backend response trailers to relay")
+	flag.IntVar(&config.MaxHeaderBytes, "max_header_bytes", config.MaxHeaderBytes,
+		"Max total size in bytes of the names and values of backend response headers to relay (0 for no limit)")
 	flag.IntVar(&config.NumPendingRequests, "num_pending_requests", config.NumPendingRequests,
 		"Number of pending http requests to the relay")
+	flag.IntVar(&config.MaxPendingRequests, "max_pending_requests", config.MaxPendingRequests,
+		"Maximum number of pending http requests to the relay when it reports queued requests")
+	flag.DurationVar(&config.StartupJitter, "startup_jitter", config.StartupJitter,
+		"Delay the first poll of each worker by a random duration up to this value")
+	flag.DurationVar(&config.PollJitter, "poll_jitter", config.PollJitter,
+		"Delay the poll following a timeout by a random duration up to this value")
+	flag.DurationVar(&config.StartupMaxInterval, "startup_max_interval", config.StartupMaxInterval,
+		"Maximum delay between polls until the relay server is first reached")
+	flag.DurationVar(&config.StartupDeadline, "startup_deadline", config.StartupDeadline,
+		"Exit if the relay server can't be reached within this time after startup (0 to keep trying)")
+	flag.BoolVar(&config.ResetStuckWorkerConnections, "reset_stuck_worker_connections", config.ResetStuckWorkerConnections,
+		"Close idle connections to the relay server when a worker's poll takes 3 times relay_poll_timeout")
+	flag.IntVar(&config.ResetConnectionsAfterPollFailures, "reset_connections_after_poll_failures", config.ResetConnectionsAfterPollFailures,
+		"Close idle connections to the relay server after this many consecutive polls failed to reach it (0 to disable)")
+	flag.BoolVar(&config.RelayHttp2Multiplexing, "relay_http2_multiplexing", config.RelayHttp2Multiplexing,
+		"Send all polls and responses over a single HTTP/2 connection to the relay server, if it supports HTTP/2")
+	flag.IntVar(&config.IdleTimeoutsBeforeBackoff, "idle_timeouts_before_backoff", config.IdleTimeoutsBeforeBackoff,
+		"Number of consecutive polls without a request before polling slows down")
+	flag.DurationVar(&config.MaxIdlePollInterval, "max_idle_poll_interval", config.MaxIdlePollInterval,
+		"Maximum delay between polls while the relay server has no requests (0 to always poll right away)")
+	flag.IntVar(&config.MaxConcurrentRequests, "max_concurrent_requests", config.MaxConcurrentRequests,
+		"Maximum number of requests handled at the same time (0 for no limit)")
+	flag.BoolVar(&config.RejectWhenSaturated, "reject_when_saturated", config.RejectWhenSaturated,
+		"Answer requests over max_concurrent_requests with 503, instead of waiting before polling for more")
+	flag.IntVar(&config.ReservedPrioritySlots, "reserved_priority_slots", config.ReservedPrioritySlots,
+		"Additional slots over max_concurrent_requests for requests the relay server gave a high priority")
+	flag.DurationVar(&config.WorkerRecycleInterval, "worker_recycle_interval", config.WorkerRecycleInterval,
+		"Replace idle workers that have been running for longer than this by fresh ones (0 to disable)")
+	flag.DurationVar(&config.DrainTimeout, "drain_timeout", config.DrainTimeout,
+		"On SIGTERM, wait this long for running requests to finish before exiting")
 	flag.IntVar(&config.MaxIdleConnsPerHost, "max_idle_conns_per_host", config.MaxIdleConnsPerHost,
 		"The maximum number of idle (keep-alive) connections to keep per-host")
 	flag.BoolVar(&config.DisableHttp2, "disable_http2", config.DisableHttp2,
 		"Disable http2 protocol usage (e.g. for channels that use special streaming protocols such as SPDY).")
 	flag.BoolVar(&config.ForceHttp2, "force_http2", config.ForceHttp2,
 		"Force enable http2 protocol usage through the use of go's http2 transport (e.g. when relaying grpc).")
+	flag.BoolVar(&config.BackendHttp2PriorKnowledge, "backend_http2_prior_knowledge", config.BackendHttp2PriorKnowledge,
+		"With --force_http2, speak http2 to an https backend even if it doesn't offer it with ALPN")
+	flag.DurationVar(&config.BackendHttp2ReadIdleTimeout, "backend_http2_read_idle_timeout", config.BackendHttp2ReadIdleTimeout,
+		"Ping http2 connections to the backend that received no frames for this long, to detect dead connections (0 to disable)")
+	flag.DurationVar(&config.BackendHttp2PingTimeout, "backend_http2_ping_timeout", config.BackendHttp2PingTimeout,
+		"Close http2 connections to the backend that don't answer a health check ping within this time")
 	flag.BoolVar(&config.DisableAuthForRemote, "disable_auth_for_remote", config.DisableAuthForRemote,
 		"Disable auth when talking to the relay server for local testing.")
+	flag.BoolVar(&config.StrictResponseHeaderValidation, "strict_response_header_validation", config.StrictResponseHeaderValidation,
+		"Fail requests whose backend response has header values with CR, LF or NUL "+
+			"bytes, instead of stripping these bytes")
+	flag.Func("redacted_headers",
+		"Comma-separated headers whose values are redacted in logs, in addition to "+
+			"Authorization, Proxy-Authorization, Cookie and Set-Cookie",
+		func(s string) error {
+			config.RedactedHeaders = strings.Split(s, ",")
+			return nil
+		})
+	flag.Func("no_store_path_prefixes",
+		"Comma-separated path prefixes of requests whose bodies are zeroed once relayed "+
+			"and never logged",
+		func(s string) error {
+			config.NoStorePathPrefixes = strings.Split(s, ",")
+			return nil
+		})
+	flag.StringVar(&config.RecordDir, "record_dir", config.RecordDir,
+		"Directory to record relayed requests and responses in, for debugging (default: disabled)")
+	flag.Func("record_path_prefixes",
+		"Comma-separated path prefixes of requests to record in record_dir (default: all)",
+		func(s string) error {
+			config.RecordPathPrefixes = strings.Split(s, ",")
+			return nil
+		})
+	flag.IntVar(&config.RecordMaxFileBytes, "record_max_file_bytes", config.RecordMaxFileBytes,
+		"Truncate recorded request and response bodies to this size")
+	flag.Int64Var(&config.RecordMaxTotalBytes, "record_max_total_bytes", config.RecordMaxTotalBytes,
+		"Remove the oldest recordings once all of them are larger than this")
+	flag.Int64Var(&config.ResponseCacheMaxBytes, "response_cache_max_bytes", config.ResponseCacheMaxBytes,
+		"Cache responses that the backend allows to be cached, up to this total size (default: disabled)")
+	flag.IntVar(&config.ResponseCacheMaxEntryBytes, "response_cache_max_entry_bytes", config.ResponseCacheMaxEntryBytes,
+		"Don't cache responses larger than this")
+	flag.StringVar(&config.AccessLogPath, "access_log_path", config.AccessLogPath,
+		"File to append a JSON line to for each relayed request, reopened on SIGHUP (default: disabled)")
+	flag.StringVar(&config.HealthAddress, "health_address", config.HealthAddress,
+		"Address (e.g. :8082, which binds to localhost) to serve /healthz, /metrics, /debug/requests and /debug/logging on (default: disabled)")
+	flag.StringVar(&config.HealthTokenFile, "health_token_file", config.HealthTokenFile,
+		"File with a bearer token that requests to health_address, except /healthz, must carry (default: none required)")
+	flag.BoolVar(&config.EnablePprof, "enable_pprof", config.EnablePprof,
+		"Serve the pprof profiles under /debug/pprof/ on health_address")
+	flag.IntVar(&config.PprofMutexProfileFraction, "pprof_mutex_profile_fraction", config.PprofMutexProfileFraction,
+		"With --enable_pprof, sample 1 in this many mutex contention events (0 to disable the mutex profile)")
+	flag.IntVar(&config.PprofBlockProfileRate, "pprof_block_profile_rate", config.PprofBlockProfileRate,
+		"With --enable_pprof, sample one blocking event per this many nanoseconds blocked (0 to disable the block profile)")
+	flag.BoolVar(&config.DebugLogging, "debug_logging", config.DebugLogging,
+		"Log every step of relaying requests, can be toggled at runtime with SIGUSR1")
+	flag.BoolVar(&config.DisableTracing, "disable_tracing", config.DisableTracing,
+		"Don't create OpenCensus spans for relayed requests, nor wrap the backend transport to propagate them")
+	flag.IntVar(&config.LogSampling.First, "log_sampling_first", config.LogSampling.First,
+		"With --log_sampling_interval, log this many identical errors in a row before sampling them")
+	flag.DurationVar(&config.LogSampling.Interval, "log_sampling_interval", config.LogSampling.Interval,
+		"Log repeated identical errors once per this interval, with the number suppressed (0 to log all)")
+	flag.BoolVar(&config.EnableFaultInjection, "enable_fault_injection", config.EnableFaultInjection,
+		"Inject the faults configured by the fault_injection_* flags, for chaos testing")
+	flag.Float64Var(&config.FaultInjection.DropResponsePercent, "fault_injection_drop_response_percent", config.FaultInjection.DropResponsePercent,
+		"With --enable_fault_injection, don't post this percentage of the responses to the relay server")
+	flag.IntVar(&config.FaultInjection.DelayBackendMs, "fault_injection_delay_backend_ms", config.FaultInjection.DelayBackendMs,
+		"With --enable_fault_injection, delay each backend request by this many milliseconds")
+	flag.Float64Var(&config.FaultInjection.FailPollPercent, "fault_injection_fail_poll_percent", config.FaultInjection.FailPollPercent,
+		"With --enable_fault_injection, fail this percentage of the polls without contacting the relay server")
+	flag.Float64Var(&config.FaultInjection.CorruptChunkPercent, "fault_injection_corrupt_chunk_percent", config.FaultInjection.CorruptChunkPercent,
+		"With --enable_fault_injection, corrupt a byte in this percentage of the response bodies posted to the relay server")
+
+	flag.StringVar(&configFile, "config", "",
+		"YAML file with the client config (see client.LoadConfig), flags override its values")
+	flag.BoolVar(&check, "check", false,
+		"Check the connectivity to the relay server and the backend, print a report and exit, "+
+			"with a non-zero exit code if a critical check failed")
 
 	// The stackdriver project ID is a client independent variable and so we
 	// initialize it independently.
@@ -89,12 +423,42 @@ func init() {
 		"the log message level required to be logged")
 }
 
+// loadConfig replaces the config with the config file and the
+// HTTP_RELAY_CLIENT_* environment variables, then parses the flags in args
+// again so that they win. Lists given by repeated flags replace the lists
+// from the file. The flags must have been parsed before.
+func loadConfig(args []string) error {
+	loaded, err := client.LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "backend_route":
+			loaded.BackendRoutes = nil
+		case "backend_auth":
+			loaded.BackendAuth = nil
+		case "access_rule":
+			loaded.Rules = nil
+		}
+	})
+	config = loaded
+	return flag.CommandLine.Parse(args)
+}
+
 func main() {
 	flag.Parse()
 	logHandler := ilog.NewLogHandler(slog.Level(logLevel), os.Stderr)
 	slog.SetDefault(slog.New(logHandler))
 
-	if stackdriverProjectID != "" {
+	if err := loadConfig(os.Args[1:]); err != nil {
+		slog.Error("Failed to load the config", slog.String("File", configFile), ilog.Err(err))
+		os.Exit(1)
+	}
+
+	if stackdriverProjectID != "" && config.DisableTracing {
+		slog.Warn("Not uploading traces, as tracing is disabled", slog.String("Project", stackdriverProjectID))
+	} else if stackdriverProjectID != "" {
 		sd, err := stackdriver.NewExporter(stackdriver.Options{
 			ProjectID: stackdriverProjectID,
 		})
@@ -107,6 +471,48 @@ func main() {
 		}
 	}
 
-	client := client.NewClient(config)
-	client.Start()
+	client, err := client.NewClient(config)
+	if err != nil {
+		slog.Error("Invalid configuration", ilog.Err(err))
+		os.Exit(1)
+	}
+	if check {
+		report, err := client.Doctor(context.Background())
+		if err != nil {
+			slog.Error("Failed to run the checks", ilog.Err(err))
+			os.Exit(1)
+		}
+		fmt.Print(report)
+		if !report.OK() {
+			os.Exit(1)
+		}
+		return
+	}
+	go func() {
+		// Kubernetes sends SIGTERM when terminating the pod.
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		sig := <-sigs
+		slog.Info("Received signal", slog.String("Signal", sig.String()))
+		client.Stop()
+	}()
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGUSR1)
+		for range sigs {
+			client.SetDebugLogging(!client.DebugLogging())
+		}
+	}()
+	go func() {
+		// logrotate sends SIGHUP once it moved the access log.
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGHUP)
+		for range sigs {
+			client.ReopenAccessLog()
+		}
+	}()
+	if err := client.Start(); err != nil {
+		slog.Error("Relay client failed", ilog.Err(err))
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,52 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/googlecloudrobotics/core/src/go/cmd/http-relay-client/client"
+)
+
+func TestFlagsOverrideConfigFileLists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := []byte(`
+backend_auth:
+  - /api/,/file/token
+rules:
+  - deny,,/file/*
+`)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"--config", path, "--backend_auth", "/api/,/flag/token"}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(args); err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+
+	want := client.BackendAuth{PathPrefix: "/api/", TokenFile: "/flag/token"}
+	if len(config.BackendAuth) != 1 || config.BackendAuth[0] != want {
+		t.Errorf("BackendAuth = %+v, want only %+v", config.BackendAuth, want)
+	}
+	if len(config.Rules) != 1 || config.Rules[0].PathPattern != "/file/*" {
+		t.Errorf("Rules = %+v, want the rule from the config file", config.Rules)
+	}
+}
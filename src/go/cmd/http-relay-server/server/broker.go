@@ -85,6 +85,10 @@ type pendingResponse struct {
 	responseStream chan *pb.HttpResponse
 
 	lastActivity time.Time
+	// nextSequence is the sequence number of the next response to deliver,
+	// and early holds the responses that arrived before it, see inSequence.
+	nextSequence int64
+	early        map[int64]*pb.HttpResponse
 	// For diagnostics only.
 	startTime   time.Time
 	requestPath string
@@ -108,12 +112,19 @@ type broker struct {
 	m    sync.Mutex
 	req  map[string]chan *pb.HttpRequest
 	resp map[string]*pendingResponse
+
+	// Number of requests per server waiting to be picked up by a relay client.
+	// Servers without waiting requests have no entry.
+	// This has its own lock, as m may be held while waiting for a relay client.
+	queuedM sync.Mutex
+	queued  map[string]int
 }
 
 func newBroker() *broker {
 	var r broker
 	r.req = make(map[string]chan *pb.HttpRequest)
 	r.resp = make(map[string]*pendingResponse)
+	r.queued = make(map[string]int)
 	return &r
 }
 
@@ -156,6 +167,12 @@ func (r *broker) RelayRequest(server string, request *pb.HttpRequest) (<-chan *p
 	respChan := r.resp[id].responseStream
 	r.m.Unlock()
 
+	// The request is counted as queued until GetRequest takes it from the
+	// channel, or we give up waiting for it to do so.
+	r.queuedM.Lock()
+	r.queued[server]++
+	r.queuedM.Unlock()
+
 	slog.Info("Enqueuing request", slog.String("ID", id))
 	brokerRequests.WithLabelValues("client", server).Inc()
 	select {
@@ -163,12 +180,35 @@ func (r *broker) RelayRequest(server string, request *pb.HttpRequest) (<-chan *p
 	case reqChan <- request:
 		return respChan, nil
 	case <-time.After(10 * time.Second):
+		r.dequeue(server)
 		// This branch is triggered if the channel is not ready to consume the request
 		// since it is still busy with handling a different request.
 		return nil, fmt.Errorf("Cannot reach the client %q. Check that it's turned on, set up, and connected to the internet. (timeout waiting for relay client to accept request)", server)
 	}
 }
 
+// QueueDepth returns the number of requests for the server that are waiting
+// to be picked up by a relay client.
+func (r *broker) QueueDepth(server string) int {
+	r.queuedM.Lock()
+	defer r.queuedM.Unlock()
+	return r.queued[server]
+}
+
+// dequeue removes a request for the server from the queue and returns the
+// number of requests still waiting.
+func (r *broker) dequeue(server string) int {
+	r.queuedM.Lock()
+	defer r.queuedM.Unlock()
+	n := r.queued[server] - 1
+	if n <= 0 {
+		delete(r.queued, server)
+		return 0
+	}
+	r.queued[server] = n
+	return n
+}
+
 // StopRelayRequest forgets a relaying request, this causes the next chunk from the backend
 // with the relay id to not be recognized, resulting in the relay server returning an error.
 func (r *broker) StopRelayRequest(requestId string) {
@@ -178,8 +218,10 @@ func (r *broker) StopRelayRequest(requestId string) {
 }
 
 // GetRequest obtains a client's request for the server identifier. It blocks
-// until a client makes a request.
-func (r *broker) GetRequest(ctx context.Context, server, path string) (*pb.HttpRequest, error) {
+// until a client makes a request. It also returns the number of requests for
+// the server that were still waiting right after this one was taken from the
+// queue, ie not counting the returned request.
+func (r *broker) GetRequest(ctx context.Context, server, path string) (*pb.HttpRequest, int, error) {
 	r.m.Lock()
 	if r.req[server] == nil {
 		// This happens when the relay-server started and a client connects before
@@ -193,12 +235,12 @@ func (r *broker) GetRequest(ctx context.Context, server, path string) (*pb.HttpR
 	select {
 	case req := <-reqChan:
 		brokerResponses.WithLabelValues("server_request", "ok", server).Inc()
-		return req, nil
+		return req, r.dequeue(server), nil
 	case <-time.After(time.Second * 30):
 		brokerResponses.WithLabelValues("server_request", "timeout", server).Inc()
-		return nil, fmt.Errorf("No request received within timeout")
+		return nil, r.QueueDepth(server), fmt.Errorf("No request received within timeout")
 	case <-ctx.Done():
-		return nil, fmt.Errorf("Server is restarting")
+		return nil, r.QueueDepth(server), fmt.Errorf("Server is restarting")
 	}
 }
 
@@ -239,7 +281,8 @@ func (r *broker) PutRequestStream(id string, data []byte) bool {
 }
 
 // SendResponse delivers the HttpResponse to the user-client handler that created the
-// request. It fails if and only if the request ID is not recognized.
+// request. It fails if and only if the request ID is not recognized, or if the
+// response is too far ahead of the responses delivered so far.
 func (r *broker) SendResponse(resp *pb.HttpResponse) error {
 	id := *resp.Id
 	backendName := strings.SplitN(id, ":", 2)[0]
@@ -250,35 +293,85 @@ func (r *broker) SendResponse(resp *pb.HttpResponse) error {
 		brokerResponses.WithLabelValues("server_response", "invalid", backendName).Inc()
 		return fmt.Errorf("Duplicate or invalid request ID %s", id)
 	}
-	if resp.GetEof() {
-		delete(r.resp, id)
-	} else {
-		pr.lastActivity = time.Now()
+	ready, err := pr.inSequence(resp)
+	if err != nil {
+		r.m.Unlock()
+		brokerResponses.WithLabelValues("server_response", "invalid", backendName).Inc()
+		return fmt.Errorf("Invalid response to request ID %s: %v", id, err)
 	}
+	pr.lastActivity = time.Now()
 	duration := time.Since(pr.startTime).Seconds()
 
 	// Writing to this channel will notify consumers which are waiting for data
 	// on the channel returned by RelayRequest().
-	pr.responseStream <- resp
+	eof := false
+	for _, resp := range ready {
+		if resp.GetEof() {
+			delete(r.resp, id)
+			eof = true
+		}
+		pr.responseStream <- resp
+	}
 
 	r.m.Unlock()
 	brokerRequests.WithLabelValues("server_response", backendName).Inc()
 	brokerResponseDurations.WithLabelValues("server_response", backendName).Observe(duration)
-	if resp.GetEof() {
-		close(pr.responseStream)
-		backendDuration := (time.Duration(resp.GetBackendDurationMs()) * time.Millisecond).Seconds()
-		if backendDuration > 0.0 {
-			brokerBackendResponseDurations.WithLabelValues("server_response", backendName).Observe(backendDuration)
-			brokerOverheadDurations.WithLabelValues("server_response", backendName).Observe(duration - backendDuration)
+	for _, resp := range ready {
+		if resp.GetEof() {
+			backendDuration := (time.Duration(resp.GetBackendDurationMs()) * time.Millisecond).Seconds()
+			if backendDuration > 0.0 {
+				brokerBackendResponseDurations.WithLabelValues("server_response", backendName).Observe(backendDuration)
+				brokerOverheadDurations.WithLabelValues("server_response", backendName).Observe(duration - backendDuration)
+			}
+			slog.Info("Delivered final response to client", slog.String("ID", id), slog.Int("Bytes", len(resp.Body)), slog.Float64("Elapsed", duration), slog.Float64("BackendDuration", backendDuration))
+		} else {
+			slog.Info("Delivered response to client", slog.String("ID", id), slog.Int("Bytes", len(resp.Body)), slog.Float64("Elapsed", duration))
 		}
-		slog.Info("Delivered final response to client", slog.String("ID", id), slog.Int("Bytes", len(resp.Body)), slog.Float64("Elapsed", duration), slog.Float64("BackendDuration", backendDuration))
-	} else {
-		slog.Info("Delivered response to client", slog.String("ID", id), slog.Int("Bytes", len(resp.Body)), slog.Float64("Elapsed", duration))
+	}
+	if eof {
+		close(pr.responseStream)
 	}
 	brokerResponses.WithLabelValues("server_response", "ok", backendName).Inc()
 	return nil
 }
 
+// maxEarlyResponses limits the number of responses to a request that are
+// held back until the responses before them arrive. The relay client posts
+// only a few responses at once, so more suggest a gap that won't be filled.
+const maxEarlyResponses = 64
+
+// inSequence returns the responses that are ready to be delivered now that
+// resp arrived. Responses without a sequence number are delivered as they
+// arrive. Others are held back until all responses with a lower sequence
+// number were delivered, and duplicates from retried posts are dropped.
+func (pr *pendingResponse) inSequence(resp *pb.HttpResponse) ([]*pb.HttpResponse, error) {
+	if resp.Sequence == nil {
+		return []*pb.HttpResponse{resp}, nil
+	}
+	seq := *resp.Sequence
+	switch {
+	case seq < pr.nextSequence || pr.early[seq] != nil:
+		return nil, nil
+	case seq > pr.nextSequence:
+		if len(pr.early) >= maxEarlyResponses {
+			return nil, fmt.Errorf("response %d is too far ahead of response %d", seq, pr.nextSequence)
+		}
+		if pr.early == nil {
+			pr.early = make(map[int64]*pb.HttpResponse)
+		}
+		pr.early[seq] = resp
+		return nil, nil
+	}
+	ready := []*pb.HttpResponse{resp}
+	pr.nextSequence++
+	for next := pr.early[pr.nextSequence]; next != nil; next = pr.early[pr.nextSequence] {
+		delete(pr.early, pr.nextSequence)
+		ready = append(ready, next)
+		pr.nextSequence++
+	}
+	return ready, nil
+}
+
 func (r *broker) ReapInactiveRequests(threshold time.Time) {
 	r.m.Lock()
 	for id, pr := range r.resp {
@@ -52,7 +52,7 @@ func runSender(t *testing.T, b *broker, s string, m string, wg *sync.WaitGroup)
 }
 
 func runReceiver(t *testing.T, b *broker, s string, wg *sync.WaitGroup) {
-	req, err := b.GetRequest(context.Background(), s, "/")
+	req, _, err := b.GetRequest(context.Background(), s, "/")
 	if err != nil {
 		t.Errorf("Error when getting request: %v", err)
 	}
@@ -87,7 +87,7 @@ func runSenderStream(t *testing.T, b *broker, s string, m string, wg *sync.WaitG
 // runReceiverStream sends two items in the response stream, waiting before the second.
 // It returns after the first response has been sent.
 func runReceiverStream(t *testing.T, b *broker, s string, wg *sync.WaitGroup, done <-chan bool) {
-	req, err := b.GetRequest(context.Background(), s, "/")
+	req, _, err := b.GetRequest(context.Background(), s, "/")
 	if err != nil {
 		t.Errorf("Error when getting request: %v", err)
 	}
@@ -154,6 +154,53 @@ func TestDuplicateId(t *testing.T) {
 	}
 }
 
+func TestSequencedResponses(t *testing.T) {
+	b := newBroker()
+	responses := make(chan *pb.HttpResponse, 10)
+	b.resp[idOne] = &pendingResponse{responseStream: responses}
+	send := func(seq int64, eof bool) {
+		t.Helper()
+		resp := &pb.HttpResponse{
+			Id:       proto.String(idOne),
+			Body:     []byte{byte('0' + seq)},
+			Eof:      proto.Bool(eof),
+			Sequence: proto.Int64(seq),
+		}
+		if err := b.SendResponse(resp); err != nil {
+			t.Fatalf("SendResponse(%d) failed: %v", seq, err)
+		}
+	}
+
+	send(0, false)
+	send(2, false)
+	send(0, false)
+	send(3, true)
+	if len(responses) != 1 {
+		t.Fatalf("Got %d responses before the gap was filled, want 1", len(responses))
+	}
+	send(1, false)
+	var got []byte
+	for resp := range responses {
+		got = append(got, resp.Body...)
+	}
+	if string(got) != "0123" {
+		t.Errorf("Got responses %q, want 0123", got)
+	}
+}
+
+func TestSequencedResponsesTooFarAhead(t *testing.T) {
+	b := newBroker()
+	b.resp[idOne] = &pendingResponse{responseStream: make(chan *pb.HttpResponse)}
+	for seq := int64(1); seq <= maxEarlyResponses; seq++ {
+		if err := b.SendResponse(&pb.HttpResponse{Id: proto.String(idOne), Sequence: proto.Int64(seq)}); err != nil {
+			t.Fatalf("SendResponse(%d) failed: %v", seq, err)
+		}
+	}
+	if err := b.SendResponse(&pb.HttpResponse{Id: proto.String(idOne), Sequence: proto.Int64(maxEarlyResponses + 1)}); err == nil {
+		t.Error("Response too far ahead did not produce an error")
+	}
+}
+
 func TestRequestStream(t *testing.T) {
 	// Start a request that won't terminate until we send `done`.
 	b := newBroker()
@@ -221,3 +268,36 @@ func TestTimeout(t *testing.T) {
 	}()
 	wg.Wait()
 }
+
+func TestQueueDepth(t *testing.T) {
+	b := newBroker()
+	b.req["foo"] = make(chan *pb.HttpRequest)
+
+	for _, id := range []string{idOne, idTwo} {
+		go b.RelayRequest("foo", &pb.HttpRequest{Id: proto.String(id), Url: proto.String("http://example.com/foo")})
+	}
+	waitForDepth := func(want int) {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			if b.QueueDepth("foo") == want {
+				return
+			}
+		}
+		t.Fatalf("QueueDepth(foo) = %d, want %d", b.QueueDepth("foo"), want)
+	}
+	waitForDepth(2)
+	if got := b.QueueDepth("bar"); got != 0 {
+		t.Errorf("QueueDepth(bar) = %d, want 0", got)
+	}
+	// The depth returned with a request doesn't count that request.
+	for _, want := range []int{1, 0} {
+		if _, got, err := b.GetRequest(context.Background(), "foo", "/"); err != nil || got != want {
+			t.Errorf("GetRequest(foo) = %d, %v, want %d, nil", got, err, want)
+		}
+		waitForDepth(want)
+	}
+	b.queuedM.Lock()
+	defer b.queuedM.Unlock()
+	if _, ok := b.queued["foo"]; ok {
+		t.Errorf("Queue of foo wasn't removed once empty")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/klauspost/compress/zstd"
+)
+
+// supportedBodyCodecs is the value of bodyCodecsHeader, in the order of
+// preference.
+const supportedBodyCodecs = "zstd, gzip"
+
+// zstdDecoder decompresses response bodies. DecodeAll is safe for concurrent
+// use. NewReader only fails for invalid options.
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// bodyDecoders undo the codecs listed in supportedBodyCodecs.
+var bodyDecoders = map[string]func([]byte) ([]byte, error){
+	"gzip": func(b []byte) ([]byte, error) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	},
+	"zstd": func(b []byte) ([]byte, error) {
+		return zstdDecoder.DecodeAll(b, nil)
+	},
+}
+
+// decodeResponseBody undoes the codec that the relay client applied to the
+// body of br, if any, before it's passed on to the user-client.
+func decodeResponseBody(br *pb.HttpResponse) error {
+	if br.BodyCodec == nil {
+		return nil
+	}
+	decode, ok := bodyDecoders[br.GetBodyCodec()]
+	if !ok {
+		return fmt.Errorf("unsupported body codec %q", br.GetBodyCodec())
+	}
+	body, err := decode(br.Body)
+	if err != nil {
+		return fmt.Errorf("invalid %s body: %v", br.GetBodyCodec(), err)
+	}
+	br.Body = body
+	br.BodyCodec = nil
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDecodeResponseBody(t *testing.T) {
+	plain := []byte(strings.Repeat(`{"key": "value"}`, 100))
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	w.Write(plain)
+	w.Close()
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		desc    string
+		codec   *string
+		body    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"no codec", nil, plain, plain, false},
+		{"gzip", proto.String("gzip"), gzipped.Bytes(), plain, false},
+		{"zstd", proto.String("zstd"), encoder.EncodeAll(plain, nil), plain, false},
+		{"unsupported codec", proto.String("br"), plain, nil, true},
+		{"corrupt body", proto.String("zstd"), plain, nil, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			br := &pb.HttpResponse{Id: proto.String("15"), Body: tc.body, BodyCodec: tc.codec}
+			err := decodeResponseBody(br)
+			if tc.wantErr {
+				if err == nil {
+					t.Error("decodeResponseBody() = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeResponseBody() failed: %v", err)
+			}
+			if !bytes.Equal(br.Body, tc.want) {
+				t.Errorf("Body = %q, want %q", br.Body, tc.want)
+			}
+			if br.BodyCodec != nil {
+				t.Errorf("BodyCodec = %q, want none", br.GetBodyCodec())
+			}
+		})
+	}
+}
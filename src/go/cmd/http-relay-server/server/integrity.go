@@ -0,0 +1,79 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+)
+
+// errBodyHashMismatch is returned for a response whose body doesn't match
+// the hash that the relay client sent along.
+var errBodyHashMismatch = errors.New("response body doesn't match its SHA-256 hash")
+
+// requestBodyHash returns the hash of body for the relay client to check, or
+// nil for an empty body.
+func requestBodyHash(body []byte) []byte {
+	if len(body) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(body)
+	return sum[:]
+}
+
+// verifyResponseBody checks the body of br against its hash, if the relay
+// client signed it. The body codec must have been undone already.
+func verifyResponseBody(br *pb.HttpResponse) error {
+	if br.BodySha256 == nil {
+		return nil
+	}
+	if sum := sha256.Sum256(br.Body); !bytes.Equal(sum[:], br.BodySha256) {
+		return errBodyHashMismatch
+	}
+	return nil
+}
+
+// bodyVerifier checks the bodies of the responses to a request, in the order
+// they're passed on to the user-client, against the hash of the whole body on
+// the final response. It's nil if the relay client doesn't sign responses.
+type bodyVerifier struct {
+	total hash.Hash
+}
+
+// newBodyVerifier returns a bodyVerifier if first is signed. Relay clients
+// that sign responses sign all of them.
+func newBodyVerifier(first *pb.HttpResponse) *bodyVerifier {
+	if first.BodySha256 == nil {
+		return nil
+	}
+	return &bodyVerifier{total: sha256.New()}
+}
+
+// add adds the body of br, and returns errBodyHashMismatch if br is the final
+// response and the whole body doesn't match its hash.
+func (v *bodyVerifier) add(br *pb.HttpResponse) error {
+	if v == nil {
+		return nil
+	}
+	v.total.Write(br.Body)
+	if br.TotalBodySha256 != nil && !bytes.Equal(v.total.Sum(nil), br.TotalBodySha256) {
+		return errBodyHashMismatch
+	}
+	return nil
+}
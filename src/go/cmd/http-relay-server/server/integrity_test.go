@@ -0,0 +1,176 @@
+// Copyright 2024 The Cloud Robotics Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
+	"google.golang.org/protobuf/proto"
+)
+
+func sha256Sum(b string) []byte {
+	sum := sha256.Sum256([]byte(b))
+	return sum[:]
+}
+
+func TestCreateBackendRequestHashesBody(t *testing.T) {
+	server := NewServer()
+	backendCtx := backendContext{Id: "foo:1", ServerName: "foo", Path: "/"}
+	r := httptest.NewRequest("POST", "/client/foo/", nil)
+
+	req := server.createBackendRequest(backendCtx, r, []byte("thebody"))
+	if !bytes.Equal(req.BodySha256, sha256Sum("thebody")) {
+		t.Errorf("BodySha256 = %x, want %x", req.BodySha256, sha256Sum("thebody"))
+	}
+	if req := server.createBackendRequest(backendCtx, r, nil); req.BodySha256 != nil {
+		t.Errorf("BodySha256 = %x for empty body, want none", req.BodySha256)
+	}
+}
+
+func TestServerResponseHandlerVerifiesBody(t *testing.T) {
+	tests := []struct {
+		desc       string
+		hash       []byte
+		wantStatus int
+	}{
+		{"unsigned", nil, http.StatusOK},
+		{"signed", sha256Sum("thebody"), http.StatusOK},
+		{"tampered", sha256Sum("otherbody"), http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			server := NewServer()
+			server.b.req["b"] = make(chan *pb.HttpRequest, 1)
+			respChan, err := server.b.RelayRequest("b", &pb.HttpRequest{
+				Id:  proto.String("15"),
+				Url: proto.String("http://invalid/my/url"),
+			})
+			if err != nil {
+				t.Fatalf("RelayRequest() failed: %v", err)
+			}
+			body, err := proto.Marshal(&pb.HttpResponse{
+				Id:         proto.String("15"),
+				StatusCode: proto.Int32(200),
+				Body:       []byte("thebody"),
+				BodySha256: tc.hash,
+				Eof:        proto.Bool(true),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorder := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				server.serverResponse(recorder, httptest.NewRequest("POST", "/server/response", bytes.NewReader(body)))
+				close(done)
+			}()
+
+			if tc.wantStatus == http.StatusOK {
+				select {
+				case <-respChan:
+				case <-time.After(5 * time.Second):
+					t.Fatal("Response wasn't passed on")
+				}
+			}
+			<-done
+			if got := recorder.Result().StatusCode; got != tc.wantStatus {
+				t.Errorf("Got status %d, want %d", got, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestClientHandlerVerifiesWholeBody(t *testing.T) {
+	tests := []struct {
+		desc      string
+		signed    bool
+		totalHash []byte
+		wantErr   bool
+	}{
+		{"unsigned", false, nil, false},
+		{"signed", true, sha256Sum(`{"entries": []}`), false},
+		{"tampered", true, sha256Sum(`{"entries": [1]}`), true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			server := NewServer()
+			userClientServer := httptest.NewServer(http.HandlerFunc(server.userClientRequest))
+			defer userClientServer.Close()
+
+			respChan := make(chan *http.Response, 1)
+			go func() {
+				resp, err := http.Get(userClientServer.URL + "/client/foo/logs")
+				if err != nil {
+					t.Errorf("Request failed: %v", err)
+					close(respChan)
+					return
+				}
+				respChan <- resp
+			}()
+			relayRequest, _, err := server.b.GetRequest(context.Background(), "foo", "/")
+			if err != nil {
+				t.Fatalf("Error when getting request: %v", err)
+			}
+
+			chunks := []*pb.HttpResponse{{
+				Id:         relayRequest.Id,
+				StatusCode: proto.Int32(200),
+				Body:       []byte(`{"entries": `),
+			}, {
+				Id:              relayRequest.Id,
+				Body:            []byte(`[]}`),
+				Eof:             proto.Bool(true),
+				TotalBodySha256: tc.totalHash,
+			}}
+			for _, chunk := range chunks {
+				if tc.signed {
+					chunk.BodySha256 = sha256Sum(string(chunk.Body))
+				}
+				server.b.SendResponse(chunk)
+			}
+			var resp *http.Response
+			select {
+			case resp = <-respChan:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for the response")
+			}
+			if resp == nil {
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Reading the body succeeded with %q, want an error", body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Reading the body failed: %v", err)
+			}
+			if want := `{"entries": []}`; string(body) != want {
+				t.Errorf("Got body %q, want %q", body, want)
+			}
+		})
+	}
+}
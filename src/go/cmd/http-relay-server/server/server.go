@@ -15,8 +15,12 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"log/slog"
@@ -27,6 +31,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -34,6 +39,7 @@ import (
 	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
 	"github.com/googlecloudrobotics/ilog"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/protobuf/encoding/protodelim"
 	"google.golang.org/protobuf/proto"
 
 	"go.opencensus.io/plugin/ochttp"
@@ -53,6 +59,18 @@ const (
 	cleanShutdownTimeout = 20 * time.Second
 	// Print more detailed logs when enabled.
 	debugLogs = false
+	// Set on /server/request responses to tell the relay client that it can
+	// send responses on /server/responsestream.
+	responseStreamHeader = "X-Relay-Response-Stream"
+	// Set on /server/request responses to tell the relay client that it can
+	// post batches of responses on /server/responses.
+	responseBatchHeader = "X-Relay-Response-Batch"
+	// Set on /server/request responses to tell the relay client which codecs
+	// it can compress response bodies with, see decodeResponseBody.
+	bodyCodecsHeader = "X-Relay-Body-Codecs"
+	// Set on /server/request responses to tell the relay client that it can
+	// post several responses to a request at once, see HttpResponse.sequence.
+	sequencedResponsesHeader = "X-Relay-Sequenced-Responses"
 )
 
 type Server struct {
@@ -133,6 +151,10 @@ func extractBackendNameAndPath(r *http.Request) (backendName string, path string
 type responseChunk struct {
 	Body     []byte
 	Trailers []*pb.HttpHeader
+	// StreamError is set if the relay client failed to read the rest of the
+	// body from the backend, or if the body doesn't match the relay client's
+	// hash.
+	StreamError string
 }
 
 // responseFilter enforces that there's at least one HttpResponse in the 'in'
@@ -162,24 +184,34 @@ func responseFilter(backendCtx backendContext, in <-chan *pb.HttpResponse) ([]*p
 		return nil, http.StatusInternalServerError, responseChunks
 	}
 
-	responseChunks <- &responseChunk{
-		Body:     []byte(firstMessage.Body),
-		Trailers: []*pb.HttpHeader(firstMessage.Trailer),
-	}
+	verifier := newBodyVerifier(firstMessage)
+	responseChunks <- newResponseChunk(firstMessage, verifier)
 
 	go func() {
 		for backendResp := range in {
 			brokerResponses.WithLabelValues("client", "ok", backendCtx.ServerName).Inc()
-			responseChunks <- &responseChunk{
-				Body:     []byte(backendResp.Body),
-				Trailers: []*pb.HttpHeader(backendResp.Trailer),
-			}
+			responseChunks <- newResponseChunk(backendResp, verifier)
 		}
 		close(responseChunks)
 	}()
 	return firstMessage.Header, int(*firstMessage.StatusCode), responseChunks
 }
 
+// newResponseChunk returns the part of br that is passed on to the
+// user-client. A body that doesn't match the relay client's hash is treated
+// like a truncated one.
+func newResponseChunk(br *pb.HttpResponse, verifier *bodyVerifier) *responseChunk {
+	chunk := &responseChunk{
+		Body:        []byte(br.Body),
+		Trailers:    []*pb.HttpHeader(br.Trailer),
+		StreamError: br.GetStreamError(),
+	}
+	if err := verifier.add(br); err != nil && chunk.StreamError == "" {
+		chunk.StreamError = err.Error()
+	}
+	return chunk
+}
+
 type backendContext struct {
 	Id         string
 	ServerName string
@@ -290,18 +322,47 @@ func (s *Server) createBackendRequest(backendCtx backendContext, r *http.Request
 		Fragment: r.URL.Fragment,
 	}
 
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
 	backendReq := &pb.HttpRequest{
-		Id:     proto.String(backendCtx.Id),
-		Method: proto.String(r.Method),
-		Host:   proto.String(r.Host),
-		Url:    proto.String(backendUrl.String()),
-		Header: marshalHeader(&r.Header),
-		Body:   body,
+		Id:              proto.String(backendCtx.Id),
+		Method:          proto.String(r.Method),
+		Host:            proto.String(r.Host),
+		Url:             proto.String(backendUrl.String()),
+		Header:          marshalHeader(&r.Header),
+		Body:            body,
+		BodySha256:      requestBodyHash(body),
+		RemoteAddr:      proto.String(r.RemoteAddr),
+		Scheme:          proto.String(scheme),
+		PeerCertificate: peerCertificate(r.TLS),
 	}
 
 	return backendReq
 }
 
+// peerCertificate describes the verified client certificate of the
+// user-client's connection, or returns nil if there is none.
+func peerCertificate(cs *tls.ConnectionState) *pb.PeerCertificate {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := cs.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	var uris []string
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+	return &pb.PeerCertificate{
+		Subject:           proto.String(cert.Subject.String()),
+		DnsNames:          cert.DNSNames,
+		Uris:              uris,
+		Sha256Fingerprint: proto.String(hex.EncodeToString(fingerprint[:])),
+		Pem:               proto.String(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))),
+	}
+}
+
 func (s *Server) relayRequest(ctx context.Context, backendCtx backendContext, request *pb.HttpRequest) (<-chan *pb.HttpResponse, error) {
 	_, span := trace.StartSpan(ctx, "Schedule request for pickup")
 	addServiceName(span)
@@ -416,6 +477,13 @@ func (s *Server) userClientRequest(w http.ResponseWriter, r *http.Request) {
 			flush.Flush()
 		}
 		numBytes += len(responseChunk.Body)
+		if responseChunk.StreamError != "" {
+			// Aborting the connection is the only way to tell the
+			// user-client that the body is incomplete.
+			slog.Error("Backend response was truncated or corrupted, aborting response to user-client",
+				slog.String("ID", backendCtx.Id), slog.String("Error", responseChunk.StreamError))
+			panic(http.ErrAbortHandler)
+		}
 
 		// Only the last chunk will actually contain trailers.
 		for _, h := range responseChunk.Trailers {
@@ -444,10 +512,21 @@ func (s *Server) serverRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing server query parameter", http.StatusBadRequest)
 		return
 	}
-	slog.Info("Relay client connected", slog.String("ServerName", server))
+	slog.Info("Relay client connected", slog.String("ServerName", server), slog.String("ClientVersion", r.URL.Query().Get("client_version")))
 
 	// Get pending request from client and sent as a reply to the relay-client.
-	request, err := s.b.GetRequest(r.Context(), server, r.URL.Path)
+	request, depth, err := s.b.GetRequest(r.Context(), server, r.URL.Path)
+	// Let the relay client know how many more requests are waiting, so it can
+	// scale the number of concurrent polls.
+	w.Header().Set("X-Relay-Queue-Depth", strconv.Itoa(depth))
+	// Response streams need a full-duplex connection, which only HTTP/2
+	// provides.
+	if r.ProtoMajor >= 2 {
+		w.Header().Set(responseStreamHeader, "1")
+	}
+	w.Header().Set(responseBatchHeader, "1")
+	w.Header().Set(bodyCodecsHeader, supportedBodyCodecs)
+	w.Header().Set(sequencedResponsesHeader, "1")
 	if err != nil {
 		slog.Error("Relay client got no request", slog.String("ID", server), ilog.Err(err))
 		http.Error(w, err.Error(), http.StatusRequestTimeout)
@@ -501,10 +580,18 @@ func (s *Server) serverResponse(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err = decodeResponseBody(br); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = verifyResponseBody(br); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Send the response to the actual user-client using our broker.
 	if err = s.b.SendResponse(br); err != nil {
-		// SendResponse fails if and only if the request ID is bad.
+		// SendResponse fails if and only if the request ID or sequence is bad.
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -516,6 +603,101 @@ func (s *Server) serverResponse(w http.ResponseWriter, r *http.Request) {
 	slog.Info("Relay client sent response", slog.String("ID", *br.Id))
 }
 
+// serverResponses receives responses to several requests in one POST, as an
+// alternative to posting each to serverResponse. The body is an HttpResponses
+// message. Each response is acknowledged with a line in the response body:
+// "ok" if it was passed on, or a description of the error otherwise.
+func (s *Server) serverResponses(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	batch := &pb.HttpResponses{}
+	if err = proto.Unmarshal(body, batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var acks strings.Builder
+	for _, br := range batch.Response {
+		err := decodeResponseBody(br)
+		if err == nil {
+			err = verifyResponseBody(br)
+		}
+		if err != nil {
+			slog.Error("Relay client sent response with bad body", slog.String("ID", br.GetId()), ilog.Err(err))
+			fmt.Fprintf(&acks, "%s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+			continue
+		}
+		// SendResponse fails if and only if the request ID or sequence is bad.
+		if err := s.b.SendResponse(br); err != nil {
+			slog.Error("Relay client sent response for bad request", slog.String("ID", br.GetId()), ilog.Err(err))
+			fmt.Fprintf(&acks, "%s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+			continue
+		}
+		acks.WriteString("ok\n")
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(acks.String()))
+
+	slog.Info("Relay client sent responses", slog.Int("Count", len(batch.Response)))
+}
+
+// serverResponseStream receives all responses to a request in a single
+// long-lived POST, as an alternative to posting each chunk to serverResponse.
+// The body is a stream of length-delimited HttpResponse messages. Each message
+// is acknowledged with an "ok" line in the response body once it has been
+// passed on, or with a line describing the error, after which the stream
+// ends.
+func (s *Server) serverResponseStream(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing id query parameter", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Response streams are not supported", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	slog.Info("Relay client opened response stream", slog.String("ID", id))
+
+	in := bufio.NewReader(r.Body)
+	for {
+		br := &pb.HttpResponse{}
+		err := protodelim.UnmarshalOptions{MaxSize: -1}.UnmarshalFrom(in, br)
+		if err == io.EOF {
+			break
+		}
+		if err == nil && br.GetId() != id {
+			err = fmt.Errorf("response for %q on stream for %q", br.GetId(), id)
+		}
+		if err == nil {
+			err = decodeResponseBody(br)
+		}
+		if err == nil {
+			err = verifyResponseBody(br)
+		}
+		if err == nil {
+			// SendResponse fails if and only if the request ID or sequence is bad.
+			err = s.b.SendResponse(br)
+		}
+		if err != nil {
+			slog.Error("Closing response stream", slog.String("ID", id), ilog.Err(err))
+			fmt.Fprintf(w, "%s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+			return
+		}
+		w.Write([]byte("ok\n"))
+		flusher.Flush()
+	}
+	slog.Info("Relay client closed response stream", slog.String("ID", id))
+}
+
 func (s *Server) Start(port int, blockSize int) {
 	s.port = port
 	s.blockSize = blockSize
@@ -526,6 +708,8 @@ func (s *Server) Start(port int, blockSize int) {
 	h.HandleFunc("/server/request", s.serverRequest)
 	h.HandleFunc("/server/requeststream", s.serverRequestStream)
 	h.HandleFunc("/server/response", s.serverResponse)
+	h.HandleFunc("/server/responses", s.serverResponses)
+	h.HandleFunc("/server/responsestream", s.serverResponseStream)
 	h.Handle("/metrics", promhttp.Handler())
 
 	// This context will be terminated we get SIGTERM from Kubernetes. We need
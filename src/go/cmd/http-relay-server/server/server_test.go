@@ -24,10 +24,12 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	pb "github.com/googlecloudrobotics/core/src/proto/http-relay"
 
 	hijacktest "github.com/getlantern/httptest"
+	"google.golang.org/protobuf/encoding/protodelim"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -53,7 +55,7 @@ func TestClientHandler(t *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() { server.userClientRequest(respRecorder, req); wg.Done() }()
-	relayRequest, err := server.b.GetRequest(context.Background(), "foo", "/")
+	relayRequest, _, err := server.b.GetRequest(context.Background(), "foo", "/")
 	if err != nil {
 		t.Errorf("Error when getting request: %v", err)
 	}
@@ -67,7 +69,10 @@ func TestClientHandler(t *testing.T) {
 			Name:  proto.String("X-Deadline"),
 			Value: proto.String("now"),
 		}},
-		Body: []byte("body"),
+		Body:       []byte("body"),
+		BodySha256: sha256Sum("body"),
+		RemoteAddr: proto.String("192.0.2.1:1234"),
+		Scheme:     proto.String("http"),
 	}
 	// Remove the Traceparent header entry since we cannot assert on its value.
 	tempHeader := relayRequest.Header[:0]
@@ -121,7 +126,7 @@ func TestClientHandlerWithChunkedResponse(t *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() { server.userClientRequest(respRecorder, req); wg.Done() }()
-	relayRequest, err := server.b.GetRequest(context.Background(), "foo", "/")
+	relayRequest, _, err := server.b.GetRequest(context.Background(), "foo", "/")
 	if err != nil {
 		t.Errorf("Error when getting request: %v", err)
 	}
@@ -135,7 +140,10 @@ func TestClientHandlerWithChunkedResponse(t *testing.T) {
 			Name:  proto.String("X-Deadline"),
 			Value: proto.String("now"),
 		}},
-		Body: []byte("body"),
+		Body:       []byte("body"),
+		BodySha256: sha256Sum("body"),
+		RemoteAddr: proto.String("192.0.2.1:1234"),
+		Scheme:     proto.String("http"),
 	}
 	// Remove the Traceparent header entry since we cannot assert on its value.
 	tempHeader := relayRequest.Header[:0]
@@ -186,6 +194,107 @@ func TestClientHandlerWithChunkedResponse(t *testing.T) {
 	}
 }
 
+// Test that the headers of a response are passed on to the user-client as soon
+// as the relay client posts them, even without body.
+func TestClientHandlerWithHeadersOnlyFirstResponse(t *testing.T) {
+	server := NewServer()
+	userClientServer := httptest.NewServer(http.HandlerFunc(server.userClientRequest))
+	defer userClientServer.Close()
+
+	respChan := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(userClientServer.URL + "/client/foo/events")
+		if err != nil {
+			t.Errorf("Request failed: %v", err)
+			close(respChan)
+			return
+		}
+		respChan <- resp
+	}()
+	relayRequest, _, err := server.b.GetRequest(context.Background(), "foo", "/")
+	if err != nil {
+		t.Fatalf("Error when getting request: %v", err)
+	}
+
+	server.b.SendResponse(&pb.HttpResponse{
+		Id:         relayRequest.Id,
+		StatusCode: proto.Int32(200),
+		Header: []*pb.HttpHeader{{
+			Name:  proto.String("Content-Type"),
+			Value: proto.String("text/event-stream"),
+		}},
+	})
+	var resp *http.Response
+	select {
+	case resp = <-respChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the response headers")
+	}
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+	if want, got := "text/event-stream", resp.Header.Get("Content-Type"); want != got {
+		t.Errorf("Wrong header value; want %s; got %s", want, got)
+	}
+
+	server.b.SendResponse(&pb.HttpResponse{
+		Id:   relayRequest.Id,
+		Body: []byte("data: event\n\n"),
+		Eof:  proto.Bool(true),
+	})
+	checkResponse(t, resp, 200, "data: event\n\n")
+}
+
+// Test that the connection to the user-client is aborted if the relay client
+// couldn't read the whole body from the backend, so that the user-client
+// doesn't mistake the truncated body for a complete one.
+func TestClientHandlerAbortsTruncatedResponse(t *testing.T) {
+	server := NewServer()
+	userClientServer := httptest.NewServer(http.HandlerFunc(server.userClientRequest))
+	defer userClientServer.Close()
+
+	respChan := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(userClientServer.URL + "/client/foo/logs")
+		if err != nil {
+			t.Errorf("Request failed: %v", err)
+			close(respChan)
+			return
+		}
+		respChan <- resp
+	}()
+	relayRequest, _, err := server.b.GetRequest(context.Background(), "foo", "/")
+	if err != nil {
+		t.Fatalf("Error when getting request: %v", err)
+	}
+
+	server.b.SendResponse(&pb.HttpResponse{
+		Id:         relayRequest.Id,
+		StatusCode: proto.Int32(200),
+		Body:       []byte(`{"entries": [`),
+	})
+	server.b.SendResponse(&pb.HttpResponse{
+		Id:          relayRequest.Id,
+		Eof:         proto.Bool(true),
+		StreamError: proto.String("connection reset by peer"),
+	})
+	var resp *http.Response
+	select {
+	case resp = <-respChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the response")
+	}
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("Reading the body succeeded with %q, want an error", body)
+	}
+}
+
 func TestClientBadRequest(t *testing.T) {
 	tests := []struct {
 		desc     string
@@ -259,7 +368,7 @@ func TestRequestStreamHandler(t *testing.T) {
 	go func() { server.userClientRequest(respRecorder, req); wg.Done() }()
 
 	// Simulate a 101 Switching Protocols response from the backend.
-	relayRequest, err := server.b.GetRequest(context.Background(), "foo", "/")
+	relayRequest, _, err := server.b.GetRequest(context.Background(), "foo", "/")
 	if err != nil {
 		t.Errorf("Error when getting request: %v", err)
 	}
@@ -374,6 +483,125 @@ func TestServerRequestResponseHandler(t *testing.T) {
 	}
 }
 
+func TestServerResponseStreamHandler(t *testing.T) {
+	backendReq := &pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/my/url"),
+	}
+	backendResps := []*pb.HttpResponse{{
+		Id:         backendReq.Id,
+		StatusCode: proto.Int32(200),
+		Body:       []byte("first"),
+	}, {
+		Id:   backendReq.Id,
+		Body: []byte("second"),
+		Eof:  proto.Bool(true),
+	}}
+	var stream bytes.Buffer
+	for _, r := range backendResps {
+		if _, err := protodelim.MarshalTo(&stream, r); err != nil {
+			t.Fatalf("Failed to marshal test response: %v", err)
+		}
+	}
+
+	server := NewServer()
+	server.b.req["b"] = make(chan *pb.HttpRequest, 1)
+	serverRespChan, err := server.b.RelayRequest("b", backendReq)
+	if err != nil {
+		t.Fatalf("Got relay request error: %v", err)
+	}
+	resp := httptest.NewRequest("POST", "/server/responsestream?id=15", &stream)
+	respRecorder := httptest.NewRecorder()
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		server.serverResponseStream(respRecorder, resp)
+		wg.Done()
+	}()
+
+	for _, want := range backendResps {
+		if got := <-serverRespChan; !proto.Equal(got, want) {
+			t.Errorf("Encapsulated response was garbled; want %s; got %s", want, got)
+		}
+	}
+	wg.Wait()
+	checkResponse(t, respRecorder.Result(), http.StatusOK, "ok\nok\n")
+}
+
+func TestServerResponseStreamHandlerWithInvalidRequestID(t *testing.T) {
+	var stream bytes.Buffer
+	if _, err := protodelim.MarshalTo(&stream, &pb.HttpResponse{
+		Id:   proto.String("not found"),
+		Body: []byte("thebody"),
+		Eof:  proto.Bool(true),
+	}); err != nil {
+		t.Fatalf("Failed to marshal test response: %v", err)
+	}
+
+	resp := httptest.NewRequest("POST", "/server/responsestream?id=not+found", &stream)
+	respRecorder := httptest.NewRecorder()
+	server := NewServer()
+	server.serverResponseStream(respRecorder, resp)
+
+	body, err := io.ReadAll(respRecorder.Result().Body)
+	if err != nil {
+		t.Errorf("Failed to read body stream: %v", err)
+	}
+	if got := string(body); got == "ok\n" || !strings.HasSuffix(got, "\n") {
+		t.Errorf("serverResponseStream() didn't reject the response; got %q", got)
+	}
+}
+
+func TestServerResponsesHandler(t *testing.T) {
+	backendReq := &pb.HttpRequest{
+		Id:     proto.String("15"),
+		Method: proto.String("GET"),
+		Url:    proto.String("http://invalid/my/url"),
+	}
+	backendResp := &pb.HttpResponse{
+		Id:         backendReq.Id,
+		StatusCode: proto.Int32(200),
+		Body:       []byte("thebody"),
+		Eof:        proto.Bool(true),
+	}
+	batch, err := proto.Marshal(&pb.HttpResponses{Response: []*pb.HttpResponse{{
+		Id:   proto.String("not found"),
+		Body: []byte("lost"),
+	}, backendResp}})
+	if err != nil {
+		t.Fatalf("Failed to marshal test responses: %v", err)
+	}
+
+	server := NewServer()
+	server.b.req["b"] = make(chan *pb.HttpRequest, 1)
+	serverRespChan, err := server.b.RelayRequest("b", backendReq)
+	if err != nil {
+		t.Fatalf("Got relay request error: %v", err)
+	}
+	resp := httptest.NewRequest("POST", "/server/responses", bytes.NewReader(batch))
+	respRecorder := httptest.NewRecorder()
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		server.serverResponses(respRecorder, resp)
+		wg.Done()
+	}()
+
+	if got := <-serverRespChan; !proto.Equal(got, backendResp) {
+		t.Errorf("Encapsulated response was garbled; want %s; got %s", backendResp, got)
+	}
+	wg.Wait()
+	body, err := io.ReadAll(respRecorder.Result().Body)
+	if err != nil {
+		t.Errorf("Failed to read body: %v", err)
+	}
+	acks := strings.Split(string(body), "\n")
+	if len(acks) != 3 || acks[0] == "ok" || acks[1] != "ok" || acks[2] != "" {
+		t.Errorf("serverResponses() gave wrong acknowledgements; want an error and ok; got %q", body)
+	}
+}
+
 func TestServerResponseHandlerWithInvalidRequestID(t *testing.T) {
 	backendResp := &pb.HttpResponse{
 		Id:         proto.String("not found"),
@@ -59,7 +59,10 @@ func initRelay() {
 			config.BackendScheme = "http"
 			config.BackendAddress = fmt.Sprint("127.0.0.1:", backendPort)
 			config.DisableAuthForRemote = true
-			relayClient := client.NewClient(config)
+			relayClient, err := client.NewClient(config)
+			if err != nil {
+				glog.Fatalf("Invalid relay client config: %v", err)
+			}
 			relayClient.Start()
 		}()
 